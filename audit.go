@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/daaku/go.flagbytes"
+)
+
+var auditLog = flag.String("audit-log", "audit.log",
+	`Audit log file, relative to the data directory ("" disables)`)
+var auditMaxBytes = flagbytes.Bytes("audit-max-bytes", "10MB",
+	"Audit log size that triggers a rotation")
+var auditKeep = flag.Int("audit-keep", 5,
+	"Number of rotated audit log files to keep")
+
+// Number of recent audit records kept in memory for querying.
+var auditRecent = 1000
+
+const (
+	AUDIT_AUTH_FAILURE    = "auth-failure"
+	AUDIT_SASL_AUTH       = "sasl-auth"
+	AUDIT_BUCKET_CREATE   = "bucket-create"
+	AUDIT_BUCKET_DELETE   = "bucket-delete"
+	AUDIT_BUCKET_COMPACT  = "bucket-compact"
+	AUDIT_BUCKET_BACKUP   = "bucket-backup"
+	AUDIT_BUCKET_RESTORE  = "bucket-restore"
+	AUDIT_BUCKET_FLUSH    = "bucket-flush"
+	AUDIT_BUCKET_PASSWORD = "bucket-password"
+	AUDIT_DDOC_PUT        = "ddoc-put"
+	AUDIT_DDOC_DELETE     = "ddoc-delete"
+	AUDIT_USER_SET        = "user-set"
+	AUDIT_USER_DELETE     = "user-delete"
+	AUDIT_RUNTIME_GC      = "runtime-gc"
+	AUDIT_PROFILE_CPU     = "profile-cpu"
+	AUDIT_PROFILE_MEMORY  = "profile-memory"
+)
+
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote,omitempty"`
+	Action string    `json:"action"`
+	Bucket string    `json:"bucket,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// An append-only log of JSON audit records, one per line, rotated to
+// path.1, path.2, etc. when it grows past maxBytes.
+type Auditor struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	f        *os.File
+	size     int64
+	recent   *Ring
+}
+
+var auditor *Auditor
+
+func initAudit(dataDir string) error {
+	if *auditLog == "" {
+		return nil
+	}
+	path := *auditLog
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dataDir, path)
+	}
+	a, err := NewAuditor(path, int64(*auditMaxBytes), *auditKeep)
+	if err != nil {
+		return err
+	}
+	auditor = a
+	return nil
+}
+
+func NewAuditor(path string, maxBytes int64, keep int) (*Auditor, error) {
+	a := &Auditor{
+		path:     path,
+		maxBytes: maxBytes,
+		keep:     keep,
+		recent:   NewRing(auditRecent),
+	}
+	// Recover the recent records from before a restart.
+	if f, err := os.Open(path); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			rec := &AuditRecord{}
+			if jsonUnmarshal(s.Bytes(), rec) == nil {
+				a.recent.Push(rec)
+			}
+		}
+		f.Close()
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Auditor) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+func (a *Auditor) rotate() error {
+	a.f.Close()
+	a.f = nil
+	for i := a.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i),
+			fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.keep > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+func (a *Auditor) Write(rec *AuditRecord) error {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.f == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	a.recent.Push(rec)
+	if a.size > 0 && a.size+int64(len(j)) > a.maxBytes {
+		if err = a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(j)
+	a.size += int64(n)
+	return err
+}
+
+// Returns up to limit of the most recent records, oldest first, that
+// match the action and bucket when they're not "".
+func (a *Auditor) Recent(limit int, action, bucketName string) []*AuditRecord {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rv := []*AuditRecord{}
+	a.recent.Visit(func(v interface{}) {
+		rec, ok := v.(*AuditRecord)
+		if !ok || rec == nil ||
+			(action != "" && rec.Action != action) ||
+			(bucketName != "" && rec.Bucket != bucketName) {
+			return
+		}
+		rv = append(rv, rec)
+	})
+	if limit > 0 && len(rv) > limit {
+		rv = rv[len(rv)-limit:]
+	}
+	return rv
+}
+
+func (a *Auditor) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func audit(rec *AuditRecord) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if auditor == nil {
+		return
+	}
+	if err := auditor.Write(rec); err != nil {
+		log.Printf("error: audit write, err: %v, record: %#v", err, rec)
+	}
+}
+
+// Audits an action by the current user of an HTTP request, where a
+// non-nil err means the action failed.
+func auditHTTP(r *http.Request, action, bucketName, target string, err error) {
+	rec := &AuditRecord{
+		User:   string(currentUser(r)),
+		Remote: r.RemoteAddr,
+		Action: action,
+		Bucket: bucketName,
+		Target: target,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	audit(rec)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestAuditorRotate(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "audit.log")
+
+	a, err := NewAuditor(path, 300, 2)
+	if err != nil {
+		t.Fatalf("expected NewAuditor to work, got: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = a.Write(&AuditRecord{User: "u", Action: AUDIT_RUNTIME_GC,
+			Bucket: "b"}); err != nil {
+			t.Fatalf("expected Write to work, got: %v", err)
+		}
+	}
+	a.Close()
+	if err = a.Write(&AuditRecord{}); err == nil {
+		t.Errorf("expected Write after Close to fail")
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		fi, err := os.Stat(filepath.Join(d, name))
+		if err != nil || fi.Size() <= 0 || fi.Size() > 300 {
+			t.Errorf("expected rotated file %v, got: %v, %v", name, fi, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(d, "audit.log.3")); err == nil {
+		t.Errorf("expected only 2 rotated files to be kept")
+	}
+
+	// The recent records of the current file survive a reopen.
+	a, err = NewAuditor(path, 300, 2)
+	if err != nil {
+		t.Fatalf("expected NewAuditor reopen to work, got: %v", err)
+	}
+	defer a.Close()
+	recs := a.Recent(0, "", "")
+	if len(recs) <= 0 || recs[0].Action != AUDIT_RUNTIME_GC {
+		t.Errorf("expected recovered records, got: %v", recs)
+	}
+}
+
+func TestAuditorRecent(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+
+	a, err := NewAuditor(filepath.Join(d, "audit.log"), 1000000, 1)
+	if err != nil {
+		t.Fatalf("expected NewAuditor to work, got: %v", err)
+	}
+	defer a.Close()
+	a.Write(&AuditRecord{Action: AUDIT_BUCKET_CREATE, Bucket: "a"})
+	a.Write(&AuditRecord{Action: AUDIT_BUCKET_CREATE, Bucket: "b"})
+	a.Write(&AuditRecord{Action: AUDIT_BUCKET_DELETE, Bucket: "a"})
+
+	tests := []struct {
+		limit          int
+		action, bucket string
+		exp            int
+	}{
+		{0, "", "", 3},
+		{2, "", "", 2},
+		{0, AUDIT_BUCKET_CREATE, "", 2},
+		{0, "", "a", 2},
+		{0, AUDIT_BUCKET_DELETE, "b", 0},
+	}
+	for _, test := range tests {
+		got := a.Recent(test.limit, test.action, test.bucket)
+		if len(got) != test.exp {
+			t.Errorf("expected %v records for %#v, got: %v",
+				test.exp, test, got)
+		}
+	}
+	if got := a.Recent(1, "", ""); got[0].Action != AUDIT_BUCKET_DELETE {
+		t.Errorf("expected the latest record, got: %v", got[0])
+	}
+}
+
+func testAuditSetup(t *testing.T) func() {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	a, err := NewAuditor(filepath.Join(d, "audit.log"), 1000000, 1)
+	if err != nil {
+		t.Fatalf("expected NewAuditor to work, got: %v", err)
+	}
+	auditor = a
+	return func() {
+		auditor = nil
+		a.Close()
+		os.RemoveAll(d)
+	}
+}
+
+func TestAuditRestHooks(t *testing.T) {
+	defer testAuditSetup(t)()
+
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	defer func(orig *BucketSettings) { bucketSettings = orig }(bucketSettings)
+	bucketSettings = &BucketSettings{NumPartitions: 1}
+	mr := testSetupMux(d)
+
+	for _, req := range []struct{ method, url string }{
+		{"POST", "/_api/buckets?name=audited"},
+		{"DELETE", "/_api/buckets/audited"},
+		{"POST", "/_api/runtime/gc"},
+	} {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest(req.method, "http://127.0.0.1"+req.url, nil)
+		mr.ServeHTTP(rr, r)
+	}
+
+	recs := auditor.Recent(0, "", "")
+	exp := []string{AUDIT_BUCKET_CREATE, AUDIT_BUCKET_DELETE, AUDIT_RUNTIME_GC}
+	if len(recs) != len(exp) {
+		t.Fatalf("expected %v records, got: %v", exp, recs)
+	}
+	for i, rec := range recs {
+		if rec.Action != exp[i] || rec.Error != "" {
+			t.Errorf("expected %v, got: %#v", exp[i], rec)
+		}
+	}
+	if recs[0].Bucket != "audited" {
+		t.Errorf("expected bucket-create of audited, got: %#v", recs[0])
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://127.0.0.1/_api/audit?action=bucket-delete", nil)
+	mr.ServeHTTP(rr, r)
+	got := []*AuditRecord{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil ||
+		len(got) != 1 || got[0].Bucket != "audited" {
+		t.Errorf("expected one bucket-delete record, got: %v, %v",
+			rr.Body.String(), err)
+	}
+}
+
+func TestAuditSaslFailure(t *testing.T) {
+	defer testAuditSetup(t)()
+
+	rh, done := testSaslSetup(t)
+	defer done()
+	rh.addr = "1.2.3.4:5"
+
+	rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(SASL_PLAIN),
+		Body:   []byte("\x00haspwd\x00wrong"),
+	})
+	recs := auditor.Recent(0, AUDIT_SASL_AUTH, "")
+	if len(recs) != 1 || recs[0].User != "haspwd" ||
+		recs[0].Remote != "1.2.3.4:5" || recs[0].Error == "" {
+		t.Errorf("expected a failed sasl-auth record, got: %v", recs)
+	}
+}
@@ -57,11 +57,28 @@ type authenticationFilter struct {
 type httpUser string
 
 func (h httpUser) isAdmin() bool {
-	return string(h) == *adminUser
+	if string(h) == *adminUser {
+		return true
+	}
+	u := users.Get(string(h))
+	return u != nil && u.isAdmin()
+}
+
+// A user named like a bucket, but without a named user's roles, has
+// all permissions on that bucket.
+func (h httpUser) can(bucket string, perm userPerm) bool {
+	if h.isAdmin() {
+		return true
+	}
+	if u := users.Get(string(h)); u != nil {
+		return u.can(bucket, perm)
+	}
+	return string(h) == bucket
 }
 
+// Returns true if the user has any permission on the bucket.
 func (h httpUser) canAccess(bucket string) bool {
-	return h.isAdmin() || string(h) == bucket
+	return h.can(bucket, 0)
 }
 
 func parseBasicAuth(ahdr string) (string, string, error) {
@@ -81,6 +98,9 @@ func authenticateUser(u, p string) bool {
 	if u == *adminUser {
 		return p == *adminPass
 	}
+	if user := users.Get(u); user != nil {
+		return user.Auth([]byte(p))
+	}
 	b := buckets.Get(u)
 	if b != nil {
 		return b.Auth([]byte(p))
@@ -89,9 +109,16 @@ func authenticateUser(u, p string) bool {
 }
 
 func (a authenticationFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer a.next.ServeHTTP(w, r)
 	ahdr := r.Header.Get("Authorization")
-	if ahdr != "" {
+	if ahdr != "" && r.TLS == nil && *tlsStrict {
+		http.Error(w, "Basic auth is only allowed over TLS", 403)
+		return
+	}
+	defer a.next.ServeHTTP(w, r)
+	if u := tlsClientName(r.TLS); u != "" &&
+		(users.Get(u) != nil || buckets.Get(u) != nil) {
+		context.Set(r, authInfoKey, httpUser(u))
+	} else if ahdr != "" {
 		u, p, err := parseBasicAuth(ahdr)
 		if err != nil {
 			log.Printf("error: parseBasicAuth, err: %v", err)
@@ -102,6 +129,12 @@ func (a authenticationFilter) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			if !strings.HasSuffix(r.URL.Path, "/stats") {
 				log.Printf("error: incorrect password, user: %v", u)
 			}
+			audit(&AuditRecord{
+				User:   u,
+				Remote: r.RemoteAddr,
+				Action: AUDIT_AUTH_FAILURE,
+				Target: r.URL.Path,
+			})
 		}
 	}
 }
@@ -113,18 +146,18 @@ func currentUser(req *http.Request) httpUser {
 
 func adminRequired(req *http.Request, rm *mux.RouteMatch) bool {
 	u := currentUser(req)
-	if !strings.HasSuffix(req.URL.Path, "/stats") {
+	if !strings.HasSuffix(req.URL.Path, "/stats") && req.URL.Path != "/metrics" {
 		log.Printf("verifying admin for url: %v, user: %v", req.URL, u)
 	}
 	return u.isAdmin()
 }
 
-func withBucketAccess(orig func(http.ResponseWriter,
+func withBucketAccess(perm userPerm, orig func(http.ResponseWriter,
 	*http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		u := currentUser(r)
 		b := mux.Vars(r)["bucketname"]
-		if u.canAccess(b) {
+		if u.can(b, perm) {
 			orig(w, r)
 		} else {
 			log.Printf("%q (isAdmin=%v) can't access bucket: %v", u, u.isAdmin(), b)
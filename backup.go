@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/steveyen/gkvlite"
+)
+
+const BACKUP_MANIFEST = "backup.json"
+
+// Describes a backup, saved as backup.json next to the backup's
+// settings.json and store files.
+type BackupManifest struct {
+	Bucket        string            `json:"bucket"`
+	UUID          string            `json:"uuid"`
+	NumPartitions int               `json:"numPartitions"`
+	Time          time.Time         `json:"time"`
+	Version       string            `json:"version"`
+	Files         []string          `json:"files"`
+	LastCas       map[string]uint64 `json:"lastCas"` // Keyed by vbid.
+}
+
+func (m *BackupManifest) save(dir string) error {
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, BACKUP_MANIFEST), j, 0666)
+}
+
+func loadBackupManifest(dir string) (*BackupManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, BACKUP_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+	m := &BackupManifest{}
+	return m, jsonUnmarshal(b, m)
+}
+
+// Writes a point-in-time copy of the bucket, including the ddocs
+// vbucket and settings.json, into dir, which can later be opened like
+// any other bucket directory.  Mutations may continue meanwhile.
+func (b *livebucket) Backup(dir string) (*BackupManifest, error) {
+	if !b.Available() {
+		return nil, bucketUnavailable
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileInfos) > 0 {
+		return nil, fmt.Errorf("backup dir is not empty: %v", dir)
+	}
+
+	settings := b.GetBucketSettings().Copy()
+
+	m := &BackupManifest{
+		Bucket:        b.name,
+		UUID:          settings.UUID,
+		NumPartitions: settings.NumPartitions,
+		Time:          time.Now(),
+		Version:       VERSION,
+		LastCas:       map[string]uint64{},
+	}
+	for i := 0; i < len(b.bucketstores); i++ {
+		fname := makeStoreFileName(strconv.Itoa(i), 0, STORE_FILE_SUFFIX)
+		err = b.bucketstores[i].backup(filepath.Join(dir, fname), m.LastCas)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, fname)
+	}
+	if err = settings.save(dir); err != nil {
+		return nil, err
+	}
+	if err = m.save(dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Copies the bucketstore into a new store file at path, recording
+// each partition's last CAS into lastCas.  Like compaction, the copy
+// is made from a gkvlite snapshot, but the snapshot is taken while
+// all the partitions are paused, so it's consistent across them.
+func (s *bucketstore) backup(path string,
+	lastCas map[string]uint64) (err error) {
+	s.diskLock.Lock() // Keeps compaction from swapping files on us.
+	defer s.diskLock.Unlock()
+
+	snapshots := s.snapshotPartitions(lastCas)
+	defer func() {
+		for _, snapshot := range snapshots {
+			snapshot.Close()
+		}
+	}()
+
+	backupFile, err := fileService.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		backupFile.Close()
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	backupStore, err := gkvlite.NewStoreEx(backupFile,
+		mkBucketStoreCallbacks(s.keyCompareForCollection))
+	if err != nil {
+		return err
+	}
+	defer backupStore.Close()
+
+	// TODO: Parametrize writeEvery.
+	writeEvery := 1000
+
+	for _, snapshot := range snapshots {
+		for _, collName := range snapshot.GetCollectionNames() {
+			src := snapshot.GetCollection(collName)
+			dst := backupStore.SetCollection(collName,
+				s.KeyCompareForCollection(collName))
+			if src == nil || dst == nil {
+				return fmt.Errorf("backup coll missing: %v, collName: %v",
+					path, collName)
+			}
+			if _, _, err = copyColl(src, dst, writeEvery); err != nil {
+				return err
+			}
+		}
+	}
+	return backupStore.Flush()
+}
+
+// Snapshots the data and, when kept separately, the metadata stores
+// while holding every partition's lock.  Should only be called when
+// holding the diskLock, so vbucket metadata can't change underneath.
+func (s *bucketstore) snapshotPartitions(
+	lastCas map[string]uint64) []*gkvlite.Store {
+	ps := make([]*partitionstore, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		ps = append(ps, p)
+	}
+	var snapshots []*gkvlite.Store
+	var pause func(i int)
+	pause = func(i int) {
+		if i < len(ps) {
+			ps[i].mutate(func(keys, changes *gkvlite.Collection) {
+				lastCas[strconv.Itoa(int(ps[i].vbid))] = ps[i].getLastCas()
+				pause(i + 1)
+			})
+			return
+		}
+		snapshots = append(snapshots, s.BSFData().store.Snapshot())
+		if s.bsfMemoryOnly != nil {
+			snapshots = append(snapshots, s.BSF().store.Snapshot())
+		}
+	}
+	pause(0)
+	return snapshots
+}
+
+// Writes the files of a backup directory as a tar stream.
+func tarDir(w io.Writer, dir string) error {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		if err = tarFile(tw, dir, fileInfo); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func tarFile(tw *tar.Writer, dir string, fileInfo os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(fileInfo, "")
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(dir, fileInfo.Name()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestBucketBackup(t *testing.T) {
+	d, _, b0 := testSetupDefaultBucket(t, MAX_VBUCKETS, 2)
+	defer os.RemoveAll(d)
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	testLoadInts(t, r0, 2, 5)
+	if err := b0.SetDDoc("_design/d0", []byte(`{"views":{}}`)); err != nil {
+		t.Fatalf("expected SetDDoc to work, err: %v", err)
+	}
+
+	// Keep mutating a different key while the backup runs.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+				Opcode:  gomemcached.SET,
+				Key:     []byte("busy"),
+				Body:    []byte(strconv.Itoa(i)),
+				VBucket: 2,
+			})
+		}
+	}()
+
+	backupDir := filepath.Join(d, "backup")
+	m, err := b0.Backup(backupDir)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("expected Backup to work, err: %v", err)
+	}
+	if m.Bucket != "default" || len(m.Files) != STORES_PER_BUCKET {
+		t.Errorf("unexpected backup manifest: %#v", m)
+	}
+	if _, err = b0.Backup(backupDir); err == nil {
+		t.Errorf("expected Backup into a non-empty dir to fail")
+	}
+
+	m1, err := loadBackupManifest(backupDir)
+	if err != nil || m1.UUID != m.UUID || m1.LastCas["2"] != m.LastCas["2"] {
+		t.Errorf("expected saved manifest to match, got: %#v, err: %v", m1, err)
+	}
+
+	settings := &BucketSettings{}
+	if exists, err := settings.load(backupDir); !exists || err != nil {
+		t.Fatalf("expected backup settings.json, exists: %v, err: %v",
+			exists, err)
+	}
+	b1, err := NewBucket("restored", backupDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket on backup to work, err: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load of backup to work, err: %v", err)
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	for i := 0; i < 5; i++ {
+		res := r1.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.GET,
+			Key:     []byte(strconv.Itoa(i)),
+			VBucket: 2,
+		})
+		if res.Status != gomemcached.SUCCESS ||
+			string(res.Body) != strconv.Itoa(i) {
+			t.Errorf("expected backed up item %v, got: %v", i, res)
+		}
+	}
+	vb1, _ := b1.GetVBucket(2)
+	if vb1 == nil || vb1.GetVBState() != VBActive {
+		t.Errorf("expected backed up vbucket state, got: %v", vb1)
+	}
+	if vb1 != nil && vb1.Meta().LastCas < m.LastCas["2"] {
+		t.Errorf("expected backup to reach LastCas %v, got: %v",
+			m.LastCas["2"], vb1.Meta().LastCas)
+	}
+	ddoc, err := b1.GetDDoc("_design/d0")
+	if err != nil || string(ddoc) != `{"views":{}}` {
+		t.Errorf("expected backed up ddoc, got: %s, err: %v", ddoc, err)
+	}
+}
+
+func TestBucketBackupMemoryOnly(t *testing.T) {
+	d, _, b0 := testSetupDefaultBucketEx(t, &BucketSettings{
+		NumPartitions: 1,
+		MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING,
+	}, 0)
+	defer os.RemoveAll(d)
+	defer b0.Close()
+	testLoadInts(t, &reqHandler{currentBucket: b0}, 0, 3)
+
+	backupDir := filepath.Join(d, "backup")
+	if _, err := b0.Backup(backupDir); err != nil {
+		t.Fatalf("expected Backup to work, err: %v", err)
+	}
+	b1, err := NewBucket("restored", backupDir,
+		&BucketSettings{NumPartitions: 1})
+	if err != nil {
+		t.Fatalf("expected NewBucket on backup to work, err: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load of backup to work, err: %v", err)
+	}
+	testExpectInts(t, &reqHandler{currentBucket: b1}, 0, []int{0, 1, 2},
+		"memory-only backup")
+}
+
+func TestRestPostBucketBackup(t *testing.T) {
+	d, _, b := testSetupDefaultBucket(t, 1, 0)
+	defer os.RemoveAll(d)
+	defer b.Close()
+	testLoadInts(t, &reqHandler{currentBucket: b}, 0, 3)
+
+	mr := testSetupMux(d)
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/default/backup", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("expected tar backup, got: %v, %v", rr.Code, rr.Body.String())
+	}
+	names := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(rr.Body.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected a readable tar, err: %v", err)
+		}
+		names[hdr.Name] = true
+	}
+	for _, name := range []string{"settings.json", BACKUP_MANIFEST, "0-0.store"} {
+		if !names[name] {
+			t.Errorf("expected %v in backup tar, got: %v", name, names)
+		}
+	}
+
+	backupDir := filepath.Join(d, "backup")
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/default/backup?dir="+backupDir, nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Fatalf("expected dir backup to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	if _, err := loadBackupManifest(backupDir); err != nil {
+		t.Errorf("expected a backup manifest, err: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/nobucket/backup", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 404 {
+		t.Errorf("expected backup of a missing bucket to 404, got: %v", rr.Code)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -21,6 +22,7 @@ const (
 	STORE_FILE_SUFFIX   = "store"
 	STORES_PER_BUCKET   = 1 // The # of *.store files per bucket (ignoring compaction).
 	VBID_DDOC           = uint16(0xffff)
+	VBID_LOCAL          = uint16(0xfffe) // Holds the couch API's _local docs.
 )
 
 var broadcastMux = broadcast.NewMuxObserver(0, 0)
@@ -29,13 +31,16 @@ var statAggPeriodic *periodically
 var statAggPassPeriodic *periodically
 
 var bucketUnavailable = errors.New("Bucket unavailable")
+var flushDisabled = errors.New("flush is not enabled for this bucket")
 
 type Bucket interface {
 	Name() string
 	Available() bool
+	Backup(dir string) (*BackupManifest, error)
 	Compact() error
 	Close() error
 	Flush() error
+	FlushAll() error
 	Load() error
 
 	Subscribe(ch chan<- interface{})
@@ -52,6 +57,8 @@ type Bucket interface {
 	GetBucketStore(int) *bucketstore
 
 	Auth([]byte) bool
+	SetPassword([]byte) error
+	SaslSecret(mech string) (string, error)
 
 	Statish
 
@@ -63,7 +70,12 @@ type Bucket interface {
 	GetDDocs() *DDocs
 	SetDDocs(old, val *DDocs) bool
 
+	GetLocalDoc(vbucket, docId string) ([]byte, error)
+	SetLocalDoc(vbucket, docId string, body []byte) error
+
 	GetItemBytes() int64
+	GetResidentItemBytes() int64
+	GetTimings() *BucketTimings
 
 	PushErr(err error)
 	Errs() []error
@@ -76,15 +88,18 @@ type livebucket struct {
 	availablech  chan bool
 	name         string
 	dir          string
-	settings     *BucketSettings
+	settings     unsafe.Pointer               // *BucketSettings, replaced but never changed.
 	vbuckets     [MAX_VBUCKETS]unsafe.Pointer // *vbucket
 	vbucketDDoc  *VBucket
+	vbucketLocal *VBucket
 	bucketstores map[int]*bucketstore
 	observer     broadcast.Broadcaster
 	observers    int64
 
 	bucketItemBytes int64
+	evictNext       int   // The next vbucket to evict from.
 	activity        int64 // To track quiescence opportunities.
+	timings         *BucketTimings
 
 	ddocs unsafe.Pointer // *DDocs, holding the json.Unmarshal'ed design docs.
 
@@ -96,6 +111,13 @@ type livebucket struct {
 
 func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 	b Bucket, err error) {
+	if err = checkEvictionPolicy(settings); err != nil {
+		return nil, err
+	}
+	if err = checkCompactWindow(settings); err != nil {
+		return nil, err
+	}
+
 	fileNames, err := bucketFileNames(dirForBucket, settings)
 	if err != nil {
 		return nil, err
@@ -113,12 +135,15 @@ func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 	aggBucketStoreStats := NewAggStats(func() Aggregatable {
 		return &BucketStoreStats{Time: int64(time.Now().Unix())}
 	})
+	aggTimings := NewAggStats(func() Aggregatable {
+		return &BucketTimings{Time: int64(time.Now().Unix())}
+	})
 
 	res := &livebucket{
 		availablech:  make(chan bool),
 		name:         name,
 		dir:          dirForBucket,
-		settings:     settings,
+		settings:     unsafe.Pointer(settings),
 		bucketstores: make(map[int]*bucketstore),
 		observer:     broadcastMux.Sub(),
 		logs:         NewRing(10),
@@ -128,7 +153,10 @@ func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 			CurBucketStore: &BucketStoreStats{},
 			AggBucket:      aggStats,
 			AggBucketStore: aggBucketStoreStats,
+			CurTimings:     &BucketTimings{},
+			AggTimings:     aggTimings,
 		},
+		timings: &BucketTimings{},
 	}
 
 	for i, fileName := range fileNames {
@@ -138,6 +166,7 @@ func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 			res.Close()
 			return nil, err
 		}
+		bs.setTimings(res.timings)
 		res.bucketstores[i] = bs
 	}
 
@@ -154,6 +183,23 @@ func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 	}
 	res.vbucketDDoc = vbucketDDoc
 
+	vbucketLocal, err := newVBucket(res, VBID_LOCAL, res.bucketstores[0],
+		&res.bucketItemBytes)
+	if err != nil {
+		res.Close()
+		return nil, err
+	}
+	_, err = vbucketLocal.SetVBState(VBActive, nil)
+	if err != nil {
+		res.Close()
+		return nil, err
+	}
+	res.vbucketLocal = vbucketLocal
+
+	if settings.EvictionPolicy != EVICTION_NONE {
+		evictPeriodic.Register(res.availablech, res.mkEvictor())
+	}
+
 	return res, nil
 }
 
@@ -184,7 +230,7 @@ func (b *livebucket) GetBucketDir() string {
 }
 
 func (b *livebucket) GetBucketSettings() *BucketSettings {
-	return b.settings
+	return (*BucketSettings)(atomic.LoadPointer(&b.settings))
 }
 
 // Subscribe to bucket events.
@@ -194,7 +240,7 @@ func (b *livebucket) Subscribe(ch chan<- interface{}) {
 	atomic.AddInt64(&b.observers, 1)
 	b.observer.Register(ch)
 	go func() {
-		for i := uint16(0); i < uint16(b.settings.NumPartitions); i++ {
+		for i := uint16(0); i < uint16(b.GetBucketSettings().NumPartitions); i++ {
 			c := vbucketChange{bucket: b,
 				vbid:     i,
 				oldState: VBDead,
@@ -235,6 +281,7 @@ func (b *livebucket) Close() error {
 		}
 	}
 	b.vbucketDDoc.Close()
+	b.vbucketLocal.Close()
 	for _, bs := range b.bucketstores {
 		bs.Close()
 	}
@@ -256,6 +303,30 @@ func (b *livebucket) Flush() error {
 	return nil
 }
 
+// Deletes every item and _local doc in the bucket, keeping its
+// vbuckets and design docs, and notifies subscribers with a
+// bucketFlush.
+func (b *livebucket) FlushAll() error {
+	if !b.GetBucketSettings().FlushEnabled {
+		return flushDisabled
+	}
+	if !b.Available() {
+		return bucketUnavailable
+	}
+	for i := uint16(0); i < uint16(b.GetBucketSettings().NumPartitions); i++ {
+		if vb, _ := b.GetVBucket(i); vb != nil {
+			if err := vb.flushItems(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := b.vbucketLocal.flushItems(); err != nil {
+		return err
+	}
+	b.observer.Submit(bucketFlush{b})
+	return b.Flush()
+}
+
 func (b *livebucket) Compact() error {
 	for _, bs := range b.bucketstores {
 		err := bs.Compact()
@@ -290,7 +361,7 @@ func (b *livebucket) Load() (err error) {
 				if errVisit = vb.load(); errVisit != nil {
 					return false
 				}
-				if vbid < b.settings.NumPartitions {
+				if vbid < b.GetBucketSettings().NumPartitions {
 					if !b.casVBucket(uint16(vbid), vb, nil) {
 						errVisit = fmt.Errorf("loading vbucket: %v, but it already exists",
 							vbid)
@@ -301,9 +372,14 @@ func (b *livebucket) Load() (err error) {
 						b.vbucketDDoc.Close()
 					}
 					b.vbucketDDoc = vb
+				} else if uint16(vbid) == VBID_LOCAL {
+					if b.vbucketLocal != nil {
+						b.vbucketLocal.Close()
+					}
+					b.vbucketLocal = vb
 				} else {
 					errVisit = fmt.Errorf("vbid out of range during load: %v versus %v",
-						vbid, b.settings.NumPartitions)
+						vbid, b.GetBucketSettings().NumPartitions)
 					return false
 				}
 				return true
@@ -330,6 +406,15 @@ func (b *livebucket) GetVBucket(vbid uint16) (*VBucket, error) {
 	return (*VBucket)(vbp), nil
 }
 
+// Like GetVBucket, but doesn't count as activity, so it doesn't keep
+// the bucket from quiescing.
+func (b *livebucket) peekVBucket(vbid uint16) *VBucket {
+	if !b.Available() {
+		return nil
+	}
+	return (*VBucket)(atomic.LoadPointer(&b.vbuckets[vbid]))
+}
+
 func (b *livebucket) casVBucket(vbid uint16, vb *VBucket, vbPrev *VBucket) bool {
 	return atomic.CompareAndSwapPointer(&b.vbuckets[vbid],
 		unsafe.Pointer(vbPrev), unsafe.Pointer(vb))
@@ -380,7 +465,43 @@ func (b *livebucket) SetVBState(vbid uint16, newState VBState) error {
 }
 
 func (b *livebucket) Auth(passwordClearText []byte) bool {
-	return b.settings.Auth(passwordClearText)
+	settings := b.GetBucketSettings()
+	if !settings.Auth(passwordClearText) {
+		return false
+	}
+	if settings.NeedsRehash(*passwordHashFunc) {
+		// Now that we know the cleartext password, hash it.
+		if err := b.SetPassword(passwordClearText); err != nil {
+			log.Printf("could not rehash password, bucket: %v, err: %v",
+				b.name, err)
+		}
+	}
+	return true
+}
+
+func (b *livebucket) SaslSecret(mech string) (string, error) {
+	return b.GetBucketSettings().SaslSecret(mech)
+}
+
+// Changes the bucket's password, hashing it with the -password-hash
+// func and saving the bucket's settings.  Readers don't take the
+// lock, so the settings are replaced by a changed copy.
+func (b *livebucket) SetPassword(passwordClearText []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	settings := b.GetBucketSettings().Copy()
+	err := settings.SetPassword(*passwordHashFunc, passwordClearText)
+	if err != nil {
+		return err
+	}
+	if settings.MemoryOnly < MemoryOnly_LEVEL_PERSIST_NOTHING {
+		if err = settings.save(b.dir); err != nil {
+			return err
+		}
+	}
+	atomic.StorePointer(&b.settings, unsafe.Pointer(settings))
+	return nil
 }
 
 func (b *livebucket) SnapshotStats() StatsSnapshot {
@@ -412,6 +533,15 @@ func (b *livebucket) sampleStats(t time.Time) {
 	b.stats.AggBucketStore.AddSample(diffBucketStoreStats)
 	b.stats.CurBucketStore = currBucketStoreStats
 
+	currTimings := &BucketTimings{}
+	currTimings.Add(b.timings)
+	diffTimings := &BucketTimings{}
+	diffTimings.Add(currTimings)
+	diffTimings.Sub(b.stats.CurTimings)
+	diffTimings.Time = t.Unix()
+	b.stats.AggTimings.AddSample(diffTimings)
+	b.stats.CurTimings = currTimings
+
 	b.stats.LatestUpdate = t
 }
 
@@ -472,6 +602,10 @@ func (b *livebucket) GetItemBytes() int64 {
 	return atomic.LoadInt64(&b.bucketItemBytes)
 }
 
+func (b *livebucket) GetTimings() *BucketTimings {
+	return b.timings
+}
+
 func (b *livebucket) PushErr(err error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
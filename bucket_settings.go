@@ -2,10 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"code.google.com/p/go.crypto/pbkdf2"
+	"code.google.com/p/go.crypto/scrypt"
 )
 
 const (
@@ -26,18 +35,91 @@ type BucketSettings struct {
 	PasswordSalt     string `json:"passwordSalt"`
 	QuotaBytes       int64  `json:"quotaBytes"`
 	MemoryOnly       int    `json:"memoryOnly"`
+	EvictionPolicy   string `json:"evictionPolicy"`
 	UUID             string `json:"uuid"`
+
+	// Flush as soon as this many items or bytes are dirty, rather
+	// than waiting for the next persist-freq interval; 0 disables.
+	FlushDirtyItems int64 `json:"flushDirtyItems"`
+	FlushDirtyBytes int64 `json:"flushDirtyBytes"`
+
+	// Compact once this percentage of the store file isn't live
+	// data; 0 disables.
+	CompactFragmentation int `json:"compactFragmentation"`
+
+	// Local time window, like "01:00-05:00", when automatic
+	// compaction may run; empty allows any time.
+	CompactWindow string `json:"compactWindow"`
+
+	// Allows deleting all items with FLUSH or the REST flush.
+	FlushEnabled bool `json:"flushEnabled"`
+
+	// Seconds to keep the tombstones of deleted keys, after which
+	// compaction purges them; 0 keeps them forever.  A change from
+	// elsewhere that's older than a purged deletion can resurrect
+	// its key.
+	MetadataPurgeAge int64 `json:"metadataPurgeAge"`
+
+	// Secrets derived from the password for challenge-response SASL
+	// mechs, keyed by mech name.  See saslSecrets().
+	SaslSecrets map[string]string `json:"saslSecrets,omitempty"`
 }
 
+const (
+	PASSWORD_HASH_PLAIN         = ""
+	PASSWORD_HASH_BCRYPT        = "bcrypt"
+	PASSWORD_HASH_SCRYPT        = "scrypt"
+	PASSWORD_HASH_PBKDF2_SHA256 = "pbkdf2-sha256"
+)
+
 type pwverifier func(salt string, bpass, input []byte) bool
 
 var pwverifiers = map[string]pwverifier{
-	"": func(salt string, bpass, input []byte) bool {
+	PASSWORD_HASH_PLAIN: func(salt string, bpass, input []byte) bool {
 		if salt != "" {
 			return false
 		}
 		return bytes.Equal([]byte(bpass), input)
 	},
+	PASSWORD_HASH_BCRYPT: func(salt string, bpass, input []byte) bool {
+		return bcrypt.CompareHashAndPassword(bpass, input) == nil
+	},
+	PASSWORD_HASH_SCRYPT:        rehashVerifier(PASSWORD_HASH_SCRYPT),
+	PASSWORD_HASH_PBKDF2_SHA256: rehashVerifier(PASSWORD_HASH_PBKDF2_SHA256),
+}
+
+// Returns the PasswordHash of a password with the given salt.
+type pwhasher func(salt string, input []byte) (string, error)
+
+var pwhashers = map[string]pwhasher{
+	PASSWORD_HASH_BCRYPT: func(salt string, input []byte) (string, error) {
+		// The bcrypt hash carries its own salt.
+		h, err := bcrypt.GenerateFromPassword(input, bcrypt.DefaultCost)
+		return string(h), err
+	},
+	PASSWORD_HASH_SCRYPT: func(salt string, input []byte) (string, error) {
+		h, err := scrypt.Key(input, []byte(salt), 16384, 8, 1, 32)
+		return hex.EncodeToString(h), err
+	},
+	PASSWORD_HASH_PBKDF2_SHA256: func(salt string, input []byte) (string, error) {
+		h := pbkdf2.Key(input, []byte(salt), 10000, 32, sha256.New)
+		return hex.EncodeToString(h), nil
+	},
+}
+
+// Verifies a password by hashing it again with the same salt.
+func rehashVerifier(hashFunc string) pwverifier {
+	return func(salt string, bpass, input []byte) bool {
+		h, err := pwhashers[hashFunc](salt, input)
+		return err == nil && subtle.ConstantTimeCompare([]byte(h), bpass) == 1
+	}
+}
+
+func checkPasswordHashFunc(hashFunc string) error {
+	if _, ok := pwverifiers[hashFunc]; !ok {
+		return fmt.Errorf("unknown password hash func: %v", hashFunc)
+	}
+	return nil
 }
 
 func (bs *BucketSettings) Auth(input []byte) bool {
@@ -51,6 +133,76 @@ func (bs *BucketSettings) Auth(input []byte) bool {
 	return fun(bs.PasswordSalt, []byte(bs.PasswordHash), input)
 }
 
+// Sets the password, hashed by hashFunc with a new random salt.  An
+// empty password, meaning no password, is kept in plaintext.
+func (bs *BucketSettings) SetPassword(hashFunc string, password []byte) error {
+	if hashFunc == PASSWORD_HASH_PLAIN || len(password) == 0 {
+		bs.PasswordHashFunc = PASSWORD_HASH_PLAIN
+		bs.PasswordSalt = ""
+		bs.PasswordHash = string(password)
+		bs.SaslSecrets = nil
+		return nil
+	}
+	hasher := pwhashers[hashFunc]
+	if hasher == nil {
+		return fmt.Errorf("unknown password hash func: %v", hashFunc)
+	}
+	saltBytes := make([]byte, 16)
+	if _, err := rand.Read(saltBytes); err != nil {
+		return err
+	}
+	salt := hex.EncodeToString(saltBytes)
+	h, err := hasher(salt, password)
+	if err != nil {
+		return err
+	}
+	secrets, err := saslSecrets(password)
+	if err != nil {
+		return err
+	}
+	bs.PasswordHashFunc = hashFunc
+	bs.PasswordSalt = salt
+	bs.PasswordHash = h
+	bs.SaslSecrets = secrets
+	return nil
+}
+
+// Returns true if the password is still kept in plaintext, but
+// should be hashed by hashFunc, or if it's hashed but its secrets
+// aren't those of the enabled SASL mechs.
+func (bs *BucketSettings) NeedsRehash(hashFunc string) bool {
+	if bs.PasswordHashFunc == PASSWORD_HASH_PLAIN {
+		return bs.PasswordHash != "" && hashFunc != PASSWORD_HASH_PLAIN
+	}
+	numSecrets := 0
+	for _, mech := range saslEnabledMechs() {
+		if mech == SASL_PLAIN {
+			continue
+		}
+		if _, ok := bs.SaslSecrets[mech]; !ok {
+			return true
+		}
+		numSecrets++
+	}
+	return len(bs.SaslSecrets) != numSecrets
+}
+
+// Returns the secret a challenge-response SASL mech needs.
+func (bs *BucketSettings) SaslSecret(mech string) (string, error) {
+	if bs.PasswordHashFunc == PASSWORD_HASH_PLAIN {
+		if bs.PasswordSalt != "" {
+			return "", fmt.Errorf("unexpected salt for a plaintext password")
+		}
+		return saslSecret(mech, []byte(bs.PasswordHash))
+	}
+	secret, ok := bs.SaslSecrets[mech]
+	if !ok {
+		return "", fmt.Errorf("no %v secret; please auth with PLAIN"+
+			" or set the password again", mech)
+	}
+	return secret, nil
+}
+
 func (bs *BucketSettings) Copy() *BucketSettings {
 	rv := *bs
 	return &rv
@@ -59,10 +211,18 @@ func (bs *BucketSettings) Copy() *BucketSettings {
 // Returns a safe subset (no passwords) useful for JSON-ification.
 func (bs *BucketSettings) SafeView() map[string]interface{} {
 	return map[string]interface{}{
-		"numPartitions": bs.NumPartitions,
-		"quotaBytes":    bs.QuotaBytes,
-		"memoryOnly":    bs.MemoryOnly,
-		"uuid":          bs.UUID,
+		"numPartitions":  bs.NumPartitions,
+		"quotaBytes":     bs.QuotaBytes,
+		"memoryOnly":     bs.MemoryOnly,
+		"evictionPolicy": bs.EvictionPolicy,
+		"uuid":           bs.UUID,
+
+		"flushDirtyItems":      bs.FlushDirtyItems,
+		"flushDirtyBytes":      bs.FlushDirtyBytes,
+		"compactFragmentation": bs.CompactFragmentation,
+		"compactWindow":        bs.CompactWindow,
+		"flushEnabled":         bs.FlushEnabled,
+		"metadataPurgeAge":     bs.MetadataPurgeAge,
 	}
 }
 
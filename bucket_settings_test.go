@@ -39,3 +39,54 @@ func TestBucketSettingsAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestBucketSettingsSetPassword(t *testing.T) {
+	for _, hf := range []string{PASSWORD_HASH_PLAIN, PASSWORD_HASH_BCRYPT,
+		PASSWORD_HASH_SCRYPT, PASSWORD_HASH_PBKDF2_SHA256} {
+		bs := &BucketSettings{}
+		if err := bs.SetPassword(hf, []byte("secret")); err != nil {
+			t.Fatalf("expected SetPassword(%v) to work, got: %v", hf, err)
+		}
+		if bs.PasswordHashFunc != hf {
+			t.Errorf("expected hash func %v, got: %v", hf, bs.PasswordHashFunc)
+		}
+		if hf != PASSWORD_HASH_PLAIN && bs.PasswordHash == "secret" {
+			t.Errorf("expected %v to not keep a cleartext password", hf)
+		}
+		if !bs.Auth([]byte("secret")) {
+			t.Errorf("expected %v auth to work", hf)
+		}
+		if bs.Auth([]byte("wrong")) {
+			t.Errorf("expected %v auth with the wrong password to fail", hf)
+		}
+		if bs.NeedsRehash(PASSWORD_HASH_BCRYPT) != (hf == PASSWORD_HASH_PLAIN) {
+			t.Errorf("unexpected NeedsRehash for %v", hf)
+		}
+	}
+
+	bs := &BucketSettings{}
+	if err := bs.SetPassword("notimplemented", []byte("secret")); err == nil {
+		t.Errorf("expected an unknown hash func to fail")
+	}
+	if err := bs.SetPassword(PASSWORD_HASH_BCRYPT, nil); err != nil ||
+		bs.PasswordHashFunc != PASSWORD_HASH_PLAIN || !bs.Auth(nil) ||
+		bs.NeedsRehash(PASSWORD_HASH_BCRYPT) {
+		t.Errorf("expected an empty password to stay plaintext, got: %#v", bs)
+	}
+
+	defer func(v bool) { *saslCramMD5 = v }(*saslCramMD5)
+	if err := bs.SetPassword(PASSWORD_HASH_BCRYPT, []byte("secret")); err != nil {
+		t.Fatalf("expected SetPassword to work, got: %v", err)
+	}
+	*saslCramMD5 = true
+	if !bs.NeedsRehash(PASSWORD_HASH_BCRYPT) {
+		t.Errorf("expected a rehash to add the CRAM-MD5 secret")
+	}
+	if err := bs.SetPassword(PASSWORD_HASH_BCRYPT, []byte("secret")); err != nil {
+		t.Fatalf("expected SetPassword to work, got: %v", err)
+	}
+	*saslCramMD5 = false
+	if !bs.NeedsRehash(PASSWORD_HASH_BCRYPT) {
+		t.Errorf("expected a rehash to drop the CRAM-MD5 secret")
+	}
+}
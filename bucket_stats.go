@@ -15,6 +15,8 @@ type BucketStatsSnapshot struct {
 	CurBucketStore *BucketStoreStats
 	AggBucket      *AggStats
 	AggBucketStore *AggStats
+	CurTimings     *BucketTimings
+	AggTimings     *AggStats
 	LatestUpdate   time.Time
 
 	requests int
@@ -29,10 +31,12 @@ func (bss *BucketStatsSnapshot) ToMap() map[string]interface{} {
 		"totals": map[string]interface{}{
 			"bucketStats":      bss.CurBucket,
 			"bucketStoreStats": bss.CurBucketStore,
+			"timings":          bss.CurTimings,
 		},
 		"diffs": map[string]interface{}{
 			"bucketStats":      bss.AggBucket,
 			"bucketStoreStats": bss.AggBucketStore,
+			"timings":          bss.AggTimings,
 		},
 		"levels": AggStatsLevels,
 	}
@@ -44,6 +48,8 @@ func (b *BucketStatsSnapshot) Copy() *BucketStatsSnapshot {
 		&(*b.CurBucketStore),
 		&(*b.AggBucket),
 		&(*b.AggBucketStore),
+		b.CurTimings,
+		&(*b.AggTimings),
 		b.LatestUpdate,
 		0,
 	}
@@ -66,9 +72,15 @@ type BucketStats struct {
 	Incrs       int64 `json:"incrs"`
 	Decrs       int64 `json:"decrs"`
 	Deletes     int64 `json:"deletes"`
+	Touches     int64 `json:"touches"`
+	GetLocks    int64 `json:"getLocks"`
+	Unlocks     int64 `json:"unlocks"`
+	LockedErrs  int64 `json:"lockedErrs"`
+	LockExpires int64 `json:"lockExpires"`
 	Creates     int64 `json:"creates"`
 	Updates     int64 `json:"updates"`
 	Expirable   int64 `json:"expirable"`
+	Evictions   int64 `json:"evictions"`
 	RGets       int64 `json:"rGets"`
 	RGetResults int64 `json:"rGetResults"`
 	Unknowns    int64 `json:"unknowns"`
@@ -102,8 +114,14 @@ func (s *BucketStats) Op(in *BucketStats, op func(int64, int64) int64) {
 	s.Incrs = op(s.Incrs, atomic.LoadInt64(&in.Incrs))
 	s.Decrs = op(s.Decrs, atomic.LoadInt64(&in.Decrs))
 	s.Deletes = op(s.Deletes, atomic.LoadInt64(&in.Deletes))
+	s.Touches = op(s.Touches, atomic.LoadInt64(&in.Touches))
+	s.GetLocks = op(s.GetLocks, atomic.LoadInt64(&in.GetLocks))
+	s.Unlocks = op(s.Unlocks, atomic.LoadInt64(&in.Unlocks))
+	s.LockedErrs = op(s.LockedErrs, atomic.LoadInt64(&in.LockedErrs))
+	s.LockExpires = op(s.LockExpires, atomic.LoadInt64(&in.LockExpires))
 	s.Creates = op(s.Creates, atomic.LoadInt64(&in.Creates))
 	s.Updates = op(s.Updates, atomic.LoadInt64(&in.Updates))
+	s.Evictions = op(s.Evictions, atomic.LoadInt64(&in.Evictions))
 	s.RGets = op(s.RGets, atomic.LoadInt64(&in.RGets))
 	s.RGetResults = op(s.RGetResults, atomic.LoadInt64(&in.RGetResults))
 	s.Unknowns = op(s.Unknowns, atomic.LoadInt64(&in.Unknowns))
@@ -134,8 +152,14 @@ func (s *BucketStats) Equal(in *BucketStats) bool {
 		s.Incrs == atomic.LoadInt64(&in.Incrs) &&
 		s.Decrs == atomic.LoadInt64(&in.Decrs) &&
 		s.Deletes == atomic.LoadInt64(&in.Deletes) &&
+		s.Touches == atomic.LoadInt64(&in.Touches) &&
+		s.GetLocks == atomic.LoadInt64(&in.GetLocks) &&
+		s.Unlocks == atomic.LoadInt64(&in.Unlocks) &&
+		s.LockedErrs == atomic.LoadInt64(&in.LockedErrs) &&
+		s.LockExpires == atomic.LoadInt64(&in.LockExpires) &&
 		s.Creates == atomic.LoadInt64(&in.Creates) &&
 		s.Updates == atomic.LoadInt64(&in.Updates) &&
+		s.Evictions == atomic.LoadInt64(&in.Evictions) &&
 		s.RGets == atomic.LoadInt64(&in.RGets) &&
 		s.RGetResults == atomic.LoadInt64(&in.RGetResults) &&
 		s.Unknowns == atomic.LoadInt64(&in.Unknowns) &&
@@ -159,8 +183,14 @@ func (s *BucketStats) Send(ch chan<- statItem) {
 	ch <- statItem{"incrs", strconv.FormatInt(s.Incrs, 10)}
 	ch <- statItem{"decrs", strconv.FormatInt(s.Decrs, 10)}
 	ch <- statItem{"deletes", strconv.FormatInt(s.Deletes, 10)}
+	ch <- statItem{"touches", strconv.FormatInt(s.Touches, 10)}
+	ch <- statItem{"get_locks", strconv.FormatInt(s.GetLocks, 10)}
+	ch <- statItem{"unlocks", strconv.FormatInt(s.Unlocks, 10)}
+	ch <- statItem{"locked_errs", strconv.FormatInt(s.LockedErrs, 10)}
+	ch <- statItem{"lock_expires", strconv.FormatInt(s.LockExpires, 10)}
 	ch <- statItem{"creates", strconv.FormatInt(s.Creates, 10)}
 	ch <- statItem{"updates", strconv.FormatInt(s.Updates, 10)}
+	ch <- statItem{"evictions", strconv.FormatInt(s.Evictions, 10)}
 	ch <- statItem{"rgets", strconv.FormatInt(s.RGets, 10)}
 	ch <- statItem{"rget_results", strconv.FormatInt(s.RGetResults, 10)}
 	ch <- statItem{"unknowns", strconv.FormatInt(s.Unknowns, 10)}
@@ -199,12 +229,18 @@ func doStats(b Bucket, w io.Writer, key string) error {
 	statAge := b.StatAge()
 	ch <- statItem{"stateAge", statAge.String()}
 
-	if statAge > time.Second*30 {
+	if key == "timings" {
+		// Timings are recorded as they happen, so need no sampling.
+		b.GetTimings().Send(ch)
+	} else if statAge > time.Second*30 {
 		log.Printf("stats are too old; starting them up")
 		b.StartStats(time.Second)
 	} else {
 		agg := AggregateBucketStats(b, key)
 		agg.Send(ch)
+		if key == "" {
+			sendResidencyStats(b, ch)
+		}
 	}
 
 	close(ch)
@@ -8,8 +8,10 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/dustin/gomemcached"
 )
@@ -627,6 +629,56 @@ func TestBucketSettingsSafeView(t *testing.T) {
 	}
 }
 
+func TestBucketPasswordRehash(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			PasswordHash:  "secret",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	if b0.Auth([]byte("wrong")) {
+		t.Errorf("expected auth with the wrong password to fail")
+	}
+	if b0.GetBucketSettings().PasswordHashFunc != PASSWORD_HASH_PLAIN {
+		t.Errorf("expected no rehash after a failed auth")
+	}
+	if !b0.Auth([]byte("secret")) {
+		t.Errorf("expected auth to work")
+	}
+	if b0.GetBucketSettings().PasswordHashFunc != *passwordHashFunc ||
+		b0.GetBucketSettings().PasswordHash == "secret" {
+		t.Errorf("expected the password to be rehashed, got: %#v",
+			b0.GetBucketSettings())
+	}
+
+	bs := &BucketSettings{}
+	if _, err = bs.load(testBucketDir); err != nil {
+		t.Fatalf("expected settings load to work, got: %v", err)
+	}
+	if bs.PasswordHash == "secret" || !bs.Auth([]byte("secret")) {
+		t.Errorf("expected the saved password to be rehashed, got: %#v", bs)
+	}
+
+	prev := b0.GetBucketSettings()
+	prevHash := prev.PasswordHash
+	if err = b0.SetPassword([]byte("newsecret")); err != nil {
+		t.Errorf("expected SetPassword to work, got: %v", err)
+	}
+	if b0.Auth([]byte("secret")) || !b0.Auth([]byte("newsecret")) {
+		t.Errorf("expected only the new password to work")
+	}
+	if prev.PasswordHash != prevHash || prev == b0.GetBucketSettings() {
+		t.Errorf("expected SetPassword to replace, not change, the settings")
+	}
+}
+
 func TestMemoryOnlyLevel1Bucket(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
@@ -845,6 +897,141 @@ func TestBucketQuotaBytes(t *testing.T) {
 	}
 }
 
+func TestBucketFlushAll(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	buckets0, err := NewBuckets(testBucketDir,
+		&BucketSettings{NumPartitions: MAX_VBUCKETS})
+	if err != nil {
+		t.Fatalf("Expected NewBuckets to succeed: %v", err)
+	}
+	defer buckets0.CloseAll()
+
+	b0, _ := buckets0.New("foo", &BucketSettings{NumPartitions: MAX_VBUCKETS})
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	r0 := &reqHandler{currentBucket: b0}
+	emptyBytes := b0.GetItemBytes()
+	testLoadInts(t, r0, 2, 5)
+
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSH,
+	})
+	if res.Status != NOT_SUPPORTED {
+		t.Errorf("expected FLUSH of a bucket without flushEnabled to fail, got: %v", res)
+	}
+	testExpectInts(t, r0, 2, []int{0, 1, 2, 3, 4}, "after disabled flush")
+
+	// Settings are replaced but never changed, so install a changed copy.
+	settings := b0.GetBucketSettings().Copy()
+	settings.FlushEnabled = true
+	atomic.StorePointer(&b0.(*livebucket).settings, unsafe.Pointer(settings))
+	res = r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSH,
+		Extras: []byte{0, 0},
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected FLUSH with bad extras to fail, got: %v", res)
+	}
+
+	lastCas := vb0.Meta().LastCas
+	res = r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSHQ,
+	})
+	if res != nil {
+		t.Errorf("expected FLUSHQ to work quietly, got: %v", res)
+	}
+	testExpectInts(t, r0, 2, []int{}, "after flush")
+	if vb0.stats.Items != 0 || b0.GetItemBytes() > emptyBytes {
+		t.Errorf("expected flush to reset items and item bytes, got: %v, %v",
+			vb0.stats.Items, b0.GetItemBytes())
+	}
+	if vb0.Meta().LastCas <= lastCas {
+		t.Errorf("expected LastCas to keep increasing after flush")
+	}
+
+	testLoadInts(t, r0, 2, 2)
+	b0.Flush()
+	b0.Close()
+
+	buckets1, err := NewBuckets(testBucketDir,
+		&BucketSettings{NumPartitions: MAX_VBUCKETS})
+	if err != nil {
+		t.Fatalf("Expected NewBuckets to succeed: %v", err)
+	}
+	defer buckets1.CloseAll()
+	b1 := buckets1.Get("foo")
+	if b1 == nil {
+		t.Fatalf("expected bucket foo to reload")
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	testExpectInts(t, r1, 2, []int{0, 1}, "reloaded after flush")
+	if vb1, _ := b1.GetVBucket(2); vb1 == nil || vb1.Meta().LastCas <= lastCas {
+		t.Errorf("expected a reloaded LastCas after the flush")
+	}
+}
+
+func TestBucketFlushDelay(t *testing.T) {
+	d, _, b := testSetupDefaultBucketEx(t,
+		&BucketSettings{NumPartitions: 1, FlushEnabled: true}, 0)
+	defer os.RemoveAll(d)
+	r := &reqHandler{currentBucket: b}
+	testLoadInts(t, r, 0, 3)
+
+	res := r.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSH,
+		Extras: []byte{0, 0, 0, 1},
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delayed FLUSH to work, got: %v", res)
+	}
+	testExpectInts(t, r, 0, []int{0, 1, 2}, "before the flush delay")
+	time.Sleep(1500 * time.Millisecond)
+	testExpectInts(t, r, 0, []int{}, "after the flush delay")
+}
+
+func TestBucketFlushDelayAfterQuiesce(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	buckets, err := NewBuckets(testBucketDir,
+		&BucketSettings{NumPartitions: MAX_VBUCKETS})
+	if err != nil {
+		t.Fatalf("Expected NewBuckets to succeed: %v", err)
+	}
+	defer buckets.CloseAll()
+
+	b0, _ := buckets.New("foo", &BucketSettings{
+		NumPartitions: MAX_VBUCKETS,
+		FlushEnabled:  true,
+	})
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	r0 := &reqHandler{buckets: buckets, currentBucket: b0}
+	testLoadInts(t, r0, 2, 3)
+	b0.Flush()
+
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSH,
+		Extras: []byte{0, 0, 0, 1},
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delayed FLUSH to work, got: %v", res)
+	}
+	if err = buckets.Close("foo", false); err != nil {
+		t.Fatalf("expected Close to work, got: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	b1 := buckets.Get("foo")
+	if b1 == nil || b1 == b0 {
+		t.Fatalf("expected bucket foo to reopen, got: %v", b1)
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	testExpectInts(t, r1, 2, []int{}, "after a flush delay over a quiesce")
+}
+
 func TestReloadOnlyNewDirectory(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
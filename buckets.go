@@ -29,8 +29,9 @@ type (
 	}
 
 	getBucketReq struct {
-		name string
-		res  chan Bucket
+		name     string
+		res      chan Bucket
+		openOnly bool // Don't open a closed, such as quiesced, bucket.
 	}
 
 	newBucketReq struct {
@@ -172,7 +173,7 @@ func (b *Buckets) service() {
 				return
 			}
 			// request to retrieve a bucket
-			b.getInternal(req.name, req.res)
+			b.getInternal(req.name, req.res, req.openOnly)
 		case ao := <-b.agch:
 			for _, ch := range b.opening[ao.name] {
 				ch <- ao.bucket
@@ -198,7 +199,17 @@ func (b *Buckets) service() {
 
 // Get the named bucket (or nil if it doesn't exist).
 func (b *Buckets) Get(name string) Bucket {
-	r := getBucketReq{name, make(chan Bucket)}
+	r := getBucketReq{name, make(chan Bucket), false}
+
+	b.gch <- r
+
+	return <-r.res
+}
+
+// Get the named bucket only if it's already open (or nil), so that a
+// quiesced bucket stays closed.
+func (b *Buckets) GetOpen(name string) Bucket {
+	r := getBucketReq{name, make(chan Bucket), true}
 
 	b.gch <- r
 
@@ -252,10 +263,10 @@ func (b *Buckets) asyncOpen(name string) {
 	b.agch <- asyncOpenComplete{name: name}
 }
 
-func (b *Buckets) getInternal(name string, ch chan<- Bucket) {
+func (b *Buckets) getInternal(name string, ch chan<- Bucket, openOnly bool) {
 	// If the bucket is already open, we're done here.
 	rv := b.buckets[name]
-	if rv != nil {
+	if rv != nil || openOnly {
 		ch <- rv
 		return
 	}
@@ -7,12 +7,17 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/steveyen/gkvlite"
 )
 
 func (s *bucketstore) Compact() error {
+	return s.compactFor(PERSIST_REASON_REQUESTED)
+}
+
+func (s *bucketstore) compactFor(reason string) error {
 	s.diskLock.Lock()
 	defer s.diskLock.Unlock()
 
@@ -21,6 +26,10 @@ func (s *bucketstore) Compact() error {
 		return nil
 	}
 
+	if s.timings != nil {
+		defer s.timings.Compacts.Since(time.Now())
+	}
+
 	compactPath := bsf.path + ".compact"
 	if err := s.compactGo(bsf, compactPath); err != nil {
 		atomic.AddInt64(&s.stats.CompactErrors, 1)
@@ -28,6 +37,7 @@ func (s *bucketstore) Compact() error {
 	}
 
 	atomic.AddInt64(&s.stats.Compacts, 1)
+	s.noteReason(&s.lastCompact, reason)
 	return nil
 }
 
@@ -133,6 +143,7 @@ func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string)
 	sc := mkBucketStoreCallbacks(s.keyCompareForCollection)
 
 	nextBSF := NewBucketStoreFile(nextPath, nextFile, bsf.stats)
+	nextBSF.timings = bsf.timings
 	nextStore, err := gkvlite.NewStoreEx(nextBSF, sc)
 	if err != nil {
 		// TODO: Rollback the previous *.orig rename.
@@ -151,6 +162,14 @@ func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string)
 
 func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 	writeEvery int) (numItems uint64, lastItem *gkvlite.Item, err error) {
+	return copyCollIf(srcColl, dstColl, writeEvery, nil)
+}
+
+// Like copyColl(), but only copies the items that keep returns true
+// for, where a nil keep copies every item.
+func copyCollIf(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
+	writeEvery int, keep func(*gkvlite.Item) bool) (
+	numItems uint64, lastItem *gkvlite.Item, err error) {
 	minItem, err := srcColl.MinItem(true)
 	if err != nil {
 		return 0, nil, err
@@ -161,6 +180,9 @@ func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 
 	var errVisit error
 	err = srcColl.VisitItemsAscend(minItem.Key, true, func(i *gkvlite.Item) bool {
+		if keep != nil && !keep(i) {
+			return true
+		}
 		if errVisit = dstColl.SetItem(i.Copy()); errVisit != nil {
 			return false
 		}
@@ -334,7 +356,11 @@ func (s *bucketstore) copyRemainingColls(bsf *bucketstorefile,
 			return fmt.Errorf("compact rest dest missing: %v, collName: %v",
 				bsf.path, collName)
 		}
-		_, _, err := copyColl(collCurr, collNext, writeEvery)
+		var keep func(*gkvlite.Item) bool
+		if strings.HasSuffix(collName, COLL_SUFFIX_TOMBS) {
+			keep = s.unpurgedTombstone(time.Now())
+		}
+		_, _, err := copyCollIf(collCurr, collNext, writeEvery, keep)
 		if err != nil {
 			return err
 		}
@@ -342,6 +368,19 @@ func (s *bucketstore) copyRemainingColls(bsf *bucketstorefile,
 	return nil
 }
 
+// Returns whether a tombstone is to be kept by a compaction at time
+// t, per the bucket's MetadataPurgeAge, or nil to keep them all.
+func (s *bucketstore) unpurgedTombstone(t time.Time) func(*gkvlite.Item) bool {
+	if s.settings == nil || s.settings.MetadataPurgeAge <= 0 {
+		return nil
+	}
+	purgeBefore := t.Add(-time.Duration(s.settings.MetadataPurgeAge) * time.Second)
+	return func(i *gkvlite.Item) bool {
+		_, deleted, err := tombstoneParse(i.Val)
+		return err != nil || !deleted.Before(purgeBefore)
+	}
+}
+
 // Copy any mutations that concurrently just came in.  We use
 // recursion to naturally have a phase of pausing & copying,
 // and then unpausing as the recursion unwinds.
@@ -378,3 +417,49 @@ func (s *bucketstore) copyBucketStoreDeltas(bsf *bucketstorefile,
 	})
 	return err
 }
+
+// Parses a compaction window like "01:00-05:30", in local time, into
+// offsets from midnight.  The window may wrap around midnight.
+func parseCompactWindow(window string) (start, end time.Duration, err error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("compaction window not HH:MM-HH:MM: %v", window)
+	}
+	var offsets [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("compaction window %v, err: %v", window, err)
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour +
+			time.Duration(t.Minute())*time.Minute
+	}
+	return offsets[0], offsets[1], nil
+}
+
+func checkCompactWindow(bs *BucketSettings) error {
+	if bs.CompactWindow == "" {
+		return nil
+	}
+	_, _, err := parseCompactWindow(bs.CompactWindow)
+	return err
+}
+
+// Returns true if automatic compaction may run at time t.  An empty
+// window allows compaction at any time.
+func inCompactWindow(window string, t time.Time) bool {
+	if window == "" {
+		return true
+	}
+	start, end, err := parseCompactWindow(window)
+	if err != nil {
+		return false
+	}
+	t = t.Local()
+	at := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute
+	if start <= end {
+		return start <= at && at < end
+	}
+	return at >= start || at < end
+}
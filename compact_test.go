@@ -10,8 +10,10 @@ import (
 	"sort"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
 )
 
 func TestCompaction(t *testing.T) {
@@ -505,3 +507,150 @@ func TestCompactionViews(t *testing.T) {
 
 	close(done)
 }
+
+func TestCompactWindow(t *testing.T) {
+	if _, _, err := parseCompactWindow("01:00"); err == nil {
+		t.Errorf("expected a window without an end to fail")
+	}
+	if _, _, err := parseCompactWindow("01:00-25:00"); err == nil {
+		t.Errorf("expected a window with a bad hour to fail")
+	}
+	_, err := NewBucket("test", "./tmp/not-there",
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			CompactWindow: "bogus",
+		})
+	if err == nil {
+		t.Errorf("expected NewBucket to fail on a bad compaction window")
+	}
+
+	at := func(h, m int) time.Time {
+		return time.Date(2013, 1, 1, h, m, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window string
+		t      time.Time
+		exp    bool
+	}{
+		{"", at(12, 0), true},
+		{"01:00-05:00", at(3, 0), true},
+		{"01:00-05:00", at(5, 0), false},
+		{"01:00-05:00", at(0, 59), false},
+		{"22:00-02:30", at(23, 0), true},
+		{"22:00-02:30", at(1, 0), true},
+		{"22:00-02:30", at(12, 0), false},
+		{"bogus", at(12, 0), false},
+	}
+	for _, test := range tests {
+		if inCompactWindow(test.window, test.t) != test.exp {
+			t.Errorf("expected inCompactWindow(%v, %v) to be %v",
+				test.window, test.t, test.exp)
+		}
+	}
+}
+
+func TestCompactFragmentation(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	defer func(m int64) { compactMinFileSize = m }(compactMinFileSize)
+	compactMinFileSize = 0
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:        MAX_VBUCKETS,
+			CompactFragmentation: 10,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	bs := b0.GetBucketStore(0)
+	for i := 0; i < 10; i++ {
+		testLoadInts(t, r0, 2, 5)
+		if _, err = bs.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+	}
+	if bs.Fragmentation() < 10 {
+		t.Fatalf("expected overwrites to fragment the file, got: %v",
+			bs.Fragmentation())
+	}
+
+	bs.maybeCompact(time.Now())
+	if bs.Stats().Compacts != 1 {
+		t.Errorf("expected a compaction, got: %v", bs.Stats().Compacts)
+	}
+	_, lastCompact := bs.LastReasons()
+	if lastCompact.Reason != PERSIST_REASON_FRAGMENTATION {
+		t.Errorf("expected fragmentation compaction, got: %#v", lastCompact)
+	}
+	testExpectInts(t, r0, 2, []int{0, 1, 2, 3, 4}, "after compaction")
+}
+
+func TestCompactionPurgesTombstones(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:    MAX_VBUCKETS,
+			MetadataPurgeAge: 3600,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	vb, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 2)
+	for _, key := range []string{"0", "1"} {
+		res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.DELETE,
+			VBucket: 2,
+			Key:     []byte(key),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected DELETE of %v to work, got: %v", key, res)
+		}
+	}
+
+	// Age the tombstone of "0" past the purge age.
+	tomb, err := vb.ps.getTombstone([]byte("0"))
+	if err != nil || tomb == nil {
+		t.Fatalf("expected a tombstone, got: %v, err: %v", tomb, err)
+	}
+	vb.ps.mutate(func(keys, changes *gkvlite.Collection) {
+		err = vb.ps.tombs().SetItem(&gkvlite.Item{
+			Key:      tomb.key,
+			Val:      tombstoneBytes(tomb, time.Now().Add(-2*time.Hour)),
+			Priority: 1,
+		})
+	})
+	if err != nil {
+		t.Fatalf("expected tombstone to be aged, got: %v", err)
+	}
+
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	if err = b0.Compact(); err != nil {
+		t.Fatalf("expected Compact to work, got: %v", err)
+	}
+
+	if tomb, err = vb.ps.getTombstone([]byte("0")); err != nil || tomb != nil {
+		t.Errorf("expected old tombstone to be purged, got: %v, err: %v",
+			tomb, err)
+	}
+	if tomb, err = vb.ps.getTombstone([]byte("1")); err != nil || tomb == nil {
+		t.Errorf("expected new tombstone to be kept, got: %v, err: %v",
+			tomb, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/steveyen/gkvlite"
+)
+
+var evictPeriodic *periodically
+
+// Eviction starts when a bucket's resident item bytes reach
+// evictHighWater percent of its quota, and continues until they're
+// under evictLowWater percent.
+var evictHighWater = int64(85)
+var evictLowWater = int64(75)
+
+const (
+	EVICTION_NONE  = ""
+	EVICTION_VALUE = "value" // Evict values, keeping the keys index resident.
+	EVICTION_FULL  = "full"  // Evict both values and the keys index.
+)
+
+// Eviction is not-recently-used by partition: the evictor sweeps the
+// vbuckets like a clock, and a vbucket whose items were read since it
+// last came by gets a second chance instead of being evicted from.
+// Within a vbucket, items are not-recently-used by their treap
+// priorities; see recencyPriority().
+var evictionPolicies = map[string]bool{
+	EVICTION_NONE:  true,
+	EVICTION_VALUE: true,
+	EVICTION_FULL:  true,
+}
+
+func checkEvictionPolicy(bs *BucketSettings) error {
+	if !evictionPolicies[bs.EvictionPolicy] {
+		return fmt.Errorf("unknown eviction policy: %v", bs.EvictionPolicy)
+	}
+	if bs.EvictionPolicy != EVICTION_NONE &&
+		bs.MemoryOnly != MemoryOnly_LEVEL_PERSIST_EVERYTHING {
+		// Only items that have been persisted can be evicted, as
+		// they're faulted back in from the store file.
+		return fmt.Errorf("eviction policy %v needs a fully persisted bucket",
+			bs.EvictionPolicy)
+	}
+	return nil
+}
+
+// The changes of an evictable bucket are given treap priorities that
+// fall as the time of their last use rises.  EvictSomeItems() evicts
+// the items on a random walk down from a treap's root, and the higher
+// an item's priority the nearer the root it sits, so the items that
+// haven't been used for the longest are evicted the most.  The high
+// bits of a priority count down recency periods, wrapping around after
+// 1<<16 periods, and the low bits are random to keep the treap
+// balanced among items used in the same period.
+var evictRecencyPeriod = 10 * time.Minute
+
+const evictRecencyRandBits = 15
+
+// Bounds the used changes that a partition remembers between visits
+// from the evictor.  Uses beyond that aren't recorded.
+var evictMaxUsed = 10000
+
+func recencyPriority(t time.Time) int32 {
+	period := uint32(t.UnixNano()/int64(evictRecencyPeriod)) & 0xffff
+	return int32((0xffff-period)<<evictRecencyRandBits |
+		uint32(rand.Int31n(1<<evictRecencyRandBits)))
+}
+
+// Returns whether a change with the given priority was last used in
+// an earlier recency period than t.
+func recencyStale(priority int32, t time.Time) bool {
+	return priority>>evictRecencyRandBits !=
+		recencyPriority(t)>>evictRecencyRandBits
+}
+
+// Returns the estimated bytes of items that are resident in memory.
+// Each partition estimates the bytes that it evicted, and counts an
+// evicted item as resident again only once it's read back in.
+func (b *livebucket) GetResidentItemBytes() int64 {
+	itemBytes := atomic.LoadInt64(&b.bucketItemBytes)
+	nonResident := int64(0)
+	for _, bs := range b.bucketstores {
+		nonResident += atomic.LoadInt64(&bs.evictedBytes)
+	}
+	if nonResident > itemBytes {
+		return 0
+	}
+	return itemBytes - nonResident
+}
+
+func (b *livebucket) mkEvictor() func(time.Time) bool {
+	return func(t time.Time) bool {
+		b.evict()
+		return true
+	}
+}
+
+// Evicts items from a bucket that's over its high water mark until
+// it's under its low water mark, or until no more items can be
+// evicted, returning the number of items evicted.
+func (b *livebucket) evict() (numEvicted int64) {
+	settings := b.GetBucketSettings()
+	quotaBytes := settings.QuotaBytes
+	if quotaBytes <= 0 || settings.EvictionPolicy == EVICTION_NONE {
+		return 0
+	}
+	if b.GetResidentItemBytes() < quotaBytes*evictHighWater/100 {
+		return 0
+	}
+	full := settings.EvictionPolicy == EVICTION_FULL
+	lowBytes := quotaBytes * evictLowWater / 100
+	np := settings.NumPartitions
+	secondChances := 0
+	for misses := 0; misses < np && b.GetResidentItemBytes() >= lowBytes; {
+		vb, _ := b.GetVBucket(uint16(b.evictNext % np))
+		b.evictNext++
+		if vb == nil {
+			misses++
+			continue
+		}
+		// Once every vbucket has had its second chance, they're all
+		// recently used, so evict from them anyway.
+		if vb.ps.unreference() && secondChances < np {
+			secondChances++
+			continue
+		}
+		n := vb.evict(full)
+		if n == 0 {
+			misses++
+			continue
+		}
+		misses = 0
+		numEvicted += n
+	}
+	return numEvicted
+}
+
+// Evicts some persisted items from memory, returning the number of
+// items evicted.  Their bytes are estimated from the average item.
+// Changes that were used since the last visit are first moved away
+// from the root, which leaves them dirty and so unevictable until
+// they're persisted again.
+func (v *VBucket) evict(full bool) (numEvicted int64) {
+	v.ps.mutate(func(keys, changes *gkvlite.Collection) {
+		v.ps.reprioritize_unlocked(changes)
+		numEvicted = int64(changes.EvictSomeItems())
+		if full {
+			keys.EvictSomeItems()
+		}
+	})
+	if numEvicted > 0 {
+		atomic.AddInt64(&v.stats.Evictions, numEvicted)
+		items := atomic.LoadInt64(&v.stats.Items)
+		itemBytes := atomic.LoadInt64(&v.stats.ItemBytes)
+		if items > 0 {
+			v.ps.addEvictedBytes(numEvicted*(itemBytes/items), itemBytes)
+		}
+	}
+	return numEvicted
+}
+
+func sendResidencyStats(b Bucket, ch chan<- statItem) {
+	itemBytes := b.GetItemBytes()
+	residentBytes := b.GetResidentItemBytes()
+	ch <- statItem{"resident_item_bytes", strconv.FormatInt(residentBytes, 10)}
+	ratio := 100.0
+	if itemBytes > 0 {
+		ratio = float64(residentBytes) * 100.0 / float64(itemBytes)
+	}
+	ch <- statItem{"resident_ratio", strconv.FormatFloat(ratio, 'f', 2, 64)}
+}
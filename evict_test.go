@@ -0,0 +1,320 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
+)
+
+func TestEvictionPolicyInvalid(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	_, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  MAX_VBUCKETS,
+			EvictionPolicy: "not-a-policy",
+		})
+	if err == nil {
+		t.Errorf("expected NewBucket to fail on an unknown eviction policy")
+	}
+
+	_, err = NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  MAX_VBUCKETS,
+			MemoryOnly:     MemoryOnly_LEVEL_PERSIST_METADATA,
+			EvictionPolicy: EVICTION_VALUE,
+		})
+	if err == nil {
+		t.Errorf("expected NewBucket to fail on evicting a memory-only bucket")
+	}
+}
+
+// Settings are replaced but never changed, so install a changed copy.
+func testSetQuotaBytes(lb *livebucket, quotaBytes int64) {
+	settings := lb.GetBucketSettings().Copy()
+	settings.QuotaBytes = quotaBytes
+	atomic.StorePointer(&lb.settings, unsafe.Pointer(settings))
+}
+
+func TestEvictValues(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  MAX_VBUCKETS,
+			QuotaBytes:     1000000,
+			EvictionPolicy: EVICTION_VALUE,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	numItems := 100
+	testLoadInts(t, r0, 2, numItems)
+
+	lb := b0.(*livebucket)
+	if n := lb.evict(); n != 0 {
+		t.Errorf("expected no eviction under the high water mark, got: %v", n)
+	}
+
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+
+	itemBytes := b0.GetItemBytes()
+	if b0.GetResidentItemBytes() != itemBytes {
+		t.Errorf("expected all items to be resident, got: %v, expected: %v",
+			b0.GetResidentItemBytes(), itemBytes)
+	}
+
+	testSetQuotaBytes(lb, itemBytes)
+	numEvicted := int64(0)
+	for i := 0; i < 10 && numEvicted == 0; i++ {
+		numEvicted += lb.evict()
+	}
+	if numEvicted <= 0 {
+		t.Fatalf("expected some items to be evicted")
+	}
+	if vb0.stats.Evictions != numEvicted {
+		t.Errorf("expected evictions stat of %v, got: %v",
+			numEvicted, vb0.stats.Evictions)
+	}
+	if b0.GetResidentItemBytes() >= itemBytes {
+		t.Errorf("expected fewer resident bytes than %v, got: %v",
+			itemBytes, b0.GetResidentItemBytes())
+	}
+
+	bgFetchesOf := func() (n int64) {
+		for _, bs := range lb.bucketstores {
+			n += bs.stats.BgFetches
+		}
+		return n
+	}
+	bgFetches := bgFetchesOf()
+	visited, withoutValue := 0, 0
+	err = vb0.ps.visitItems(nil, false, func(i *item) bool {
+		visited++
+		if i.data == nil && i.cas != 0 {
+			withoutValue++
+		}
+		return true
+	})
+	if err != nil || visited != numItems || withoutValue <= 0 {
+		t.Errorf("expected a visit without values to see all the keys, but"+
+			" not evicted values, got: %v, %v, err: %v",
+			visited, withoutValue, err)
+	}
+	if bgFetchesOf() != bgFetches {
+		t.Errorf("expected a visit without values to not fetch values")
+	}
+
+	getAll := func() {
+		for i := 0; i < numItems; i++ {
+			res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+				Opcode:  gomemcached.GET,
+				VBucket: 2,
+				Key:     []byte(strconv.Itoa(i)),
+			})
+			if res.Status != gomemcached.SUCCESS ||
+				string(res.Body) != strconv.Itoa(i) {
+				t.Errorf("expected GET of evicted item %v to work, got: %v", i, res)
+			}
+		}
+	}
+
+	residentBytes := b0.GetResidentItemBytes()
+	getAll()
+	if bgFetchesOf() <= bgFetches {
+		t.Errorf("expected evicted items to be fetched back in")
+	}
+	if b0.GetResidentItemBytes() <= residentBytes {
+		t.Errorf("expected fetched items to be resident again, got: %v",
+			b0.GetResidentItemBytes())
+	}
+
+	// Items that are already resident aren't counted again.
+	residentBytes = b0.GetResidentItemBytes()
+	getAll()
+	if b0.GetResidentItemBytes() != residentBytes {
+		t.Errorf("expected resident bytes to stay at %v, got: %v",
+			residentBytes, b0.GetResidentItemBytes())
+	}
+}
+
+func TestEvictNotRecentlyUsed(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  4,
+			QuotaBytes:     1000000,
+			EvictionPolicy: EVICTION_VALUE,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	for vbid := uint16(2); vbid <= 3; vbid++ {
+		b0.CreateVBucket(vbid)
+		b0.SetVBState(vbid, VBActive)
+		for i := 0; i < 20; i++ {
+			res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+				Opcode:  gomemcached.SET,
+				VBucket: vbid,
+				Key:     []byte(strconv.Itoa(i)),
+				Body:    make([]byte, 5000),
+			})
+			if res.Status != gomemcached.SUCCESS {
+				t.Fatalf("expected SET to work, got: %v", res)
+			}
+		}
+	}
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+
+	vb2, _ := b0.GetVBucket(2)
+	vb3, _ := b0.GetVBucket(3)
+	vb2.ps.unreference()
+	vb3.ps.unreference()
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: 3,
+		Key:     []byte("0"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected GET to work, got: %v", res)
+	}
+
+	// Evicting any one item is enough to get under the low water mark.
+	defer func(high, low int64) {
+		evictHighWater, evictLowWater = high, low
+	}(evictHighWater, evictLowWater)
+	evictHighWater, evictLowWater = 100, 99
+	lb := b0.(*livebucket)
+	testSetQuotaBytes(lb, b0.GetItemBytes())
+	lb.evictNext = 3
+
+	if n := lb.evict(); n <= 0 {
+		t.Fatalf("expected some items to be evicted")
+	}
+	if vb2.stats.Evictions <= 0 || vb3.stats.Evictions != 0 {
+		t.Errorf("expected eviction from the not recently used vbucket,"+
+			" got: %v, %v", vb2.stats.Evictions, vb3.stats.Evictions)
+	}
+	if vb3.ps.unreference() {
+		t.Errorf("expected the evictor to clear the recently used mark")
+	}
+}
+
+func TestEvictRecentlyUsedItems(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	defer func(d time.Duration) { evictRecencyPeriod = d }(evictRecencyPeriod)
+	evictRecencyPeriod = 50 * time.Millisecond
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  MAX_VBUCKETS,
+			QuotaBytes:     1000000,
+			EvictionPolicy: EVICTION_VALUE,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	numItems := 100
+	testLoadInts(t, r0, 2, numItems)
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+
+	time.Sleep(2 * evictRecencyPeriod)
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: 2,
+		Key:     []byte("3"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected GET to work, got: %v", res)
+	}
+	vb0.evict(false)
+
+	hot, err := vb0.ps.get([]byte("3"))
+	if err != nil || hot == nil {
+		t.Fatalf("expected get to work, got: %v, err: %v", hot, err)
+	}
+	hotCas := string(casBytes(hot.cas))
+	_, changes := vb0.ps.colls()
+	var hotPriority, minColdPriority int32 = -1, math.MaxInt32
+	err = changes.VisitItemsAscend(nil, false, func(cItem *gkvlite.Item) bool {
+		if string(cItem.Key) == hotCas {
+			hotPriority = cItem.Priority
+		} else if cItem.Priority < minColdPriority {
+			minColdPriority = cItem.Priority
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("expected visit to work, got: %v", err)
+	}
+	if hotPriority < 0 || hotPriority >= minColdPriority {
+		t.Errorf("expected the used item to sit below the unused ones,"+
+			" got priority: %v, lowest unused: %v", hotPriority, minColdPriority)
+	}
+}
+
+func TestEvictQuotaTmpFail(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  MAX_VBUCKETS,
+			QuotaBytes:     1000,
+			EvictionPolicy: EVICTION_FULL,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 2,
+		Key:     []byte("toobig"),
+		Body:    make([]byte, 2000),
+	})
+	if res.Status != gomemcached.TMPFAIL {
+		t.Errorf("expected TMPFAIL on an evictable bucket over quota, got: %v",
+			res)
+	}
+}
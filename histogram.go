@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Bin 0 counts durations under 1 microsecond, and bin i counts
+// durations in [2^(i-1), 2^i) microseconds.  The last bin also counts
+// everything longer.
+const histogramBins = 28
+
+type Histogram struct {
+	Count      int64                `json:"count"`
+	TotalUsecs int64                `json:"totalUsecs"`
+	Bins       [histogramBins]int64 `json:"bins"`
+}
+
+func histogramBin(d time.Duration) int {
+	usecs := int64(d / time.Microsecond)
+	i := 0
+	for usecs > 0 && i < histogramBins-1 {
+		usecs >>= 1
+		i++
+	}
+	return i
+}
+
+// Returns the exclusive upper bound label of a bin, like "4us".
+func histogramBinLabel(i int) string {
+	if i >= histogramBins-1 {
+		return "inf"
+	}
+	return strconv.FormatInt(int64(1)<<uint(i), 10) + "us"
+}
+
+func (h *Histogram) Add(d time.Duration) {
+	atomic.AddInt64(&h.Count, 1)
+	atomic.AddInt64(&h.TotalUsecs, int64(d/time.Microsecond))
+	atomic.AddInt64(&h.Bins[histogramBin(d)], 1)
+}
+
+func (h *Histogram) Since(start time.Time) {
+	h.Add(time.Since(start))
+}
+
+func (h *Histogram) Op(in *Histogram, op func(int64, int64) int64) {
+	h.Count = op(h.Count, atomic.LoadInt64(&in.Count))
+	h.TotalUsecs = op(h.TotalUsecs, atomic.LoadInt64(&in.TotalUsecs))
+	for i := range h.Bins {
+		h.Bins[i] = op(h.Bins[i], atomic.LoadInt64(&in.Bins[i]))
+	}
+}
+
+func (h *Histogram) Send(ch chan<- statItem, prefix string) {
+	ch <- statItem{prefix + "_count", strconv.FormatInt(h.Count, 10)}
+	ch <- statItem{prefix + "_total_usecs", strconv.FormatInt(h.TotalUsecs, 10)}
+	for i, n := range h.Bins {
+		if n > 0 {
+			ch <- statItem{prefix + "_" + histogramBinLabel(i),
+				strconv.FormatInt(n, 10)}
+		}
+	}
+}
+
+// Latency histograms for a bucket's operations.
+type BucketTimings struct {
+	Time int64
+
+	ops [256]unsafe.Pointer // *Histogram per opcode, created on first use.
+
+	StoreReads  Histogram
+	StoreWrites Histogram
+	Views       Histogram
+	Compacts    Histogram
+}
+
+// Returns the histogram for an opcode.
+func (t *BucketTimings) Op(cmd gomemcached.CommandCode) *Histogram {
+	p := &t.ops[uint8(cmd)]
+	h := (*Histogram)(atomic.LoadPointer(p))
+	if h == nil {
+		atomic.CompareAndSwapPointer(p, nil, unsafe.Pointer(&Histogram{}))
+		h = (*Histogram)(atomic.LoadPointer(p))
+	}
+	return h
+}
+
+func (t *BucketTimings) Add(in *BucketTimings) {
+	t.Apply(in, addInt64)
+}
+
+func (t *BucketTimings) Sub(in *BucketTimings) {
+	t.Apply(in, subInt64)
+}
+
+func (t *BucketTimings) Apply(in *BucketTimings, op func(int64, int64) int64) {
+	for i := range in.ops {
+		if h := (*Histogram)(atomic.LoadPointer(&in.ops[i])); h != nil {
+			t.Op(gomemcached.CommandCode(i)).Op(h, op)
+		}
+	}
+	t.StoreReads.Op(&in.StoreReads, op)
+	t.StoreWrites.Op(&in.StoreWrites, op)
+	t.Views.Op(&in.Views, op)
+	t.Compacts.Op(&in.Compacts, op)
+}
+
+func (t *BucketTimings) Aggregate(in Aggregatable) {
+	if in == nil {
+		return
+	}
+	t.Add(in.(*BucketTimings))
+}
+
+func (t *BucketTimings) Send(ch chan<- statItem) {
+	for i := range t.ops {
+		if h := (*Histogram)(atomic.LoadPointer(&t.ops[i])); h != nil {
+			h.Send(ch, fmt.Sprintf("%v", gomemcached.CommandCode(i)))
+		}
+	}
+	t.StoreReads.Send(ch, "store_reads")
+	t.StoreWrites.Send(ch, "store_writes")
+	t.Views.Send(ch, "views")
+	t.Compacts.Send(ch, "compacts")
+}
+
+func (t *BucketTimings) MarshalJSON() ([]byte, error) {
+	ops := map[string]*Histogram{}
+	for i := range t.ops {
+		if h := (*Histogram)(atomic.LoadPointer(&t.ops[i])); h != nil {
+			ops[fmt.Sprintf("%v", gomemcached.CommandCode(i))] = h
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"time":        t.Time,
+		"ops":         ops,
+		"storeReads":  &t.StoreReads,
+		"storeWrites": &t.StoreWrites,
+		"views":       &t.Views,
+		"compacts":    &t.Compacts,
+	})
+}
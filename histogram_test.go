@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestHistogramBins(t *testing.T) {
+	tests := []struct {
+		d   time.Duration
+		bin int
+	}{
+		{0, 0},
+		{time.Microsecond - 1, 0},
+		{time.Microsecond, 1},
+		{3 * time.Microsecond, 2},
+		{4 * time.Microsecond, 3},
+		{time.Millisecond, 10},
+		{time.Hour, histogramBins - 1},
+	}
+	for _, test := range tests {
+		if histogramBin(test.d) != test.bin {
+			t.Errorf("expected %v in bin %v, got: %v",
+				test.d, test.bin, histogramBin(test.d))
+		}
+	}
+	if histogramBinLabel(2) != "4us" ||
+		histogramBinLabel(histogramBins-1) != "inf" {
+		t.Errorf("unexpected bin labels: %v, %v",
+			histogramBinLabel(2), histogramBinLabel(histogramBins-1))
+	}
+}
+
+func TestBucketTimingsDiff(t *testing.T) {
+	a := &BucketTimings{}
+	a.Op(gomemcached.GET).Add(3 * time.Microsecond)
+	a.StoreReads.Add(time.Millisecond)
+
+	b := &BucketTimings{}
+	b.Add(a)
+	b.Op(gomemcached.GET).Add(3 * time.Microsecond)
+	b.Op(gomemcached.SET).Add(time.Microsecond)
+
+	b.Sub(a)
+	if b.Op(gomemcached.GET).Count != 1 ||
+		b.Op(gomemcached.GET).Bins[2] != 1 ||
+		b.Op(gomemcached.SET).Count != 1 ||
+		b.StoreReads.Count != 0 {
+		t.Errorf("unexpected timings diff: %#v", b)
+	}
+
+	j, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("expected timings to marshal, got: %v", err)
+	}
+	m := map[string]interface{}{}
+	json.Unmarshal(j, &m)
+	ops := m["ops"].(map[string]interface{})
+	if _, ok := ops["GET"]; !ok || len(ops) != 2 {
+		t.Errorf("expected GET and SET timings, got: %s", j)
+	}
+}
+
+func TestStatsTimings(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+
+	rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("a"),
+		Body:   []byte("a"),
+	})
+	if testBucket.GetTimings().Op(gomemcached.SET).Count != 1 {
+		t.Errorf("expected a SET timing")
+	}
+
+	w := &bytes.Buffer{}
+	res := rh.HandleMessage(w, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.STAT,
+		Key:    []byte("timings"),
+	})
+	if res != nil {
+		t.Fatalf("expected nil from stats, got: %v", res)
+	}
+	found := false
+	for _, r := range decodeResponses(t, w.Bytes()) {
+		if string(r.Key) == "SET_count" {
+			found = string(r.Body) == "1"
+		}
+	}
+	if !found {
+		t.Errorf("expected SET_count of 1 in timings stats")
+	}
+}
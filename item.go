@@ -13,14 +13,18 @@ import (
 	"github.com/steveyen/gkvlite"
 )
 
-const DELETION_EXP = 0x80000000  // Deletion sentinel exp.
-const DELETION_FLAG = 0xffffffff // Deletion sentinel flag.
+const DELETION_EXP = 0x80000000   // Deletion sentinel exp.
+const EXPIRATION_EXP = 0x80000001 // Deletion sentinel exp, due to expiration.
+const DELETION_FLAG = 0xffffffff  // Deletion sentinel flag.
 
 type item struct {
 	key       []byte
 	exp, flag uint32
 	cas       uint64
 	data      []byte
+	revSeq    uint64 // Revision sequence number, where 0 means 1.
+	revCas    uint64 // Cas of the revision, where 0 means cas.
+	fetched   uint32 // 1 when read back from storage, until counted as resident.
 }
 
 func (i item) String() string {
@@ -29,14 +33,58 @@ func (i item) String() string {
 
 func (i *item) clone() *item {
 	return &item{
-		key:  i.key,
-		exp:  i.exp,
-		flag: i.flag,
-		cas:  i.cas,
-		data: i.data,
+		key:    i.key,
+		exp:    i.exp,
+		flag:   i.flag,
+		cas:    i.cas,
+		data:   i.data,
+		revSeq: i.revSeq,
+		revCas: i.revCas,
 	}
 }
 
+func (i *item) getRevSeq() uint64 {
+	if i.revSeq == 0 {
+		return 1
+	}
+	return i.revSeq
+}
+
+// Returns the cas of the item's revision.  An item changed elsewhere
+// (e.g., by XDCR) keeps the cas of its revision, even when it's
+// stored under a different, local cas to keep the changes stream
+// ordered.
+func (i *item) getRevCas() uint64 {
+	if i.revCas == 0 {
+		return i.cas
+	}
+	return i.revCas
+}
+
+// Returns the revSeq for an item that replaces i, which may be nil.
+func (i *item) nextRevSeq() uint64 {
+	if i == nil {
+		return 1
+	}
+	return i.getRevSeq() + 1
+}
+
+// Returns true if i should win over j when resolving a conflict
+// between changes made elsewhere, comparing revSeq, then the rev's
+// cas, then expiration, then flags.
+func (i *item) winsOver(j *item) bool {
+	if i.getRevSeq() != j.getRevSeq() {
+		return i.getRevSeq() > j.getRevSeq()
+	}
+	if i.getRevCas() != j.getRevCas() {
+		return i.getRevCas() > j.getRevCas()
+	}
+	if i.exp != j.exp {
+		return i.exp > j.exp
+	}
+	return i.flag > j.flag
+}
+
 func (i *item) markAsDeletion() *item {
 	i.exp = DELETION_EXP
 	i.flag = DELETION_FLAG
@@ -44,14 +92,27 @@ func (i *item) markAsDeletion() *item {
 	return i
 }
 
+// A deletion that happened because the item expired.
+func (i *item) markAsExpiration() *item {
+	i.markAsDeletion()
+	i.exp = EXPIRATION_EXP
+	return i
+}
+
 func (i *item) isDeletion() bool {
-	return i.exp == DELETION_EXP && i.flag == DELETION_FLAG &&
+	return (i.exp == DELETION_EXP || i.exp == EXPIRATION_EXP) &&
+		i.flag == DELETION_FLAG &&
 		(i.data == nil || len(i.data) == 0)
 }
 
+func (i *item) isExpiration() bool {
+	return i.exp == EXPIRATION_EXP && i.isDeletion()
+}
+
 func (i *item) Equal(j *item) bool {
 	return bytes.Equal(i.key, j.key) &&
 		i.exp == j.exp && i.flag == j.flag && i.cas == j.cas &&
+		i.getRevSeq() == j.getRevSeq() && i.getRevCas() == j.getRevCas() &&
 		bytes.Equal(i.data, j.data)
 }
 
@@ -61,6 +122,26 @@ func (i *item) isExpired(t time.Time) bool {
 
 const itemHdrLen = 4 + 4 + 8 + 2 + 4
 
+// The revSeq, when beyond 1, is persisted as an optional trailer
+// after the data, so files written before revSeq existed still load.
+// The revCas, when it differs from the cas, follows the revSeq.
+const itemRevSeqLen = 8
+const itemRevCasLen = 8
+
+func (i *item) hasRevCas() bool {
+	return i.revCas != 0 && i.revCas != i.cas
+}
+
+func (i *item) revTrailerLen() int {
+	if i.hasRevCas() {
+		return itemRevSeqLen + itemRevCasLen
+	}
+	if i.revSeq > 1 {
+		return itemRevSeqLen
+	}
+	return 0
+}
+
 func (i *item) toValueBytes() []byte {
 	if len(i.key) > MAX_ITEM_KEY_LENGTH {
 		return nil
@@ -68,7 +149,7 @@ func (i *item) toValueBytes() []byte {
 	if len(i.data) > MAX_ITEM_DATA_LENGTH {
 		return nil
 	}
-	rv := make([]byte, itemHdrLen+len(i.key)+len(i.data))
+	rv := make([]byte, itemHdrLen+len(i.key)+len(i.data)+i.revTrailerLen())
 	off := 0
 	binary.BigEndian.PutUint32(rv[off:], i.exp)
 	off += 4
@@ -82,7 +163,15 @@ func (i *item) toValueBytes() []byte {
 	off += 4
 	n := copy(rv[off:], i.key)
 	off += n
-	copy(rv[off:], i.data)
+	n = copy(rv[off:], i.data)
+	off += n
+	if i.revTrailerLen() > 0 {
+		binary.BigEndian.PutUint64(rv[off:], i.revSeq)
+		off += itemRevSeqLen
+	}
+	if i.hasRevCas() {
+		binary.BigEndian.PutUint64(rv[off:], i.revCas)
+	}
 	return rv
 }
 
@@ -113,6 +202,14 @@ func (i *item) fromValueBytes(b []byte) (err error) {
 	} else {
 		i.data = []byte{}
 	}
+	i.revSeq, i.revCas = 0, 0
+	trailer := b[itemHdrLen+int(keylen)+int(datalen):]
+	if len(trailer) >= itemRevSeqLen {
+		i.revSeq = binary.BigEndian.Uint64(trailer)
+	}
+	if len(trailer) >= itemRevSeqLen+itemRevCasLen {
+		i.revCas = binary.BigEndian.Uint64(trailer[itemRevSeqLen:])
+	}
 	return nil
 }
 
@@ -150,7 +247,7 @@ func itemValLength(coll *gkvlite.Collection, i *gkvlite.Item) int {
 	if item == nil {
 		panic(fmt.Sprintf("itemValLength invoked on nil item, i: %#v", i))
 	}
-	return itemHdrLen + len(item.key) + len(item.data)
+	return itemHdrLen + len(item.key) + len(item.data) + item.revTrailerLen()
 }
 
 func itemValWrite(coll *gkvlite.Collection, i *gkvlite.Item,
@@ -192,11 +289,15 @@ func itemValRead(coll *gkvlite.Collection, i *gkvlite.Item,
 	if !strings.HasSuffix(coll.Name(), COLL_SUFFIX_CHANGES) {
 		return nil
 	}
-	x := &item{}
+	x := &item{fetched: 1}
 	if err = x.fromValueBytes(i.Val); err != nil {
 		return err
 	}
 	atomic.StorePointer(&i.Transient, unsafe.Pointer(x))
+	if bsf, ok := r.(*bucketstorefile); ok {
+		atomic.AddInt64(&bsf.stats.BgFetches, 1)
+		atomic.AddInt64(&bsf.stats.BgFetchBytes, x.NumBytes())
+	}
 	return nil
 }
 
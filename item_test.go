@@ -40,6 +40,13 @@ func TestItemDeletionSentinel(t *testing.T) {
 	if !i.isDeletion() {
 		t.Errorf("expected deletion sentinel")
 	}
+	if i.isExpiration() {
+		t.Errorf("expected not-an-expiration sentinel")
+	}
+	i.markAsExpiration()
+	if !i.isDeletion() || !i.isExpiration() {
+		t.Errorf("expected expiration to be a deletion sentinel")
+	}
 }
 
 func TestItemSerialization(t *testing.T) {
@@ -229,6 +236,64 @@ func TestItemExpiration(t *testing.T) {
 	}
 }
 
+func TestItemRevSeqSerialization(t *testing.T) {
+	i := &item{key: []byte("a"), data: []byte("b"), cas: 5}
+	if len(i.toValueBytes()) != itemHdrLen+2 {
+		t.Errorf("expected no revSeq trailer for a first revision")
+	}
+	i.revSeq = 1
+	if len(i.toValueBytes()) != itemHdrLen+2 {
+		t.Errorf("expected no revSeq trailer for revSeq 1")
+	}
+	i.revSeq = 0x123456789
+	ib := i.toValueBytes()
+	if len(ib) != itemHdrLen+2+itemRevSeqLen {
+		t.Errorf("expected a revSeq trailer, got len: %v", len(ib))
+	}
+	j := &item{}
+	if err := j.fromValueBytes(ib); err != nil || !i.Equal(j) ||
+		j.revSeq != 0x123456789 || string(j.data) != "b" {
+		t.Errorf("expected revSeq to round-trip, got: %#v, err: %v", j, err)
+	}
+	if j.nextRevSeq() != 0x12345678a || (*item)(nil).nextRevSeq() != 1 {
+		t.Errorf("unexpected nextRevSeq")
+	}
+	i.revCas = 5
+	if len(i.toValueBytes()) != itemHdrLen+2+itemRevSeqLen {
+		t.Errorf("expected no revCas trailer when it's the cas")
+	}
+	i.revSeq, i.revCas = 0, 3
+	ib = i.toValueBytes()
+	if len(ib) != itemHdrLen+2+itemRevSeqLen+itemRevCasLen {
+		t.Errorf("expected a revCas trailer, got len: %v", len(ib))
+	}
+	j = &item{}
+	if err := j.fromValueBytes(ib); err != nil || !i.Equal(j) ||
+		j.cas != 5 || j.getRevCas() != 3 || j.getRevSeq() != 1 {
+		t.Errorf("expected revCas to round-trip, got: %#v, err: %v", j, err)
+	}
+}
+
+func TestItemWinsOver(t *testing.T) {
+	tests := []struct {
+		i, j *item
+		exp  bool
+	}{
+		{&item{revSeq: 2, cas: 1}, &item{revSeq: 1, cas: 9}, true},
+		{&item{revSeq: 0, cas: 9}, &item{revSeq: 1, cas: 1}, true},
+		{&item{revSeq: 2, cas: 1}, &item{revSeq: 2, cas: 2}, false},
+		{&item{revSeq: 2, cas: 2, exp: 1}, &item{revSeq: 2, cas: 2}, true},
+		{&item{revSeq: 2, cas: 2, flag: 1}, &item{revSeq: 2, cas: 2}, true},
+		{&item{revSeq: 2, cas: 2}, &item{revSeq: 2, cas: 2}, false},
+		{&item{revSeq: 2, cas: 1, revCas: 3}, &item{revSeq: 2, cas: 2}, true},
+	}
+	for testi, test := range tests {
+		if test.i.winsOver(test.j) != test.exp {
+			t.Errorf("test %v, expected winsOver %v", testi, test.exp)
+		}
+	}
+}
+
 func TestItemNumBytes(t *testing.T) {
 	i := &item{key: []byte("hi"), data: []byte("bye")}
 	if i.NumBytes() != 5+8+itemHdrLen {
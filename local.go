@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Local docs, like XDCR checkpoints, are never replicated or indexed,
+// and are kept per couch API vbucket (e.g., "0" or "master").
+func localDocKey(vbucket, docId string) []byte {
+	return []byte(vbucket + "/" + docId)
+}
+
+func (b *livebucket) GetLocalDoc(vbucket, docId string) ([]byte, error) {
+	res := b.vbucketLocal.get(localDocKey(vbucket, docId))
+	if res.Status == gomemcached.KEY_ENOENT {
+		return nil, nil
+	}
+	if res.Status != gomemcached.SUCCESS {
+		return nil, fmt.Errorf("no local doc: %v, status: %v", docId, res.Status)
+	}
+	return res.Body, nil
+}
+
+func (b *livebucket) SetLocalDoc(vbucket, docId string, body []byte) error {
+	res := vbMutate(b.vbucketLocal, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    localDocKey(vbucket, docId),
+		Body:   body,
+	})
+	if res.Status != gomemcached.SUCCESS {
+		return fmt.Errorf("set local doc failed: %v, status: %v",
+			docId, res.Status)
+	}
+	return nil
+}
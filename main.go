@@ -33,12 +33,18 @@ var verbose = flag.Bool("v", true,
 	"Amount of logging")
 var addr = flag.String("addr", ":11210",
 	"Data protocol listen address")
+var addrTLS = flag.String("addr-tls", "",
+	"Data protocol TLS listen address")
 var data = flag.String("data", "./tmp",
 	"Data directory")
 var restCouch = flag.String("rest-couch", ":8092",
 	"REST couch protocol listen address")
+var restCouchTLS = flag.String("rest-couch-tls", "",
+	"REST couch protocol TLS listen address")
 var restNS = flag.String("rest-ns", ":8091",
 	"REST NS protocol listen address")
+var restNSTLS = flag.String("rest-ns-tls", "",
+	"REST NS protocol TLS listen address")
 var staticPath = flag.String("static-path", "http://cbgb.io/static.zip",
 	"Path to static web UI content")
 var defaultBucketName = flag.String("default-bucket-name", DEFAULT_BUCKET_NAME,
@@ -49,12 +55,24 @@ var defaultQuotaBytes = flagbytes.Bytes("default-quota", "100MB",
 	"Quota for default bucket")
 var defaultPersistence = flag.Int("default-persistence", 2,
 	"Persistence level for default bucket")
+var defaultEvictionPolicy = flag.String("default-eviction-policy", "",
+	`Eviction policy for default bucket ("", "value" or "full")`)
+var defaultFlushEnabled = flag.Bool("default-flush-enabled", false,
+	"Whether FLUSH may delete all items of the default bucket")
+var defaultPurgeAge = flag.Duration("default-metadata-purge-age", time.Hour*72,
+	"How long compaction keeps deleted keys' tombstones (0 keeps them)")
+var passwordHashFunc = flag.String("password-hash", PASSWORD_HASH_BCRYPT,
+	`Hash for bucket passwords ("", "bcrypt", "scrypt" or "pbkdf2-sha256")`)
 var quiesceFreq = flag.Duration("quiesce-freq", time.Minute*5,
 	"Bucket quiescence frequency")
 var expireFreq = flag.Duration("expire-freq", time.Minute*5,
 	"Expiration scanner frequency")
+var lockExpireFreq = flag.Duration("lock-expire-freq", time.Second*1,
+	"Lock expiration scanner frequency")
 var persistFreq = flag.Duration("persist-freq", time.Second*5,
 	"Persistence frequency")
+var evictFreq = flag.Duration("evict-freq", time.Second*1,
+	"Eviction frequency")
 var viewRefreshFreq = flag.Duration("view-refresh-freq", time.Second*10,
 	"View refresh frequency")
 var statAggFreq = flag.Duration("stat-agg-freq", time.Second*1,
@@ -67,6 +85,8 @@ var fileServiceWorkers = flag.Int("file-service-workers", 32,
 	"Number of file service workers")
 var compactEvery = flag.Int("compact-every", 10000,
 	"Compact file after this many writes")
+var saslCramMD5 = flag.Bool("sasl-cram-md5", false,
+	"Offer SASL CRAM-MD5 auth, storing a password-equivalent secret for it")
 var logSyslog = flag.Bool("syslog", false, "Log to syslog")
 var logPlain = flag.Bool("log-no-ts", false, "Log without timestamps")
 
@@ -88,7 +108,9 @@ func initPeriodically() {
 	// TODO: The periodically's have # workers that could be configured.
 	quiescePeriodic = newPeriodically(*quiesceFreq, 1)
 	expirePeriodic = newPeriodically(*expireFreq, 2)
+	lockExpirePeriodic = newPeriodically(*lockExpireFreq, 2)
 	persistPeriodic = newPeriodically(*persistFreq, 5)
+	evictPeriodic = newPeriodically(*evictFreq, 5)
 	viewRefreshPeriodic = newPeriodically(*viewRefreshFreq, 5)
 	statAggPeriodic = newPeriodically(*statAggFreq, 10)
 	statAggPassPeriodic = newPeriodically(*statAggPassFreq, 10)
@@ -104,6 +126,8 @@ func main() {
 	startInfoHandler()
 
 	must(initAdmin())
+	must(initTLS())
+	must(checkPasswordHashFunc(*passwordHashFunc))
 	initPeriodically()
 
 	if !*verbose {
@@ -120,9 +144,13 @@ func main() {
 	}
 
 	bss := &BucketSettings{
-		NumPartitions: *defaultNumPartitions,
-		QuotaBytes:    int64(*defaultQuotaBytes),
-		MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING - *defaultPersistence,
+		NumPartitions:  *defaultNumPartitions,
+		QuotaBytes:     int64(*defaultQuotaBytes),
+		MemoryOnly:     MemoryOnly_LEVEL_PERSIST_NOTHING - *defaultPersistence,
+		EvictionPolicy: *defaultEvictionPolicy,
+		FlushEnabled:   *defaultFlushEnabled,
+
+		MetadataPurgeAge: int64(defaultPurgeAge.Seconds()),
 	}
 	bs, err := NewBuckets(*data, bss)
 	if err != nil {
@@ -133,18 +161,28 @@ func main() {
 	buckets = bs
 	bucketSettings = bss
 
+	users, err = NewUsers(*data)
+	if err != nil {
+		log.Fatalf("error: could not load users: %v, data dir: %v", err, *data)
+	}
+	if err = initAudit(*data); err != nil {
+		log.Fatalf("error: could not open audit log: %v, data dir: %v", err, *data)
+	}
+
 	defaultEventManager = eventManager{make(chan statusEvent, 20)}
 	go defaultEventManager.deliverEvents(*eventUrl)
 
-	mainServer(*defaultBucketName, *addr, *maxConns, *restCouch, *restNS,
+	mainServer(*defaultBucketName, *addr, *addrTLS, *maxConns,
+		*restCouch, *restCouchTLS, *restNS, *restNSTLS,
 		*staticPath, filepath.Join(*data, ".staticCache"))
 
 	// Let goroutines do their work.
 	select {}
 }
 
-func mainServer(defaultBucketName string, addr string, maxConns int,
-	restCouch string, restNS string,
+func mainServer(defaultBucketName string, addr string, addrTLS string,
+	maxConns int, restCouch string, restCouchTLS string,
+	restNS string, restNSTLS string,
 	staticPath string, staticCachePath string) {
 	if buckets.Get(defaultBucketName) == nil && defaultBucketName != "" {
 		_, err := createBucket(defaultBucketName, bucketSettings)
@@ -161,21 +199,36 @@ func mainServer(defaultBucketName string, addr string, maxConns int,
 			os.Exit(1)
 		}
 	}
+	if addrTLS != "" {
+		_, err := StartTLSServer(addrTLS, maxConns, buckets, defaultBucketName,
+			tlsConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not start TLS server: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	log.Printf("primary connections...")
+	if restNS != "" || restNSTLS != "" {
+		go restNSServe(restNS, restNSTLS, staticPath, staticCachePath)
+	}
 	if restNS != "" {
-		go restNSServe(restNS, staticPath, staticCachePath)
 		hp := strings.Split(restNS, ":")
 		log.Printf("  connect your couchbase client to: http://HOST:%s/pools/default",
 			hp[len(hp)-1])
 		log.Printf("  web admin U/I available on: http://HOST:%s",
 			hp[len(hp)-1])
 	}
+	if restNSTLS != "" {
+		hp := strings.Split(restNSTLS, ":")
+		log.Printf("  web admin U/I available on: https://HOST:%s",
+			hp[len(hp)-1])
+	}
 	log.Printf("secondary connections...")
-	if restCouch != "" {
-		go restCouchServe(restCouch, staticPath)
-		log.Printf("  view listening: %s", restCouch)
+	if restCouch != "" || restCouchTLS != "" {
+		go restCouchServe(restCouch, restCouchTLS, staticPath)
+		log.Printf("  view listening: %s, tls: %s", restCouch, restCouchTLS)
 	}
-	log.Printf("  data listening: %s", addr)
+	log.Printf("  data listening: %s, tls: %s", addr, addrTLS)
 }
 
 func createBucket(bucketName string, bucketSettings *BucketSettings) (
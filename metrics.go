@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsType    = "application/openmetrics-text"
+)
+
+// Stats fields, by json name, that are levels rather than running
+// totals.
+var metricsGauges = map[string]bool{
+	"items":         true,
+	"expirable":     true,
+	"itemBytes":     true,
+	"openConns":     true,
+	"fileSize":      true,
+	"nodeAllocs":    true,
+	"lastCompactAt": true,
+}
+
+type metricSample struct {
+	suffix string // Like "_total" or "_bucket".
+	labels string // Like `bucket="default",vbucket="0"`.
+	value  float64
+}
+
+type metricFamily struct {
+	name    string
+	kind    string // "counter", "gauge" or "histogram".
+	help    string
+	samples []metricSample
+}
+
+// Collects metric families in the order they're first seen, so the
+// samples of a family are written together.
+type metrics struct {
+	families map[string]*metricFamily
+	order    []*metricFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{families: map[string]*metricFamily{}}
+}
+
+func (m *metrics) family(name, kind, help string) *metricFamily {
+	f := m.families[name]
+	if f == nil {
+		f = &metricFamily{name: name, kind: kind, help: help}
+		m.families[name] = f
+		m.order = append(m.order, f)
+	}
+	return f
+}
+
+func (m *metrics) add(name, kind, help, labels string, v float64) {
+	f := m.family(name, kind, help)
+	suffix := ""
+	if kind == "counter" {
+		suffix = "_total"
+	}
+	f.samples = append(f.samples, metricSample{suffix, labels, v})
+}
+
+// Adds the int64 fields of a stats struct, like BucketStats, named
+// by their json names.
+func (m *metrics) addStats(prefix, help, labels string, s interface{}) {
+	v := reflect.Indirect(reflect.ValueOf(s))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "time" || v.Field(i).Kind() != reflect.Int64 {
+			continue
+		}
+		kind := "counter"
+		if metricsGauges[name] {
+			kind = "gauge"
+		}
+		m.add(prefix+metricsName(name), kind, help+" "+name, labels,
+			float64(v.Field(i).Int()))
+	}
+}
+
+// Adds a Histogram as seconds, where bin i's upper bound is 2^i
+// microseconds.
+func (m *metrics) addHistogram(name, help, labels string, h *Histogram) {
+	f := m.family(name, "histogram", help)
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var n int64
+	for i := range h.Bins {
+		n += atomic.LoadInt64(&h.Bins[i])
+		le := "+Inf"
+		if i < histogramBins-1 {
+			le = strconv.FormatFloat(float64(int64(1)<<uint(i))/1e6, 'g', -1, 64)
+		}
+		f.samples = append(f.samples, metricSample{"_bucket",
+			labels + sep + `le="` + le + `"`, float64(n)})
+	}
+	f.samples = append(f.samples,
+		metricSample{"_sum", labels, float64(atomic.LoadInt64(&h.TotalUsecs)) / 1e6},
+		metricSample{"_count", labels, float64(atomic.LoadInt64(&h.Count))})
+}
+
+// Writes the Prometheus text format, or the OpenMetrics text format,
+// which differs in naming counter families without their "_total"
+// and in ending with "# EOF".
+func (m *metrics) WriteTo(w io.Writer, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range m.order {
+		name := f.name
+		if f.kind == "counter" && !openMetrics {
+			name += "_total"
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+		for _, s := range f.samples {
+			bw.WriteString(f.name + s.suffix)
+			if s.labels != "" {
+				bw.WriteString("{" + s.labels + "}")
+			}
+			bw.WriteString(" " + metricsValue(s.value) + "\n")
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func metricsValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Converts a json name like "getMisses" to "get_misses".
+func metricsName(s string) string {
+	rv := make([]rune, 0, len(s)+4)
+	for _, c := range s {
+		if unicode.IsUpper(c) {
+			rv = append(rv, '_')
+			c = unicode.ToLower(c)
+		}
+		rv = append(rv, c)
+	}
+	return string(rv)
+}
+
+func metricsLabels(kvs ...string) string {
+	parts := make([]string, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).
+			Replace(kvs[i+1])
+		parts = append(parts, kvs[i]+`="`+v+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// The named periodically's, whose task timings are exported.
+func metricsPeriodicals() map[string]*periodically {
+	return map[string]*periodically{
+		"quiesce":       quiescePeriodic,
+		"expire":        expirePeriodic,
+		"lock_expire":   lockExpirePeriodic,
+		"persist":       persistPeriodic,
+		"evict":         evictPeriodic,
+		"view_refresh":  viewRefreshPeriodic,
+		"stat_agg":      statAggPeriodic,
+		"stat_agg_pass": statAggPassPeriodic,
+	}
+}
+
+// Adds the stats of the open buckets.  Quiesced buckets are skipped
+// rather than reopened, and the stats are read without counting as
+// bucket activity, so scraping doesn't keep buckets from quiescing.
+func (m *metrics) addBuckets(bs *Buckets) {
+	names := bs.GetNames()
+	sort.Strings(names)
+	for _, name := range names {
+		lb, ok := bs.GetOpen(name).(*livebucket)
+		if !ok || !lb.Available() {
+			continue
+		}
+		bl := metricsLabels("bucket", name)
+		agg := &BucketStats{}
+		vbs := map[int]*BucketStats{}
+		for i := 0; i < MAX_VBUCKETS; i++ {
+			if vb := lb.peekVBucket(uint16(i)); vb != nil {
+				vb.AddStatsTo(agg, "")
+				vbs[i] = &BucketStats{}
+				vbs[i].Add(&vb.stats)
+			}
+		}
+		m.addStats("cbgb_bucket_", "Bucket stat", bl, agg)
+		m.addStats("cbgb_bucket_store_", "Bucket store stat", bl,
+			AggregateBucketStoreStats(lb, ""))
+		for i := 0; i < MAX_VBUCKETS; i++ {
+			if s := vbs[i]; s != nil {
+				m.addStats("cbgb_vbucket_", "VBucket stat",
+					metricsLabels("bucket", name, "vbucket", strconv.Itoa(i)), s)
+			}
+		}
+
+		t := lb.GetTimings()
+		for i := range t.ops {
+			if h := (*Histogram)(atomic.LoadPointer(&t.ops[i])); h != nil {
+				m.addHistogram("cbgb_bucket_op_duration_seconds",
+					"Bucket operation latencies",
+					metricsLabels("bucket", name, "op",
+						fmt.Sprintf("%v", gomemcached.CommandCode(i))), h)
+			}
+		}
+		m.addHistogram("cbgb_bucket_store_read_duration_seconds",
+			"Bucket store read latencies", bl, &t.StoreReads)
+		m.addHistogram("cbgb_bucket_store_write_duration_seconds",
+			"Bucket store write latencies", bl, &t.StoreWrites)
+		m.addHistogram("cbgb_bucket_view_duration_seconds",
+			"Bucket view query latencies", bl, &t.Views)
+		m.addHistogram("cbgb_bucket_compact_duration_seconds",
+			"Bucket compaction latencies", bl, &t.Compacts)
+	}
+}
+
+func (m *metrics) addServer() {
+	s := &ServerStats{}
+	s.Add(serverStats)
+	m.addStats("cbgb_server_", "Server stat", "", s)
+
+	names := []string{}
+	ps := metricsPeriodicals()
+	for name := range ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if p := ps[name]; p != nil {
+			m.addHistogram("cbgb_periodic_task_duration_seconds",
+				"Periodic task run latencies",
+				metricsLabels("task", name), &p.timings)
+		}
+	}
+}
+
+func (m *metrics) addRuntime() {
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+	m.add("go_goroutines", "gauge", "Number of goroutines", "",
+		float64(runtime.NumGoroutine()))
+	for _, x := range []struct {
+		name, kind, help string
+		v                uint64
+	}{
+		{"go_memstats_alloc_bytes", "gauge",
+			"Bytes allocated and still in use", ms.Alloc},
+		{"go_memstats_allocated_bytes", "counter",
+			"Bytes allocated, even if freed", ms.TotalAlloc},
+		{"go_memstats_sys_bytes", "gauge",
+			"Bytes obtained from the system", ms.Sys},
+		{"go_memstats_mallocs", "counter", "Number of mallocs", ms.Mallocs},
+		{"go_memstats_frees", "counter", "Number of frees", ms.Frees},
+		{"go_memstats_heap_alloc_bytes", "gauge",
+			"Heap bytes allocated and still in use", ms.HeapAlloc},
+		{"go_memstats_heap_sys_bytes", "gauge",
+			"Heap bytes obtained from the system", ms.HeapSys},
+		{"go_memstats_heap_idle_bytes", "gauge",
+			"Heap bytes waiting to be used", ms.HeapIdle},
+		{"go_memstats_heap_inuse_bytes", "gauge",
+			"Heap bytes in use", ms.HeapInuse},
+		{"go_memstats_heap_released_bytes", "gauge",
+			"Heap bytes released to the system", ms.HeapReleased},
+		{"go_memstats_heap_objects", "gauge",
+			"Number of allocated objects", ms.HeapObjects},
+		{"go_memstats_gc", "counter", "Number of GC's", uint64(ms.NumGC)},
+	} {
+		m.add(x.name, x.kind, x.help, "", float64(x.v))
+	}
+	m.add("go_memstats_gc_pause_seconds", "counter",
+		"GC pause time", "", float64(ms.PauseTotalNs)/1e9)
+}
+
+func restGetMetrics(w http.ResponseWriter, r *http.Request) {
+	m := newMetrics()
+	m.addServer()
+	m.addRuntime()
+	m.addBuckets(buckets)
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), openMetricsType)
+	if openMetrics {
+		w.Header().Set("Content-Type",
+			openMetricsType+"; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", metricsContentType)
+	}
+	m.WriteTo(w, openMetrics)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricsName(t *testing.T) {
+	tests := map[string]string{
+		"ops":                "ops",
+		"getMisses":          "get_misses",
+		"incomingValueBytes": "incoming_value_bytes",
+	}
+	for in, exp := range tests {
+		if got := metricsName(in); got != exp {
+			t.Errorf("expected %v for %v, got: %v", exp, in, got)
+		}
+	}
+	if got := metricsLabels("bucket", `a"b`, "vbucket", "1"); got !=
+		`bucket="a\"b",vbucket="1"` {
+		t.Errorf("expected escaped labels, got: %v", got)
+	}
+}
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := newMetrics()
+	m.add("x_ops", "counter", "Ops", `b="1"`, 3)
+	m.add("x_items", "gauge", "Items", "", 4)
+	m.add("x_ops", "counter", "Ops", `b="2"`, 5)
+	h := &Histogram{}
+	h.Add(0)
+	h.Add(3 * time.Microsecond)
+	m.addHistogram("x_seconds", "Latency", "", h)
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf, false)
+	got := buf.String()
+	for _, exp := range []string{
+		"# TYPE x_ops_total counter\nx_ops_total{b=\"1\"} 3\nx_ops_total{b=\"2\"} 5\n",
+		"# TYPE x_items gauge\nx_items 4\n",
+		"x_seconds_bucket{le=\"1e-06\"} 1\n",
+		"x_seconds_bucket{le=\"2e-06\"} 1\n",
+		"x_seconds_bucket{le=\"4e-06\"} 2\n",
+		"x_seconds_bucket{le=\"+Inf\"} 2\n",
+		"x_seconds_count 2\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in:\n%v", exp, got)
+		}
+	}
+	if strings.Contains(got, "# EOF") {
+		t.Errorf("expected no EOF in the prometheus format")
+	}
+
+	buf.Reset()
+	m.WriteTo(buf, true)
+	got = buf.String()
+	if !strings.Contains(got, "# TYPE x_ops counter\nx_ops_total{b=\"1\"} 3\n") ||
+		!strings.HasSuffix(got, "# EOF\n") {
+		t.Errorf("expected the openmetrics format, got:\n%v", got)
+	}
+}
+
+func TestRestMetrics(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, 3)
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	lb := bucket.(*livebucket)
+	vb, _ := bucket.GetVBucket(3)
+	atomic.AddInt64(&vb.stats.Gets, 7)
+	atomic.StoreInt64(&lb.activity, 0)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/metrics", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 ||
+		rr.Header().Get("Content-Type") != metricsContentType {
+		t.Fatalf("expected /metrics to work, got: %v, %v", rr.Code, rr.Header())
+	}
+	got := rr.Body.String()
+	for _, exp := range []string{
+		"cbgb_server_accepted_conns_total ",
+		"go_goroutines ",
+		`cbgb_bucket_gets_total{bucket="default"} 7` + "\n",
+		`cbgb_bucket_items{bucket="default"} 0` + "\n",
+		`cbgb_vbucket_gets_total{bucket="default",vbucket="3"} 7` + "\n",
+		`cbgb_bucket_store_file_size{bucket="default"} `,
+		`cbgb_bucket_compact_duration_seconds_count{bucket="default"} 0` + "\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in /metrics", exp)
+		}
+	}
+	if atomic.LoadInt64(&lb.activity) != 0 {
+		t.Errorf("expected scraping to not count as bucket activity")
+	}
+
+	// A quiesced bucket is neither scraped nor reopened.
+	buckets.Close("default", false)
+	rr = httptest.NewRecorder()
+	mr.ServeHTTP(rr, r)
+	if strings.Contains(rr.Body.String(), `bucket="default"`) {
+		t.Errorf("expected no metrics for a closed bucket")
+	}
+	if buckets.GetOpen("default") != nil {
+		t.Errorf("expected GetOpen to not reopen a closed bucket")
+	}
+}
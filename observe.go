@@ -13,8 +13,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"time"
 )
 
 const minObsReq = 4
@@ -24,6 +26,7 @@ const (
 	obsPersisted    = 1
 	obsNotFound     = 0x80
 	obsDeleted      = 0x81
+	obsNotMyVBucket = 0xfe // The key's vbucket isn't active here.
 )
 
 type obsKey struct {
@@ -83,3 +86,44 @@ func encodeObserveBody(r []obsStatus) []byte {
 
 	return rv
 }
+
+// Reports the observed state and CAS of a key in the vbucket.  An item
+// is persisted once a flush has completed that covers its CAS.  A key
+// that's missing is reported as logically deleted if its deletion has
+// not yet been persisted, or as not found otherwise.
+func (v *VBucket) observe(key []byte, now time.Time) (
+	state byte, cas uint64, err error) {
+	persistedCas := v.ps.getPersistedCas()
+
+	i, err := v.getUnexpired(key, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if i != nil {
+		if v.bs.persistsData() && i.cas <= persistedCas {
+			return obsPersisted, i.cas, nil
+		}
+		return obsNotPersisted, i.cas, nil
+	}
+
+	if !v.bs.persistsData() {
+		return obsNotFound, 0, nil
+	}
+
+	// Only the changes since the last flush might hold an
+	// unpersisted deletion of the key.
+	err = v.ps.visitChanges(casBytes(persistedCas+1), true,
+		func(c *item) bool {
+			if c.isDeletion() && bytes.Equal(c.key, key) {
+				cas = c.cas
+			}
+			return true
+		})
+	if err != nil {
+		return 0, 0, err
+	}
+	if cas != 0 {
+		return obsDeleted, cas, nil
+	}
+	return obsNotFound, 0, nil
+}
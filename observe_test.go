@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/dustin/gomemcached"
 )
 
 func TestObserveParse(t *testing.T) {
@@ -77,3 +82,131 @@ func TestObserveEncode(t *testing.T) {
 		t.Fatalf("Encoding failed:\n%x\n%x", got, exp)
 	}
 }
+
+func testObserve(t *testing.T, rh *reqHandler, keys ...obsKey) *gomemcached.MCResponse {
+	body := []byte{}
+	for _, k := range keys {
+		b := make([]byte, 4+len(k.key))
+		binary.BigEndian.PutUint16(b, k.vbid)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(k.key)))
+		copy(b[4:], k.key)
+		body = append(body, b...)
+	}
+	return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.OBSERVE,
+		Body:   body,
+	})
+}
+
+func testObserveExpect(t *testing.T, rh *reqHandler, k obsKey,
+	expState byte, expCas uint64, msg string) {
+	res := testObserve(t, rh, k)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("%v: expected observe success, got: %v", msg, res)
+	}
+	exp := encodeObserveBody([]obsStatus{{k, expState, expCas}})
+	if !bytes.Equal(res.Body, exp) {
+		t.Errorf("%v: expected observe body\n%x\ngot\n%x", msg, exp, res.Body)
+	}
+}
+
+func TestObserveMatrix(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := &reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	k := obsKey{3, []byte("a")}
+
+	testObserveExpect(t, rh, k, obsNotFound, 0, "missing key")
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     k.key,
+		Body:    []byte("aye"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	setCas := res.Cas
+	testObserveExpect(t, rh, k, obsNotPersisted, setCas, "unflushed set")
+
+	if err := testBucket.Flush(); err != nil {
+		t.Fatalf("expected flush to work, got: %v", err)
+	}
+	testObserveExpect(t, rh, k, obsPersisted, setCas, "flushed set")
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: 3,
+		Key:     k.key,
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delete to work, got: %v", res)
+	}
+	testObserveExpect(t, rh, k, obsDeleted, res.Cas, "unflushed delete")
+
+	if err := testBucket.Flush(); err != nil {
+		t.Fatalf("expected flush to work, got: %v", err)
+	}
+	testObserveExpect(t, rh, k, obsNotFound, 0, "flushed delete")
+
+	testBucket.CreateVBucket(5)
+	testBucket.SetVBState(5, VBReplica)
+	missing, replica := obsKey{4, []byte("b")}, obsKey{5, []byte("c")}
+	res = testObserve(t, rh, k, missing, replica)
+	exp := encodeObserveBody([]obsStatus{
+		{k, obsNotFound, 0},
+		{missing, obsNotMyVBucket, 0},
+		{replica, obsNotMyVBucket, 0},
+	})
+	if res.Status != gomemcached.SUCCESS || !bytes.Equal(res.Body, exp) {
+		t.Errorf("expected per key not-my-vbucket for missing and replica"+
+			" vbuckets, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.OBSERVE,
+		Body:   []byte{0, 3, 0, 9, 'x'},
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected EINVAL for short observe body, got: %v", res)
+	}
+}
+
+func TestObserveMemoryOnly(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			MemoryOnly:    MemoryOnly_LEVEL_PERSIST_METADATA,
+		})
+	defer testBucket.Close()
+	rh := &reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	k := obsKey{3, []byte("a")}
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     k.key,
+		Body:    []byte("aye"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	if err := testBucket.Flush(); err != nil {
+		t.Fatalf("expected flush to work, got: %v", err)
+	}
+	testObserveExpect(t, rh, k, obsNotPersisted, res.Cas,
+		"memory-only items are never persisted")
+}
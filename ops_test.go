@@ -1321,3 +1321,405 @@ func TestArithOps(t *testing.T) {
 		}
 	}
 }
+
+func TestTouchOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	expExtras := func(exp uint32) []byte {
+		e := make([]byte, 4)
+		binary.BigEndian.PutUint32(e, exp)
+		return e
+	}
+	future := uint32(time.Now().Add(time.Hour).Unix())
+	past := uint32(30*86400 + 1) // Absolute time, long ago.
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: TOUCH, VBucket: 3, Key: []byte("a"), Extras: expExtras(future),
+	})
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected touch of missing key to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: GATQ, VBucket: 3, Key: []byte("a"), Extras: expExtras(future),
+	})
+	if res != nil {
+		t.Errorf("expected quiet gatq miss, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET, VBucket: 3, Key: []byte("a"),
+		Extras: []byte{0, 0, 0, 7, 0, 0, 0, 0}, Body: []byte("aye"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	setCas := res.Cas
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: TOUCH, VBucket: 3, Key: []byte("a"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected touch without extras to fail, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: TOUCH, VBucket: 3, Key: []byte("a"), Extras: expExtras(future),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas <= setCas || len(res.Body) != 0 {
+		t.Errorf("expected touch to work with a new cas, got: %v", res)
+	}
+	if vb.stats.Expirable != 1 {
+		t.Errorf("expected touched item to be expirable, got: %v",
+			vb.stats.Expirable)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: GAT, VBucket: 3, Key: []byte("a"), Extras: expExtras(future),
+	})
+	if res.Status != gomemcached.SUCCESS ||
+		!bytes.Equal(res.Body, []byte("aye")) ||
+		!bytes.Equal(res.Extras, []byte{0, 0, 0, 7}) {
+		t.Errorf("expected gat to return the value and flags, got: %v", res)
+	}
+	if vb.stats.Expirable != 1 {
+		t.Errorf("expected re-touched item to be counted once, got: %v",
+			vb.stats.Expirable)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: TOUCH, VBucket: 3, Key: []byte("a"), Extras: expExtras(0),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected touch to no expiration to work, got: %v", res)
+	}
+	if vb.stats.Expirable != 0 {
+		t.Errorf("expected item touched to no expiration to be uncounted,"+
+			" got: %v", vb.stats.Expirable)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: TOUCH, VBucket: 3, Key: []byte("a"), Extras: expExtras(0),
+	})
+	if res.Status != gomemcached.SUCCESS || vb.stats.Expirable != 0 {
+		t.Errorf("expected expirable count to stay at 0, got: %v, %v",
+			res, vb.stats.Expirable)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: TOUCH, VBucket: 3, Key: []byte("a"), Extras: expExtras(past),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected touch into the past to work, got: %v", res)
+	}
+	res = testGet(&rh, 3, "a")
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected item touched into the past to be expired, got: %v", res)
+	}
+
+	if vb.stats.Touches != 8 {
+		t.Errorf("expected 8 touches, got: %v", vb.stats.Touches)
+	}
+}
+
+func TestGetLockOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	set := func(cas uint64) *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET, VBucket: 3, Key: []byte("a"),
+			Cas: cas, Body: []byte("aye"),
+		})
+	}
+	getl := func() *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: GETL, VBucket: 3, Key: []byte("a"),
+			Extras: []byte{0, 0, 0, 5},
+		})
+	}
+	unl := func(cas uint64) *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: UNLOCK_KEY, VBucket: 3, Key: []byte("a"), Cas: cas,
+		})
+	}
+
+	res := getl()
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected getl of missing key to fail, got: %v", res)
+	}
+	res = set(0)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	setCas := res.Cas
+
+	res = getl()
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "aye" {
+		t.Fatalf("expected getl to work, got: %v", res)
+	}
+	lockCas := res.Cas
+	if lockCas == setCas {
+		t.Errorf("expected getl to return a new cas")
+	}
+	if res = getl(); res.Status != LOCKED {
+		t.Errorf("expected second getl to see lock, got: %v", res)
+	}
+	if res = set(0); res.Status != LOCKED {
+		t.Errorf("expected set on locked key to fail, got: %v", res)
+	}
+	if res = set(setCas); res.Status != LOCKED {
+		t.Errorf("expected set with stale cas to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE, VBucket: 3, Key: []byte("a"),
+	})
+	if res.Status != LOCKED {
+		t.Errorf("expected delete on locked key to fail, got: %v", res)
+	}
+	if res = unl(setCas); res.Status != LOCKED {
+		t.Errorf("expected unlock with wrong cas to fail, got: %v", res)
+	}
+	if res = testGet(&rh, 3, "a"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected get on locked key to work, got: %v", res)
+	}
+
+	// The lock holder may mutate, which releases the lock.
+	if res = set(lockCas); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected set with lock cas to work, got: %v", res)
+	}
+	if res = set(0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected set after release to work, got: %v", res)
+	}
+
+	res = getl()
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected getl to work, got: %v", res)
+	}
+	if res = unl(res.Cas); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected unlock to work, got: %v", res)
+	}
+	if res = unl(res.Cas); res.Status != gomemcached.TMPFAIL {
+		t.Errorf("expected unlock of unlocked key to fail, got: %v", res)
+	}
+
+	res = getl()
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected getl to work, got: %v", res)
+	}
+	if !vb.lockExpirationScan(time.Now()) {
+		t.Errorf("expected lock scan to find a remaining lock")
+	}
+	if vb.lockExpirationScan(time.Now().Add(time.Minute)) {
+		t.Errorf("expected lock scan to release the lock")
+	}
+	if res = set(0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected set after lock expiry to work, got: %v", res)
+	}
+
+	if vb.stats.GetLocks != 5 || vb.stats.Unlocks != 3 ||
+		vb.stats.LockedErrs != 5 || vb.stats.LockExpires != 1 {
+		t.Errorf("unexpected lock stats: %#v", vb.stats)
+	}
+}
+
+func TestWithMetaOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	metaExtras := func(flag, exp uint32, revSeq, cas uint64) []byte {
+		e := make([]byte, withMetaExtrasLen)
+		binary.BigEndian.PutUint32(e, flag)
+		binary.BigEndian.PutUint32(e[4:], exp)
+		binary.BigEndian.PutUint64(e[8:], revSeq)
+		binary.BigEndian.PutUint64(e[16:], cas)
+		return e
+	}
+	getMeta := func() (revSeq uint64, cas uint64, flag uint32) {
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: GET_META, VBucket: 3, Key: []byte("a"),
+		})
+		if res.Status != gomemcached.SUCCESS || len(res.Extras) != getMetaExtrasLen {
+			return 0, 0, 0
+		}
+		return binary.BigEndian.Uint64(res.Extras[12:]), res.Cas,
+			binary.BigEndian.Uint32(res.Extras[4:])
+	}
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: GET_META, VBucket: 3, Key: []byte("a"),
+	})
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected get_meta of missing key to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"), Body: []byte("x"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected set_with_meta without extras to fail, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"), Body: []byte("remote"),
+		Extras: metaExtras(7, 0, 5, 1000),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas != 1000 {
+		t.Fatalf("expected set_with_meta to keep its cas, got: %v", res)
+	}
+	if revSeq, cas, flag := getMeta(); revSeq != 5 || cas != 1000 || flag != 7 {
+		t.Errorf("expected remote meta, got: %v, %v, %v", revSeq, cas, flag)
+	}
+
+	// Lower revSeqs lose the conflict resolution, even with a higher cas.
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"), Body: []byte("older"),
+		Extras: metaExtras(0, 0, 4, 2000),
+	})
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("expected set_with_meta of a losing rev to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: ADD_WITH_META, VBucket: 3, Key: []byte("a"), Body: []byte("add"),
+		Extras: metaExtras(0, 0, 9, 3000),
+	})
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("expected add_with_meta of an existing key to fail, got: %v", res)
+	}
+
+	// Local mutations continue the revSeq.
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET, VBucket: 3, Key: []byte("a"), Body: []byte("local"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	if revSeq, cas, _ := getMeta(); revSeq != 6 || cas != res.Cas || cas <= 1000 {
+		t.Errorf("expected local revSeq 6, got: %v, cas: %v", revSeq, cas)
+	}
+
+	// Equal revSeqs are resolved by cas; a cas not beyond the
+	// vbucket's LastCas is replaced by a new one.
+	_, localCas, _ := getMeta()
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"), Body: []byte("lower"),
+		Extras: metaExtras(0, 0, 6, localCas-1),
+	})
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("expected set_with_meta with a lower cas to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"), Body: []byte("higher"),
+		Extras: metaExtras(0, 0, 7, 2),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas <= localCas {
+		t.Errorf("expected set_with_meta to get a new cas, got: %v", res)
+	}
+	if revSeq, cas, _ := getMeta(); revSeq != 7 || cas != 2 {
+		t.Errorf("expected remote revSeq 7 and rev cas 2, got: %v, %v",
+			revSeq, cas)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: DELETE_WITH_META, VBucket: 3, Key: []byte("a"),
+		Extras: metaExtras(0, 0, 6, 99999),
+	})
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("expected delete_with_meta of a losing rev to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: DELETE_WITH_META, VBucket: 3, Key: []byte("a"),
+		Extras: metaExtras(0, 0, 8, 99999),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas != 99999 {
+		t.Errorf("expected delete_with_meta to work, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.GET, VBucket: 3, Key: []byte("a"),
+	})
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected deleted item, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: DELETEQ_WITH_META, VBucket: 3, Key: []byte("a"),
+		Extras: metaExtras(0, 0, 9, 100000),
+	})
+	if res != nil {
+		t.Errorf("expected quiet delete_with_meta miss, got: %v", res)
+	}
+
+	// The deletions are kept as a tombstone, so stale changes can't
+	// resurrect the item.
+	for _, extras := range [][]byte{
+		metaExtras(0, 0, 8, 200000),
+		metaExtras(0, 0, 9, 99999),
+	} {
+		res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"),
+			Body: []byte("stale"), Extras: extras,
+		})
+		if res.Status != gomemcached.KEY_EEXISTS {
+			t.Errorf("expected stale set_with_meta after delete to fail, got: %v",
+				res)
+		}
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.GET, VBucket: 3, Key: []byte("a"),
+	})
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected item to stay deleted, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: GET_META, VBucket: 3, Key: []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS || len(res.Extras) != getMetaExtrasLen ||
+		binary.BigEndian.Uint32(res.Extras) != 1 ||
+		binary.BigEndian.Uint64(res.Extras[12:]) != 9 || res.Cas != 100000 {
+		t.Errorf("expected get_meta of the tombstone, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SET_WITH_META, VBucket: 3, Key: []byte("a"),
+		Body: []byte("newer"), Extras: metaExtras(0, 0, 10, 1),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected newer set_with_meta after delete to work, got: %v", res)
+	}
+
+	// A recreated item continues the revisions of its deletion.
+	for _, opcode := range []gomemcached.CommandCode{
+		gomemcached.DELETE, gomemcached.ADD,
+	} {
+		res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: opcode, VBucket: 3, Key: []byte("a"), Body: []byte("local"),
+			Extras: make([]byte, 8),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Errorf("expected %v to work, got: %v", opcode, res)
+		}
+	}
+	if revSeq, _, _ := getMeta(); revSeq != 12 {
+		t.Errorf("expected recreated revSeq 12, got: %v", revSeq)
+	}
+}
@@ -13,16 +13,27 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/steveyen/gkvlite"
 )
 
 type partitionstore struct {
+	lastCas      uint64 // Highest CAS applied to the collections.
+	persistedCas uint64 // Highest CAS known to be flushed to storage.
+	evictedBytes int64  // Estimated bytes of items evicted from memory.
+	referenced   int32  // 1 when read since the evictor last came by.
+
+	usedLock sync.Mutex      // Covers used, and is never held for long.
+	used     map[string]bool // Cas bytes of changes used since the evictor came by.
+
 	vbid    uint16
 	parent  *bucketstore
 	lock    sync.Mutex     // Properties below here are covered by this lock.
@@ -56,12 +67,238 @@ func (p *partitionstore) collsPauseSwap(
 	atomic.StorePointer(&p.keys, unsafe.Pointer(k))
 }
 
+// Replaces the keys, changes and tombstones collections with empty
+// ones.  Should only be called when holding the bucketstore
+// service/apply "lock".
+func (p *partitionstore) clear_unlocked() {
+	kName := fmt.Sprintf("%v%s", p.vbid, COLL_SUFFIX_KEYS)
+	cName := fmt.Sprintf("%v%s", p.vbid, COLL_SUFFIX_CHANGES)
+	tName := fmt.Sprintf("%v%s", p.vbid, COLL_SUFFIX_TOMBS)
+	p.collsPauseSwap(func() (keys, changes *gkvlite.Collection) {
+		store := p.parent.BSFData().store
+		store.RemoveCollection(kName)
+		store.RemoveCollection(cName)
+		store.RemoveCollection(tName)
+		p.parent.coll(tName)
+		return p.parent.coll(kName), p.parent.coll(cName)
+	})
+	p.addEvictedBytes(0, 0) // The new collections have nothing evicted.
+}
+
+// The tombstones collection maps each deleted key to its last
+// deletion, so that the key's revisions continue if it's recreated
+// and so that a stale change from elsewhere can't resurrect it.  It's
+// looked up by name, so it follows the store through compactions,
+// which purge tombstones older than the bucket's MetadataPurgeAge.
+func (p *partitionstore) tombs() *gkvlite.Collection {
+	return p.parent.BSFData().store.GetCollection(
+		fmt.Sprintf("%v%s", p.vbid, COLL_SUFFIX_TOMBS))
+}
+
+// A tombstone's value is the time of the deletion, in unix seconds,
+// followed by the deletion's value bytes.
+const tombTimeLen = 8
+
+func tombstoneBytes(dItem *item, t time.Time) []byte {
+	vBytes := dItem.toValueBytes()
+	rv := make([]byte, tombTimeLen+len(vBytes))
+	binary.BigEndian.PutUint64(rv, uint64(t.Unix()))
+	copy(rv[tombTimeLen:], vBytes)
+	return rv
+}
+
+func tombstoneParse(b []byte) (dItem *item, t time.Time, err error) {
+	if len(b) < tombTimeLen {
+		return nil, t, fmt.Errorf("tombstone too short: %v", len(b))
+	}
+	t = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	dItem = &item{}
+	if err = dItem.fromValueBytes(b[tombTimeLen:]); err != nil {
+		return nil, t, err
+	}
+	return dItem, t, nil
+}
+
+// Returns the last deletion of a key that's now missing, or nil.
+func (p *partitionstore) getTombstone(key []byte) (*item, error) {
+	tombs := p.tombs()
+	if tombs == nil {
+		return nil, nil
+	}
+	tItem, err := tombs.GetItem(key, true)
+	if err != nil || tItem == nil {
+		return nil, err
+	}
+	i, _, err := tombstoneParse(tItem.Val)
+	return i, err
+}
+
+// Records a deletion in the tombstones collection, if there is one.
+// Should only be called while holding the mutate() lock.
+func (p *partitionstore) putTombstone_unlocked(dItem *item) error {
+	tombs := p.tombs()
+	if tombs == nil {
+		return nil
+	}
+	return tombs.SetItem(&gkvlite.Item{
+		Key:      dItem.key,
+		Val:      tombstoneBytes(dItem, time.Now()),
+		Priority: rand.Int31(),
+	})
+}
+
+// Returns the revSeq for an item that replaces oldItem, which may be
+// nil, in which case the key's revisions continue from its tombstone.
+func (p *partitionstore) nextRevSeq(key []byte, oldItem *item) (uint64, error) {
+	if oldItem != nil {
+		return oldItem.nextRevSeq(), nil
+	}
+	tomb, err := p.getTombstone(key)
+	if err != nil {
+		return 0, err
+	}
+	return tomb.nextRevSeq(), nil
+}
+
+// Records the deletion of a key that's already missing, such as a
+// deletion from elsewhere, unless the key's current tombstone wins.
+func (p *partitionstore) setTombstone(dItem *item) (err error) {
+	p.mutate(func(keys, changes *gkvlite.Collection) {
+		var tomb *item
+		if tomb, err = p.getTombstone(dItem.key); err != nil ||
+			(tomb != nil && !dItem.winsOver(tomb)) {
+			return
+		}
+		if err = p.putTombstone_unlocked(dItem); err != nil {
+			return
+		}
+		p.parent.dirty(false, dItem.NumBytes())
+	})
+	return err
+}
+
+// Adjusts the estimated bytes of evicted items, keeping them between
+// 0 and max, and tallies the change on the bucketstore.
+func (p *partitionstore) addEvictedBytes(delta, max int64) {
+	for {
+		prev := atomic.LoadInt64(&p.evictedBytes)
+		next := prev + delta
+		if next > max {
+			next = max
+		}
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt64(&p.evictedBytes, prev, next) {
+			atomic.AddInt64(&p.parent.evictedBytes, next-prev)
+			return
+		}
+	}
+}
+
+// Counts an item as resident again the first time it's seen after
+// being read back from storage.
+func (p *partitionstore) fetched(i *item) {
+	if atomic.CompareAndSwapUint32(&i.fetched, 1, 0) {
+		p.addEvictedBytes(-i.NumBytes(), math.MaxInt64)
+	}
+}
+
+// Marks the partition as recently used, so the evictor passes it by.
+func (p *partitionstore) reference() {
+	if atomic.LoadInt32(&p.referenced) == 0 {
+		atomic.StoreInt32(&p.referenced, 1)
+	}
+}
+
+// Clears the recently used mark, returning whether it was set.
+func (p *partitionstore) unreference() bool {
+	return atomic.CompareAndSwapInt32(&p.referenced, 1, 0)
+}
+
+// Remembers that a change was used, if it hasn't been in the current
+// recency period, for the evictor to give it a fresher priority.
+// Readers don't take the mutate() lock, which compaction may hold.
+func (p *partitionstore) use(cItem *gkvlite.Item) {
+	if !p.parent.evictable || !recencyStale(cItem.Priority, time.Now()) {
+		return
+	}
+	p.usedLock.Lock()
+	if p.used == nil {
+		p.used = map[string]bool{}
+	}
+	if len(p.used) < evictMaxUsed {
+		p.used[string(cItem.Key)] = true
+	}
+	p.usedLock.Unlock()
+}
+
+// Gives the changes that were used since the last call the current
+// recency priority.  Should only be called while holding the mutate()
+// lock.
+func (p *partitionstore) reprioritize_unlocked(changes *gkvlite.Collection) {
+	p.usedLock.Lock()
+	used := p.used
+	p.used = nil
+	p.usedLock.Unlock()
+
+	now := time.Now()
+	for cas := range used {
+		cItem, err := changes.GetItem([]byte(cas), true)
+		if err != nil || cItem == nil || !recencyStale(cItem.Priority, now) {
+			continue
+		}
+		changes.SetItem(&gkvlite.Item{
+			Key:       cItem.Key,
+			Val:       cItem.Val,
+			Priority:  recencyPriority(now),
+			Transient: atomic.LoadPointer(&cItem.Transient),
+		})
+	}
+}
+
+// Returns the treap priority of a change that's being written.
+func (p *partitionstore) changePriority() int32 {
+	if p.parent.evictable {
+		return recencyPriority(time.Now())
+	}
+	return rand.Int31()
+}
+
+// Returns the highest CAS applied to the collections.
+func (p *partitionstore) getLastCas() uint64 {
+	return atomic.LoadUint64(&p.lastCas)
+}
+
+// Raises lastCas to at least the given cas, so it never goes backwards.
+func (p *partitionstore) raiseLastCas(cas uint64) {
+	for {
+		lastCas := atomic.LoadUint64(&p.lastCas)
+		if cas <= lastCas || atomic.CompareAndSwapUint64(&p.lastCas, lastCas, cas) {
+			return
+		}
+	}
+}
+
+// Returns the highest CAS whose change is known to be persisted.
+func (p *partitionstore) getPersistedCas() uint64 {
+	return atomic.LoadUint64(&p.persistedCas)
+}
+
+// Invoked when the collections were loaded from storage, so
+// everything up to the given CAS is both applied and persisted.
+func (p *partitionstore) loadedCas(cas uint64) {
+	atomic.StoreUint64(&p.lastCas, cas)
+	atomic.StoreUint64(&p.persistedCas, cas)
+}
+
 func (p *partitionstore) get(key []byte) (*item, error) {
 	return p.getItem(key, true)
 }
 
 func (p *partitionstore) getItem(key []byte, withValue bool) (
 	i *item, err error) {
+	p.reference()
 	for retries := 0; retries < 5; retries++ {
 		keys, changes := p.colls()
 		kItem, err := keys.GetItem(key, true)
@@ -83,9 +320,11 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (
 			return nil, err
 		}
 		if cItem != nil {
+			p.use(cItem)
 			i = (*item)(atomic.LoadPointer(&cItem.Transient))
 			if i != nil {
-				atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
+				p.fetched(i)
+				p.pin(kItem, i)
 				return i, nil
 			}
 			i := &item{key: key}
@@ -93,7 +332,7 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (
 				return nil, err
 			}
 			atomic.StorePointer(&cItem.Transient, unsafe.Pointer(i))
-			atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
+			p.pin(kItem, i)
 			return i, nil
 		}
 		// If cItem is nil, perhaps a concurrent set() happened after
@@ -102,6 +341,14 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (
 	return nil, fmt.Errorf("max getItem retries for key: %v", key)
 }
 
+// Caches an item on its keys index entry, unless the item's value
+// needs to stay evictable from the changes collection.
+func (p *partitionstore) pin(kItem *gkvlite.Item, i *item) {
+	if !p.parent.evictable {
+		atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
+	}
+}
+
 func (p *partitionstore) getTotals() (
 	numItems uint64, numItemBytes uint64, err error) {
 	keys, changes := p.colls()
@@ -112,8 +359,23 @@ func (p *partitionstore) getTotals() (
 	return
 }
 
+// Visits the items from the start key.  Without withValue, an item
+// whose change isn't resident isn't read from storage, so the visitor
+// sees just its key and cas.
 func (p *partitionstore) visitItems(start []byte, withValue bool,
 	visitor func(*item) bool) (err error) {
+	return p.visitItemsEx(start, false, withValue, visitor)
+}
+
+// Visits the items with keys before the end key, in descending
+// order, where a nil end visits all the items.
+func (p *partitionstore) visitItemsDescend(end []byte, withValue bool,
+	visitor func(*item) bool) (err error) {
+	return p.visitItemsEx(end, true, withValue, visitor)
+}
+
+func (p *partitionstore) visitItemsEx(target []byte, descend bool,
+	withValue bool, visitor func(*item) bool) (err error) {
 	keys, changes := p.colls()
 	var vErr error
 	v := func(kItem *gkvlite.Item) bool {
@@ -122,7 +384,7 @@ func (p *partitionstore) visitItems(start []byte, withValue bool,
 			return visitor(i)
 		}
 		var cItem *gkvlite.Item
-		cItem, vErr = changes.GetItem(kItem.Val, true)
+		cItem, vErr = changes.GetItem(kItem.Val, withValue)
 		if vErr != nil {
 			return false
 		}
@@ -131,7 +393,15 @@ func (p *partitionstore) visitItems(start []byte, withValue bool,
 		}
 		i = (*item)(atomic.LoadPointer(&cItem.Transient))
 		if i != nil {
-			atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
+			p.fetched(i)
+			p.pin(kItem, i)
+			return visitor(i)
+		}
+		if cItem.Val == nil {
+			i = &item{key: kItem.Key}
+			if i.cas, vErr = casBytesParse(kItem.Val); vErr != nil {
+				return false
+			}
 			return visitor(i)
 		}
 		i = &item{key: kItem.Key}
@@ -139,10 +409,22 @@ func (p *partitionstore) visitItems(start []byte, withValue bool,
 			return false
 		}
 		atomic.StorePointer(&cItem.Transient, unsafe.Pointer(i))
-		atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
+		p.pin(kItem, i)
 		return visitor(i)
 	}
-	if err := p.visit(keys, start, true, v); err != nil {
+	if descend {
+		if target == nil {
+			max, err := keys.MaxItem(false)
+			if err != nil || max == nil {
+				return err
+			}
+			target = append(append([]byte(nil), max.Key...), 0)
+		}
+		err = keys.VisitItemsDescend(target, true, v)
+	} else {
+		err = p.visit(keys, target, true, v)
+	}
+	if err != nil {
 		return err
 	}
 	return vErr
@@ -165,6 +447,24 @@ func (p *partitionstore) visitChanges(start []byte, withValue bool,
 	return vErr
 }
 
+// Visits the changes before the end cas bytes, in descending order.
+func (p *partitionstore) visitChangesDescend(end []byte, withValue bool,
+	visitor func(*item) bool) (err error) {
+	_, changes := p.colls()
+	var vErr error
+	v := func(cItem *gkvlite.Item) bool {
+		i := &item{}
+		if vErr = i.fromValueBytes(cItem.Val); vErr != nil {
+			return false
+		}
+		return visitor(i)
+	}
+	if err := changes.VisitItemsDescend(end, withValue, v); err != nil {
+		return err
+	}
+	return vErr
+}
+
 func (p *partitionstore) visit(coll *gkvlite.Collection,
 	start []byte, withValue bool,
 	v func(*gkvlite.Item) bool) (err error) {
@@ -197,18 +497,18 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 	cItem := &gkvlite.Item{
 		Key:       cBytes,
 		Val:       newItem.toValueBytes(),
-		Priority:  rand.Int31(),
+		Priority:  p.changePriority(),
 		Transient: unsafe.Pointer(newItem),
 	}
 
 	var kItem *gkvlite.Item
 	if newItem.key != nil && len(newItem.key) > 0 {
 		kItem = &gkvlite.Item{
-			Key:       newItem.key,
-			Val:       cBytes,
-			Priority:  rand.Int31(),
-			Transient: unsafe.Pointer(newItem),
+			Key:      newItem.key,
+			Val:      cBytes,
+			Priority: rand.Int31(),
 		}
+		p.pin(kItem, newItem)
 	}
 
 	deltaItemBytes = newItem.NumBytes()
@@ -234,6 +534,11 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 			if err = keys.SetItem(kItem); err != nil {
 				return
 			}
+			if tombs := p.tombs(); oldItem == nil && tombs != nil {
+				if _, err = tombs.Delete(newItem.key); err != nil {
+					return
+				}
+			}
 		} else {
 			dirtyForce = true // An nil/empty key means this is a metadata change.
 		}
@@ -243,7 +548,8 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 			changes.Delete(oldItemCasBytes)
 		}
 
-		p.parent.dirty(dirtyForce)
+		p.raiseLastCas(newItem.cas)
+		p.parent.dirty(dirtyForce, newItem.NumBytes())
 
 		if cb != nil {
 			cb()
@@ -254,13 +560,26 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 
 func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 	deltaItemBytes int64, err error) {
+	return p.delItem((&item{key: key, cas: cas,
+		revSeq: oldItem.nextRevSeq()}).markAsDeletion(), oldItem)
+}
+
+// Like del(), but records that the deletion was due to expiration.
+func (p *partitionstore) expire(key []byte, cas uint64, oldItem *item) (
+	deltaItemBytes int64, err error) {
+	return p.delItem((&item{key: key, cas: cas,
+		revSeq: oldItem.nextRevSeq()}).markAsExpiration(), oldItem)
+}
+
+func (p *partitionstore) delItem(dItem *item, oldItem *item) (
+	deltaItemBytes int64, err error) {
+	key, cas := dItem.key, dItem.cas
 	cBytes := casBytes(cas)
-	dItem := &item{key: key, cas: cas}
-	vBytes := dItem.markAsDeletion().toValueBytes()
+	vBytes := dItem.toValueBytes()
 	cItem := &gkvlite.Item{
 		Key:      cBytes,
 		Val:      vBytes,
-		Priority: rand.Int31(),
+		Priority: p.changePriority(),
 	}
 
 	deltaItemBytes = dItem.NumBytes()
@@ -286,6 +605,9 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 			if _, err = keys.Delete(key); err != nil {
 				return
 			}
+			if err = p.putTombstone_unlocked(dItem); err != nil {
+				return
+			}
 		} else {
 			dirtyForce = true // An nil/empty key means this is a metadata change.
 		}
@@ -295,7 +617,8 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 			changes.Delete(oldItemCasBytes)
 		}
 
-		p.parent.dirty(dirtyForce)
+		p.raiseLastCas(cas)
+		p.parent.dirty(dirtyForce, dItem.NumBytes())
 	})
 	return deltaItemBytes, err
 }
@@ -52,6 +52,19 @@ func TestPartitionStoreEmptyVisit(t *testing.T) {
 	}
 }
 
+func TestPartitionStoreLastCasOnlyRises(t *testing.T) {
+	p := &partitionstore{}
+	p.raiseLastCas(10)
+	p.raiseLastCas(5)
+	if p.getLastCas() != 10 {
+		t.Errorf("expected lastCas to stay at 10, got: %v", p.getLastCas())
+	}
+	p.raiseLastCas(11)
+	if p.getLastCas() != 11 {
+		t.Errorf("expected lastCas to rise to 11, got: %v", p.getLastCas())
+	}
+}
+
 func testFillColl(x *gkvlite.Collection, arr []string) {
 	for i, s := range arr {
 		x.SetItem(&gkvlite.Item{
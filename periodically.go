@@ -19,6 +19,7 @@ type periodically struct {
 	ticker  tickSrc
 	sem     chan bool
 	running chan bool
+	timings Histogram // Durations of the task runs.
 }
 
 type tickSrc interface {
@@ -99,7 +100,10 @@ func (p *periodically) runTask(t time.Time,
 	p.sem <- true
 	go func() {
 		defer func() { <-p.sem }()
-		rv <- f(t)
+		start := time.Now()
+		ok := f(t)
+		p.timings.Since(start)
+		rv <- ok
 	}()
 	return rv
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The default timeout of the longpoll, continuous and eventsource
+// _changes feeds, and of their heartbeats when heartbeat=true.
+var changesTimeoutDefault = time.Minute
+var changesHeartbeatDefault = time.Minute
+
+// A position in a bucket's changes, which is the cas of the last
+// change seen in each vbucket.  It's formatted as vbid:cas pairs,
+// like "0:12,3:7", where a missing vbucket is at cas 0.
+type changesSeq map[uint16]uint64
+
+func parseChangesSeq(s string) (changesSeq, error) {
+	rv := changesSeq{}
+	if s == "" || s == "0" {
+		return rv, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid since: %v", s)
+		}
+		vbid, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since: %v", s)
+		}
+		cas, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since: %v", s)
+		}
+		rv[uint16(vbid)] = cas
+	}
+	return rv, nil
+}
+
+func (s changesSeq) String() string {
+	vbids := make([]int, 0, len(s))
+	for vbid, cas := range s {
+		if cas > 0 {
+			vbids = append(vbids, int(vbid))
+		}
+	}
+	if len(vbids) <= 0 {
+		return "0"
+	}
+	sort.Ints(vbids)
+	pairs := make([]string, len(vbids))
+	for i, vbid := range vbids {
+		pairs[i] = fmt.Sprintf("%d:%d", vbid, s[uint16(vbid)])
+	}
+	return strings.Join(pairs, ",")
+}
+
+type ChangeRev struct {
+	Rev string `json:"rev"`
+}
+
+type ChangeRow struct {
+	Seq     string        `json:"seq"`
+	Id      string        `json:"id"`
+	Changes []ChangeRev   `json:"changes"`
+	Deleted bool          `json:"deleted,omitempty"`
+	Doc     *ViewDocValue `json:"doc,omitempty"`
+
+	vbid uint16
+	cas  uint64
+}
+
+// Expired items are reported as deleted.
+func newChangeRow(vbid uint16, i *item, includeDocs bool,
+	now time.Time) *ChangeRow {
+	row := &ChangeRow{
+		Id:      string(i.key),
+		Changes: []ChangeRev{{Rev: couchDbItemRev(i)}},
+		Deleted: i.isDeletion() || i.isExpired(now),
+		vbid:    vbid,
+		cas:     i.cas,
+	}
+	if includeDocs && !row.Deleted {
+		row.Doc = couchDbDocValue(row.Id, row.Changes[0].Rev, i.data)
+	}
+	return row
+}
+
+func (c *ChangeRow) before(o *ChangeRow, descending bool) bool {
+	if c.cas != o.cas {
+		return (c.cas < o.cas) != descending
+	}
+	return c.vbid < o.vbid
+}
+
+type changesParams struct {
+	since       changesSeq // Where nil means now.
+	limit       int
+	includeDocs bool
+	descending  bool
+	feed        string
+	timeout     time.Duration
+	heartbeat   time.Duration
+}
+
+func parseChangesParams(r *http.Request) (*changesParams, error) {
+	q := r.URL.Query()
+	p := &changesParams{
+		includeDocs: q.Get("include_docs") == "true",
+		descending:  q.Get("descending") == "true",
+		feed:        q.Get("feed"),
+		timeout:     changesTimeoutDefault,
+	}
+	switch p.feed {
+	case "":
+		p.feed = "normal"
+	case "normal", "longpoll", "continuous", "eventsource":
+	default:
+		return nil, fmt.Errorf("unknown feed: %v", p.feed)
+	}
+	if p.descending && p.feed != "normal" {
+		return nil, fmt.Errorf("descending is only for the normal feed")
+	}
+	var err error
+	if since := q.Get("since"); since != "now" {
+		if p.since, err = parseChangesSeq(since); err != nil {
+			return nil, err
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if p.limit, err = strconv.Atoi(s); err != nil || p.limit < 0 {
+			return nil, fmt.Errorf("invalid limit: %v", s)
+		}
+	}
+	if s := q.Get("timeout"); s != "" {
+		ms, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %v", s)
+		}
+		p.timeout = time.Duration(ms) * time.Millisecond
+	}
+	if s := q.Get("heartbeat"); s == "true" {
+		p.heartbeat = changesHeartbeatDefault
+	} else if s != "" {
+		ms, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid heartbeat: %v", s)
+		}
+		p.heartbeat = time.Duration(ms) * time.Millisecond
+	}
+	return p, nil
+}
+
+// Follows the changes of a bucket's active vbuckets, like CouchDB's
+// _changes.  Each row's seq is just its vbid:cas, while the last_seq
+// is the position in every vbucket, which can be given as the since
+// of a later request to resume where the feed left off...
+//    curl http://127.0.0.1:8092/default/_changes?since=0:12&feed=continuous
+// The normal feed merges the changes of all the vbuckets in cas
+// order; the other feeds then follow new changes until the timeout.
+// A longpoll feed returns as soon as it has any rows.
+func couchDbChanges(w http.ResponseWriter, r *http.Request) {
+	_, _, bucket := checkDb(w, r)
+	if bucket == nil {
+		return
+	}
+	p, err := parseChangesParams(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+
+	vbs := make([]*VBucket, bucket.GetBucketSettings().NumPartitions)
+	for vbid := range vbs {
+		vb, _ := bucket.GetVBucket(uint16(vbid))
+		if vb != nil && vb.GetVBState() == VBActive {
+			vbs[vbid] = vb
+		}
+	}
+
+	var pending *pendingVBuckets
+	if p.feed != "normal" {
+		// Observe before visiting, so that no change is missed.
+		mch := make(chan interface{}, 100)
+		donech := make(chan bool)
+		defer close(donech)
+		pending = newPendingVBuckets()
+		go pending.absorb(mch, donech)
+		for _, vb := range vbs {
+			if vb != nil {
+				vb.observer.Register(mch)
+				defer vb.observer.Unregister(mch)
+			}
+		}
+	}
+
+	if p.since == nil {
+		p.since = changesSeq{}
+		for vbid, vb := range vbs {
+			if vb != nil {
+				p.since[uint16(vbid)] = atomic.LoadUint64(&vb.Meta().LastCas)
+			}
+		}
+	}
+
+	cw := newChangesWriter(w, p)
+	cw.start()
+
+	mergeDonech := make(chan bool)
+	in, out := MakeChangeRowMerger(len(vbs), p.descending, mergeDonech)
+	for vbid := range in {
+		go visitVBucketChanges(vbs[vbid], p.since[uint16(vbid)],
+			p.descending, p.includeDocs, in[vbid], mergeDonech)
+	}
+	for row := range out {
+		if !cw.write(row) {
+			break
+		}
+	}
+	close(mergeDonech)
+
+	if pending != nil {
+		cw.follow(vbs, pending)
+	}
+	cw.end()
+}
+
+// Merges changes from each vbucket, which are in cas order, into one
+// stream in cas order (or descending), like MergeViewRows.  Closing
+// donech stops the merge and its inputs.
+func MakeChangeRowMerger(np int, descending bool, donech <-chan bool) (
+	[]chan *ChangeRow, chan *ChangeRow) {
+	out := make(chan *ChangeRow)
+	if np == 1 {
+		return []chan *ChangeRow{out}, out
+	}
+	in := make([]chan *ChangeRow, np)
+	for vbid := 0; vbid < np; vbid++ {
+		in[vbid] = make(chan *ChangeRow)
+	}
+	go MergeChangeRows(in, out, descending, donech)
+	return in, out
+}
+
+func MergeChangeRows(inSorted []chan *ChangeRow, out chan *ChangeRow,
+	descending bool, donech <-chan bool) {
+	defer close(out)
+
+	arr := make([]*ChangeRow, len(inSorted)) // A nil means an input is done.
+	for i, in := range inSorted {
+		arr[i] = <-in
+	}
+	for {
+		ileast := -1
+		for i, c := range arr {
+			if c != nil && (ileast < 0 || c.before(arr[ileast], descending)) {
+				ileast = i
+			}
+		}
+		if ileast < 0 {
+			return
+		}
+		select {
+		case out <- arr[ileast]:
+		case <-donech:
+			return
+		}
+		arr[ileast] = <-inSorted[ileast]
+	}
+}
+
+func visitVBucketChanges(vb *VBucket, since uint64, descending bool,
+	includeDocs bool, ch chan *ChangeRow, donech <-chan bool) {
+	defer close(ch)
+
+	if vb == nil {
+		return
+	}
+	now := time.Now()
+	visitor := func(i *item) bool {
+		if i.cas <= since {
+			return false // When descending, we're done.
+		}
+		if len(i.key) <= 0 {
+			return true // Skip metadata changes.
+		}
+		select {
+		case ch <- newChangeRow(vb.vbid, i, includeDocs, now):
+			return true
+		case <-donech:
+			return false
+		}
+	}
+	var err error
+	if descending {
+		err = vb.ps.visitChangesDescend(
+			casBytes(atomic.LoadUint64(&vb.Meta().LastCas)+1), true, visitor)
+	} else {
+		err = vb.ps.visitChanges(casBytes(since+1), true, visitor)
+	}
+	if err != nil {
+		log.Printf("_changes visit err: %v, vbucket: %v", err, vb.vbid)
+	}
+}
+
+// Writes the rows of a _changes feed in the format of its feed type,
+// tracking the seq of every vbucket, for the last_seq, after each row.
+type changesWriter struct {
+	w   http.ResponseWriter
+	p   *changesParams
+	seq changesSeq
+	n   int // The # of rows written.
+	err error
+}
+
+func newChangesWriter(w http.ResponseWriter, p *changesParams) *changesWriter {
+	cw := &changesWriter{w: w, p: p, seq: changesSeq{}}
+	for vbid, cas := range p.since {
+		cw.seq[vbid] = cas
+	}
+	return cw
+}
+
+func (cw *changesWriter) start() {
+	cw.w.Header().Set("Cache-Control", "no-cache")
+	switch cw.p.feed {
+	case "eventsource":
+		cw.w.Header().Set("Content-Type", "text/event-stream")
+	default:
+		cw.w.Header().Set("Content-Type", "application/json")
+	}
+	switch cw.p.feed {
+	case "normal", "longpoll":
+		cw.emit([]byte(`{"results":[` + "\n"))
+	}
+}
+
+// Returns false once no more rows should be written.
+func (cw *changesWriter) write(row *ChangeRow) bool {
+	if cw.done() {
+		return false
+	}
+	if row.cas > cw.seq[row.vbid] {
+		cw.seq[row.vbid] = row.cas
+	}
+	row.Seq = changesSeq{row.vbid: row.cas}.String()
+	j, err := json.Marshal(row)
+	if err != nil {
+		cw.err = err
+		return false
+	}
+	switch cw.p.feed {
+	case "continuous":
+		cw.emit(append(j, '\n'))
+	case "eventsource":
+		cw.emit([]byte("data: " + string(j) + "\nid: " + row.Seq + "\n\n"))
+	default:
+		if cw.n > 0 {
+			cw.emit([]byte(",\n"))
+		}
+		cw.emit(j)
+	}
+	cw.n++
+	return !cw.done()
+}
+
+func (cw *changesWriter) emit(b []byte) {
+	if cw.err != nil {
+		return
+	}
+	if _, cw.err = cw.w.Write(b); cw.err != nil {
+		return
+	}
+	if cw.p.feed != "normal" {
+		if f, ok := cw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func (cw *changesWriter) done() bool {
+	return cw.err != nil || (cw.p.limit > 0 && cw.n >= cw.p.limit)
+}
+
+// Writes the changes of vbuckets as they're observed, until the
+// timeout, the limit, or for a longpoll feed, the first rows.
+func (cw *changesWriter) follow(vbs []*VBucket, pending *pendingVBuckets) {
+	timeout := time.After(cw.p.timeout)
+	var heartbeat <-chan time.Time
+	if cw.p.heartbeat > 0 {
+		ticker := time.NewTicker(cw.p.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var closed <-chan bool
+	if cn, ok := cw.w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	for !cw.done() && !(cw.p.feed == "longpoll" && cw.n > 0) {
+		select {
+		case <-pending.ch:
+			for vbid := range pending.take() {
+				if int(vbid) < len(vbs) && vbs[vbid] != nil && !cw.done() {
+					cw.writeVBucket(vbs[vbid])
+				}
+			}
+		case <-heartbeat:
+			if cw.p.feed == "eventsource" {
+				cw.emit([]byte(":\n\n"))
+			} else {
+				cw.emit([]byte("\n"))
+			}
+		case <-timeout:
+			return
+		case <-closed:
+			cw.err = fmt.Errorf("_changes client closed")
+			return
+		}
+	}
+}
+
+// Writes a vbucket's changes after its seq.
+func (cw *changesWriter) writeVBucket(vb *VBucket) {
+	now := time.Now()
+	err := vb.ps.visitChanges(casBytes(cw.seq[vb.vbid]+1), true,
+		func(i *item) bool {
+			if len(i.key) <= 0 {
+				return true
+			}
+			return cw.write(newChangeRow(vb.vbid, i, cw.p.includeDocs, now))
+		})
+	if err != nil {
+		log.Printf("_changes visit err: %v, vbucket: %v", err, vb.vbid)
+	}
+}
+
+func (cw *changesWriter) end() {
+	if cw.err != nil {
+		return
+	}
+	lastSeq, _ := json.Marshal(cw.seq.String())
+	switch cw.p.feed {
+	case "normal", "longpoll":
+		cw.emit([]byte("\n],\n" + `"last_seq":` + string(lastSeq) + "}\n"))
+	case "continuous":
+		cw.emit([]byte(`{"last_seq":` + string(lastSeq) + "}\n"))
+	}
+}
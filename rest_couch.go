@@ -12,11 +12,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -27,10 +30,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func restCouchServe(rest string, staticPath string) {
+func restCouchServe(rest string, restTLS string, staticPath string) {
 	r := mux.NewRouter()
 	restCouchAPI(r)
-	log.Fatal(http.ListenAndServe(rest, authenticationFilter{r}))
+	log.Fatal(serveHTTP(rest, restTLS, authenticationFilter{r}))
 }
 
 func referencesVBucket(r *http.Request, rm *mux.RouteMatch) bool {
@@ -60,7 +63,9 @@ func restCouchAPI(r *mux.Router) *mux.Router {
 
 	dbr.Handle("/_all_docs",
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbAllDocs))).
-		Methods("GET")
+		Methods("GET", "POST")
+	dbr.Handle("/_changes",
+		http.HandlerFunc(couchDbChanges)).Methods("GET")
 
 	dbr.Handle("/_design/{docId}/_view/{viewId}",
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbGetView))).
@@ -100,18 +105,33 @@ func restCouchAPI(r *mux.Router) *mux.Router {
 		MatcherFunc(referencesVBucket)
 
 	dbr.Handle("/{vbucket};{bucketUUID}/_local/{docId}",
-		http.HandlerFunc(couchDbGetDoc)).Methods("GET", "HEAD").
+		http.HandlerFunc(couchDbGetLocalDoc)).Methods("GET", "HEAD").
 		MatcherFunc(referencesVBucket).
 		MatcherFunc(includesBucketUUID)
 	dbr.Handle("/{vbucket}/_local/{docId}",
-		http.HandlerFunc(couchDbGetDoc)).Methods("GET", "HEAD").
+		http.HandlerFunc(couchDbGetLocalDoc)).Methods("GET", "HEAD").
 		MatcherFunc(referencesVBucket)
 	dbr.Handle("/{vbucket};{bucketUUID}/_local/{docId}/{source}/{destination}",
-		http.HandlerFunc(couchDbGetDoc)).Methods("GET", "HEAD").
+		http.HandlerFunc(couchDbGetLocalDoc)).Methods("GET", "HEAD").
 		MatcherFunc(referencesVBucket).
 		MatcherFunc(includesBucketUUID)
 	dbr.Handle("/{vbucket}/_local/{docId}/{source}/{destination}",
-		http.HandlerFunc(couchDbGetDoc)).Methods("GET", "HEAD").
+		http.HandlerFunc(couchDbGetLocalDoc)).Methods("GET", "HEAD").
+		MatcherFunc(referencesVBucket)
+
+	dbr.Handle("/{vbucket};{bucketUUID}/_local/{docId}",
+		http.HandlerFunc(couchDbPutLocalDoc)).Methods("PUT").
+		MatcherFunc(referencesVBucket).
+		MatcherFunc(includesBucketUUID)
+	dbr.Handle("/{vbucket}/_local/{docId}",
+		http.HandlerFunc(couchDbPutLocalDoc)).Methods("PUT").
+		MatcherFunc(referencesVBucket)
+	dbr.Handle("/{vbucket};{bucketUUID}/_local/{docId}/{source}/{destination}",
+		http.HandlerFunc(couchDbPutLocalDoc)).Methods("PUT").
+		MatcherFunc(referencesVBucket).
+		MatcherFunc(includesBucketUUID)
+	dbr.Handle("/{vbucket}/_local/{docId}/{source}/{destination}",
+		http.HandlerFunc(couchDbPutLocalDoc)).Methods("PUT").
 		MatcherFunc(referencesVBucket)
 
 	dbr.Handle("/{vbucket};{bucketUUID}/_revs_diff",
@@ -162,7 +182,7 @@ func couchDbGetDesignDoc(w http.ResponseWriter, r *http.Request) {
 }
 
 func couchDbPutDesignDoc(w http.ResponseWriter, r *http.Request) {
-	_, _, bucket, ddocId := checkDocId(w, r)
+	_, bucketName, bucket, ddocId := checkDocId(w, r)
 	if bucket == nil || ddocId == "" {
 		return
 	}
@@ -180,7 +200,9 @@ func couchDbPutDesignDoc(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Bad Request, err: %v", err), 400)
 		return
 	}
-	if err = bucket.SetDDoc("_design/"+ddocId, body); err != nil {
+	err = bucket.SetDDoc("_design/"+ddocId, body)
+	auditHTTP(r, AUDIT_DDOC_PUT, bucketName, "_design/"+ddocId, err)
+	if err != nil {
 		http.Error(w, fmt.Sprintf("SetDDoc err: %v", err), 400)
 		return
 	}
@@ -188,11 +210,13 @@ func couchDbPutDesignDoc(w http.ResponseWriter, r *http.Request) {
 }
 
 func couchDbDelDesignDoc(w http.ResponseWriter, r *http.Request) {
-	_, _, bucket, ddocId := checkDocId(w, r)
+	_, bucketName, bucket, ddocId := checkDocId(w, r)
 	if bucket == nil || ddocId == "" {
 		return
 	}
-	if err := bucket.DelDDoc("_design/" + ddocId); err != nil {
+	err := bucket.DelDDoc("_design/" + ddocId)
+	auditHTTP(r, AUDIT_DDOC_DELETE, bucketName, "_design/"+ddocId, err)
+	if err != nil {
 		http.Error(w, fmt.Sprintf("DelDDoc err: %v", err), 400)
 		return
 	}
@@ -212,8 +236,10 @@ func couchDbGetDb(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// TODO this implementation does no conflict resolution
-// only suitable for one way replications
+// Answers which of the given revs are missing, where a rev is
+// missing unless the current item's rev is the same or would win the
+// conflict resolution.  Like XDCR, each doc may be given one rev as a
+// string or a list of revs.
 func couchDbRevsDiff(w http.ResponseWriter, r *http.Request) {
 	_, _, bucket := checkDb(w, r)
 	if bucket == nil {
@@ -229,12 +255,68 @@ func couchDbRevsDiff(w http.ResponseWriter, r *http.Request) {
 	}
 
 	revsDiffResponse := map[string]interface{}{}
-	for key, val := range revsDiffRequest {
-		revsDiffResponse[key] = map[string]interface{}{"missing": val}
+	for docId, val := range revsDiffRequest {
+		var revs []string
+		switch x := val.(type) {
+		case string:
+			revs = []string{x}
+		case []interface{}:
+			for _, rev := range x {
+				if s, ok := rev.(string); ok {
+					revs = append(revs, s)
+				}
+			}
+		}
+		missing, err := couchDbMissingRevs(bucket, docId, revs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("_revs_diff err: %v, docId: %v",
+				err, docId), 400)
+			return
+		}
+		if len(missing) <= 0 {
+			continue
+		}
+		if _, ok := val.(string); ok {
+			revsDiffResponse[docId] = map[string]interface{}{"missing": missing[0]}
+		} else {
+			revsDiffResponse[docId] = map[string]interface{}{"missing": missing}
+		}
 	}
 	mustEncode(w, revsDiffResponse)
 }
 
+func couchDbMissingRevs(bucket Bucket, docId string,
+	revs []string) ([]string, error) {
+	vb, err := GetVBucketForKey(bucket, []byte(docId))
+	if err != nil {
+		return nil, err
+	}
+	var cur *item
+	if vb != nil {
+		if cur, err = vb.getUnexpired([]byte(docId), time.Now()); err != nil {
+			return nil, err
+		}
+		if cur == nil {
+			// A deleted doc's revs are only missing if they're newer
+			// than its deletion.
+			if cur, err = vb.ps.getTombstone([]byte(docId)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	missing := []string{}
+	for _, rev := range revs {
+		i, err := parseCouchDbRev(rev)
+		if err != nil {
+			return nil, err
+		}
+		if cur == nil || i.winsOver(cur) {
+			missing = append(missing, rev)
+		}
+	}
+	return missing, nil
+}
+
 type BulkDocsItemMeta struct {
 	Id         string  `json:"id"`
 	Rev        string  `json:"rev"`
@@ -253,10 +335,11 @@ type BulkDocsRequest struct {
 	Docs []BulkDocsItem `json:"docs"`
 }
 
-// TODO this implementation uses the wrong memcached commands
-// it should use commands that can overwrite the metadata
-// for now this is done with the wrong commands just to get
-// data transfer up and running
+// Applies docs changed elsewhere, as XDCR does, keeping their revs,
+// expirations and flags, using SET_WITH_META and DELETE_WITH_META.
+// Each doc gets its own result, which is an error (e.g., a conflict,
+// when the existing doc wins the conflict resolution) or the rev
+// that's now stored.
 func couchDbBulkDocs(w http.ResponseWriter, r *http.Request) {
 	_, _, bucket := checkDb(w, r)
 	if bucket == nil {
@@ -275,49 +358,64 @@ func couchDbBulkDocs(w http.ResponseWriter, r *http.Request) {
 
 	bulkDocsResponse := make([]map[string]interface{}, 0, len(bulkDocsRequest.Docs))
 	for _, doc := range bulkDocsRequest.Docs {
-		key := []byte(doc.Meta.Id)
-		vbucketId := VBucketIdForKey(key, bucket.GetBucketSettings().NumPartitions)
-		vbucket, _ := bucket.GetVBucket(vbucketId)
-		if vbucket == nil {
-			http.Error(w, fmt.Sprintf("Invalid vbucket for this key: %v - %v",
-				key, err), 500)
-			return
-		}
+		bulkDocsResponse = append(bulkDocsResponse,
+			couchDbBulkDoc(bucket, &doc))
+	}
+	w.WriteHeader(201)
+	mustEncode(w, bulkDocsResponse)
+}
 
-		val, err := base64.StdEncoding.DecodeString(doc.Base64)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error decoding base64 data "+
-				"_bulk_docs body as JSON for key: %v - %v",
-				key, err), 500)
-			return
-		}
+func couchDbBulkDoc(bucket Bucket, doc *BulkDocsItem) map[string]interface{} {
+	result := map[string]interface{}{"id": doc.Meta.Id}
+	fail := func(e, reason string) map[string]interface{} {
+		result["error"] = e
+		result["reason"] = reason
+		return result
+	}
 
-		response := vbucket.Dispatch(nil, &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vbucketId,
-			Key:     key,
-			Body:    val,
-		})
+	key := []byte(doc.Meta.Id)
+	vb, _ := GetVBucket(bucket, key, VBActive)
+	if vb == nil {
+		return fail("not_found", "not_my_vbucket")
+	}
+	meta, err := parseCouchDbRev(doc.Meta.Rev)
+	if err != nil {
+		return fail("bad_request", err.Error())
+	}
+	meta.flag = uint32(doc.Meta.Flags)
+	meta.exp = uint32(doc.Meta.Expiration)
 
-		// TODO proper error handling
-		// for now we just bail if anything ever goes wrong
-		if response.Status != gomemcached.SUCCESS {
-			log.Printf("Got error writing data: %v - %v",
-				string(key), string(response.Body))
-			http.Error(w, "Internal Error", 500)
-			return
-		} else {
-			// TODO return actual revision created here we
-			// just lie and pretend to have created the
-			// requested revsion (we did not)
-			bulkDocsResponse = append(bulkDocsResponse,
-				map[string]interface{}{
-					"id":  doc.Meta.Id,
-					"rev": doc.Meta.Rev})
+	req := &gomemcached.MCRequest{
+		Opcode:  SET_WITH_META,
+		VBucket: vb.vbid,
+		Key:     key,
+		Extras:  make([]byte, withMetaExtrasLen),
+	}
+	if doc.Meta.Deleted {
+		req.Opcode = DELETE_WITH_META
+	} else {
+		req.Body, err = base64.StdEncoding.DecodeString(doc.Base64)
+		if err != nil {
+			return fail("bad_request", fmt.Sprintf("base64 err: %v", err))
 		}
 	}
-	w.WriteHeader(201)
-	mustEncode(w, bulkDocsResponse)
+	binary.BigEndian.PutUint32(req.Extras, meta.flag)
+	binary.BigEndian.PutUint32(req.Extras[4:], meta.exp)
+	binary.BigEndian.PutUint64(req.Extras[8:], meta.getRevSeq())
+	binary.BigEndian.PutUint64(req.Extras[16:], meta.cas)
+
+	res := vb.Dispatch(nil, req)
+	switch {
+	case res.Status == gomemcached.SUCCESS:
+		// The doc keeps its rev, even if it got a new local cas.
+	case res.Status == gomemcached.KEY_ENOENT && doc.Meta.Deleted:
+		// Already deleted.
+	default:
+		_, e, reason := couchDbStatusError(res)
+		return fail(e, reason)
+	}
+	result["rev"] = couchDbRev(meta)
+	return result
 }
 
 func couchDbEnsureFullCommit(w http.ResponseWriter, r *http.Request) {
@@ -340,22 +438,324 @@ func couchDbGetDoc(w http.ResponseWriter, r *http.Request) {
 	if bucket == nil || docId == "" {
 		return
 	}
-	res := GetItem(bucket, []byte(docId), VBActive)
-	if res == nil || res.Status != gomemcached.SUCCESS {
+	vb, _ := GetVBucket(bucket, []byte(docId), VBActive)
+	if vb == nil {
 		http.Error(w, `{"error": "not_found", "reason": "missing"}`, 404)
 		return
 	}
+	res, i := vbGetItem(vb, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: vb.vbid,
+		Key:     []byte(docId),
+	})
+	if i == nil {
+		couchDbMutationError(w, res)
+		return
+	}
 	// TODO: Content Type, Accepts, much to leverage from sync_gateway.
 	// w.Header().Add("X-Couchbase-Meta", walrus.MakeMeta(docId))
+	w.Header().Set("ETag", `"`+couchDbRev(i)+`"`)
 	w.Write(res.Body)
 }
 
+// Returns the full id of a _local doc, which XDCR may give as
+// docId/source/destination.
+func couchDbLocalDocId(vars map[string]string) string {
+	docId := vars["docId"]
+	if source, ok := vars["source"]; ok {
+		docId = docId + "/" + source + "/" + vars["destination"]
+	}
+	return docId
+}
+
+func couchDbGetLocalDoc(w http.ResponseWriter, r *http.Request) {
+	vars, _, bucket, docId := checkDocId(w, r)
+	if bucket == nil || docId == "" {
+		return
+	}
+	body, err := bucket.GetLocalDoc(vars["vbucket"], couchDbLocalDocId(vars))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "unknown_error", "reason": %q}`,
+			err.Error()), 500)
+		return
+	}
+	if body == nil {
+		http.Error(w, `{"error": "not_found", "reason": "missing"}`, 404)
+		return
+	}
+	w.Write(body)
+}
+
+// Stores a _local doc, such as an XDCR checkpoint.  Local docs have
+// no revs, so the last write wins.
+func couchDbPutLocalDoc(w http.ResponseWriter, r *http.Request) {
+	vars, _, bucket, docId := checkDocId(w, r)
+	if bucket == nil || docId == "" {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	var into map[string]interface{}
+	if err = jsonUnmarshal(body, &into); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	localDocId := couchDbLocalDocId(vars)
+	if err = bucket.SetLocalDoc(vars["vbucket"], localDocId, body); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "unknown_error", "reason": %q}`,
+			err.Error()), 500)
+		return
+	}
+	w.WriteHeader(201)
+	mustEncode(w, map[string]interface{}{
+		"ok": true, "id": "_local/" + localDocId, "rev": "0-1",
+	})
+}
+
+// Stores a doc.  Without a rev (via If-Match header or rev param) the
+// doc must not already exist; with a rev, it must match the doc's
+// current rev.  Flags and expiry may be given as params or as
+// X-Couchbase-Flags and X-Couchbase-Expiry headers.
 func couchDbPutDoc(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "unimplemented", 501)
+	_, _, bucket, docId := checkDocId(w, r)
+	if bucket == nil || docId == "" {
+		return
+	}
+	rev, err := couchDbReqRev(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	flags, err := couchDbReqUint32(r, "flags", "X-Couchbase-Flags")
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	exp, err := couchDbReqUint32(r, "expiry", "X-Couchbase-Expiry")
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	vb, _ := GetVBucket(bucket, []byte(docId), VBActive)
+	if vb == nil {
+		http.Error(w, `{"error": "not_found", "reason": "not_my_vbucket"}`, 404)
+		return
+	}
+	cas := couchDbRevCas(vb, []byte(docId), rev)
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.ADD,
+		VBucket: vb.vbid,
+		Key:     []byte(docId),
+		Cas:     cas,
+		Extras:  make([]byte, 8),
+		Body:    body,
+	}
+	if cas != 0 {
+		req.Opcode = gomemcached.SET
+	}
+	binary.BigEndian.PutUint32(req.Extras, flags)
+	binary.BigEndian.PutUint32(req.Extras[4:], exp)
+	res, itemNew := vbMutateItem(vb, nil, req)
+	if itemNew == nil {
+		couchDbMutationError(w, res)
+		return
+	}
+	newRev := couchDbRev(itemNew)
+	w.Header().Set("ETag", `"`+newRev+`"`)
+	w.WriteHeader(201)
+	mustEncode(w, map[string]interface{}{"ok": true, "id": docId, "rev": newRev})
 }
 
+// Deletes a doc, whose current rev must be given via If-Match header
+// or rev param.
 func couchDbDelDoc(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "unimplemented", 501)
+	_, _, bucket, docId := checkDocId(w, r)
+	if bucket == nil || docId == "" {
+		return
+	}
+	rev, err := couchDbReqRev(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "bad_request", "reason": %q}`,
+			err.Error()), 400)
+		return
+	}
+	vb, _ := GetVBucket(bucket, []byte(docId), VBActive)
+	if vb == nil {
+		http.Error(w, `{"error": "not_found", "reason": "not_my_vbucket"}`, 404)
+		return
+	}
+	if rev == nil {
+		// Like couchdb, a delete without a rev is a conflict,
+		// unless there's nothing to delete.
+		res := vb.get([]byte(docId))
+		if res.Status == gomemcached.SUCCESS {
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+		}
+		couchDbMutationError(w, res)
+		return
+	}
+	res, prevItem := vbDeleteItem(vb, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: vb.vbid,
+		Key:     []byte(docId),
+		Cas:     couchDbRevCas(vb, []byte(docId), rev),
+	})
+	if prevItem == nil {
+		couchDbMutationError(w, res)
+		return
+	}
+	newRev := couchDbRev(&item{cas: res.Cas, revSeq: prevItem.nextRevSeq()})
+	w.Header().Set("ETag", `"`+newRev+`"`)
+	mustEncode(w, map[string]interface{}{"ok": true, "id": docId, "rev": newRev})
+}
+
+// Revs are formatted like XDCR's: the revSeq, followed by the hex
+// of the cas, exp and flags.
+func couchDbRev(i *item) string {
+	return fmt.Sprintf("%d-%016x%08x%08x", i.getRevSeq(), i.getRevCas(),
+		i.exp, i.flag)
+}
+
+// Like couchDbRev, but a deletion's rev has just its revSeq and cas,
+// as its exp and flags are sentinels.
+func couchDbItemRev(i *item) string {
+	if i.isDeletion() {
+		return couchDbRev(&item{cas: i.getRevCas(), revSeq: i.revSeq})
+	}
+	return couchDbRev(i)
+}
+
+// Parses a rev into an item holding just the rev's metadata.  The
+// exp and flags are optional.
+func parseCouchDbRev(rev string) (*item, error) {
+	parts := strings.SplitN(rev, "-", 2)
+	if len(parts) != 2 || (len(parts[1]) != 16 && len(parts[1]) != 32) {
+		return nil, fmt.Errorf("invalid rev: %v", rev)
+	}
+	revSeq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rev: %v", rev)
+	}
+	i := &item{revSeq: revSeq}
+	if i.cas, err = strconv.ParseUint(parts[1][:16], 16, 64); err != nil {
+		return nil, fmt.Errorf("invalid rev: %v", rev)
+	}
+	if len(parts[1]) > 16 {
+		exp, err := strconv.ParseUint(parts[1][16:24], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rev: %v", rev)
+		}
+		flag, err := strconv.ParseUint(parts[1][24:], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rev: %v", rev)
+		}
+		i.exp, i.flag = uint32(exp), uint32(flag)
+	}
+	return i, nil
+}
+
+// Returns the rev of the request's If-Match header or rev param, or
+// nil if the request has neither.
+func couchDbReqRev(r *http.Request) (*item, error) {
+	rev := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if rev == "" {
+		rev = r.URL.Query().Get("rev")
+	}
+	if rev == "" {
+		return nil, nil
+	}
+	i, err := parseCouchDbRev(rev)
+	if err != nil {
+		return nil, err
+	}
+	if i.cas == 0 {
+		return nil, fmt.Errorf("invalid rev: %v", rev)
+	}
+	return i, nil
+}
+
+// Returns the cas to use to change a doc given its rev, which may be
+// nil, meaning 0.  A doc changed elsewhere has a rev whose cas isn't
+// the doc's local cas, so a rev that matches the doc's current rev
+// maps to the local cas, and any other rev maps to a cas that
+// mismatches.
+func couchDbRevCas(vb *VBucket, key []byte, rev *item) uint64 {
+	if rev == nil {
+		return 0
+	}
+	cur, err := vb.getUnexpired(key, time.Now())
+	if err != nil || cur == nil ||
+		cur.getRevSeq() != rev.getRevSeq() || cur.getRevCas() != rev.cas {
+		return math.MaxUint64
+	}
+	return cur.cas
+}
+
+func couchDbReqUint32(r *http.Request, param, header string) (uint32, error) {
+	s := r.URL.Query().Get(param)
+	if s == "" {
+		s = r.Header.Get(header)
+	}
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v: %v", param, s)
+	}
+	return uint32(v), nil
+}
+
+func couchDbMutationError(w http.ResponseWriter, res *gomemcached.MCResponse) {
+	code, e, reason := couchDbStatusError(res)
+	http.Error(w, fmt.Sprintf(`{"error": %q, "reason": %q}`, e, reason), code)
+}
+
+// Maps a failed memcached response to an http status code and a
+// couchdb style error and reason.
+func couchDbStatusError(res *gomemcached.MCResponse) (int, string, string) {
+	switch res.Status {
+	case gomemcached.KEY_EEXISTS:
+		return 409, "conflict", "Document update conflict."
+	case gomemcached.KEY_ENOENT:
+		return 404, "not_found", "missing"
+	case LOCKED:
+		return 423, "locked", "Document is locked."
+	case gomemcached.E2BIG:
+		return 413, "too_large", string(res.Body)
+	case gomemcached.EINVAL:
+		return 400, "bad_request", string(res.Body)
+	case gomemcached.TMPFAIL:
+		return 503, "temporary_failure", string(res.Body)
+	}
+	return 500, "unknown_error", string(res.Body)
+}
+
+// Returns the permission a couch API request needs on its db.
+func couchDbPerm(r *http.Request) userPerm {
+	switch {
+	case strings.Contains(r.URL.Path, "/_view/"):
+		return PERM_VIEWS
+	case r.Method == "GET" || r.Method == "HEAD":
+		return PERM_READ
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_all_docs"):
+		return PERM_READ // A POST of keys only reads.
+	}
+	return PERM_WRITE
 }
 
 func checkDb(w http.ResponseWriter, r *http.Request) (
@@ -368,7 +768,7 @@ func checkDb(w http.ResponseWriter, r *http.Request) (
 		return vars, "", nil
 	}
 
-	if !currentUser(r).canAccess(bucketName) {
+	if !currentUser(r).can(bucketName, couchDbPerm(r)) {
 		http.Error(w, "Access denied", 403)
 		return vars, "", nil
 	}
@@ -427,66 +827,299 @@ func checkDocId(w http.ResponseWriter, r *http.Request) (
 	return vars, bucketName, bucket, docId
 }
 
+// Lists a bucket's docs, by merging the docs of its active vbuckets
+// in doc id order, with the startkey, endkey, inclusive_end, key,
+// descending, skip, limit and include_docs params...
+//    curl http://127.0.0.1:8092/default/_all_docs?startkey="a"&limit=10
+// Or, lists the docs with the given keys, in their given order...
+//    curl -X POST http://127.0.0.1:8092/default/_all_docs \
+//         -d '{"keys": ["a", "b"]}'
 func couchDbAllDocs(w http.ResponseWriter, r *http.Request) {
 	_, _, bucket := checkDb(w, r)
 	if bucket == nil {
 		return
 	}
-	_, err := ParseViewParams(r) // TODO: Handle params.
+	p, err := ParseViewParams(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("param parsing err: %v", err), 400)
+		return
+	}
+	keys, err := couchDbAllDocsKeys(r, p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("keys parsing err: %v", err), 400)
+		return
+	}
+	ap, err := newAllDocsParams(p)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("param parsing err: %v", err), 400)
 		return
 	}
-	in, out := MakeViewRowMerger(bucket)
-	for vbid := 0; vbid < len(in); vbid++ {
+
+	np := bucket.GetBucketSettings().NumPartitions
+	vbs := make([]*VBucket, np)
+	totalRows := uint64(0)
+	for vbid := range vbs {
 		vb, _ := bucket.GetVBucket(uint16(vbid))
-		go visitVBucketAllDocs(vb, in[vbid])
-	}
-	w.Write([]byte(`{"rows":[`))
-	i := 0
-	for vr := range out {
-		j, err := json.Marshal(vr)
-		if err == nil {
-			if i > 0 {
-				w.Write([]byte(",\n"))
+		if vb != nil && vb.GetVBState() == VBActive {
+			numItems, _, err := vb.ps.getTotals()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("totals err: %v", err), 500)
+				return
 			}
-			_, err = w.Write(j)
-			if err == nil {
-				i++
+			totalRows += numItems
+			vbs[vbid] = vb
+		}
+	}
+
+	var out chan *ViewRow
+	if keys != nil {
+		out = make(chan *ViewRow)
+		go visitAllDocsKeys(bucket, keys, ap, out)
+	} else {
+		var in []chan *ViewRow
+		in, out = MakeAllDocsMerger(np, ap.descending)
+		for vbid := range in {
+			go visitVBucketAllDocs(vbs[vbid], ap, in[vbid])
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(fmt.Sprintf(`{"total_rows":%v,"offset":%v,"rows":[`,
+		totalRows, p.Skip)))
+	seen, written := uint64(0), uint64(0)
+	for vr := range out { // Drained to the end, so the visitors finish.
+		seen++
+		if err != nil || seen <= p.Skip || (p.Limit > 0 && written >= p.Limit) {
+			continue
+		}
+		j, jerr := json.Marshal(vr)
+		if jerr != nil {
+			log.Printf("_all_docs marshal err: %v", jerr)
+			continue
+		}
+		if written > 0 {
+			w.Write([]byte(",\n"))
+		}
+		_, err = w.Write(j)
+		written++
+	}
+	if err == nil {
+		w.Write([]byte("\n]}\n"))
+	}
+}
+
+// The doc id range and options of an _all_docs request.
+type allDocsParams struct {
+	startKey     []byte // A nil means unbounded.
+	endKey       []byte // A nil means unbounded.
+	inclusiveEnd bool
+	descending   bool
+	includeDocs  bool
+	max          uint64 // The most rows needed from each vbucket, or 0.
+}
+
+func newAllDocsParams(p *ViewParams) (*allDocsParams, error) {
+	ap := &allDocsParams{
+		inclusiveEnd: p.InclusiveEnd,
+		descending:   p.Descending,
+		includeDocs:  p.IncludeDocs,
+	}
+	if p.Limit > 0 {
+		ap.max = p.Skip + p.Limit
+	}
+	startKey, endKey := p.StartKey, p.EndKey
+	if p.Key != nil {
+		startKey, endKey, ap.inclusiveEnd = p.Key, p.Key, true
+	}
+	for _, k := range []struct {
+		name string
+		val  interface{}
+		dest *[]byte
+	}{
+		{"startkey", startKey, &ap.startKey},
+		{"endkey", endKey, &ap.endKey},
+	} {
+		if k.val == nil {
+			continue
+		}
+		s, ok := k.val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a string", k.name)
+		}
+		*k.dest = []byte(s)
+	}
+	return ap, nil
+}
+
+func (ap *allDocsParams) pastEnd(key []byte) bool {
+	if ap.endKey == nil {
+		return false
+	}
+	c := bytes.Compare(key, ap.endKey)
+	if ap.descending {
+		c = -c
+	}
+	return c > 0 || (c == 0 && !ap.inclusiveEnd)
+}
+
+// Returns the keys of a POST'ed body or of the keys param, or nil.
+func couchDbAllDocsKeys(r *http.Request, p *ViewParams) (
+	[]interface{}, error) {
+	if r.Method == "POST" {
+		body := struct {
+			Keys []interface{} `json:"keys"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if body.Keys == nil {
+			return nil, fmt.Errorf("missing keys")
+		}
+		return body.Keys, nil
+	}
+	if p.Keys == "" {
+		return nil, nil
+	}
+	keys := []interface{}{}
+	if err := jsonUnmarshal([]byte(p.Keys), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func newAllDocsRow(i *item, includeDocs bool) *ViewRow {
+	docId, rev := string(i.key), couchDbItemRev(i)
+	row := &ViewRow{
+		Id:    docId,
+		Key:   docId,
+		Value: map[string]interface{}{"rev": rev},
+	}
+	if includeDocs {
+		row.Doc = couchDbDocValue(docId, rev, i.data)
+	}
+	return row
+}
+
+// Merges rows from each vbucket, which are in doc id order, into one
+// stream in doc id order (or descending).  Unlike MergeViewRows, the
+// doc ids are compared as bytes, as they're ordered in the vbuckets.
+func MakeAllDocsMerger(np int, descending bool) (
+	[]chan *ViewRow, chan *ViewRow) {
+	out := make(chan *ViewRow)
+	if np == 1 {
+		return []chan *ViewRow{out}, out
+	}
+	in := make([]chan *ViewRow, np)
+	for vbid := 0; vbid < np; vbid++ {
+		in[vbid] = make(chan *ViewRow)
+	}
+	go MergeAllDocsRows(in, out, descending)
+	return in, out
+}
+
+func MergeAllDocsRows(inSorted []chan *ViewRow, out chan *ViewRow,
+	descending bool) {
+	defer close(out)
+
+	arr := make([]*ViewRow, len(inSorted)) // A nil means an input is done.
+	for i, in := range inSorted {
+		arr[i] = <-in
+	}
+	for {
+		ileast := -1
+		for i, v := range arr {
+			if v != nil &&
+				(ileast < 0 || (v.Id < arr[ileast].Id) != descending) {
+				ileast = i
 			}
-		} // TODO: else, json marshalling and Write error handling.
+		}
+		if ileast < 0 {
+			return
+		}
+		out <- arr[ileast]
+		arr[ileast] = <-inSorted[ileast]
+	}
+}
+
+func visitAllDocsKeys(bucket Bucket, keys []interface{},
+	ap *allDocsParams, ch chan *ViewRow) {
+	defer close(ch)
+
+	now := time.Now()
+	for j := range keys {
+		key := keys[j]
+		if ap.descending {
+			key = keys[len(keys)-1-j]
+		}
+		docId, ok := key.(string)
+		if !ok {
+			ch <- &ViewRow{Key: key, Error: "not_found"}
+			continue
+		}
+		var i *item
+		vb, _ := GetVBucket(bucket, []byte(docId), VBActive)
+		if vb != nil {
+			i, _ = vb.ps.get([]byte(docId))
+		}
+		if i == nil || i.isExpired(now) {
+			ch <- &ViewRow{Key: docId, Error: "not_found"}
+			continue
+		}
+		ch <- newAllDocsRow(i, ap.includeDocs)
+	}
+}
+
+// Returns a doc in the meta and json form of include_docs, where a
+// doc that's not JSON is base64 encoded.
+func couchDbDocValue(docId, rev string, data []byte) *ViewDocValue {
+	docType := "json"
+	var doc interface{}
+	if err := jsonUnmarshal(data, &doc); err != nil {
+		doc = base64.StdEncoding.EncodeToString(data)
+		docType = "base64"
+	}
+	return &ViewDocValue{
+		Meta: map[string]interface{}{
+			"id":   docId,
+			"rev":  rev,
+			"type": docType,
+		},
+		Json: doc,
 	}
-	w.Write([]byte(fmt.Sprintf(`],"total_rows":%v}`, i)))
 }
 
-func visitVBucketAllDocs(vb *VBucket, ch chan *ViewRow) {
+func visitVBucketAllDocs(vb *VBucket, ap *allDocsParams, ch chan *ViewRow) {
 	defer close(ch)
 
 	if vb == nil {
 		return
 	}
-	vb.Visit(nil, func(key []byte, data []byte) bool {
-		docId := string(key)
-		docType := "json"
-		var doc interface{}
-		err := jsonUnmarshal(data, &doc)
-		if err != nil {
-			doc = base64.StdEncoding.EncodeToString(data)
-			docType = "base64"
-		}
-		// TODO: The couchdb spec emits Value instead of Doc.
-		ch <- &ViewRow{
-			Id:  docId,
-			Key: docId,
-			Doc: &ViewDocValue{
-				Meta: map[string]interface{}{
-					"id":   docId,
-					"type": docType,
-					// TODO: rev.
-				},
-				Json: doc,
-			},
-		}
-		return true
-	})
+	now := time.Now()
+	n := uint64(0)
+	visitor := func(i *item) bool {
+		if ap.pastEnd(i.key) {
+			return false
+		}
+		if i.isExpired(now) {
+			return true
+		}
+		ch <- newAllDocsRow(i, ap.includeDocs)
+		n++
+		return ap.max <= 0 || n < ap.max
+	}
+	// A row's rev needs the item's metadata, which is stored with its
+	// value, so the values are visited even without include_docs.
+	var err error
+	if ap.descending {
+		var end []byte // Visits the keys before end, so startkey is included.
+		if ap.startKey != nil {
+			end = append(append([]byte(nil), ap.startKey...), 0)
+		}
+		err = vb.ps.visitItemsDescend(end, true, visitor)
+	} else {
+		err = vb.ps.visitItems(ap.startKey, true, visitor)
+	}
+	if err != nil {
+		log.Printf("_all_docs visit err: %v, vbucket: %v", err, vb.vbid)
+	}
 }
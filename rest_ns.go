@@ -280,11 +280,6 @@ func restNSLocalRandomKey(w http.ResponseWriter, r *http.Request) {
 
 func restNSAPI(r *mux.Router) {
 	ns_server_paths := []string{
-		"/pools/default/buckets/{bucketname}/statsDirectory",
-		"/pools/default/buckets/{bucketname}/stats",
-		"/pools/default/buckets/{bucketname}/nodes",
-		"/pools/default/buckets/{bucketname}/nodes/{node}/stats",
-		"/pools/default/stats",
 		"/poolsStreaming",
 	}
 
@@ -298,25 +293,37 @@ func restNSAPI(r *mux.Router) {
 	r.HandleFunc("/pools/default", restNSPoolsDefault)
 
 	r.HandleFunc("/pools/default/buckets/{bucketname}",
-		withBucketAccess(restNSBucket))
+		withBucketAccess(PERM_READ, restNSBucket))
 	r.HandleFunc("/pools/default/bucketsStreaming/{bucketname}",
-		withBucketAccess(restNSStreaming(restNSBucket)))
+		withBucketAccess(PERM_READ, restNSStreaming(restNSBucket)))
 	r.HandleFunc("/pools/default/buckets", restNSBucketList)
+	r.HandleFunc("/pools/default/buckets/{bucketname}/stats",
+		withBucketAccess(PERM_READ, restNSBucketStats))
+	r.HandleFunc("/pools/default/buckets/{bucketname}/stats/{statName}",
+		withBucketAccess(PERM_READ, restNSBucketStat))
+	r.HandleFunc("/pools/default/buckets/{bucketname}/statsDirectory",
+		withBucketAccess(PERM_READ, restNSBucketStatsDirectory))
+	r.HandleFunc("/pools/default/buckets/{bucketname}/nodes",
+		withBucketAccess(PERM_READ, restNSBucketNodes))
+	r.HandleFunc("/pools/default/buckets/{bucketname}/nodes/{node}/stats",
+		withBucketAccess(PERM_READ, restNSBucketStats))
+	r.HandleFunc("/pools/default/stats", restNSPoolsDefaultStats)
 	r.HandleFunc("/pools/default/buckets/{bucketname}/ddocs",
-		withBucketAccess(restNSBucketDDocs))
+		withBucketAccess(PERM_READ, restNSBucketDDocs))
 	r.HandleFunc("/pools/default/buckets/{bucketname}/localRandomKey",
-		withBucketAccess(restNSLocalRandomKey))
+		withBucketAccess(PERM_READ, restNSLocalRandomKey))
 	r.HandleFunc("/poolsStreaming/default",
 		restNSStreaming(restNSPoolsDefault))
 	r.HandleFunc("/poolsStreaming/default/buckets/{bucketname}",
-		withBucketAccess(restNSStreaming(restNSBucket)))
+		withBucketAccess(PERM_READ, restNSStreaming(restNSBucket)))
 
 	r.HandleFunc("/pools/default/tasks",
 		restNSPoolsDefaultTasks)
 	r.HandleFunc("/settings/stats", restNSSettingsStats)
 }
 
-func restNSServe(restNS string, staticPath string, staticCachePath string) {
+func restNSServe(restNS string, restNSTLS string,
+	staticPath string, staticCachePath string) {
 	r := mux.NewRouter()
 	err := initStatic(r, "/_static/", staticPath, staticCachePath)
 	must(err)
@@ -325,5 +332,5 @@ func restNSServe(restNS string, staticPath string, staticCachePath string) {
 	cbr := r.PathPrefix("/couchBase/").Subrouter()
 	restCouchAPI(cbr)
 	r.Handle("/", http.RedirectHandler("/_static/app.html", 302))
-	log.Fatal(http.ListenAndServe(restNS, authenticationFilter{r}))
+	log.Fatal(serveHTTP(restNS, restNSTLS, authenticationFilter{r}))
 }
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The ns_server stats zoom levels, each served from an AggStats level
+// whose samples are interval milliseconds apart.
+var nsStatsZooms = map[string]struct {
+	level    string
+	interval int64
+}{
+	"minute": {"second", 1000},
+	"hour":   {"minute", 60 * 1000},
+	"day":    {"hour", 60 * 60 * 1000},
+}
+
+const (
+	nsStatRate  = iota // Per second, from the diffs.
+	nsStatGauge        // From the totals as of each sample.
+	nsStatRatio        // A percentage, from the diffs.
+)
+
+type nsStat struct {
+	name  string
+	kind  int
+	block string
+	title string
+	desc  string
+	val   func(s *BucketStats, ss *BucketStoreStats) float64
+}
+
+func ratio(n, d int64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(d)
+}
+
+var nsStats = []nsStat{
+	{"ops", nsStatRate, "Summary", "ops per second",
+		"Total amount of operations per second to this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Ops)
+		}},
+	{"cmd_get", nsStatRate, "Summary", "gets per sec.",
+		"Number of reads (get operations) per second from this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Gets)
+		}},
+	{"get_hits", nsStatRate, "Summary", "get hits per sec.",
+		"Number of get operations per second for keys that exist",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Gets - s.GetMisses)
+		}},
+	{"get_misses", nsStatRate, "Summary", "get misses per sec.",
+		"Number of get operations per second for keys that do not exist",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.GetMisses)
+		}},
+	{"hit_ratio", nsStatRatio, "Summary", "Gets hit ratio %",
+		"Percentage of get requests served with data from this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return ratio(s.Gets-s.GetMisses, s.Gets)
+		}},
+	{"cmd_set", nsStatRate, "Summary", "sets per sec.",
+		"Number of writes (set operations) per second to this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Sets + s.Adds + s.Replaces + s.Appends + s.Prepends)
+		}},
+	{"delete_hits", nsStatRate, "Summary", "deletes per sec.",
+		"Number of delete operations per second for this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Deletes)
+		}},
+	{"incr_hits", nsStatRate, "Summary", "incr hits per sec.",
+		"Number of increment operations per second for this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Incrs)
+		}},
+	{"decr_hits", nsStatRate, "Summary", "decr hits per sec.",
+		"Number of decrement operations per second for this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Decrs)
+		}},
+	{"ep_ops_create", nsStatRate, "Summary", "new items per sec.",
+		"Number of new items created per second in this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Creates)
+		}},
+	{"ep_ops_update", nsStatRate, "Summary", "updates per sec.",
+		"Number of existing items updated per second in this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Updates)
+		}},
+	{"bytes_read", nsStatRate, "Summary", "bytes read per sec.",
+		"Number of value bytes per second written by clients to this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.IncomingValueBytes)
+		}},
+	{"bytes_written", nsStatRate, "Summary", "bytes written per sec.",
+		"Number of value bytes per second read by clients from this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.OutgoingValueBytes)
+		}},
+	{"curr_items", nsStatGauge, "Summary", "items",
+		"Number of unique items in this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Items)
+		}},
+	{"ep_kv_size", nsStatGauge, "Summary", "memory used",
+		"Estimated bytes of the items in this bucket",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.ItemBytes)
+		}},
+	{"evictions", nsStatRate, "Summary", "evictions per sec.",
+		"Number of items per second evicted from memory",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(s.Evictions)
+		}},
+	{"ep_bg_fetched", nsStatRate, "Disk", "disk reads per sec.",
+		"Number of evicted items per second read back from disk",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(ss.BgFetches)
+		}},
+	{"ep_cache_miss_rate", nsStatRatio, "Disk", "cache miss ratio",
+		"Percentage of reads per second to this bucket from disk",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return ratio(ss.BgFetches, s.Gets)
+		}},
+	{"disk_commit_count", nsStatRate, "Disk", "disk commits per sec.",
+		"Number of flushes per second of this bucket's store files",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(ss.Flushes)
+		}},
+	{"ep_diskqueue_drain", nsStatRate, "Disk", "drain rate",
+		"Number of items per second written to disk",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(ss.Writes)
+		}},
+	{"ep_item_commit_failed", nsStatRate, "Disk", "commit failures per sec.",
+		"Number of failed flushes and writes per second to disk",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(ss.FlushErrors + ss.WriteErrors)
+		}},
+	{"couch_docs_actual_disk_size", nsStatGauge, "Disk", "disk size",
+		"Size of this bucket's store files on disk",
+		func(s *BucketStats, ss *BucketStoreStats) float64 {
+			return float64(ss.FileSize)
+		}},
+}
+
+// The samples of a zoom level, oldest first, along with the totals
+// as of the newest sample.
+type nsRawStats struct {
+	diffs      []*BucketStats
+	storeDiffs []*BucketStoreStats
+	cur        BucketStats
+	curStore   BucketStoreStats
+	last       time.Time
+}
+
+func getNSRawStats(bucket Bucket, level string) *nsRawStats {
+	return nsRawStatsOf(snapshotBucketStats(bucket).(*BucketStatsSnapshot),
+		level)
+}
+
+func nsRawStatsOf(st *BucketStatsSnapshot, level string) *nsRawStats {
+	rv := &nsRawStats{last: st.LatestUpdate}
+	rv.cur.Add(st.CurBucket)
+	rv.curStore.Add(st.CurBucketStore)
+	for i, l := range AggStatsLevels {
+		if l.Name != level {
+			continue
+		}
+		for _, s := range st.AggBucket.Levels[i].Samples() {
+			rv.diffs = append(rv.diffs, s.(*BucketStats))
+		}
+		for _, s := range st.AggBucketStore.Levels[i].Samples() {
+			rv.storeDiffs = append(rv.storeDiffs, s.(*BucketStoreStats))
+		}
+	}
+	return rv
+}
+
+// Adds another bucket's samples, aligned by their newest samples.
+func (r *nsRawStats) add(in *nsRawStats) {
+	r.cur.Add(&in.cur)
+	r.curStore.Add(&in.curStore)
+	if in.last.After(r.last) {
+		r.last = in.last
+	}
+	for len(r.diffs) < len(in.diffs) {
+		r.diffs = append([]*BucketStats{{}}, r.diffs...)
+	}
+	for len(r.storeDiffs) < len(in.storeDiffs) {
+		r.storeDiffs = append([]*BucketStoreStats{{}}, r.storeDiffs...)
+	}
+	for i, j := len(r.diffs)-1, len(in.diffs)-1; j >= 0; i, j = i-1, j-1 {
+		d := &BucketStats{}
+		d.Add(r.diffs[i])
+		d.Add(in.diffs[j])
+		r.diffs[i] = d
+	}
+	for i, j := len(r.storeDiffs)-1, len(in.storeDiffs)-1; j >= 0; i, j = i-1, j-1 {
+		d := &BucketStoreStats{}
+		d.Add(r.storeDiffs[i])
+		d.Add(in.storeDiffs[j])
+		r.storeDiffs[i] = d
+	}
+}
+
+// Returns the ns_server "op" object, with samples newer than
+// haveTStamp (in milliseconds).
+func (r *nsRawStats) op(interval int64, haveTStamp int64) map[string]interface{} {
+	n := len(r.diffs)
+	if len(r.storeDiffs) < n {
+		n = len(r.storeDiffs)
+	}
+	diffs := r.diffs[len(r.diffs)-n:]
+	storeDiffs := r.storeDiffs[len(r.storeDiffs)-n:]
+
+	// Work back from the current totals to the totals at each sample.
+	totals := make([]*BucketStats, n)
+	storeTotals := make([]*BucketStoreStats, n)
+	t, st := &BucketStats{}, &BucketStoreStats{}
+	t.Add(&r.cur)
+	st.Add(&r.curStore)
+	for i := n - 1; i >= 0; i-- {
+		totals[i], storeTotals[i] = t, st
+		t, st = &BucketStats{}, &BucketStoreStats{}
+		t.Add(totals[i])
+		t.Sub(diffs[i])
+		st.Add(storeTotals[i])
+		st.Sub(storeDiffs[i])
+	}
+
+	lastTStamp := r.last.UnixNano() / int64(time.Millisecond)
+	timestamps := []int64{}
+	samples := map[string][]float64{}
+	for i := 0; i < n; i++ {
+		ts := lastTStamp - int64(n-1-i)*interval
+		if ts <= haveTStamp {
+			continue
+		}
+		timestamps = append(timestamps, ts)
+		for _, s := range nsStats {
+			var v float64
+			switch s.kind {
+			case nsStatRate:
+				v = s.val(diffs[i], storeDiffs[i]) * 1000 / float64(interval)
+			case nsStatGauge:
+				v = s.val(totals[i], storeTotals[i])
+			case nsStatRatio:
+				v = s.val(diffs[i], storeDiffs[i])
+			}
+			samples[s.name] = append(samples[s.name], v)
+		}
+	}
+
+	rv := map[string]interface{}{
+		"samplesCount": len(timestamps),
+		"isPersistent": true,
+		"lastTStamp":   lastTStamp,
+		"interval":     interval,
+		"timestamp":    timestamps,
+	}
+	sm := map[string]interface{}{"timestamp": timestamps}
+	for k, v := range samples {
+		sm[k] = v
+	}
+	rv["samples"] = sm
+	return rv
+}
+
+// Parses the zoom and haveTStamp params, writing an error on failure.
+func parseNSStatsParams(w http.ResponseWriter, r *http.Request) (
+	level string, interval int64, haveTStamp int64, ok bool) {
+	zoom := r.FormValue("zoom")
+	if zoom == "" {
+		zoom = "minute"
+	}
+	z, ok := nsStatsZooms[zoom]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported zoom: %v", zoom), 400)
+		return "", 0, 0, false
+	}
+	haveTStamp = getIntValue(r.Form, "haveTStamp", 0)
+	return z.level, z.interval, haveTStamp, true
+}
+
+func restNSBucketStats(w http.ResponseWriter, r *http.Request) {
+	_, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	level, interval, haveTStamp, ok := parseNSStatsParams(w, r)
+	if !ok {
+		return
+	}
+	op := getNSRawStats(bucket, level).op(interval, haveTStamp)
+	delete(op, "timestamp")
+	mustEncode(w, map[string]interface{}{
+		"op":       op,
+		"hot_keys": []interface{}{},
+	})
+}
+
+// A single stat, keyed by node as ns_server does.
+func restNSBucketStat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	_, bucket := parseBucketName(w, vars)
+	if bucket == nil {
+		return
+	}
+	level, interval, haveTStamp, ok := parseNSStatsParams(w, r)
+	if !ok {
+		return
+	}
+	statName := vars["statName"]
+	if _, ok = nsStatsByName()[statName]; !ok {
+		http.Error(w, "no stat with that statName", 404)
+		return
+	}
+	op := getNSRawStats(bucket, level).op(interval, haveTStamp)
+	stat, ok := op["samples"].(map[string]interface{})[statName]
+	if !ok {
+		stat = []float64{}
+	}
+	delete(op, "samples")
+	op["nodeStats"] = map[string]interface{}{r.Host: stat}
+	mustEncode(w, op)
+}
+
+func nsStatsByName() map[string]nsStat {
+	rv := map[string]nsStat{}
+	for _, s := range nsStats {
+		rv[s.name] = s
+	}
+	return rv
+}
+
+func restNSBucketStatsDirectory(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	blocks := []map[string]interface{}{}
+	byName := map[string]map[string]interface{}{}
+	for _, s := range nsStats {
+		block := byName[s.block]
+		if block == nil {
+			block = map[string]interface{}{
+				"blockName": s.block,
+				"stats":     []map[string]interface{}{},
+			}
+			byName[s.block] = block
+			blocks = append(blocks, block)
+		}
+		stat := map[string]interface{}{
+			"name":  s.name,
+			"title": s.title,
+			"desc":  s.desc,
+			"specificStatsURL": "/pools/default/buckets/" + bucketName +
+				"/stats/" + s.name,
+		}
+		if s.kind == nsStatRatio {
+			stat["maxY"] = 100
+		}
+		block["stats"] = append(block["stats"].([]map[string]interface{}), stat)
+	}
+	mustEncode(w, map[string]interface{}{"blocks": blocks})
+}
+
+func restNSBucketNodes(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	uri := "/pools/default/buckets/" + bucketName + "/nodes/" +
+		url.QueryEscape(r.Host)
+	mustEncode(w, map[string]interface{}{
+		"servers": []interface{}{
+			map[string]interface{}{
+				"hostname": r.Host,
+				"uri":      uri,
+				"stats":    map[string]interface{}{"uri": uri + "/stats"},
+			},
+		},
+	})
+}
+
+// Aggregates the stats of all buckets the user can access.
+func restNSPoolsDefaultStats(w http.ResponseWriter, r *http.Request) {
+	level, interval, haveTStamp, ok := parseNSStatsParams(w, r)
+	if !ok {
+		return
+	}
+	// Only open buckets are polled, so quiesced buckets stay closed,
+	// and any quiesced stats are started together, so there's just
+	// one catch up delay.
+	u := currentUser(r)
+	bs := []Bucket{}
+	started := false
+	for _, bn := range buckets.GetNames() {
+		if !u.canAccess(bn) {
+			continue
+		}
+		if b := buckets.GetOpen(bn); b != nil {
+			st := b.SnapshotStats()
+			if time.Since(st.LatestUpdateTime()) > statsSnapshotStart {
+				b.StartStats(time.Second)
+				started = true
+			}
+			bs = append(bs, b)
+		}
+	}
+	if started {
+		time.Sleep(statsSnapshotDelay)
+	}
+	agg := &nsRawStats{}
+	for _, b := range bs {
+		agg.add(nsRawStatsOf(b.SnapshotStats().(*BucketStatsSnapshot), level))
+	}
+	op := agg.op(interval, haveTStamp)
+	delete(op, "timestamp")
+	mustEncode(w, map[string]interface{}{
+		"op":       op,
+		"hot_keys": []interface{}{},
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dustin/go-jsonpointer"
 	"github.com/dustin/gomemcached"
@@ -124,6 +126,101 @@ func TestCouchDocGet(t *testing.T) {
 	}
 }
 
+func TestCouchDocPutDelete(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	put := func(url, ifMatch, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", url, strings.NewReader(body))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+	del := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("DELETE", url, nil)
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder) map[string]interface{} {
+		m := map[string]interface{}{}
+		if err := jsonUnmarshal(rr.Body.Bytes(), &m); err != nil {
+			t.Fatalf("expected json response, got: %v, err: %v",
+				rr.Body.String(), err)
+		}
+		return m
+	}
+
+	rr := put("http://127.0.0.1/default/hello?flags=42", "", `{"a":1}`)
+	if rr.Code != 201 {
+		t.Fatalf("expected create to 201, got: %v, %v", rr.Code, rr.Body.String())
+	}
+	m := decode(rr)
+	rev1, _ := m["rev"].(string)
+	if m["ok"] != true || m["id"] != "hello" || rev1 == "" ||
+		rr.Header().Get("ETag") != `"`+rev1+`"` {
+		t.Errorf("unexpected create response: %v, %v", m, rr.Header())
+	}
+	res := GetItem(bucket, []byte("hello"), VBActive)
+	if meta, _ := parseCouchDbRev(rev1); res == nil || meta == nil ||
+		string(res.Body) != `{"a":1}` || meta.cas != res.Cas ||
+		binary.BigEndian.Uint32(res.Extras) != 42 {
+		t.Errorf("expected stored doc, got: %v", res)
+	}
+
+	if rr = put("http://127.0.0.1/default/hello", "", `{"a":2}`); rr.Code != 409 {
+		t.Errorf("expected create of existing doc to 409, got: %v", rr.Code)
+	}
+	if rr = put("http://127.0.0.1/default/hello", "bogus", `{}`); rr.Code != 400 {
+		t.Errorf("expected bad rev to 400, got: %v", rr.Code)
+	}
+	if rr = put("http://127.0.0.1/default/hello?expiry=x", "", `{}`); rr.Code != 400 {
+		t.Errorf("expected bad expiry to 400, got: %v", rr.Code)
+	}
+
+	rr = put("http://127.0.0.1/default/hello", `"`+rev1+`"`, `{"a":2}`)
+	if rr.Code != 201 {
+		t.Fatalf("expected update to 201, got: %v, %v", rr.Code, rr.Body.String())
+	}
+	rev2, _ := decode(rr)["rev"].(string)
+	if rev2 == "" || rev2 == rev1 {
+		t.Errorf("expected a new rev, got: %v", rev2)
+	}
+	if rr = put("http://127.0.0.1/default/hello?rev="+rev1, "", `{"a":3}`); rr.Code != 409 {
+		t.Errorf("expected update with stale rev to 409, got: %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/default/hello", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || rr.Body.String() != `{"a":2}` ||
+		rr.Header().Get("ETag") != `"`+rev2+`"` {
+		t.Errorf("expected updated doc, got: %v, %v, %v",
+			rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	if rr = del("http://127.0.0.1/default/hello"); rr.Code != 409 {
+		t.Errorf("expected delete without rev to 409, got: %v", rr.Code)
+	}
+	if rr = del("http://127.0.0.1/default/hello?rev=" + rev1); rr.Code != 409 {
+		t.Errorf("expected delete with stale rev to 409, got: %v", rr.Code)
+	}
+	rr = del("http://127.0.0.1/default/hello?rev=" + rev2)
+	if rr.Code != 200 || decode(rr)["ok"] != true {
+		t.Errorf("expected delete to work, got: %v, %v", rr.Code, rr.Body.String())
+	}
+	if res = GetItem(bucket, []byte("hello"), VBActive); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected deleted doc, got: %v", res)
+	}
+	if rr = del("http://127.0.0.1/default/hello"); rr.Code != 404 {
+		t.Errorf("expected delete of missing doc to 404, got: %v", rr.Code)
+	}
+}
+
 func TestCouchDbGet(t *testing.T) {
 	d, _, bucket := testSetupDefaultBucket(t, 1024, uint16(528))
 	defer os.RemoveAll(d)
@@ -272,6 +369,149 @@ func TestCouchDbRevsDiff(t *testing.T) {
 	}
 }
 
+func TestCouchDbBulkDocsRevsDiff(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://127.0.0.1"+path,
+			strings.NewReader(body))
+		// manually set the RequestURI (not populated in test env)
+		r.RequestURI = path
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	res := SetItem(bucket, []byte("local"), []byte("l"), VBActive)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected SetItem to work, got: %v", res)
+	}
+	localRev := fmt.Sprintf("1-%016x", res.Cas)
+
+	rr := post("/default%2f0/_revs_diff", fmt.Sprintf(`{
+		"local": ["%v", "2-0000000000000001"],
+		"remote": "3-00000000000003e80000000000000000"}`, localRev))
+	if rr.Code != 200 {
+		t.Fatalf("expected _revs_diff to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	diff := map[string]map[string]interface{}{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), &diff); err != nil {
+		t.Fatalf("expected _revs_diff json, err: %v", err)
+	}
+	missing, _ := diff["local"]["missing"].([]interface{})
+	if len(missing) != 1 || missing[0] != "2-0000000000000001" {
+		t.Errorf("expected only the newer local rev missing, got: %v", diff)
+	}
+	if diff["remote"]["missing"] != "3-00000000000003e80000000000000000" {
+		t.Errorf("expected remote rev missing, got: %v", diff)
+	}
+
+	rr = post("/default%2f0/_bulk_docs", `{"docs": [
+		{"meta": {"id": "remote", "rev": "3-00000000000003e80000000000000000",
+			"flags": 7, "expiration": 0}, "base64": "cmVtb3Rl"},
+		{"meta": {"id": "local", "rev": "`+localRev+`", "flags": 0,
+			"expiration": 0}, "base64": "c3RhbGU="},
+		{"meta": {"id": "bad", "rev": "nope"}, "base64": ""},
+		{"meta": {"id": "gone", "rev": "2-0000000000000fff", "deleted": true}}]}`)
+	if rr.Code != 201 {
+		t.Fatalf("expected _bulk_docs to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	results := []map[string]interface{}{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), &results); err != nil ||
+		len(results) != 4 {
+		t.Fatalf("expected 4 _bulk_docs results, got: %v, err: %v",
+			rr.Body.String(), err)
+	}
+	if results[0]["rev"] != "3-00000000000003e80000000000000007" ||
+		results[0]["error"] != nil {
+		t.Errorf("expected remote doc to be stored, got: %v", results[0])
+	}
+	if results[1]["error"] != "conflict" {
+		t.Errorf("expected same rev to conflict, got: %v", results[1])
+	}
+	if results[2]["error"] != "bad_request" {
+		t.Errorf("expected bad rev to fail, got: %v", results[2])
+	}
+	if results[3]["error"] != nil {
+		t.Errorf("expected delete of a missing doc to work, got: %v", results[3])
+	}
+
+	res = GetItem(bucket, []byte("remote"), VBActive)
+	if res == nil || string(res.Body) != "remote" || res.Cas != 1000 ||
+		binary.BigEndian.Uint32(res.Extras) != 7 {
+		t.Errorf("expected remote doc with its meta, got: %v", res)
+	}
+	res = GetItem(bucket, []byte("local"), VBActive)
+	if res == nil || string(res.Body) != "l" {
+		t.Errorf("expected local doc to be kept, got: %v", res)
+	}
+
+	rr = post("/default%2f0/_revs_diff",
+		`{"remote": "3-00000000000003e80000000000000007"}`)
+	if rr.Code != 200 || strings.TrimSpace(rr.Body.String()) != "{}" {
+		t.Errorf("expected no missing revs, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+
+	// A rev whose cas isn't beyond the vbucket's changes is kept,
+	// though the doc gets a new local cas, so the rev stays the same
+	// on both sides and can be used to change the doc.
+	oldRev := "1-00000000000000020000000000000000"
+	rr = post("/default%2f0/_bulk_docs", `{"docs": [
+		{"meta": {"id": "old", "rev": "`+oldRev+`"}, "base64": "b2xk"}]}`)
+	if rr.Code != 201 || !strings.Contains(rr.Body.String(), oldRev) {
+		t.Errorf("expected old rev to be kept, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	rr = post("/default%2f0/_revs_diff", `{"old": "`+oldRev+`"}`)
+	if rr.Code != 200 || strings.TrimSpace(rr.Body.String()) != "{}" {
+		t.Errorf("expected old rev not missing, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/default/old", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || rr.Header().Get("ETag") != `"`+oldRev+`"` {
+		t.Errorf("expected old rev etag, got: %v, %v", rr.Code, rr.Header())
+	}
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "http://127.0.0.1/default/old",
+		strings.NewReader("new"))
+	r.Header.Set("If-Match", `"`+oldRev+`"`)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 201 || !strings.Contains(rr.Body.String(), `"rev":"2-`) {
+		t.Errorf("expected put with old rev to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+
+	rr = post("/default%2f0/_bulk_docs", `{"docs": [
+		{"meta": {"id": "remote", "rev": "4-00000000000003e90000000000000000",
+			"deleted": true}}]}`)
+	if rr.Code != 201 || !strings.Contains(rr.Body.String(), `"rev":"4-`) {
+		t.Errorf("expected remote delete to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	if res = GetItem(bucket, []byte("remote"), VBActive); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected remote doc to be deleted, got: %v", res)
+	}
+
+	// Revs older than a deletion aren't missing.
+	rr = post("/default%2f0/_revs_diff", `{"remote": ["3-00000000000003e80000000000000007",
+		"5-0000000000000001"]}`)
+	diff = map[string]map[string]interface{}{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), &diff); err != nil {
+		t.Fatalf("expected _revs_diff json, err: %v", err)
+	}
+	missing, _ = diff["remote"]["missing"].([]interface{})
+	if len(missing) != 1 || missing[0] != "5-0000000000000001" {
+		t.Errorf("expected only the rev after the deletion missing, got: %v", diff)
+	}
+}
+
 func TestCouchPutDDoc(t *testing.T) {
 	testCouchPutDDoc(t, 1)
 	testCouchPutDDoc(t, MAX_VBUCKETS)
@@ -434,6 +674,260 @@ func TestCouchAllDocs(t *testing.T) {
 	}
 }
 
+func testGetAllDocs(t *testing.T, mr *mux.Router, method, params string,
+	body string) (int, *ViewResult) {
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest(method,
+		"http://127.0.0.1/default/_all_docs?"+params, strings.NewReader(body))
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		return rr.Code, nil
+	}
+	dd := &ViewResult{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), dd); err != nil {
+		t.Fatalf("expected _all_docs?%v to parse, got: %v, err: %v",
+			params, rr.Body.String(), err)
+	}
+	return rr.Code, dd
+}
+
+func testViewRowIds(rows ViewRows) string {
+	ids := []string{}
+	for _, row := range rows {
+		if row.Error != "" {
+			ids = append(ids, fmt.Sprintf("%v:%v", row.Key, row.Error))
+		} else {
+			ids = append(ids, row.Id)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestCouchAllDocsParams(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+	mr := testSetupMux(d)
+
+	for _, k := range []string{"d", "a", "f", "c", "e", "b"} {
+		res := SetItem(bucket, []byte(k), []byte(`{"k":"`+k+`"}`), VBActive)
+		if res == nil || res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected SetItem to work, got: %v", res)
+		}
+	}
+
+	tests := []struct {
+		method string
+		params string
+		body   string
+		exp    string
+	}{
+		{"GET", "", "", "a,b,c,d,e,f"},
+		{"GET", "startkey=%22b%22&endkey=%22d%22", "", "b,c,d"},
+		{"GET", "startkey=%22b%22&endkey=%22d%22&inclusive_end=false", "",
+			"b,c"},
+		{"GET", "descending=true&startkey=%22d%22", "", "d,c,b,a"},
+		{"GET", "descending=true&endkey=%22b%22&inclusive_end=false", "",
+			"f,e,d,c"},
+		{"GET", "skip=1&limit=2", "", "b,c"},
+		{"GET", "descending=true&skip=4&limit=10", "", "b,a"},
+		{"GET", "key=%22c%22", "", "c"},
+		{"GET", "keys=%5B%22e%22,%22b%22%5D", "", "e,b"},
+		{"POST", "", `{"keys":["c","x","a"]}`, "c,x:not_found,a"},
+		{"POST", "descending=true", `{"keys":["c","a"]}`, "a,c"},
+	}
+	for _, test := range tests {
+		code, dd := testGetAllDocs(t, mr, test.method, test.params, test.body)
+		if code != 200 {
+			t.Errorf("expected %v _all_docs?%v to 200, got: %v",
+				test.method, test.params, code)
+			continue
+		}
+		if ids := testViewRowIds(dd.Rows); ids != test.exp {
+			t.Errorf("expected %v _all_docs?%v to be %v, got: %v",
+				test.method, test.params, test.exp, ids)
+		}
+		if dd.TotalRows != 6 {
+			t.Errorf("expected %v _all_docs?%v total_rows of 6, got: %v",
+				test.method, test.params, dd.TotalRows)
+		}
+	}
+
+	_, dd := testGetAllDocs(t, mr, "GET", "limit=1", "")
+	row := dd.Rows[0]
+	value, ok := row.Value.(map[string]interface{})
+	if row.Doc != nil || !ok || value["rev"] == "" || value["rev"] == nil {
+		t.Errorf("expected only a rev without include_docs, got: %#v", row)
+	}
+	_, dd = testGetAllDocs(t, mr, "GET", "limit=1&include_docs=true", "")
+	row = dd.Rows[0]
+	if row.Doc == nil || row.Doc.Meta["rev"] != value["rev"] ||
+		row.Doc.Json.(map[string]interface{})["k"] != "a" {
+		t.Errorf("expected a doc with include_docs, got: %#v", row)
+	}
+
+	for _, params := range []string{"startkey=1", "keys=notjson"} {
+		if code, _ := testGetAllDocs(t, mr, "GET", params, ""); code != 400 {
+			t.Errorf("expected _all_docs?%v to 400, got: %v", params, code)
+		}
+	}
+	if code, _ := testGetAllDocs(t, mr, "POST", "", "{}"); code != 400 {
+		t.Errorf("expected POST _all_docs without keys to 400, got: %v", code)
+	}
+
+	// A read_only user can POST keys, as that only reads.
+	defer func(orig *Users) { users = orig }(users)
+	users, _ = NewUsers(d)
+	u := &User{Name: "reader", Roles: []UserRole{{ROLE_READ_ONLY, "default"}}}
+	u.SetPassword(PASSWORD_HASH_PBKDF2_SHA256, []byte("pw"))
+	users.Set(u)
+	for _, method := range []string{"GET", "POST"} {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "http://127.0.0.1/default/_all_docs",
+			strings.NewReader(`{"keys":["a"]}`))
+		r.SetBasicAuth("reader", "pw")
+		authenticationFilter{mr}.ServeHTTP(rr, r)
+		if rr.Code != 200 {
+			t.Errorf("expected read_only user to %v _all_docs, got: %v, %v",
+				method, rr.Code, rr.Body.String())
+		}
+	}
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "http://127.0.0.1/default/x",
+		strings.NewReader(`{}`))
+	r.SetBasicAuth("reader", "pw")
+	authenticationFilter{mr}.ServeHTTP(rr, r)
+	if rr.Code != 403 {
+		t.Errorf("expected read_only user to not PUT a doc, got: %v", rr.Code)
+	}
+}
+
+type testChanges struct {
+	Results []ChangeRow `json:"results"`
+	LastSeq string      `json:"last_seq"`
+}
+
+func testGetChanges(t *testing.T, mr *mux.Router, params string) *testChanges {
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://127.0.0.1/default/_changes?"+params, nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Fatalf("expected _changes?%v to 200, got: %v, %v",
+			params, rr.Code, rr.Body.String())
+	}
+	c := &testChanges{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), c); err != nil {
+		t.Fatalf("expected _changes?%v to parse, got: %v, err: %v",
+			params, rr.Body.String(), err)
+	}
+	return c
+}
+
+func testChangesIds(c *testChanges) string {
+	ids := []string{}
+	for _, row := range c.Results {
+		ids = append(ids, row.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestCouchChanges(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+	mr := testSetupMux(d)
+
+	c := testGetChanges(t, mr, "")
+	if len(c.Results) != 0 || c.LastSeq != "0" {
+		t.Errorf("expected no changes, got: %#v", c)
+	}
+
+	testSetString(t, bucket, 0, "a", `{"n":1}`)
+	testSetString(t, bucket, 1, "b", "not json")
+	testSetString(t, bucket, 0, "c", `{"n":3}`)
+	testSetString(t, bucket, 1, "d", `{"n":4}`)
+
+	c = testGetChanges(t, mr, "")
+	if ids := testChangesIds(c); ids != "a,b,c,d" {
+		t.Errorf("expected changes merged in cas order, got: %v", ids)
+	}
+	if !strings.HasPrefix(c.Results[3].Seq, "1:") ||
+		strings.Contains(c.Results[3].Seq, ",") ||
+		c.LastSeq != c.Results[2].Seq+","+c.Results[3].Seq {
+		t.Errorf("expected row seqs of one vbucket and a last_seq of all,"+
+			" got: %#v", c)
+	}
+	if c.Results[0].Doc != nil || len(c.Results[0].Changes) != 1 ||
+		c.Results[0].Changes[0].Rev == "" {
+		t.Errorf("expected a rev and no doc, got: %#v", c.Results[0])
+	}
+
+	c = testGetChanges(t, mr, "limit=2")
+	if ids := testChangesIds(c); ids != "a,b" {
+		t.Errorf("expected limited changes, got: %v", ids)
+	}
+	c = testGetChanges(t, mr, "since="+c.LastSeq)
+	if ids := testChangesIds(c); ids != "c,d" {
+		t.Errorf("expected changes since the limit, got: %v", ids)
+	}
+	lastSeq := c.LastSeq
+
+	c = testGetChanges(t, mr, "descending=true")
+	if ids := testChangesIds(c); ids != "d,c,b,a" {
+		t.Errorf("expected descending changes, got: %v", ids)
+	}
+
+	c = testGetChanges(t, mr, "include_docs=true")
+	if c.Results[0].Doc == nil || c.Results[0].Doc.Meta["type"] != "json" ||
+		c.Results[1].Doc == nil || c.Results[1].Doc.Meta["type"] != "base64" {
+		t.Errorf("expected docs, got: %#v", c.Results)
+	}
+
+	(&reqHandler{currentBucket: bucket}).HandleMessage(nil, nil,
+		&gomemcached.MCRequest{Opcode: gomemcached.DELETE, Key: []byte("a")})
+	c = testGetChanges(t, mr, "since="+lastSeq+"&include_docs=true")
+	if len(c.Results) != 1 || c.Results[0].Id != "a" ||
+		!c.Results[0].Deleted || c.Results[0].Doc != nil {
+		t.Errorf("expected a deletion change, got: %#v", c.Results)
+	}
+	lastSeq = c.LastSeq
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://127.0.0.1/default/_changes?feed=continuous&descending=true", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected descending continuous feed to 400, got: %v", rr.Code)
+	}
+
+	// A longpoll feed waits for a change.
+	donech := make(chan *testChanges)
+	go func() {
+		donech <- testGetChanges(t, mr, "feed=longpoll&timeout=5000&since=now")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	testSetString(t, bucket, 1, "e", `{"n":5}`)
+	c = <-donech
+	if ids := testChangesIds(c); ids != "e" {
+		t.Errorf("expected longpoll to see e, got: %v", ids)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET",
+		"http://127.0.0.1/default/_changes?feed=continuous&timeout=50&since="+
+			lastSeq, nil)
+	mr.ServeHTTP(rr, r)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"id":"e"`) ||
+		!strings.HasPrefix(lines[1], `{"last_seq":`) {
+		t.Errorf("expected continuous rows then last_seq, got: %v",
+			rr.Body.String())
+	}
+}
+
 func TestCouchGetDesignDoc(t *testing.T) {
 	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
 	defer os.RemoveAll(d)
@@ -671,6 +1165,125 @@ func TestRestNSPoolsDefaultTasks(t *testing.T) {
 	}
 }
 
+func TestRestNSBucketStats(t *testing.T) {
+	o := statsSnapshotDelay
+	statsSnapshotDelay = 0
+	defer func() { statsSnapshotDelay = o }()
+
+	for _, url := range []string{
+		"http://127.0.0.1/pools/default/buckets/foo/stats",
+		"http://127.0.0.1/pools/default/buckets/foo/stats?zoom=hour",
+		"http://127.0.0.1/pools/default/buckets/foo/nodes/127.0.0.1%3A8091/stats",
+		"http://127.0.0.1/pools/default/stats?zoom=day",
+	} {
+		m := testRestGetJson(t, url).(map[string]interface{})
+		op, ok := m["op"].(map[string]interface{})
+		if !ok {
+			t.Errorf("expected an op for %v, got: %#v", url, m)
+			continue
+		}
+		samples, ok := op["samples"].(map[string]interface{})
+		if !ok || samples["timestamp"] == nil || samples["cmd_get"] == nil {
+			t.Errorf("expected samples for %v, got: %#v", url, op)
+		}
+	}
+
+	rr := testRestGet(t,
+		"http://127.0.0.1/pools/default/buckets/foo/stats?zoom=year", nil)
+	if rr.Code != 400 {
+		t.Errorf("expected unknown zoom to fail, got: %v", rr.Code)
+	}
+	rr = testRestGet(t,
+		"http://127.0.0.1/pools/default/buckets/foo/stats/not_a_stat", nil)
+	if rr.Code != 404 {
+		t.Errorf("expected unknown stat to 404, got: %v", rr.Code)
+	}
+	m := testRestGetJson(t,
+		"http://127.0.0.1/pools/default/buckets/foo/stats/ops").(map[string]interface{})
+	if ns, ok := m["nodeStats"].(map[string]interface{}); !ok ||
+		ns["127.0.0.1"] == nil {
+		t.Errorf("expected nodeStats, got: %#v", m)
+	}
+}
+
+func TestNSRawStatsOp(t *testing.T) {
+	r := &nsRawStats{
+		diffs: []*BucketStats{
+			{Gets: 10, GetMisses: 5, Items: 2},
+			{Gets: 20, Items: 1},
+		},
+		storeDiffs: []*BucketStoreStats{{}, {}},
+		cur:        BucketStats{Items: 10},
+		last:       time.Unix(100, 0),
+	}
+	op := r.op(1000, 0)
+	samples := op["samples"].(map[string]interface{})
+	ts := samples["timestamp"].([]int64)
+	if len(ts) != 2 || ts[0] != 99000 || ts[1] != 100000 {
+		t.Errorf("expected timestamps, got: %v", ts)
+	}
+	exp := map[string][]float64{
+		"cmd_get":    {10, 20},
+		"get_hits":   {5, 20},
+		"hit_ratio":  {50, 100},
+		"curr_items": {9, 10},
+	}
+	for k, e := range exp {
+		got := samples[k].([]float64)
+		if len(got) != len(e) || got[0] != e[0] || got[1] != e[1] {
+			t.Errorf("expected %v of %v, got: %v", k, e, got)
+		}
+	}
+
+	// Per-second rates at the coarser zooms.
+	samples = r.op(60000, 0)["samples"].(map[string]interface{})
+	if got := samples["cmd_get"].([]float64); got[1] != 20.0/60 {
+		t.Errorf("expected a per-second rate, got: %v", got)
+	}
+
+	op = r.op(1000, 99000)
+	if op["samplesCount"] != 1 {
+		t.Errorf("expected haveTStamp to filter, got: %#v", op)
+	}
+
+	agg := &nsRawStats{}
+	agg.add(r)
+	agg.add(&nsRawStats{
+		diffs:      []*BucketStats{{Gets: 1}},
+		storeDiffs: []*BucketStoreStats{{}},
+	})
+	if len(agg.diffs) != 2 || agg.diffs[0].Gets != 10 || agg.diffs[1].Gets != 21 {
+		t.Errorf("expected newest-aligned sums, got: %v, %v",
+			agg.diffs[0], agg.diffs[1])
+	}
+}
+
+func TestRestNSBucketStatsDirectoryNodes(t *testing.T) {
+	m := testRestGetJson(t,
+		"http://127.0.0.1/pools/default/buckets/foo/statsDirectory").(map[string]interface{})
+	blocks, ok := m["blocks"].([]interface{})
+	if !ok || len(blocks) == 0 {
+		t.Fatalf("expected blocks, got: %#v", m)
+	}
+	stats := blocks[0].(map[string]interface{})["stats"].([]interface{})
+	stat := stats[0].(map[string]interface{})
+	if stat["specificStatsURL"] != "/pools/default/buckets/foo/stats/ops" {
+		t.Errorf("expected specificStatsURL, got: %#v", stat)
+	}
+
+	m = testRestGetJson(t,
+		"http://127.0.0.1/pools/default/buckets/foo/nodes").(map[string]interface{})
+	servers, ok := m["servers"].([]interface{})
+	if !ok || len(servers) != 1 {
+		t.Fatalf("expected one server, got: %#v", m)
+	}
+	server := servers[0].(map[string]interface{})
+	if server["hostname"] != "127.0.0.1" ||
+		server["uri"] != "/pools/default/buckets/foo/nodes/127.0.0.1" {
+		t.Errorf("expected server hostname and uri, got: %#v", server)
+	}
+}
+
 func TestRestGetRuntime(t *testing.T) {
 	j := testRestGetJson(t, "http://127.0.0.1/_api/runtime")
 	m := j.(map[string]interface{})
@@ -893,3 +1506,80 @@ func testRestPost(t *testing.T, url string) *httptest.ResponseRecorder {
 	mr.ServeHTTP(rr, r)
 	return rr
 }
+
+func TestRestTapReceivers(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	b, _ := buckets.New("foo", bucketSettings)
+	defer b.Close()
+	defer tapReceivers.StopAll("foo")
+	mr := testSetupMux(d)
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"GET", "/_api/buckets/notABucket/tapReceivers", 404},
+		{"GET", "/_api/buckets/foo/tapReceivers/r", 404},
+		{"DELETE", "/_api/buckets/foo/tapReceivers/r", 404},
+		{"POST", "/_api/buckets/foo/tapReceivers", 400},
+		{"POST", "/_api/buckets/foo/tapReceivers?name=r", 400},
+		{"POST", "/_api/buckets/foo/tapReceivers?name=r&addr=127.0.0.1:1", 303},
+		{"POST", "/_api/buckets/foo/tapReceivers?name=r&addr=127.0.0.1:1", 400},
+		{"GET", "/_api/buckets/foo/tapReceivers/r", 200},
+		{"GET", "/_api/buckets/foo/tapReceivers", 200},
+		{"DELETE", "/_api/buckets/foo/tapReceivers/r", 204},
+		{"GET", "/_api/buckets/foo/tapReceivers/r", 404},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest(test.method, "http://127.0.0.1"+test.url, nil)
+		mr.ServeHTTP(rr, r)
+		if rr.Code != test.code {
+			t.Errorf("expected %v %v to give %v, got: %v, %v",
+				test.method, test.url, test.code, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRestXDCRReplications(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	b, _ := buckets.New("foo", bucketSettings)
+	defer b.Close()
+	defer xdcrReplications.StopAll("foo")
+	mr := testSetupMux(d)
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"GET", "/_api/buckets/notABucket/xdcr", 404},
+		{"GET", "/_api/buckets/foo/xdcr/r", 404},
+		{"DELETE", "/_api/buckets/foo/xdcr/r", 404},
+		{"POST", "/_api/buckets/foo/xdcr/r/pause", 404},
+		{"POST", "/_api/buckets/foo/xdcr", 400},
+		{"POST", "/_api/buckets/foo/xdcr?name=r&target=http://127.0.0.1:1", 400},
+		{"POST", "/_api/buckets/foo/xdcr?name=r&target=ftp://x&targetBucket=b", 400},
+		{"POST", "/_api/buckets/foo/xdcr?name=r%2f&target=http://127.0.0.1:1&targetBucket=b", 400},
+		{"POST", "/_api/buckets/foo/xdcr?name=r&target=http://127.0.0.1:1&targetBucket=b", 303},
+		{"POST", "/_api/buckets/foo/xdcr?name=r&target=http://127.0.0.1:1&targetBucket=b", 400},
+		{"GET", "/_api/buckets/foo/xdcr/r", 200},
+		{"GET", "/_api/buckets/foo/xdcr", 200},
+		{"POST", "/_api/buckets/foo/xdcr/r/pause", 200},
+		{"POST", "/_api/buckets/foo/xdcr/r/resume", 200},
+		{"DELETE", "/_api/buckets/foo/xdcr/r", 204},
+		{"GET", "/_api/buckets/foo/xdcr/r", 404},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest(test.method, "http://127.0.0.1"+test.url, nil)
+		mr.ServeHTTP(rr, r)
+		if rr.Code != test.code {
+			t.Errorf("expected %v %v to give %v, got: %v, %v",
+				test.method, test.url, test.code, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"time"
 
 	"github.com/couchbaselabs/walrus"
 	"github.com/dustin/gomemcached"
@@ -37,6 +38,8 @@ func couchDbGetView(w http.ResponseWriter, r *http.Request) {
 	if bucket == nil || ddocId == "" {
 		return
 	}
+	defer bucket.GetTimings().Views.Since(time.Now())
+
 	viewId, ok := vars["viewId"]
 	if !ok || viewId == "" {
 		http.Error(w, "missing viewId from path", 400)
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/steveyen/gkvlite"
+)
+
+const (
+	RESTORE_OVERWRITE     = "overwrite"     // Backup items replace existing items.
+	RESTORE_SKIP_EXISTING = "skip-existing" // Existing items are kept.
+	RESTORE_NEWER_CAS     = "newer-cas"     // The item with the higher cas wins.
+)
+
+var restoreModes = map[string]bool{
+	RESTORE_OVERWRITE:     true,
+	RESTORE_SKIP_EXISTING: true,
+	RESTORE_NEWER_CAS:     true,
+}
+
+type RestoreStats struct {
+	Items   int64 `json:"items"`   // Items restored.
+	Skipped int64 `json:"skipped"` // Items not restored due to the mode.
+	Expired int64 `json:"expired"` // Items that expired since the backup.
+	DDocs   int64 `json:"ddocs"`   // Design docs restored.
+}
+
+func checkRestoreMode(mode string) error {
+	if !restoreModes[mode] {
+		return fmt.Errorf("unknown restore mode: %v", mode)
+	}
+	return nil
+}
+
+// Creates a bucket from a backup's settings, optionally with a
+// different number of partitions.  Its vbuckets are created while
+// restoring.
+func restoreNewBucket(name, dir string, numPartitions int) (Bucket, error) {
+	settings := &BucketSettings{}
+	exists, err := settings.load(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("not a backup dir, missing settings: %v", dir)
+	}
+	if numPartitions > 0 {
+		settings.NumPartitions = numPartitions
+	}
+	return buckets.New(name, settings)
+}
+
+// Loads the items and design docs of a backup directory into a
+// bucket, resolving conflicts with existing items according to mode.
+// When the backup's number of partitions differs from the bucket's,
+// items are remapped to vbuckets by key.
+func restoreBucket(bucket Bucket, dir string, mode string) (
+	*RestoreStats, error) {
+	if err := checkRestoreMode(mode); err != nil {
+		return nil, err
+	}
+	srcSettings := &BucketSettings{}
+	exists, err := srcSettings.load(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("not a backup dir, missing settings: %v", dir)
+	}
+	fileNames, err := latestStoreFileNames(dir, STORES_PER_BUCKET,
+		STORE_FILE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	r := &restorer{
+		bucket: bucket,
+		mode:   mode,
+		remap: srcSettings.NumPartitions !=
+			bucket.GetBucketSettings().NumPartitions,
+		now:   time.Now(),
+		stats: &RestoreStats{},
+	}
+	if r.remap {
+		// Remapped items may land in any vbucket.
+		for vbid := 0; vbid < bucket.GetBucketSettings().NumPartitions; vbid++ {
+			if _, err = r.vbucket(uint16(vbid), VBActive); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, fileName := range fileNames {
+		if err = r.restoreStoreFile(filepath.Join(dir, fileName)); err != nil {
+			return r.stats, err
+		}
+	}
+	return r.stats, bucket.Flush()
+}
+
+type restorer struct {
+	bucket Bucket
+	mode   string
+	remap  bool
+	now    time.Time
+	stats  *RestoreStats
+}
+
+func (r *restorer) restoreStoreFile(path string) error {
+	file, err := fileService.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	store, err := gkvlite.NewStoreEx(file, mkBucketStoreCallbacks(nil))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	vbmeta := store.GetCollection(COLL_VBMETA)
+	if vbmeta == nil {
+		return fmt.Errorf("backup store missing vbuckets: %v", path)
+	}
+	metas := []*VBMeta{}
+	var errVisit error
+	err = vbmeta.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+		meta := &VBMeta{}
+		if errVisit = jsonUnmarshal(i.Val, meta); errVisit != nil {
+			return false
+		}
+		metas = append(metas, meta)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if errVisit != nil {
+		return errVisit
+	}
+
+	for _, meta := range metas {
+		changes := store.GetCollection(fmt.Sprintf("%v%s", meta.Id,
+			COLL_SUFFIX_CHANGES))
+		if changes == nil {
+			continue
+		}
+		srcState := parseVBState(meta.State)
+		if meta.Id == VBID_LOCAL || // Local docs describe the old bucket.
+			(meta.Id != VBID_DDOC && srcState == VBDead) {
+			continue
+		}
+		err = changes.VisitItemsAscend(nil, true, func(cItem *gkvlite.Item) bool {
+			i := &item{}
+			if errVisit = i.fromValueBytes(cItem.Val); errVisit != nil {
+				return false
+			}
+			if len(i.key) <= 0 || i.isDeletion() {
+				return true // Metadata changes and deletions aren't restored.
+			}
+			if i.isExpired(r.now) {
+				r.stats.Expired++
+				return true
+			}
+			// The item's slices point into cItem.Val, so copy.
+			i.key = append([]byte(nil), i.key...)
+			i.data = append([]byte(nil), i.data...)
+			if meta.Id == VBID_DDOC {
+				errVisit = r.restoreDDoc(i)
+			} else {
+				errVisit = r.restoreItem(meta.Id, srcState, i)
+			}
+			return errVisit == nil
+		})
+		if err != nil {
+			return err
+		}
+		if errVisit != nil {
+			return errVisit
+		}
+	}
+	return nil
+}
+
+func (r *restorer) restoreItem(srcVBId uint16, srcState VBState,
+	i *item) error {
+	vbid := srcVBId
+	if r.remap {
+		vbid = VBucketIdForKey(i.key, r.bucket.GetBucketSettings().NumPartitions)
+	} else if int(vbid) >= r.bucket.GetBucketSettings().NumPartitions {
+		return fmt.Errorf("restore vbid out of range: %v", vbid)
+	}
+	vb, err := r.vbucket(vbid, srcState)
+	if err != nil {
+		return err
+	}
+	applied, err := vb.applyItemIf(i, func(itemOld *item) bool {
+		if itemOld != nil &&
+			(r.mode == RESTORE_SKIP_EXISTING ||
+				(r.mode == RESTORE_NEWER_CAS &&
+					itemOld.getRevCas() >= i.getRevCas())) {
+			return false
+		}
+		// The changes stream is ordered by cas, so an item keeps
+		// its cas only if it's beyond all the vbucket's changes,
+		// but it always keeps its rev.
+		if i.revCas == 0 {
+			i.revCas = i.cas
+		}
+		if i.cas <= atomic.LoadUint64(&vb.Meta().LastCas) {
+			i.cas = 0
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if applied {
+		r.stats.Items++
+	} else {
+		r.stats.Skipped++
+	}
+	return nil
+}
+
+func (r *restorer) restoreDDoc(i *item) error {
+	if r.mode != RESTORE_OVERWRITE {
+		// Design docs have no meaningful cas, so they're only
+		// replaced when overwriting.
+		prev, err := r.bucket.GetDDoc(string(i.key))
+		if err != nil {
+			return err
+		}
+		if prev != nil {
+			r.stats.Skipped++
+			return nil
+		}
+	}
+	if err := r.bucket.SetDDoc(string(i.key), i.data); err != nil {
+		return err
+	}
+	r.stats.DDocs++
+	return nil
+}
+
+// Returns the bucket's vbucket, creating it in the given state if
+// it's missing.
+func (r *restorer) vbucket(vbid uint16, state VBState) (*VBucket, error) {
+	vb, err := r.bucket.GetVBucket(vbid)
+	if err != nil || vb != nil {
+		return vb, err
+	}
+	if r.remap {
+		state = VBActive
+	}
+	if _, err = r.bucket.CreateVBucket(vbid); err != nil {
+		if vb, _ = r.bucket.GetVBucket(vbid); vb != nil {
+			return vb, nil // Concurrently created.
+		}
+		return nil, err
+	}
+	if err = r.bucket.SetVBState(vbid, state); err != nil {
+		return nil, err
+	}
+	return r.bucket.GetVBucket(vbid)
+}
+
+// Extracts a backup's tar stream, as written by tarDir, into dir.
+func untarDir(rd io.Reader, dir string) error {
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := filepath.Base(hdr.Name)
+		if name != hdr.Name || name == "." || name == ".." {
+			return fmt.Errorf("unexpected file in backup archive: %v", hdr.Name)
+		}
+		if err = untarFile(tr, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+}
+
+func untarFile(rd io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, rd)
+	return err
+}
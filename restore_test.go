@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Backs up a bucket with items "0".."4" in vbucket 2 and a ddoc.
+func testBackupInts(t *testing.T, d string, numPartitions int) string {
+	os.MkdirAll(filepath.Join(d, "src"), 0777)
+	b, err := NewBucket("src", filepath.Join(d, "src"),
+		&BucketSettings{NumPartitions: numPartitions})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, err: %v", err)
+	}
+	defer b.Close()
+	b.CreateVBucket(2)
+	b.SetVBState(2, VBActive)
+	testLoadInts(t, &reqHandler{currentBucket: b}, 2, 5)
+	if err = b.SetDDoc("_design/d0", []byte(`{"views":{}}`)); err != nil {
+		t.Fatalf("expected SetDDoc to work, err: %v", err)
+	}
+	backupDir := filepath.Join(d, "backup")
+	if _, err = b.Backup(backupDir); err != nil {
+		t.Fatalf("expected Backup to work, err: %v", err)
+	}
+	return backupDir
+}
+
+func testGetString(t *testing.T, b Bucket, vbid uint16, key string) string {
+	res := (&reqHandler{currentBucket: b}).HandleMessage(nil, nil,
+		&gomemcached.MCRequest{
+			Opcode:  gomemcached.GET,
+			Key:     []byte(key),
+			VBucket: vbid,
+		})
+	if res.Status != gomemcached.SUCCESS {
+		return ""
+	}
+	return string(res.Body)
+}
+
+func testSetString(t *testing.T, b Bucket, vbid uint16, key, val string) {
+	res := (&reqHandler{currentBucket: b}).HandleMessage(nil, nil,
+		&gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			Key:     []byte(key),
+			Body:    []byte(val),
+			VBucket: vbid,
+		})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected SET of %v to work, got: %v", key, res)
+	}
+}
+
+func TestRestoreNewBucket(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	backupDir := testBackupInts(t, d, MAX_VBUCKETS)
+
+	b, err := restoreNewBucket("dst", backupDir, 0)
+	if err != nil {
+		t.Fatalf("expected restoreNewBucket to work, err: %v", err)
+	}
+	defer b.Close()
+	if b.GetBucketSettings().NumPartitions != MAX_VBUCKETS {
+		t.Errorf("expected backup's numPartitions, got: %v",
+			b.GetBucketSettings().NumPartitions)
+	}
+	stats, err := restoreBucket(b, backupDir, RESTORE_OVERWRITE)
+	if err != nil {
+		t.Fatalf("expected restoreBucket to work, err: %v", err)
+	}
+	if stats.Items != 5 || stats.DDocs != 1 || stats.Skipped != 0 {
+		t.Errorf("unexpected restore stats: %#v", stats)
+	}
+	testExpectInts(t, &reqHandler{currentBucket: b}, 2, []int{0, 1, 2, 3, 4},
+		"restored")
+	if vb, _ := b.GetVBucket(3); vb != nil {
+		t.Errorf("expected no vbucket that wasn't in the backup")
+	}
+	ddoc, err := b.GetDDoc("_design/d0")
+	if err != nil || ddoc == nil {
+		t.Errorf("expected restored ddoc, got: %s, err: %v", ddoc, err)
+	}
+	if _, err = restoreBucket(b, backupDir, "bogus"); err == nil {
+		t.Errorf("expected a bad restore mode to fail")
+	}
+	if _, err = restoreBucket(b, d, RESTORE_OVERWRITE); err == nil {
+		t.Errorf("expected restore from a non-backup dir to fail")
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	backupDir := testBackupInts(t, d, MAX_VBUCKETS)
+
+	tests := []struct {
+		mode     string
+		expect0  string // Key "0" was changed after the backup.
+		expect1  string // Key "1" was changed before the backup.
+		expected int64
+	}{
+		{RESTORE_OVERWRITE, "0", "1", 5},
+		{RESTORE_SKIP_EXISTING, "new", "old", 3},
+		{RESTORE_NEWER_CAS, "new", "1", 4},
+	}
+	for _, test := range tests {
+		os.MkdirAll(filepath.Join(d, test.mode), 0777)
+		b, err := NewBucket(test.mode, filepath.Join(d, test.mode),
+			&BucketSettings{NumPartitions: MAX_VBUCKETS})
+		if err != nil {
+			t.Fatalf("expected NewBucket to work, err: %v", err)
+		}
+		b.CreateVBucket(2)
+		b.SetVBState(2, VBActive)
+		vb, _ := b.GetVBucket(2)
+		// The "1" item is older than the backup's, and "0" is newer.
+		applied, err := vb.applyItem(&item{key: []byte("1"), cas: 2,
+			data: []byte("old")})
+		if !applied || err != nil {
+			t.Fatalf("expected applyItem to work, err: %v", err)
+		}
+		vb.raiseLastCas(1000000)
+		testSetString(t, b, 2, "0", "new")
+
+		stats, err := restoreBucket(b, backupDir, test.mode)
+		if err != nil {
+			t.Fatalf("expected restore %v to work, err: %v", test.mode, err)
+		}
+		if stats.Items != test.expected {
+			t.Errorf("expected %v to restore %v items, got: %#v",
+				test.mode, test.expected, stats)
+		}
+		if v := testGetString(t, b, 2, "0"); v != test.expect0 {
+			t.Errorf("expected %v to leave 0 as %v, got: %v",
+				test.mode, test.expect0, v)
+		}
+		if v := testGetString(t, b, 2, "1"); v != test.expect1 {
+			t.Errorf("expected %v to leave 1 as %v, got: %v",
+				test.mode, test.expect1, v)
+		}
+		if v := testGetString(t, b, 2, "4"); v != "4" {
+			t.Errorf("expected %v to restore a missing item, got: %v",
+				test.mode, v)
+		}
+		b.Close()
+	}
+}
+
+func TestRestoreRemap(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	backupDir := testBackupInts(t, d, MAX_VBUCKETS)
+
+	b, err := restoreNewBucket("dst", backupDir, 4)
+	if err != nil {
+		t.Fatalf("expected restoreNewBucket to work, err: %v", err)
+	}
+	defer b.Close()
+	stats, err := restoreBucket(b, backupDir, RESTORE_OVERWRITE)
+	if err != nil || stats.Items != 5 {
+		t.Fatalf("expected remapped restore to work, stats: %#v, err: %v",
+			stats, err)
+	}
+	for vbid := uint16(0); vbid < 4; vbid++ {
+		if vb, _ := b.GetVBucket(vbid); vb == nil || vb.GetVBState() != VBActive {
+			t.Errorf("expected active vbucket %v after remapping", vbid)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		k := strconv.Itoa(i)
+		if v := testGetString(t, b, VBucketIdForKey([]byte(k), 4), k); v != k {
+			t.Errorf("expected remapped item %v, got: %v", k, v)
+		}
+	}
+}
+
+func TestRestPostBucketRestore(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	backupDir := testBackupInts(t, d, MAX_VBUCKETS)
+	archive := &bytes.Buffer{}
+	if err := tarDir(archive, backupDir); err != nil {
+		t.Fatalf("expected tarDir to work, err: %v", err)
+	}
+
+	mr := testSetupMux(d)
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/dst/restore?mode=skip-existing", archive)
+	r.Header.Set("Content-Type", "application/x-tar")
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Fatalf("expected restore to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	b := buckets.Get("dst")
+	if b == nil {
+		t.Fatalf("expected restore to create bucket dst")
+	}
+	testExpectInts(t, &reqHandler{currentBucket: b}, 2, []int{0, 1, 2, 3, 4},
+		"restored over REST")
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/dst/restore?mode=bogus", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected a bad mode to fail, got: %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/dst/restore?dir="+backupDir, nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Errorf("expected restore from a dir to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/pbkdf2"
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	SASL_PLAIN        = "PLAIN"
+	SASL_CRAM_MD5     = "CRAM-MD5"
+	SASL_SCRAM_SHA1   = "SCRAM-SHA1"
+	SASL_SCRAM_SHA256 = "SCRAM-SHA256"
+)
+
+// All the supported mechs, strongest first.  See saslEnabledMechs().
+var saslMechs = []string{
+	SASL_SCRAM_SHA256,
+	SASL_SCRAM_SHA1,
+	SASL_CRAM_MD5,
+	SASL_PLAIN,
+}
+
+var scramIterations = 4096
+
+// Keys the fake SCRAM salts of unknown users, so that an unknown user
+// is offered the same salt on each attempt, like a known user.
+var scramFakeSaltKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+var scramHashes = map[string]func() hash.Hash{
+	SASL_SCRAM_SHA1:   sha1.New,
+	SASL_SCRAM_SHA256: sha256.New,
+}
+
+// Returns the mechs listed in SASL_LIST_MECHS, strongest first.
+// CRAM-MD5 is only offered when enabled, as its secret is as good as
+// the password for CRAM-MD5 auth; see cramMD5Secret().
+func saslEnabledMechs() []string {
+	rv := make([]string, 0, len(saslMechs))
+	for _, mech := range saslMechs {
+		if mech != SASL_CRAM_MD5 || *saslCramMD5 {
+			rv = append(rv, mech)
+		}
+	}
+	return rv
+}
+
+// Derives the secrets that the enabled challenge-response mechs need
+// from a password, so that the password itself needn't be kept.
+func saslSecrets(password []byte) (map[string]string, error) {
+	rv := map[string]string{}
+	for _, mech := range saslEnabledMechs() {
+		if mech == SASL_PLAIN {
+			continue
+		}
+		secret, err := saslSecret(mech, password)
+		if err != nil {
+			return nil, err
+		}
+		rv[mech] = secret
+	}
+	return rv, nil
+}
+
+func saslSecret(mech string, password []byte) (string, error) {
+	if mech == SASL_CRAM_MD5 {
+		return cramMD5Secret(password)
+	}
+	if newHash, ok := scramHashes[mech]; ok {
+		return scramSecret(newHash, password)
+	}
+	return "", fmt.Errorf("no secret for SASL mech: %v", mech)
+}
+
+// The CRAM-MD5 secret is the HMAC-MD5 state after hashing the inner
+// and outer padded keys, which is all that's needed to finish the
+// HMAC of a challenge.  That makes it password-equivalent: whoever
+// reads it from settings.json or users.json can pass CRAM-MD5 auth,
+// unlike with the SCRAM secrets.  So it's only stored when CRAM-MD5
+// is enabled with -sasl-cram-md5, trading that exposure for clients
+// that don't speak SCRAM.
+func cramMD5Secret(password []byte) (string, error) {
+	key := password
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+	states := make([]string, 2)
+	for i, pad := range []byte{0x36, 0x5c} {
+		block := make([]byte, md5.BlockSize)
+		copy(block, key)
+		for j := range block {
+			block[j] ^= pad
+		}
+		h := md5.New()
+		h.Write(block)
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		states[i] = hex.EncodeToString(state)
+	}
+	return strings.Join(states, ","), nil
+}
+
+func cramMD5Digest(secret string, challenge []byte) ([]byte, error) {
+	states := strings.Split(secret, ",")
+	if len(states) != 2 {
+		return nil, fmt.Errorf("invalid CRAM-MD5 secret")
+	}
+	sum := challenge
+	for _, s := range states {
+		state, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		h := md5.New()
+		err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(sum)
+		sum = h.Sum(nil)
+	}
+	return sum, nil
+}
+
+// A SCRAM secret is "salt,iterations,storedKey,serverKey", with
+// base64 encoded salt and keys, as in RFC 5802.
+func scramSecret(newHash func() hash.Hash, password []byte) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	salted := pbkdf2.Key(password, salt, scramIterations,
+		newHash().Size(), newHash)
+	clientKey := hmacSum(newHash, salted, []byte("Client Key"))
+	storedKey := newHash()
+	storedKey.Write(clientKey)
+	serverKey := hmacSum(newHash, salted, []byte("Server Key"))
+	return strings.Join([]string{
+		base64.StdEncoding.EncodeToString(salt),
+		strconv.Itoa(scramIterations),
+		base64.StdEncoding.EncodeToString(storedKey.Sum(nil)),
+		base64.StdEncoding.EncodeToString(serverKey),
+	}, ","), nil
+}
+
+func parseScramSecret(secret string) (salt []byte, iterations int,
+	storedKey, serverKey []byte, err error) {
+	parts := strings.Split(secret, ",")
+	if len(parts) != 4 {
+		return nil, 0, nil, nil, fmt.Errorf("invalid SCRAM secret")
+	}
+	if salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return
+	}
+	if iterations, err = strconv.Atoi(parts[1]); err != nil {
+		return
+	}
+	if storedKey, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return
+	}
+	serverKey, err = base64.StdEncoding.DecodeString(parts[3])
+	return
+}
+
+func hmacSum(newHash func() hash.Hash, key, msg []byte) []byte {
+	h := hmac.New(newHash, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func saslNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func saslFail(msg string) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: gomemcached.EINVAL,
+		Body:   []byte(msg),
+	}
+}
+
+func saslContinue(challenge string) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: AUTH_CONTINUE,
+		Body:   []byte(challenge),
+	}
+}
+
+func (rh *reqHandler) doSaslAuth(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	rh.saslMech, rh.saslStep = "", nil
+	mech := string(req.Key)
+	switch {
+	case mech == SASL_PLAIN:
+		return rh.saslPlain(req.Body)
+	case mech == SASL_CRAM_MD5 && *saslCramMD5:
+		return rh.saslCramMD5()
+	case scramHashes[mech] != nil:
+		return rh.saslScram(mech, req.Body)
+	}
+	return saslFail(fmt.Sprintf("unsupported SASL auth mech: %v", req.Key))
+}
+
+func (rh *reqHandler) doSaslStep(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	step := rh.saslStep
+	if step == nil || rh.saslMech != string(req.Key) {
+		return saslFail("no SASL auth in progress")
+	}
+	rh.saslMech, rh.saslStep = "", nil
+	return step(req.Body)
+}
+
+// What a SASL username names: a User, or else a Bucket.
+type saslAuther interface {
+	Auth([]byte) bool
+	SaslSecret(mech string) (string, error)
+}
+
+func (rh *reqHandler) saslLookup(name string) saslAuther {
+	if u := users.Get(name); u != nil {
+		return u
+	}
+	if b := rh.buckets.Get(name); b != nil {
+		return b
+	}
+	return nil
+}
+
+// Switches the connection to an authenticated bucket or user.  The
+// reply doesn't tell an unknown name apart from a wrong password.
+func (rh *reqHandler) saslBucket(mech, name string,
+	auth func(saslAuther) bool) *gomemcached.MCResponse {
+	rec := &AuditRecord{
+		User:   name,
+		Remote: rh.addr,
+		Action: AUDIT_SASL_AUTH,
+		Target: mech,
+	}
+	a := rh.saslLookup(name)
+	if a == nil {
+		rec.Error = "not a bucket or user"
+		audit(rec)
+		return saslFail("failed auth")
+	}
+	if !auth(a) {
+		rec.Error = "failed auth"
+		audit(rec)
+		return saslFail(rec.Error)
+	}
+	if _, ok := a.(Bucket); ok {
+		rec.Bucket = name
+	}
+	audit(rec)
+	if u, ok := a.(*User); ok {
+		rh.loginUser(u)
+		return nil
+	}
+	rh.currentBucket = a.(Bucket)
+	rh.currentBucketName = name
+	rh.user = ""
+	return nil
+}
+
+// Keeps the connection's current bucket only if the user has a role
+// on it; otherwise the user needs to SELECT_BUCKET.
+func (rh *reqHandler) loginUser(u *User) {
+	rh.user = u.Name
+	if !u.can(rh.currentBucketName, 0) {
+		rh.currentBucket = nil
+		rh.currentBucketName = ""
+	}
+}
+
+func (rh *reqHandler) saslPlain(body []byte) *gomemcached.MCResponse {
+	if len(body) < 2 {
+		return saslFail("invalid SASL auth body")
+	}
+	targetUserPswd := bytes.Split(body, []byte("\x00"))
+	if len(targetUserPswd) != 3 {
+		return saslFail("invalid SASL auth body")
+	}
+	res := rh.saslBucket(SASL_PLAIN, string(targetUserPswd[1]), func(a saslAuther) bool {
+		return a.Auth(targetUserPswd[2])
+	})
+	if res != nil {
+		return res
+	}
+	return &gomemcached.MCResponse{}
+}
+
+func (rh *reqHandler) saslCramMD5() *gomemcached.MCResponse {
+	challenge := fmt.Sprintf("<%s.%d@cbgb>", saslNonce(), time.Now().Unix())
+	rh.saslMech = SASL_CRAM_MD5
+	rh.saslStep = func(body []byte) *gomemcached.MCResponse {
+		// The response is the username, a space, and the hex digest.
+		i := bytes.LastIndex(body, []byte(" "))
+		if i < 0 {
+			return saslFail("invalid CRAM-MD5 response")
+		}
+		digest, err := hex.DecodeString(string(body[i+1:]))
+		if err != nil {
+			return saslFail("invalid CRAM-MD5 digest")
+		}
+		res := rh.saslBucket(SASL_CRAM_MD5, string(body[:i]), func(a saslAuther) bool {
+			secret, err := a.SaslSecret(SASL_CRAM_MD5)
+			if err != nil {
+				return false
+			}
+			expected, err := cramMD5Digest(secret, []byte(challenge))
+			return err == nil && hmac.Equal(digest, expected)
+		})
+		if res != nil {
+			return res
+		}
+		return &gomemcached.MCResponse{}
+	}
+	return saslContinue(challenge)
+}
+
+// Parses SCRAM attributes like "n=user,r=nonce" into a map.
+func parseScramAttrs(msg string) map[string]string {
+	rv := map[string]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 2 && attr[1] == '=' {
+			rv[attr[:1]] = attr[2:]
+		}
+	}
+	return rv
+}
+
+func (rh *reqHandler) saslScram(mech string, body []byte) *gomemcached.MCResponse {
+	newHash := scramHashes[mech]
+
+	// The client-first message is a GS2 header, like "n,,", followed
+	// by "n=username,r=clientNonce".  Channel binding isn't supported.
+	clientFirst := string(body)
+	if !strings.HasPrefix(clientFirst, "n,") &&
+		!strings.HasPrefix(clientFirst, "y,") {
+		return saslFail("unsupported SCRAM channel binding")
+	}
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return saslFail("invalid SCRAM client-first message")
+	}
+	gs2Header := parts[0] + "," + parts[1] + ","
+	clientFirstBare := parts[2]
+	attrs := parseScramAttrs(clientFirstBare)
+	user := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+	if user == "" || attrs["r"] == "" {
+		return saslFail("invalid SCRAM client-first message")
+	}
+
+	var salt, storedKey, serverKey []byte
+	iterations := scramIterations
+	if a := rh.saslLookup(user); a != nil {
+		secret, err := a.SaslSecret(mech)
+		if err != nil {
+			return saslFail(err.Error())
+		}
+		salt, iterations, storedKey, serverKey, err = parseScramSecret(secret)
+		if err != nil {
+			return saslFail(err.Error())
+		}
+	} else {
+		// Carries on with a fake salt, failing at the proof, so that
+		// the server-first message doesn't tell that the user is
+		// unknown.  No ClientKey hashes to the zeroed storedKey.
+		salt = hmacSum(newHash, scramFakeSaltKey, []byte(user))[:16]
+		storedKey = make([]byte, newHash().Size())
+	}
+
+	nonce := attrs["r"] + saslNonce()
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce,
+		base64.StdEncoding.EncodeToString(salt), iterations)
+
+	rh.saslMech = mech
+	rh.saslStep = func(body []byte) *gomemcached.MCResponse {
+		// The client-final message is "c=binding,r=nonce,p=proof".
+		clientFinal := string(body)
+		i := strings.LastIndex(clientFinal, ",p=")
+		if i < 0 {
+			return saslFail("invalid SCRAM client-final message")
+		}
+		clientFinalBare := clientFinal[:i]
+		attrs := parseScramAttrs(clientFinalBare)
+		if attrs["r"] != nonce ||
+			attrs["c"] != base64.StdEncoding.EncodeToString([]byte(gs2Header)) {
+			return saslFail("invalid SCRAM client-final message")
+		}
+		proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+		if err != nil || len(proof) != len(storedKey) {
+			return saslFail("invalid SCRAM proof")
+		}
+
+		authMessage := []byte(clientFirstBare + "," + serverFirst + "," +
+			clientFinalBare)
+		clientSignature := hmacSum(newHash, storedKey, authMessage)
+		for j := range proof {
+			proof[j] ^= clientSignature[j] // Recovers the ClientKey.
+		}
+		h := newHash()
+		h.Write(proof)
+		res := rh.saslBucket(mech, user, func(saslAuther) bool {
+			return hmac.Equal(h.Sum(nil), storedKey)
+		})
+		if res != nil {
+			return res
+		}
+		serverSignature := hmacSum(newHash, serverKey, authMessage)
+		return &gomemcached.MCResponse{
+			Body: []byte("v=" +
+				base64.StdEncoding.EncodeToString(serverSignature)),
+		}
+	}
+	return saslContinue(serverFirst)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/pbkdf2"
+	"github.com/dustin/gomemcached"
+)
+
+func TestCramMD5Secret(t *testing.T) {
+	for _, pw := range []string{"", "secret", strings.Repeat("x", 100)} {
+		secret, err := cramMD5Secret([]byte(pw))
+		if err != nil {
+			t.Fatalf("expected cramMD5Secret to work, got: %v", err)
+		}
+		got, err := cramMD5Digest(secret, []byte("<challenge>"))
+		if err != nil {
+			t.Fatalf("expected cramMD5Digest to work, got: %v", err)
+		}
+		h := hmac.New(md5.New, []byte(pw))
+		h.Write([]byte("<challenge>"))
+		if !hmac.Equal(got, h.Sum(nil)) {
+			t.Errorf("expected CRAM-MD5 digest to match HMAC-MD5, pw: %v", pw)
+		}
+	}
+}
+
+func testSaslSetup(t *testing.T) (*reqHandler, func()) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	buckets, err := NewBuckets(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("Expected NewBuckets to succeed: %v", err)
+	}
+	bs := &BucketSettings{NumPartitions: MAX_VBUCKETS}
+	if err = bs.SetPassword(PASSWORD_HASH_PBKDF2_SHA256,
+		[]byte("a nice password")); err != nil {
+		t.Fatalf("expected SetPassword to work, got: %v", err)
+	}
+	buckets.New("haspwd", bs)
+	buckets.New("plainpwd", &BucketSettings{
+		NumPartitions: MAX_VBUCKETS,
+		PasswordHash:  "a nice password",
+	})
+	return &reqHandler{buckets: buckets}, func() {
+		buckets.CloseAll()
+		os.RemoveAll(testBucketDir)
+	}
+}
+
+func TestSaslStepWithoutAuth(t *testing.T) {
+	rh, done := testSaslSetup(t)
+	defer done()
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_STEP,
+		Key:    []byte(SASL_CRAM_MD5),
+		Body:   []byte("haspwd 00"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected SASL_STEP without SASL_AUTH to fail, got: %v", res)
+	}
+}
+
+func testSaslCramMD5(rh *reqHandler, user, pw string) *gomemcached.MCResponse {
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(SASL_CRAM_MD5),
+	})
+	if res.Status != AUTH_CONTINUE {
+		return res
+	}
+	h := hmac.New(md5.New, []byte(pw))
+	h.Write(res.Body)
+	return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_STEP,
+		Key:    []byte(SASL_CRAM_MD5),
+		Body:   []byte(user + " " + hex.EncodeToString(h.Sum(nil))),
+	})
+}
+
+func TestSaslCramMD5Disabled(t *testing.T) {
+	rh, done := testSaslSetup(t)
+	defer done()
+
+	res := testSaslCramMD5(rh, "plainpwd", "a nice password")
+	if res.Status != gomemcached.EINVAL || rh.currentBucket != nil {
+		t.Errorf("expected CRAM-MD5 to be off by default, got: %v", res)
+	}
+	b := rh.buckets.Get("haspwd").(*livebucket)
+	if _, ok := b.GetBucketSettings().SaslSecrets[SASL_CRAM_MD5]; ok {
+		t.Errorf("expected no CRAM-MD5 secret to be stored")
+	}
+}
+
+func TestSaslCramMD5(t *testing.T) {
+	defer func(v bool) { *saslCramMD5 = v }(*saslCramMD5)
+	*saslCramMD5 = true
+
+	rh, done := testSaslSetup(t)
+	defer done()
+
+	for _, user := range []string{"haspwd", "plainpwd"} {
+		rh.currentBucket = nil
+		res := testSaslCramMD5(rh, user, "wrong password")
+		if res.Status != gomemcached.EINVAL || rh.currentBucket != nil {
+			t.Errorf("expected CRAM-MD5 with a wrong password to fail, got: %v",
+				res)
+		}
+		res = testSaslCramMD5(rh, user, "a nice password")
+		if res.Status != gomemcached.SUCCESS || rh.currentBucketName != user {
+			t.Errorf("expected CRAM-MD5 to work for %v, got: %v", user, res)
+		}
+	}
+}
+
+func testSaslScram(t *testing.T, rh *reqHandler, mech, user, pw string) (
+	*gomemcached.MCResponse, []byte) {
+	newHash := scramHashes[mech]
+	clientFirstBare := "n=" + user + ",r=clientnonce"
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(mech),
+		Body:   []byte("n,," + clientFirstBare),
+	})
+	if res.Status != AUTH_CONTINUE {
+		return res, nil
+	}
+	serverFirst := string(res.Body)
+	attrs := parseScramAttrs(serverFirst)
+	if !strings.HasPrefix(attrs["r"], "clientnonce") {
+		t.Fatalf("expected server nonce to extend the client's, got: %v",
+			serverFirst)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	var iterations int
+	fmt.Sscan(attrs["i"], &iterations)
+
+	salted := pbkdf2.Key([]byte(pw), salt, iterations,
+		newHash().Size(), newHash)
+	clientKey := hmacSum(newHash, salted, []byte("Client Key"))
+	h := newHash()
+	h.Write(clientKey)
+	clientFinalBare := "c=biws,r=" + attrs["r"]
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," +
+		clientFinalBare)
+	proof := hmacSum(newHash, h.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_STEP,
+		Key:    []byte(mech),
+		Body: []byte(clientFinalBare + ",p=" +
+			base64.StdEncoding.EncodeToString(proof)),
+	})
+	serverKey := hmacSum(newHash, salted, []byte("Server Key"))
+	return res, hmacSum(newHash, serverKey, authMessage)
+}
+
+func TestSaslScram(t *testing.T) {
+	rh, done := testSaslSetup(t)
+	defer done()
+
+	for _, mech := range []string{SASL_SCRAM_SHA1, SASL_SCRAM_SHA256} {
+		for _, user := range []string{"haspwd", "plainpwd"} {
+			rh.currentBucket = nil
+			res, _ := testSaslScram(t, rh, mech, user, "wrong password")
+			if res.Status != gomemcached.EINVAL || rh.currentBucket != nil {
+				t.Errorf("expected %v with a wrong password to fail, got: %v",
+					mech, res)
+			}
+			res, serverSignature := testSaslScram(t, rh, mech, user,
+				"a nice password")
+			if res.Status != gomemcached.SUCCESS ||
+				rh.currentBucketName != user {
+				t.Errorf("expected %v to work for %v, got: %v", mech, user, res)
+			}
+			if string(res.Body) != "v="+
+				base64.StdEncoding.EncodeToString(serverSignature) {
+				t.Errorf("expected %v server signature, got: %s", mech, res.Body)
+			}
+		}
+	}
+
+	for _, mech := range []string{SASL_SCRAM_SHA1, SASL_SCRAM_SHA256} {
+		res, _ := testSaslScram(t, rh, mech, "nobody", "a nice password")
+		if res.Status != gomemcached.EINVAL || string(res.Body) != "failed auth" {
+			t.Errorf("expected %v of an unknown user to fail like a wrong"+
+				" password, got: %v", mech, res)
+		}
+	}
+	salts := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SASL_AUTH,
+			Key:    []byte(SASL_SCRAM_SHA1),
+			Body:   []byte("n,,n=nobody,r=clientnonce"),
+		})
+		if res.Status != AUTH_CONTINUE {
+			t.Fatalf("expected SCRAM of an unknown user to continue, got: %v",
+				res)
+		}
+		salts[parseScramAttrs(string(res.Body))["s"]] = true
+	}
+	if len(salts) != 1 {
+		t.Errorf("expected an unknown user to get the same salt, got: %v",
+			salts)
+	}
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(SASL_SCRAM_SHA1),
+		Body:   []byte("p=tls-unique,,n=haspwd,r=clientnonce"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected SCRAM channel binding to fail, got: %v", res)
+	}
+}
@@ -13,11 +13,13 @@
 package main
 
 import (
-	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -33,6 +35,16 @@ type reqHandler struct {
 	buckets           *Buckets
 	currentBucket     Bucket
 	currentBucketName string
+
+	addr string // Remote address, for auditing.
+
+	// A named user, authenticated by SASL or TLS, whose roles limit
+	// the commands allowed.  Empty when authenticated as a bucket.
+	user string
+
+	// A multi-step SASL auth in progress, continued by SASL_STEP.
+	saslMech string
+	saslStep func(body []byte) *gomemcached.MCResponse
 }
 
 func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
@@ -56,45 +68,20 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 			}
 		}
 		return &gomemcached.MCResponse{
-			Body: []byte("PLAIN"),
-		}
-	case gomemcached.SASL_AUTH:
-		if req.VBucket != 0 || req.Cas != 0 ||
-			len(req.Extras) != 0 || len(req.Body) < 2 {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-			}
+			Body: []byte(strings.Join(saslEnabledMechs(), " ")),
 		}
-		if !bytes.Equal(req.Key, []byte("PLAIN")) {
+	case gomemcached.SASL_AUTH, gomemcached.SASL_STEP:
+		if req.VBucket != 0 || req.Cas != 0 || len(req.Extras) != 0 {
 			return &gomemcached.MCResponse{
 				Status: gomemcached.EINVAL,
-				Body:   []byte(fmt.Sprintf("unsupported SASL auth mech: %v", req.Key)),
 			}
 		}
-		targetUserPswd := bytes.Split(req.Body, []byte("\x00"))
-		if len(targetUserPswd) != 3 {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte("invalid SASL auth body"),
-			}
-		}
-		targetBucketName := string(targetUserPswd[1])
-		targetBucket := rh.buckets.Get(targetBucketName)
-		if targetBucket == nil {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte("not a bucket"),
-			}
+		if req.Opcode == gomemcached.SASL_STEP {
+			return rh.doSaslStep(req)
 		}
-		if !targetBucket.Auth(targetUserPswd[2]) {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte("failed auth"),
-			}
-		}
-		rh.currentBucket = targetBucket
-		rh.currentBucketName = targetBucketName
-		return &gomemcached.MCResponse{}
+		return rh.doSaslAuth(req)
+	case SELECT_BUCKET:
+		return rh.doSelectBucket(req)
 	}
 
 	if rh.currentBucket == nil {
@@ -114,10 +101,23 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 		rh.currentBucket = b
 	}
 
+	if rh.user != "" {
+		u := users.Get(rh.user)
+		if u == nil || !u.can(rh.currentBucketName, requestPerm(req)) {
+			return &gomemcached.MCResponse{
+				Status: EACCESS,
+				Body:   []byte("access denied"),
+			}
+		}
+	}
+
 	switch req.Opcode {
 	case gomemcached.TAP_CONNECT:
 		chpkt, cherr := transmitPackets(w)
 		return doTap(rh.currentBucket, req, r, chpkt, cherr)
+	case UPR_OPEN:
+		chpkt, cherr := transmitPackets(w)
+		return doUpr(rh.currentBucket, req, r, chpkt, cherr)
 	case gomemcached.STAT:
 		err := doStats(rh.currentBucket, w, string(req.Key))
 		if err != nil {
@@ -127,6 +127,8 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 		return nil
 	case gomemcached.OBSERVE:
 		return doObserve(rh.currentBucket, req)
+	case gomemcached.FLUSH, gomemcached.FLUSHQ:
+		return doFlush(rh.buckets, rh.currentBucket, req)
 	}
 
 	vb, err := rh.currentBucket.GetVBucket(req.VBucket)
@@ -142,16 +144,111 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 	return vb.Dispatch(w, req)
 }
 
+// Switches a named user's connection to a bucket it has a role on.
+func (rh *reqHandler) doSelectBucket(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	u := users.Get(rh.user)
+	bucketName := string(req.Key)
+	if u == nil || !u.can(bucketName, 0) {
+		return &gomemcached.MCResponse{
+			Status: EACCESS,
+			Body:   []byte("access denied"),
+		}
+	}
+	b := rh.buckets.Get(bucketName)
+	if b == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_ENOENT,
+			Body:   []byte("not a bucket"),
+		}
+	}
+	rh.currentBucket = b
+	rh.currentBucketName = bucketName
+	return &gomemcached.MCResponse{}
+}
+
+// Deletes all items in the bucket, either now or after the delay in
+// seconds given by the optional 4 byte extras.
+func doFlush(buckets *Buckets, b Bucket,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) != 0 && len(req.Extras) != 4 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("flush extras must be empty or a 4 byte delay"),
+		}
+	}
+	if !b.GetBucketSettings().FlushEnabled {
+		return &gomemcached.MCResponse{
+			Status: NOT_SUPPORTED,
+			Body:   []byte(flushDisabled.Error()),
+		}
+	}
+	var delay uint32
+	if len(req.Extras) == 4 {
+		delay = binary.BigEndian.Uint32(req.Extras)
+	}
+	if delay > 0 {
+		name := b.Name()
+		time.AfterFunc(time.Duration(delay)*time.Second, func() {
+			fb := b
+			if !fb.Available() {
+				// The bucket was closed or quiesced meanwhile, so
+				// flush whichever bucket goes by its name now.
+				if buckets == nil {
+					return
+				}
+				if fb = buckets.Get(name); fb == nil {
+					log.Printf("delayed flush of missing bucket: %v", name)
+					return
+				}
+				if !fb.GetBucketSettings().FlushEnabled {
+					log.Printf("delayed flush of bucket: %v, err: %v",
+						name, flushDisabled)
+					return
+				}
+			}
+			if err := fb.FlushAll(); err != nil {
+				log.Printf("error: delayed flush of bucket: %v, err: %v",
+					name, err)
+			}
+		})
+	} else if err := b.FlushAll(); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("flush error %v", err)),
+		}
+	}
+	if req.Opcode.IsQuiet() {
+		return nil
+	}
+	return &gomemcached.MCResponse{}
+}
+
 func doObserve(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
 	keys, err := parseObserveKeys(req.Body)
 	if err != nil {
 		return &gomemcached.MCResponse{Status: gomemcached.EINVAL,
 			Body: []byte(err.Error())}
 	}
-	// XXX:  Fake observe
-	res := []obsStatus{}
+	res := make([]obsStatus, 0, len(keys))
+	now := time.Now()
 	for _, k := range keys {
-		res = append(res, obsStatus{k, obsPersisted, 0})
+		vb, err := b.GetVBucket(k.vbid)
+		if err == bucketUnavailable {
+			return dropConnection
+		}
+		if vb == nil || vb.GetVBState() != VBActive {
+			// Reported per key, so other keys still get observed.
+			res = append(res, obsStatus{k, obsNotMyVBucket, 0})
+			continue
+		}
+		state, cas, err := vb.observe(k.key, now)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store observe error %v", err)),
+			}
+		}
+		res = append(res, obsStatus{k, state, cas})
 	}
 
 	return &gomemcached.MCResponse{Body: encodeObserveBody(res)}
@@ -162,6 +259,13 @@ func sessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
 	defer s.Close()
 	defer doneFun()
 
+	if tc, ok := s.(*tls.Conn); ok {
+		if err := handler.authTLS(tc); err != nil {
+			log.Printf("error: sessionLoop TLS, addr: %v, err: %v", addr, err)
+			return
+		}
+	}
+
 	var err error
 	for err == nil {
 		_, err = handleMessage(s, s, handler)
@@ -207,6 +311,7 @@ func waitForConnections(ls net.Listener, maxConns int, buckets *Buckets,
 				buckets:           buckets,
 				currentBucket:     buckets.Get(defaultBucketName),
 				currentBucketName: defaultBucketName,
+				addr:              s.RemoteAddr().String(),
 			}
 			go sessionLoop(s, s.RemoteAddr().String(), handler,
 				func() {
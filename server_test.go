@@ -21,8 +21,9 @@ func TestSaslListMechs(t *testing.T) {
 	if res == nil {
 		t.Errorf("expected SASL_LIST_MECHS to be non-nil")
 	}
-	if !bytes.Equal(res.Body, []byte("PLAIN")) {
-		t.Errorf("expected SASL_LIST_MECHS to be PLAIN")
+	if !bytes.Equal(res.Body,
+		[]byte("SCRAM-SHA256 SCRAM-SHA1 PLAIN")) {
+		t.Errorf("expected SASL_LIST_MECHS to list mechs, got: %s", res.Body)
 	}
 	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
 		Opcode:  gomemcached.SASL_LIST_MECHS,
@@ -104,8 +104,8 @@ func AggregateSamples(agg Aggregatable, start *AggStatsSample) Aggregatable {
 	return agg
 }
 
-// Oldest entries appear first.
-func (a *AggStatsSample) MarshalJSON() ([]byte, error) {
+// Returns the samples in a ring, oldest first.
+func (a *AggStatsSample) Samples() []Aggregatable {
 	r := make([]Aggregatable, 0, 60)
 	c := a
 	for {
@@ -117,5 +117,10 @@ func (a *AggStatsSample) MarshalJSON() ([]byte, error) {
 			break
 		}
 	}
-	return json.Marshal(r)
+	return r
+}
+
+// Oldest entries appear first.
+func (a *AggStatsSample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Samples())
 }
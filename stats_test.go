@@ -320,8 +320,14 @@ func TestStatsSub(t *testing.T) {
 		Appends:     1,
 		Prepends:    1,
 		Deletes:     1,
+		Touches:     1,
+		GetLocks:    1,
+		Unlocks:     1,
+		LockedErrs:  1,
+		LockExpires: 1,
 		Creates:     1,
 		Updates:     1,
+		Evictions:   1,
 		RGets:       1,
 		RGetResults: 1,
 		Unknowns:    1,
@@ -16,14 +16,43 @@ var fileService *FileService
 
 var persistPeriodic *periodically
 
+// Files smaller than this aren't compacted due to fragmentation.
+var compactMinFileSize = int64(1024 * 1024)
+
+const (
+	PERSIST_REASON_INTERVAL      = "interval"      // The persist-freq timer.
+	PERSIST_REASON_REQUESTED     = "requested"     // An explicit request.
+	PERSIST_REASON_VBMETA        = "vbmeta"        // A vbucket state change.
+	PERSIST_REASON_DIRTY_ITEMS   = "dirtyItems"    // Over flushDirtyItems.
+	PERSIST_REASON_DIRTY_BYTES   = "dirtyBytes"    // Over flushDirtyBytes.
+	PERSIST_REASON_WRITES        = "writes"        // Over compact-every writes.
+	PERSIST_REASON_FRAGMENTATION = "fragmentation" // Over compactFragmentation.
+)
+
+// Records when and why a bucketstore was last flushed or compacted.
+type persistReason struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
 type bucketstore struct {
 	name          string
 	dirtiness     int64          // To track when we need flush to storage.
+	dirtyBytes    int64          // Bytes of mutations since the last flush.
+	evictedBytes  int64          // Estimated bytes of items evicted from memory.
+	flushing      int32          // 1 while an activity-driven flush runs.
 	bsf           unsafe.Pointer // *bucketstorefile
 	bsfMemoryOnly *bucketstorefile
 	endch         chan bool
 	partitions    map[uint16]*partitionstore
 	stats         *BucketStoreStats
+	evictable     bool // When true, the keys index doesn't pin items.
+	settings      *BucketSettings
+	timings       *BucketTimings
+
+	reasonLock  sync.Mutex
+	lastFlush   persistReason
+	lastCompact persistReason
 
 	keyCompareForCollection func(collName string) gkvlite.KeyCompare
 
@@ -70,10 +99,20 @@ func newBucketStore(name, path string, settings BucketSettings,
 		endch:         make(chan bool),
 		partitions:    make(map[uint16]*partitionstore),
 		stats:         bsf.stats,
+		evictable:     settings.EvictionPolicy != EVICTION_NONE,
+		settings:      settings.Copy(),
 		keyCompareForCollection: keyCompareForCollection,
 	}, nil
 }
 
+func (s *bucketstore) setTimings(timings *BucketTimings) {
+	s.timings = timings
+	s.BSF().timings = timings
+	if s.bsfMemoryOnly != nil {
+		s.bsfMemoryOnly.timings = timings
+	}
+}
+
 func (s *bucketstore) BSF() *bucketstorefile {
 	return (*bucketstorefile)(atomic.LoadPointer(&s.bsf))
 }
@@ -114,57 +153,182 @@ func (s *bucketstore) Stats() *BucketStoreStats {
 // Returns the number of unprocessed dirty items and an error if we
 // had an issue doing things.
 func (s *bucketstore) Flush() (int64, error) {
+	return s.flushFor(PERSIST_REASON_REQUESTED)
+}
+
+func (s *bucketstore) flushFor(reason string) (int64, error) {
 	s.diskLock.Lock()
 	defer s.diskLock.Unlock()
-	return s.flush_unlocked()
+	return s.flush_unlocked(reason)
 }
 
-func (s *bucketstore) flush_unlocked() (int64, error) {
+func (s *bucketstore) flush_unlocked(reason string) (int64, error) {
 	d := atomic.LoadInt64(&s.dirtiness)
+	db := atomic.LoadInt64(&s.dirtyBytes)
 	bsf := s.BSF()
 	if bsf.file != nil {
+		// Remember how far each partition got before the flush, as
+		// mutations may concurrently arrive during the flush.
+		flushingCas := make(map[*partitionstore]uint64, len(s.partitions))
+		for _, p := range s.partitions {
+			flushingCas[p] = atomic.LoadUint64(&p.lastCas)
+		}
 		if err := bsf.store.Flush(); err != nil {
 			atomic.AddInt64(&s.stats.FlushErrors, 1)
 			return atomic.LoadInt64(&s.dirtiness), err
 		}
+		if s.persistsData() {
+			for p, cas := range flushingCas {
+				atomic.StoreUint64(&p.persistedCas, cas)
+			}
+		}
 	} // else, we're in memory-only mode.
 	atomic.AddInt64(&s.stats.Flushes, 1)
+	atomic.AddInt64(&s.dirtyBytes, -db)
+	s.noteReason(&s.lastFlush, reason)
 
 	defaultEventManager.sendEvent(s.name, "stats", s.Stats())
 	return atomic.AddInt64(&s.dirtiness, -d), nil
 }
 
-func (s *bucketstore) periodicPersist(time.Time) bool {
-	d, _ := s.Flush()
-	if s.stats.Writes-s.stats.LastCompactAt > int64(*compactEvery) {
-		s.stats.LastCompactAt = s.stats.Writes
-		if err := s.Compact(); err != nil {
-			log.Printf("compact err: %v", err)
-		}
-	}
+func (s *bucketstore) noteReason(r *persistReason, reason string) {
+	s.reasonLock.Lock()
+	*r = persistReason{Reason: reason, At: time.Now()}
+	s.reasonLock.Unlock()
+}
+
+// Returns why the bucketstore was last flushed and compacted.
+func (s *bucketstore) LastReasons() (lastFlush, lastCompact persistReason) {
+	s.reasonLock.Lock()
+	defer s.reasonLock.Unlock()
+	return s.lastFlush, s.lastCompact
+}
+
+// Returns true if item data (not just metadata) reaches storage.
+func (s *bucketstore) persistsData() bool {
+	return s.bsfMemoryOnly == nil && s.BSF().file != nil
+}
+
+func (s *bucketstore) periodicPersist(t time.Time) bool {
+	d, _ := s.flushFor(PERSIST_REASON_INTERVAL)
+	s.maybeCompact(t)
 	if d > 0 {
 		log.Printf("flushed all but %v items (retrying)", d)
 	}
 	return d > 0
 }
 
+// Compacts the bucketstore if enough writes have happened or if its
+// file is fragmented enough, but only during the compaction window.
+func (s *bucketstore) maybeCompact(t time.Time) {
+	if !inCompactWindow(s.settings.CompactWindow, t) {
+		return
+	}
+	writes := atomic.LoadInt64(&s.stats.Writes)
+	lastCompactAt := atomic.LoadInt64(&s.stats.LastCompactAt)
+	reason := ""
+	if writes-lastCompactAt > int64(*compactEvery) {
+		reason = PERSIST_REASON_WRITES
+	} else if s.settings.CompactFragmentation > 0 &&
+		s.Fragmentation() >= s.settings.CompactFragmentation {
+		reason = PERSIST_REASON_FRAGMENTATION
+	}
+	if reason == "" {
+		return
+	}
+	// Only one concurrent caller gets to compact.
+	if !atomic.CompareAndSwapInt64(&s.stats.LastCompactAt, lastCompactAt, writes) {
+		return
+	}
+	if err := s.compactFor(reason); err != nil {
+		log.Printf("compact err: %v", err)
+	}
+}
+
+// Returns the percentage of the store file that isn't live data, or
+// 0 for files too small to be worth compacting.
+func (s *bucketstore) Fragmentation() int {
+	fileSize := s.Stats().FileSize
+	if fileSize < compactMinFileSize || s.BSF().file == nil {
+		return 0
+	}
+	liveBytes := s.LiveBytes()
+	if liveBytes >= fileSize {
+		return 0
+	}
+	return int((fileSize - liveBytes) * 100 / fileSize)
+}
+
+// Returns the bytes of keys and changes held in the partitions.
+func (s *bucketstore) LiveBytes() (liveBytes int64) {
+	s.diskLock.Lock()
+	ps := make([]*partitionstore, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		ps = append(ps, p)
+	}
+	s.diskLock.Unlock()
+
+	for _, p := range ps {
+		keys, changes := p.colls()
+		for _, c := range []*gkvlite.Collection{keys, changes} {
+			_, numBytes, err := c.GetTotals()
+			if err == nil {
+				liveBytes += int64(numBytes)
+			}
+		}
+	}
+	return liveBytes
+}
+
 func (s *bucketstore) mkPersistFun() func(time.Time) bool {
 	return func(t time.Time) bool {
 		return s.periodicPersist(t)
 	}
 }
 
-func (s *bucketstore) dirty(force bool) {
+func (s *bucketstore) dirty(force bool, numBytes int64) {
 	if force || s.bsfMemoryOnly == nil {
 		newval := atomic.AddInt64(&s.dirtiness, 1)
+		newBytes := atomic.AddInt64(&s.dirtyBytes, numBytes)
 		if newval == 1 {
-			// TODO: Might want to kick off a persistence right now
-			// rather than only schedule a periodic persistence.
 			persistPeriodic.Register(s.endch, s.mkPersistFun())
 		}
+		if s.settings.FlushDirtyItems > 0 &&
+			newval >= s.settings.FlushDirtyItems {
+			s.kickFlush(PERSIST_REASON_DIRTY_ITEMS)
+		} else if s.settings.FlushDirtyBytes > 0 &&
+			newBytes >= s.settings.FlushDirtyBytes {
+			s.kickFlush(PERSIST_REASON_DIRTY_BYTES)
+		}
 	}
 }
 
+// Returns the number of items and bytes not yet flushed.
+func (s *bucketstore) Dirtiness() (items, bytes int64) {
+	return atomic.LoadInt64(&s.dirtiness), atomic.LoadInt64(&s.dirtyBytes)
+}
+
+// Starts a flush right away rather than waiting for the periodic
+// persistence, unless one is already running.
+func (s *bucketstore) kickFlush(reason string) {
+	if !atomic.CompareAndSwapInt32(&s.flushing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.flushing, 0)
+		select {
+		case <-s.endch:
+			return
+		default:
+		}
+		if _, err := s.flushFor(reason); err != nil {
+			log.Printf("flush err: %v", err)
+			return
+		}
+		s.maybeCompact(time.Now())
+	}()
+}
+
 func (s *bucketstore) collMeta(collName string) *gkvlite.Collection {
 	c := s.BSF().store.GetCollection(collName)
 	if c == nil {
@@ -201,6 +365,7 @@ func (s *bucketstore) getPartitionStore(vbid uint16) (res *partitionstore) {
 
 	k := s.coll(fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_KEYS))
 	c := s.coll(fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_CHANGES))
+	s.coll(fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_TOMBS))
 
 	res = s.partitions[vbid]
 	if res == nil {
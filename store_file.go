@@ -9,6 +9,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/steveyen/gkvlite"
 )
@@ -22,6 +23,8 @@ type bucketstorefile struct {
 	lock  sync.Mutex
 	purge bool // When true, purge file when GC finalized.
 	stats *BucketStoreStats
+
+	timings *BucketTimings // May be nil, such as for a views store.
 }
 
 func NewBucketStoreFile(path string, file FileLike,
@@ -46,6 +49,9 @@ func (bsf *bucketstorefile) apply(fun func()) {
 func (bsf *bucketstorefile) ReadAt(p []byte, off int64) (n int, err error) {
 	bsf.apply(func() {
 		atomic.AddInt64(&bsf.stats.Reads, 1)
+		if bsf.timings != nil {
+			defer bsf.timings.StoreReads.Since(time.Now())
+		}
 		n, err = bsf.file.ReadAt(p, off)
 		if err != nil {
 			atomic.AddInt64(&bsf.stats.ReadErrors, 1)
@@ -63,6 +69,9 @@ func (bsf *bucketstorefile) WriteAt(p []byte, off int64) (n int, err error) {
 			return
 		}
 		atomic.AddInt64(&bsf.stats.Writes, 1)
+		if bsf.timings != nil {
+			defer bsf.timings.StoreWrites.Since(time.Now())
+		}
 		n, err = bsf.file.WriteAt(p, off)
 		if err != nil {
 			atomic.AddInt64(&bsf.stats.WriteErrors, 1)
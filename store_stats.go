@@ -23,6 +23,9 @@ type BucketStoreStats struct {
 	ReadBytes  int64 `json:"readBytes"`
 	WriteBytes int64 `json:"writeBytes"`
 
+	BgFetches    int64 `json:"bgFetches"` // Items read back into memory.
+	BgFetchBytes int64 `json:"bgFetchBytes"`
+
 	FileSize   int64 `json:"fileSize"`
 	NodeAllocs int64 `json:"nodeAllocs"`
 }
@@ -48,6 +51,8 @@ func (bss *BucketStoreStats) Op(in *BucketStoreStats, op func(int64, int64) int6
 	bss.CompactErrors = op(bss.CompactErrors, atomic.LoadInt64(&in.CompactErrors))
 	bss.ReadBytes = op(bss.ReadBytes, atomic.LoadInt64(&in.ReadBytes))
 	bss.WriteBytes = op(bss.WriteBytes, atomic.LoadInt64(&in.WriteBytes))
+	bss.BgFetches = op(bss.BgFetches, atomic.LoadInt64(&in.BgFetches))
+	bss.BgFetchBytes = op(bss.BgFetchBytes, atomic.LoadInt64(&in.BgFetchBytes))
 	bss.FileSize = op(bss.FileSize, atomic.LoadInt64(&in.FileSize))
 	bss.NodeAllocs = op(bss.NodeAllocs, atomic.LoadInt64(&in.NodeAllocs))
 }
@@ -72,6 +77,8 @@ func (bss *BucketStoreStats) Equal(in *BucketStoreStats) bool {
 		bss.CompactErrors == atomic.LoadInt64(&in.CompactErrors) &&
 		bss.ReadBytes == atomic.LoadInt64(&in.ReadBytes) &&
 		bss.WriteBytes == atomic.LoadInt64(&in.WriteBytes) &&
+		bss.BgFetches == atomic.LoadInt64(&in.BgFetches) &&
+		bss.BgFetchBytes == atomic.LoadInt64(&in.BgFetchBytes) &&
 		bss.FileSize == atomic.LoadInt64(&in.FileSize) &&
 		bss.NodeAllocs == atomic.LoadInt64(&in.NodeAllocs)
 }
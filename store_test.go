@@ -690,3 +690,37 @@ func TestReadAtError(t *testing.T) {
 		t.Errorf("expected readerrors to be higher")
 	}
 }
+
+func TestFlushDirtyItems(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:   MAX_VBUCKETS,
+			FlushDirtyItems: 3,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	if b0.SetVBState(2, VBActive) != nil {
+		t.Errorf("expected SetVBState to work")
+	}
+
+	testLoadInts(t, r0, 2, 5)
+
+	bs := b0.GetBucketStore(0)
+	for i := 0; i < 100; i++ {
+		lastFlush, _ := bs.LastReasons()
+		if lastFlush.Reason == PERSIST_REASON_DIRTY_ITEMS {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lastFlush, _ := bs.LastReasons()
+	t.Errorf("expected a flush due to dirty items, got: %#v", lastFlush)
+}
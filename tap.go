@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/dustin/gomemcached"
-	"github.com/dustin/gomemcached/server"
 )
 
 // Message sent on object change
@@ -27,9 +27,256 @@ func (m mutation) String() string {
 	return fmt.Sprintf("%v: vb:%v %s -> %v", sym, m.vb, m.key, m.cas)
 }
 
+// Message sent to bucket subscribers after all items were flushed.
+type bucketFlush struct {
+	bucket Bucket
+}
+
 // How often to send opaque "heartbeats" on tap streams.
 var tapTickFreq = time.Second
 
+// For consumers that SUPPORT_ACK, every tapAckInterval'th message
+// requests an ACK, and sending pauses while tapAckWindow of those
+// requests are unacknowledged.
+var tapAckInterval = 100
+var tapAckWindow = 10
+
+// Flag in the TAP message header (the extras) requesting an ACK.
+const TAP_FLAG_ACK = uint16(0x01)
+
+// The TTL (hop count) of TAP messages that we originate.
+const TAP_TTL = byte(0xff)
+
+// The per-connection state of a TAP stream.
+type tapStream struct {
+	b     Bucket
+	chpkt chan<- transmissible
+	cherr <-chan error
+	err   error // The first transmit or ACK error.
+
+	vbuckets   map[uint16]bool   // From LIST_VBUCKETS; nil means all vbuckets.
+	takeovers  map[uint16]bool   // Vbuckets still to be taken over.
+	deadch     <-chan error      // Non-nil while deadVB is being set dead.
+	deadVB     *VBucket          // The vbucket that's being taken over.
+	sentCas    map[uint16]uint64 // Highest CAS sent, keyed by vbucket.
+	supportAck bool
+	ackch      <-chan error // Nil unless reading ACKs.
+	numSent    int
+	unacked    int
+	opaque     uint32
+}
+
+func newTapStream(b Bucket, tc *gomemcached.TapConnect,
+	chpkt chan<- transmissible, cherr <-chan error) (
+	*tapStream, *gomemcached.MCResponse) {
+	ts := &tapStream{
+		b:          b,
+		chpkt:      chpkt,
+		cherr:      cherr,
+		sentCas:    map[uint16]uint64{},
+		supportAck: tapFlagExists(tc, gomemcached.SUPPORT_ACK),
+	}
+	if v, ok := tc.Flags[gomemcached.LIST_VBUCKETS]; ok {
+		vbids, ok := v.([]uint16)
+		if !ok {
+			return nil, &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("bad LIST_VBUCKETS: %v", v)),
+			}
+		}
+		ts.vbuckets = map[uint16]bool{}
+		for _, vbid := range vbids {
+			ts.vbuckets[vbid] = true
+		}
+	}
+	res, takeover := tapFlagBool(tc, gomemcached.TAKEOVER_VBUCKETS)
+	if res != nil {
+		return nil, res
+	}
+	if takeover {
+		ts.takeovers = map[uint16]bool{}
+		np := b.GetBucketSettings().NumPartitions
+		for vbid := 0; vbid < np; vbid++ {
+			if !ts.wants(uint16(vbid)) {
+				continue
+			}
+			vb, _ := b.GetVBucket(uint16(vbid))
+			if vb != nil && vb.GetVBState() == VBActive {
+				ts.takeovers[uint16(vbid)] = true
+			}
+		}
+		if len(ts.takeovers) == 0 {
+			return nil, &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("no active vbuckets to take over"),
+			}
+		}
+	}
+	return ts, nil
+}
+
+func (ts *tapStream) wants(vbid uint16) bool {
+	return ts.vbuckets == nil || ts.vbuckets[vbid]
+}
+
+func (ts *tapStream) windowFull() bool {
+	return ts.ackch != nil && ts.unacked >= tapAckWindow
+}
+
+func (ts *tapStream) transmit(pkt *gomemcached.MCRequest) {
+	ts.numSent++
+	if ts.supportAck && ts.numSent%tapAckInterval == 0 {
+		ts.requestAck(pkt)
+	}
+	ts.chpkt <- pkt
+	if ts.err == nil {
+		select {
+		case ts.err = <-ts.cherr:
+		default:
+		}
+	}
+}
+
+func (ts *tapStream) requestAck(pkt *gomemcached.MCRequest) {
+	flags := binary.BigEndian.Uint16(pkt.Extras[2:])
+	binary.BigEndian.PutUint16(pkt.Extras[2:], flags|TAP_FLAG_ACK)
+	ts.opaque++
+	pkt.Opaque = ts.opaque
+	ts.unacked++
+}
+
+// Blocks until at most max ACK requests are outstanding.
+func (ts *tapStream) waitForAcks(max int) error {
+	for ts.err == nil && ts.ackch != nil && ts.unacked > max {
+		select {
+		case ts.err = <-ts.ackch:
+			ts.unacked--
+		case ts.err = <-ts.cherr:
+			if ts.err == nil {
+				ts.err = io.EOF
+			}
+		}
+	}
+	return ts.err
+}
+
+func (ts *tapStream) transmitItem(vbid uint16, i *item) {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: vbid,
+		Key:     i.key,
+		Cas:     i.cas,
+	}
+	if i.isDeletion() {
+		pkt.Opcode = gomemcached.TAP_DELETE
+		pkt.Extras = tapItemExtras(nil)
+	} else {
+		pkt.Extras = tapItemExtras(i)
+		pkt.Body = i.data
+	}
+	ts.transmit(pkt)
+}
+
+// Encodes the extras of a TAP_MUTATION (when i is non-nil) or a
+// TAP_DELETE, per the TAP spec: engine private length (2 bytes), TAP
+// flags (2), TTL (1), reserved (3), and for mutations, the item flags
+// (4) and expiration (4).  We have no engine private data.
+func tapItemExtras(i *item) []byte {
+	if i == nil {
+		rv := make([]byte, 8)
+		rv[4] = TAP_TTL
+		return rv
+	}
+	rv := make([]byte, 16)
+	rv[4] = TAP_TTL
+	binary.BigEndian.PutUint32(rv[8:], i.flag)
+	binary.BigEndian.PutUint32(rv[12:], i.exp)
+	return rv
+}
+
+func (ts *tapStream) transmitVBucketSet(vbid uint16, state VBState) {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_VBUCKET_SET,
+		VBucket: vbid,
+		Extras:  make([]byte, 8),
+		Body:    make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(pkt.Body, uint32(state))
+	ts.transmit(pkt)
+}
+
+// Sends a vbucket's changes that are newer than what was already
+// sent.  When the ACK window fills, it either blocks for ACKs or
+// returns false so the caller can resume later.
+func (ts *tapStream) transmitChanges(vb *VBucket, block, dump bool) (
+	complete bool, err error) {
+	from := ts.sentCas[vb.vbid]
+	complete = true
+	err = vb.ps.visitChanges(casBytes(from+1), true, func(i *item) bool {
+		if i.cas <= from {
+			return true
+		}
+		if len(i.key) > 0 && !(dump && i.isDeletion()) {
+			ts.transmitItem(vb.vbid, i)
+		}
+		ts.sentCas[vb.vbid] = i.cas
+		if ts.windowFull() {
+			if !block {
+				complete = false
+				return false
+			}
+			ts.waitForAcks(tapAckWindow - 1)
+		}
+		return ts.err == nil
+	})
+	if err == nil {
+		err = ts.err
+	}
+	return complete, err
+}
+
+// Hands a drained TAKEOVER_VBUCKETS vbucket over to the consumer,
+// one at a time: the consumer's vbucket goes pending and the vbucket
+// here is set dead, after which finishTakeOver() completes it.  The
+// vbucket is set dead on another goroutine, as the bucket's observers
+// wait on the stream to read the resulting vbucketChange.
+func (ts *tapStream) takeOver(registered map[uint16]*VBucket) error {
+	if ts.deadch != nil || ts.unacked > 0 {
+		return nil
+	}
+	for vbid := range ts.takeovers {
+		vb := registered[vbid]
+		if vb == nil || vb.ps.getLastCas() > ts.sentCas[vbid] {
+			continue
+		}
+		ts.transmitVBucketSet(vbid, VBPending)
+		deadch := make(chan error, 1)
+		go func(vbid uint16) {
+			deadch <- ts.b.SetVBState(vbid, VBDead)
+		}(vbid)
+		ts.deadch, ts.deadVB = deadch, vb
+		break
+	}
+	return ts.err
+}
+
+// Sends the last changes of the vbucket that was just set dead, and
+// then the consumer's vbucket goes active.  Returns true once every
+// takeover is done.
+func (ts *tapStream) finishTakeOver(err error) (bool, error) {
+	vb := ts.deadVB
+	ts.deadch, ts.deadVB = nil, nil
+	if err != nil {
+		return false, err
+	}
+	if _, err := ts.transmitChanges(vb, true, false); err != nil {
+		return false, err
+	}
+	ts.transmitVBucketSet(vb.vbid, VBActive)
+	delete(ts.takeovers, vb.vbid)
+	return len(ts.takeovers) == 0, ts.err
+}
+
 func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
 	tc, err := req.ParseTapCommands()
@@ -40,14 +287,25 @@ func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 		}
 	}
 
-	// TODO: TAP of a vbucket list.
+	ts, res := newTapStream(b, &tc, chpkt, cherr)
+	if res != nil {
+		return res
+	}
+
+	donech := make(chan bool)
+	defer close(donech)
+	if ts.supportAck && r != nil {
+		ackch := make(chan error)
+		ts.ackch = ackch
+		go readTapAcks(r, ackch, donech)
+	}
 
 	res, yesDump := tapFlagBool(&tc, gomemcached.DUMP)
 	if res != nil {
 		return res
 	}
 	if yesDump || tapFlagExists(&tc, gomemcached.BACKFILL) {
-		res := doTapBackFill(b, req, r, chpkt, cherr, tc)
+		res := doTapBackFill(ts, r, yesDump, tapBackFillCas(&tc))
 		if res != nil {
 			return res
 		}
@@ -57,9 +315,7 @@ func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 		}
 	}
 
-	// TODO: There's probably a mutation gap between backfill and tap-forward.
-
-	return doTapForward(b, req, r, chpkt, cherr, tc)
+	return doTapForward(ts)
 }
 
 func tapFlagBool(tc *gomemcached.TapConnect, flag gomemcached.TapConnectFlag) (
@@ -79,95 +335,190 @@ func tapFlagExists(tc *gomemcached.TapConnect, flag gomemcached.TapConnectFlag)
 	return ok
 }
 
-func doTapForward(b Bucket, req *gomemcached.MCRequest, r io.Reader,
-	chpkt chan<- transmissible, cherr <-chan error,
-	tc gomemcached.TapConnect) *gomemcached.MCResponse {
+// The BACKFILL value is treated as a CAS position, so only changes
+// after it are backfilled, allowing a consumer to resume a stream.
+func tapBackFillCas(tc *gomemcached.TapConnect) uint64 {
+	if v, ok := tc.Flags[gomemcached.BACKFILL].(uint64); ok {
+		return v
+	}
+	return 0
+}
+
+// Tracks vbuckets that have changes that might not be sent yet.
+// Observer notifications are absorbed here without blocking, so that
+// a slow stream consumer doesn't back up the vbucket observers.
+type pendingVBuckets struct {
+	lock sync.Mutex
+	vbs  map[uint16]bool
+	ch   chan bool // Signaled when vbs becomes non-empty.
+}
+
+func newPendingVBuckets() *pendingVBuckets {
+	return &pendingVBuckets{vbs: map[uint16]bool{}, ch: make(chan bool, 1)}
+}
+
+func (p *pendingVBuckets) add(vbid uint16) {
+	p.lock.Lock()
+	p.vbs[vbid] = true
+	p.lock.Unlock()
+	select {
+	case p.ch <- true:
+	default:
+	}
+}
+
+func (p *pendingVBuckets) take() map[uint16]bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rv := p.vbs
+	p.vbs = map[uint16]bool{}
+	return rv
+}
+
+func (p *pendingVBuckets) absorb(mch <-chan interface{}, donech <-chan bool) {
+	for {
+		select {
+		case mi := <-mch:
+			if m, ok := mi.(mutation); ok {
+				p.add(m.vb)
+			}
+		case <-donech:
+			return
+		}
+	}
+}
+
+// Unsubscribes from a bucket's vbucket state changes, draining the
+// channel until donech is closed, as a pending notification (such as
+// from a takeover) would otherwise block the unsubscribe.
+func unsubscribeDraining(b Bucket, bch chan interface{}, donech <-chan bool) {
+	go func() {
+		for {
+			select {
+			case <-bch:
+			case <-donech:
+				return
+			}
+		}
+	}()
+	b.Unsubscribe(bch)
+}
+
+func doTapForward(ts *tapStream) *gomemcached.MCResponse {
 	bch := make(chan interface{})
-	mch := make(chan interface{}, 1000)
+	mch := make(chan interface{}, 100)
+	donech := make(chan bool)
+	defer close(donech)
 
-	b.Subscribe(bch)
-	defer b.Unsubscribe(bch)
+	pending := newPendingVBuckets()
+	go pending.absorb(mch, donech)
+
+	ts.b.Subscribe(bch)
+	defer unsubscribeDraining(ts.b, bch, donech)
 
 	ticker := time.NewTicker(tapTickFreq)
 	defer ticker.Stop()
 
 	// defer cleanup vbucket mchs
-	registered := map[uint16]bool{}
+	registered := map[uint16]*VBucket{}
 	defer func() {
-		for vbid := range registered {
-			vb, _ := b.GetVBucket(vbid)
-			if vb != nil {
-				vb.observer.Unregister(mch)
-			}
+		for _, vb := range registered {
+			vb.observer.Unregister(mch)
 		}
 	}()
 
 	for {
 		select {
 		case ci := <-bch:
+			if _, ok := ci.(bucketFlush); ok {
+				ts.transmit(&gomemcached.MCRequest{
+					Opcode: gomemcached.TAP_FLUSH,
+					Extras: make([]byte, 8),
+				})
+				continue
+			}
 			// VBucket state change, so update registrations
 			c := ci.(vbucketChange)
-			if vb := c.getVBucket(); vb != nil {
-				if c.newState == VBActive {
-					vb.observer.Register(mch)
-					registered[vb.vbid] = true
-				} else if vb != nil {
-					vb.observer.Unregister(mch)
-					delete(registered, vb.vbid)
-				}
+			if !ts.wants(c.vbid) {
+				continue
 			}
-		case mi := <-mch:
-			// Send a change
-			m := mi.(mutation)
-			pkt := &gomemcached.MCRequest{
-				Opcode:  gomemcached.TAP_MUTATION,
-				Key:     m.key,
-				VBucket: m.vb,
-			}
-			if m.deleted {
-				pkt.Opcode = gomemcached.TAP_DELETE
-				pkt.Extras = make([]byte, 8) // TODO: fill
-			} else {
-				pkt.Extras = make([]byte, 16) // TODO: fill
-
-				vb, _ := b.GetVBucket(m.vb)
-				if vb != nil {
-					// TODO: if vb is suspended, the get() will freeze
-					// the TAP stream until vb is resumed; that may be
-					// or may not be what we want.
-					res := vb.get(m.key)
-					if res.Status != gomemcached.SUCCESS {
-						log.Printf("tapped a missing item, skipping key: %s, res: %#v",
-							m.key, res)
-						continue
+			if ts.deadVB != nil && ts.deadVB.vbid == c.vbid {
+				continue // finishTakeOver() still needs its sentCas.
+			}
+			if vb := c.getVBucket(); vb != nil && c.newState == VBActive {
+				if registered[c.vbid] != vb {
+					vb.observer.Register(mch)
+					registered[c.vbid] = vb
+					if _, ok := ts.sentCas[c.vbid]; !ok {
+						ts.sentCas[c.vbid] = vb.ps.getLastCas()
 					}
-					pkt.Body = res.Body
-				} else {
-					log.Printf("tapping a missing partition: %v", m.vb)
-					continue
 				}
+				pending.add(c.vbid)
+			} else if vbPrev := registered[c.vbid]; vbPrev != nil {
+				vbPrev.observer.Unregister(mch)
+				delete(registered, c.vbid)
+				delete(ts.sentCas, c.vbid)
+			}
+		case <-pending.ch:
+		case err := <-ts.deadch:
+			done, err := ts.finishTakeOver(err)
+			if err != nil {
+				return &gomemcached.MCResponse{Fatal: true}
 			}
-			chpkt <- pkt
+			if done {
+				close(ts.chpkt)
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+		case err := <-ts.ackch:
+			if err != nil {
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+			ts.unacked--
 		case <-ticker.C:
 			// Send a noop
-			chpkt <- &gomemcached.MCRequest{
+			ts.chpkt <- &gomemcached.MCRequest{
 				Opcode: gomemcached.TAP_OPAQUE,
 				Extras: make([]byte, 8),
 			}
-		case <-cherr:
+		case <-ts.cherr:
+			return &gomemcached.MCResponse{Fatal: true}
+		}
+
+		if !ts.windowFull() {
+			for vbid := range pending.take() {
+				vb := registered[vbid]
+				if vb == nil {
+					continue
+				}
+				complete, err := ts.transmitChanges(vb, false, false)
+				if err != nil {
+					return &gomemcached.MCResponse{Fatal: true}
+				}
+				if !complete {
+					pending.add(vbid)
+				}
+			}
+		}
+		if ts.err != nil {
 			return &gomemcached.MCResponse{Fatal: true}
 		}
+
+		if ts.takeovers != nil {
+			if err := ts.takeOver(registered); err != nil {
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+		}
 	}
 }
 
-func doTapBackFill(b Bucket, req *gomemcached.MCRequest, r io.Reader,
-	chpkt chan<- transmissible, cherr <-chan error,
-	tc gomemcached.TapConnect) *gomemcached.MCResponse {
-	var err error
-
-	np := b.GetBucketSettings().NumPartitions
+func doTapBackFill(ts *tapStream, r io.Reader, dump bool,
+	from uint64) *gomemcached.MCResponse {
+	np := ts.b.GetBucketSettings().NumPartitions
 	for vbid := 0; vbid < np; vbid++ {
-		vb, _ := b.GetVBucket(uint16(vbid))
+		if !ts.wants(uint16(vbid)) {
+			continue
+		}
+		vb, _ := ts.b.GetVBucket(uint16(vbid))
 		if vb == nil {
 			continue
 		}
@@ -175,68 +526,109 @@ func doTapBackFill(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 			continue
 		}
 
-		errVisit := vb.ps.visitItems(nil, true, func(i *item) bool {
-			// TODO: Need to occasionally send TAP_ACK's.
-			chpkt <- &gomemcached.MCRequest{
-				Opcode:  gomemcached.TAP_MUTATION,
-				VBucket: uint16(vbid),
-				Key:     i.key,
-				Cas:     i.cas,
-				Extras:  make([]byte, 16),
-				Body:    i.data,
-			}
-			select {
-			case err = <-cherr:
-				return false
-			default:
-			}
-			return true
-		})
-		if errVisit != nil {
-			close(chpkt)
+		lastCas := vb.ps.getLastCas()
+		ts.sentCas[vb.vbid] = from
+		if _, err := ts.transmitChanges(vb, true, dump); err != nil {
+			close(ts.chpkt)
 			return &gomemcached.MCResponse{Fatal: true}
 		}
-		if err != nil {
-			close(chpkt)
-			return &gomemcached.MCResponse{Fatal: true}
+		if ts.sentCas[vb.vbid] < lastCas {
+			ts.sentCas[vb.vbid] = lastCas
 		}
 	}
 
-	// TODO: Skipping error handling for now, as it always errors
-	// since the memcached.ReadPacket() is expecting a REQ instead of
-	// RES for the ACK's header magic.  The fix involves exposing more
-	// helper functions in gomemcached to help us flip the REQ/RES
-	// stream direction.
-	doTapAck(r, chpkt, cherr)
+	if err := doTapAck(ts, r); err != nil && ts.ackch != nil {
+		close(ts.chpkt)
+		return &gomemcached.MCResponse{Fatal: true}
+	}
 
 	return nil
 }
 
-func doTapAck(r io.Reader, chpkt chan<- transmissible, cherr <-chan error) error {
+// Sends an ACK request and waits for the response.  Consumers that
+// didn't ask to SUPPORT_ACK might not respond meaningfully, so the
+// caller ignores errors from them.
+func doTapAck(ts *tapStream, r io.Reader) error {
 	ackReq := &gomemcached.MCRequest{
 		Opcode: gomemcached.TAP_OPAQUE,
 		Extras: make([]byte, 8),
 	}
-	TAP_FLAG_ACK := uint16(0x01)
-	binary.BigEndian.PutUint16(ackReq.Extras[2:], TAP_FLAG_ACK)
+	ts.requestAck(ackReq)
+	ts.chpkt <- ackReq
+
+	if ts.ackch != nil {
+		return ts.waitForAcks(0)
+	}
+	ts.unacked--
 
-	chpkt <- ackReq
 	select {
-	case err := <-cherr:
+	case err := <-ts.cherr:
 		return err
 	default:
 	}
+	if r == nil {
+		return nil
+	}
 
 	// TODO: Validate that the response matches the ACK that we expect.
-	_, err := memcached.ReadPacket(r)
+	_, err := readTapResponse(r)
 	return err
 }
 
+// Reads a response packet from a TAP consumer, such as an ACK.
+func readTapResponse(r io.Reader) (*gomemcached.MCResponse, error) {
+	hdr := make([]byte, gomemcached.HDR_LEN)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != gomemcached.RES_MAGIC {
+		return nil, fmt.Errorf("bad response magic: 0x%02x", hdr[0])
+	}
+	klen := int(binary.BigEndian.Uint16(hdr[2:]))
+	elen := int(hdr[4])
+	blen := int(binary.BigEndian.Uint32(hdr[8:]))
+	if blen < klen+elen || blen > MAX_ITEM_DATA_LENGTH {
+		return nil, fmt.Errorf("bad response body length: %v", blen)
+	}
+	buf := make([]byte, blen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &gomemcached.MCResponse{
+		Opcode: gomemcached.CommandCode(hdr[1]),
+		Status: gomemcached.Status(binary.BigEndian.Uint16(hdr[6:])),
+		Opaque: binary.BigEndian.Uint32(hdr[12:]),
+		Cas:    binary.BigEndian.Uint64(hdr[16:]),
+		Extras: buf[:elen],
+		Key:    buf[elen : elen+klen],
+		Body:   buf[elen+klen:],
+	}, nil
+}
+
+func readTapAcks(r io.Reader, ackch chan<- error, donech <-chan bool) {
+	for {
+		res, err := readTapResponse(r)
+		if err == nil && res.Status != gomemcached.SUCCESS {
+			err = fmt.Errorf("tap ack error, res: %v", res)
+		}
+		select {
+		case ackch <- err:
+		case <-donech:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func MutationLogger(ch chan interface{}) {
 	for i := range ch {
 		switch o := i.(type) {
 		case mutation:
 			log.Printf("tap mutation: %v", o)
+		case bucketFlush:
+			log.Printf("tap bucket flush: %v", o.bucket.Name())
 		case vbucketChange:
 			log.Printf("tap partition change: %v", o)
 			if o.newState == VBActive {
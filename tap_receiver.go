@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	mcclient "github.com/dustin/gomemcached/client"
+	"github.com/dustin/gomemcached/server"
+)
+
+// Bounds on the delay before a TAP receiver reconnects to its source.
+var tapReceiverRetryMin = time.Second
+var tapReceiverRetryMax = time.Second * 30
+
+var tapReceiverStopped = errors.New("TAP receiver stopped")
+
+// All the TAP receivers, keyed by bucket name and then receiver name.
+var tapReceivers = &TapReceivers{m: map[string]map[string]*TapReceiver{}}
+
+type TapReceiverStats struct {
+	Connects    int64 `json:"connects"`
+	Mutations   int64 `json:"mutations"`
+	Deletes     int64 `json:"deletes"`
+	VBucketSets int64 `json:"vbucketSets"`
+	Opaques     int64 `json:"opaques"`
+	Acks        int64 `json:"acks"`
+	Skips       int64 `json:"skips"`
+	Errors      int64 `json:"errors"`
+}
+
+// A TAP receiver connects outbound to a TAP source, and applies the
+// incoming TAP_MUTATION, TAP_DELETE and TAP_VBUCKET_SET messages to
+// the non-active vbuckets of a bucket, so that the bucket can act as
+// a replication target.  Missing vbuckets are created as replicas.
+type TapReceiver struct {
+	Name      string           `json:"name"`
+	Bucket    string           `json:"bucket"`
+	Addr      string           `json:"addr"`
+	SrcBucket string           `json:"srcBucket"`
+	Started   time.Time        `json:"started"`
+	Stats     TapReceiverStats `json:"stats"`
+
+	srcPassword string
+	buckets     *Buckets // Optional, used to reacquire a quiesced bucket.
+	stopch      chan bool
+	donech      chan bool
+
+	lock      sync.Mutex // Protects the fields below.
+	b         Bucket
+	conn      net.Conn
+	connected bool
+	lastErr   error
+}
+
+func NewTapReceiver(name string, buckets *Buckets, bucketName string, b Bucket,
+	addr, srcBucket, srcPassword string) *TapReceiver {
+	return &TapReceiver{
+		Name:        name,
+		Bucket:      bucketName,
+		Addr:        addr,
+		SrcBucket:   srcBucket,
+		srcPassword: srcPassword,
+		buckets:     buckets,
+		b:           b,
+		stopch:      make(chan bool),
+		donech:      make(chan bool),
+	}
+}
+
+func (r *TapReceiver) Start() {
+	r.Started = time.Now()
+	go r.run()
+}
+
+// Stops the receiver and waits for its stream to finish.
+func (r *TapReceiver) Stop() {
+	r.lock.Lock()
+	select {
+	case <-r.stopch:
+	default:
+		close(r.stopch)
+	}
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.lock.Unlock()
+	<-r.donech
+}
+
+// A JSON-friendly snapshot of the receiver.
+func (r *TapReceiver) View() map[string]interface{} {
+	r.lock.Lock()
+	connected := r.connected
+	lastErr := ""
+	if r.lastErr != nil {
+		lastErr = r.lastErr.Error()
+	}
+	r.lock.Unlock()
+
+	stopped := false
+	select {
+	case <-r.donech:
+		stopped = true
+	default:
+	}
+
+	s := &r.Stats
+	return map[string]interface{}{
+		"name":      r.Name,
+		"bucket":    r.Bucket,
+		"addr":      r.Addr,
+		"srcBucket": r.SrcBucket,
+		"started":   r.Started,
+		"connected": connected,
+		"stopped":   stopped,
+		"lastErr":   lastErr,
+		"stats": TapReceiverStats{
+			Connects:    atomic.LoadInt64(&s.Connects),
+			Mutations:   atomic.LoadInt64(&s.Mutations),
+			Deletes:     atomic.LoadInt64(&s.Deletes),
+			VBucketSets: atomic.LoadInt64(&s.VBucketSets),
+			Opaques:     atomic.LoadInt64(&s.Opaques),
+			Acks:        atomic.LoadInt64(&s.Acks),
+			Skips:       atomic.LoadInt64(&s.Skips),
+			Errors:      atomic.LoadInt64(&s.Errors),
+		},
+	}
+}
+
+func (r *TapReceiver) run() {
+	defer close(r.donech)
+
+	delay := tapReceiverRetryMin
+	for {
+		received, err := r.runOnce()
+		if err == tapReceiverStopped {
+			return
+		}
+		select {
+		case <-r.stopch:
+			return
+		default:
+		}
+
+		atomic.AddInt64(&r.Stats.Errors, 1)
+		log.Printf("tap receiver: %v, bucket: %v, addr: %v, err: %v",
+			r.Name, r.Bucket, r.Addr, err)
+
+		if received {
+			delay = tapReceiverRetryMin
+		}
+		select {
+		case <-r.stopch:
+			return
+		case <-time.After(delay):
+		}
+		delay = delay * 2
+		if delay > tapReceiverRetryMax {
+			delay = tapReceiverRetryMax
+		}
+	}
+}
+
+// Connects once and applies the TAP stream until an error, returning
+// whether any messages were received.
+func (r *TapReceiver) runOnce() (received bool, err error) {
+	conn, err := r.connect()
+	if err != nil {
+		r.setConn(nil, err)
+		return false, err
+	}
+	defer conn.Close()
+
+	for {
+		pkt, err := memcached.ReadPacket(conn)
+		if err != nil {
+			r.setConn(nil, err)
+			return received, err
+		}
+		received = true
+
+		b := r.bucket()
+		if b == nil {
+			r.setConn(nil, tapReceiverStopped)
+			return received, tapReceiverStopped
+		}
+		if err = r.apply(b, &pkt); err != nil {
+			atomic.AddInt64(&r.Stats.Errors, 1)
+			log.Printf("tap receiver: %v, bucket: %v, apply err: %v",
+				r.Name, r.Bucket, err)
+		}
+
+		if len(pkt.Extras) >= 4 &&
+			binary.BigEndian.Uint16(pkt.Extras[2:])&TAP_FLAG_ACK != 0 {
+			atomic.AddInt64(&r.Stats.Acks, 1)
+			res := &gomemcached.MCResponse{Opcode: pkt.Opcode, Opaque: pkt.Opaque}
+			if _, err = res.Transmit(conn); err != nil {
+				r.setConn(nil, err)
+				return received, err
+			}
+		}
+	}
+}
+
+func (r *TapReceiver) connect() (net.Conn, error) {
+	conn, err := net.Dial("tcp", r.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	select {
+	case <-r.stopch:
+		r.lock.Unlock()
+		conn.Close()
+		return nil, tapReceiverStopped
+	default:
+	}
+	r.conn = conn
+	r.lock.Unlock()
+
+	if r.SrcBucket != "" {
+		mc, err := mcclient.Wrap(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		res, err := mc.Auth(r.SrcBucket, r.srcPassword)
+		if err != nil || res.Status != gomemcached.SUCCESS {
+			conn.Close()
+			return nil, fmt.Errorf("tap receiver auth failed, res: %v, err: %v",
+				res, err)
+		}
+	}
+
+	// Request a full backfill, so the receiver catches up on any
+	// changes it missed while disconnected; items it already has are
+	// recognized by their cas and skipped.
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Key:    []byte(r.Name),
+		Extras: make([]byte, 4),
+		Body:   make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(gomemcached.BACKFILL))
+	if _, err = req.Transmit(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	atomic.AddInt64(&r.Stats.Connects, 1)
+	r.setConn(conn, nil)
+	return conn, nil
+}
+
+func (r *TapReceiver) setConn(conn net.Conn, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.conn = conn
+	r.connected = conn != nil
+	if err != nil {
+		r.lastErr = err
+	}
+}
+
+// Returns the receiving bucket, reacquiring it if it was quiesced,
+// or nil if it's gone.
+func (r *TapReceiver) bucket() Bucket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.b != nil && !r.b.Available() {
+		r.b = nil
+		if r.buckets != nil {
+			r.b = r.buckets.Get(r.Bucket)
+		}
+	}
+	return r.b
+}
+
+func (r *TapReceiver) apply(b Bucket, pkt *gomemcached.MCRequest) error {
+	switch pkt.Opcode {
+	case gomemcached.TAP_MUTATION:
+		vb, err := r.replicaVBucket(b, pkt.VBucket)
+		if vb == nil || err != nil {
+			return err
+		}
+		i := &item{
+			key:  pkt.Key,
+			cas:  pkt.Cas,
+			data: pkt.Body,
+		}
+		if len(pkt.Extras) >= 16 {
+			i.flag = binary.BigEndian.Uint32(pkt.Extras[8:])
+			i.exp = binary.BigEndian.Uint32(pkt.Extras[12:])
+		}
+		atomic.AddInt64(&r.Stats.Mutations, 1)
+		_, err = vb.applyItem(i)
+		return err
+	case gomemcached.TAP_DELETE:
+		vb, err := r.replicaVBucket(b, pkt.VBucket)
+		if vb == nil || err != nil {
+			return err
+		}
+		atomic.AddInt64(&r.Stats.Deletes, 1)
+		_, err = vb.applyDeletion(pkt.Key, pkt.Cas)
+		return err
+	case gomemcached.TAP_VBUCKET_SET:
+		if len(pkt.Body) != 4 {
+			return fmt.Errorf("bad TAP_VBUCKET_SET body length: %v", len(pkt.Body))
+		}
+		state := VBState(binary.BigEndian.Uint32(pkt.Body))
+		if state < VBActive || state > VBDead {
+			return fmt.Errorf("bad TAP_VBUCKET_SET state: %v", state)
+		}
+		if int(pkt.VBucket) >= b.GetBucketSettings().NumPartitions {
+			atomic.AddInt64(&r.Stats.Skips, 1)
+			return nil
+		}
+		if vb, _ := b.GetVBucket(pkt.VBucket); vb == nil {
+			if _, err := b.CreateVBucket(pkt.VBucket); err != nil {
+				return err
+			}
+		}
+		atomic.AddInt64(&r.Stats.VBucketSets, 1)
+		return b.SetVBState(pkt.VBucket, state)
+	}
+	atomic.AddInt64(&r.Stats.Opaques, 1)
+	return nil
+}
+
+// Returns the vbucket that should receive a TAP change, creating a
+// replica vbucket if needed, or nil if the change should be skipped
+// (e.g., the vbucket is active here).
+func (r *TapReceiver) replicaVBucket(b Bucket, vbid uint16) (*VBucket, error) {
+	if int(vbid) >= b.GetBucketSettings().NumPartitions {
+		atomic.AddInt64(&r.Stats.Skips, 1)
+		return nil, nil
+	}
+	vb, err := b.GetVBucket(vbid)
+	if err != nil {
+		return nil, err
+	}
+	if vb == nil {
+		if vb, err = b.CreateVBucket(vbid); err != nil {
+			return nil, err
+		}
+		if err = b.SetVBState(vbid, VBReplica); err != nil {
+			return nil, err
+		}
+	}
+	switch vb.GetVBState() {
+	case VBReplica, VBPending:
+		return vb, nil
+	}
+	atomic.AddInt64(&r.Stats.Skips, 1)
+	return nil, nil
+}
+
+type TapReceivers struct {
+	lock sync.Mutex
+	m    map[string]map[string]*TapReceiver
+}
+
+func (t *TapReceivers) Add(r *TapReceiver) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rs := t.m[r.Bucket]
+	if rs == nil {
+		rs = map[string]*TapReceiver{}
+		t.m[r.Bucket] = rs
+	}
+	if rs[r.Name] != nil {
+		return fmt.Errorf("tap receiver already exists: %v", r.Name)
+	}
+	rs[r.Name] = r
+	r.Start()
+	return nil
+}
+
+func (t *TapReceivers) Get(bucketName, name string) *TapReceiver {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.m[bucketName][name]
+}
+
+func (t *TapReceivers) List(bucketName string) []*TapReceiver {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rv := make([]*TapReceiver, 0, len(t.m[bucketName]))
+	for _, r := range t.m[bucketName] {
+		rv = append(rv, r)
+	}
+	return rv
+}
+
+// Stops and forgets a receiver, returning false if it didn't exist.
+func (t *TapReceivers) Stop(bucketName, name string) bool {
+	t.lock.Lock()
+	r := t.m[bucketName][name]
+	if r != nil {
+		delete(t.m[bucketName], name)
+	}
+	t.lock.Unlock()
+	if r == nil {
+		return false
+	}
+	r.Stop()
+	return true
+}
+
+func (t *TapReceivers) StopAll(bucketName string) {
+	t.lock.Lock()
+	rs := t.m[bucketName]
+	delete(t.m, bucketName)
+	t.lock.Unlock()
+	for _, r := range rs {
+		r.Stop()
+	}
+}
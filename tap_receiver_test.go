@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testTapMutation(vbid uint16, key string, cas uint64,
+	flag, exp uint32, val string) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: vbid,
+		Key:     []byte(key),
+		Cas:     cas,
+		Extras:  make([]byte, 16),
+		Body:    []byte(val),
+	}
+	binary.BigEndian.PutUint32(pkt.Extras[8:], flag)
+	binary.BigEndian.PutUint32(pkt.Extras[12:], exp)
+	return pkt
+}
+
+func TestTapReceiverApply(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 4,
+		})
+	defer b.Close()
+	r := NewTapReceiver("r", nil, "test", b, "", "", "")
+
+	exp := uint32(time.Now().Add(time.Hour).Unix())
+	err := r.apply(b, testTapMutation(1, "a", 100, 7, exp, "aye"))
+	if err != nil {
+		t.Fatalf("expected apply to work, got: %v", err)
+	}
+	vb, _ := b.GetVBucket(1)
+	if vb == nil || vb.GetVBState() != VBReplica {
+		t.Fatalf("expected replica vbucket to be created, got: %v", vb)
+	}
+	i, err := vb.getUnexpired([]byte("a"), time.Now())
+	if err != nil || i == nil {
+		t.Fatalf("expected item, got: %v, err: %v", i, err)
+	}
+	if i.cas != 100 || i.flag != 7 || i.exp != exp || string(i.data) != "aye" {
+		t.Errorf("expected original item metadata, got: %#v", i)
+	}
+	if vb.Meta().LastCas < 100 {
+		t.Errorf("expected LastCas to be raised, got: %v", vb.Meta().LastCas)
+	}
+
+	// A repeat of the same change is recognized and skipped.
+	if err = r.apply(b, testTapMutation(1, "a", 100, 7, exp, "aye")); err != nil {
+		t.Errorf("expected repeat apply to work, got: %v", err)
+	}
+	if vb.stats.Items != 1 || vb.stats.Creates != 1 || vb.stats.Updates != 0 {
+		t.Errorf("expected one item created, got: %#v", vb.stats)
+	}
+
+	err = r.apply(b, &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_DELETE,
+		VBucket: 1,
+		Key:     []byte("a"),
+		Cas:     101,
+		Extras:  make([]byte, 8),
+	})
+	if err != nil {
+		t.Errorf("expected delete apply to work, got: %v", err)
+	}
+	if i, _ = vb.getUnexpired([]byte("a"), time.Now()); i != nil {
+		t.Errorf("expected item to be deleted, got: %#v", i)
+	}
+	if vb.stats.Items != 0 {
+		t.Errorf("expected no items, got: %v", vb.stats.Items)
+	}
+
+	// Active vbuckets and out of range vbuckets are not changed.
+	b.CreateVBucket(2)
+	b.SetVBState(2, VBActive)
+	r.apply(b, testTapMutation(2, "b", 200, 0, 0, "bee"))
+	r.apply(b, testTapMutation(9, "b", 200, 0, 0, "bee"))
+	vb2, _ := b.GetVBucket(2)
+	if i, _ = vb2.getUnexpired([]byte("b"), time.Now()); i != nil {
+		t.Errorf("expected active vbucket to be skipped, got: %#v", i)
+	}
+	if r.Stats.Skips != 2 {
+		t.Errorf("expected 2 skips, got: %v", r.Stats.Skips)
+	}
+
+	vbset := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_VBUCKET_SET,
+		VBucket: 3,
+		Extras:  make([]byte, 8),
+		Body:    make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(vbset.Body, uint32(VBPending))
+	if err = r.apply(b, vbset); err != nil {
+		t.Errorf("expected vbucket set to work, got: %v", err)
+	}
+	vb3, _ := b.GetVBucket(3)
+	if vb3 == nil || vb3.GetVBState() != VBPending {
+		t.Errorf("expected pending vbucket, got: %v", vb3)
+	}
+	vbset.Body = []byte{0, 0, 0, 9}
+	if err = r.apply(b, vbset); err == nil {
+		t.Errorf("expected bad vbucket state to fail")
+	}
+}
+
+func TestTapReceiverApplyCasCollision(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	defer b.Close()
+	r := NewTapReceiver("r", nil, "test", b, "", "", "")
+
+	if err := r.apply(b, testTapMutation(0, "a", 100, 0, 0, "aye")); err != nil {
+		t.Fatalf("expected apply to work, got: %v", err)
+	}
+	vb, _ := b.GetVBucket(0)
+	vb.applyItem(&item{key: []byte("b"), data: []byte("bee")})
+	iB, _ := vb.getUnexpired([]byte("b"), time.Now())
+	if iB == nil || iB.cas != 101 {
+		t.Fatalf("expected b with a local cas of 101, got: %#v", iB)
+	}
+
+	// The remote cas of c collides with b's change, so c gets a new cas.
+	if err := r.apply(b, testTapMutation(0, "c", 101, 0, 0, "sea")); err != nil {
+		t.Fatalf("expected apply to work, got: %v", err)
+	}
+	iC, _ := vb.getUnexpired([]byte("c"), time.Now())
+	if iC == nil || iC.cas <= 101 || string(iC.data) != "sea" {
+		t.Errorf("expected c with a new cas, got: %#v", iC)
+	}
+	if iB, _ = vb.getUnexpired([]byte("b"), time.Now()); iB == nil ||
+		string(iB.data) != "bee" {
+		t.Errorf("expected b to be untouched, got: %#v", iB)
+	}
+	// An older remote cas is also given a new cas, so it's not behind
+	// any changes stream cursors.
+	err := r.apply(b, &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_DELETE,
+		VBucket: 0,
+		Key:     []byte("a"),
+		Cas:     50,
+		Extras:  make([]byte, 8),
+	})
+	if err != nil {
+		t.Errorf("expected delete apply to work, got: %v", err)
+	}
+	keys := []string{}
+	vb.ps.visitChanges(casBytes(101), true, func(i *item) bool {
+		keys = append(keys, string(i.key))
+		return true
+	})
+	if strings.Join(keys, ",") != "b,c,a" {
+		t.Errorf("expected changes b,c,a after cas 100, got: %v", keys)
+	}
+}
+
+func TestTapReceiverStream(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(srcDir)
+	srcBuckets, _ := NewBuckets(srcDir, &BucketSettings{NumPartitions: 4})
+	defer srcBuckets.CloseAll()
+	src, err := srcBuckets.New(DEFAULT_BUCKET_NAME,
+		&BucketSettings{NumPartitions: 4})
+	if err != nil {
+		t.Fatalf("expected source bucket, got: %v", err)
+	}
+	for vbid := uint16(0); vbid < 4; vbid++ {
+		src.CreateVBucket(vbid)
+		src.SetVBState(vbid, VBActive)
+	}
+	res := SetItem(src, []byte("backfilled"), []byte("1"), VBActive)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected SetItem to work, got: %v", res)
+	}
+
+	l, err := StartServer("127.0.0.1:0", 100, srcBuckets, DEFAULT_BUCKET_NAME)
+	if err != nil {
+		t.Fatalf("expected StartServer to work, got: %v", err)
+	}
+	defer l.Close()
+
+	dstDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dstDir)
+	dst, _ := NewBucket("dst", dstDir, &BucketSettings{NumPartitions: 4})
+	defer dst.Close()
+
+	trs := &TapReceivers{m: map[string]map[string]*TapReceiver{}}
+	r := NewTapReceiver("r", nil, "dst", dst, l.Addr().String(), "", "")
+	if err = trs.Add(r); err != nil {
+		t.Fatalf("expected Add to work, got: %v", err)
+	}
+	defer trs.StopAll("dst")
+	if trs.Add(NewTapReceiver("r", nil, "dst", dst, "", "", "")) == nil {
+		t.Errorf("expected duplicate receiver name to fail")
+	}
+
+	waitForItem := func(key string) *item {
+		for j := 0; j < 100; j++ {
+			vb, _ := GetVBucketForKey(dst, []byte(key))
+			if vb != nil {
+				if i, _ := vb.getUnexpired([]byte(key), time.Now()); i != nil {
+					return i
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+
+	srcVB, _ := GetVBucketForKey(src, []byte("backfilled"))
+	srcItem, _ := srcVB.getUnexpired([]byte("backfilled"), time.Now())
+	i := waitForItem("backfilled")
+	if i == nil {
+		t.Fatalf("expected backfilled item to arrive, view: %v", r.View())
+	}
+	if i.cas != srcItem.cas {
+		t.Errorf("expected original cas %v, got: %v", srcItem.cas, i.cas)
+	}
+
+	SetItem(src, []byte("forwarded"), []byte("2"), VBActive)
+	if waitForItem("forwarded") == nil {
+		t.Errorf("expected forwarded item to arrive, view: %v", r.View())
+	}
+
+	if !trs.Stop("dst", "r") {
+		t.Errorf("expected Stop to work")
+	}
+	if trs.Stop("dst", "r") {
+		t.Errorf("expected second Stop to fail")
+	}
+	if v := r.View(); v["stopped"] != true {
+		t.Errorf("expected stopped receiver, got: %v", v)
+	}
+}
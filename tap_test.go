@@ -238,7 +238,6 @@ func makeMustTapFuncs(t *testing.T, rh *reqHandler, chpkt chan transmissible) (
 			t.Fatalf("expected req for mustBeAck")
 		}
 		flags := binary.BigEndian.Uint16(req.Extras[2:])
-		TAP_FLAG_ACK := uint16(0x01)
 		if flags&TAP_FLAG_ACK == 0 {
 			t.Fatalf("expected TAP_FLAG_ACK, got: %#v", req)
 		}
@@ -448,6 +447,423 @@ func TestTapBackFillBucket(t *testing.T) {
 	mustTransmit("post-DUMP-mutation", gomemcached.TAP_MUTATION)
 }
 
+func testTapConnect(flags gomemcached.TapConnectFlag,
+	backfill uint64, vbids ...uint16) *gomemcached.MCRequest {
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(flags))
+	if flags&gomemcached.BACKFILL != 0 {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, backfill)
+		treq.Body = append(treq.Body, b...)
+	}
+	if flags&gomemcached.LIST_VBUCKETS != 0 {
+		b := make([]byte, 2+2*len(vbids))
+		binary.BigEndian.PutUint16(b, uint16(len(vbids)))
+		for i, vbid := range vbids {
+			binary.BigEndian.PutUint16(b[2+2*i:], vbid)
+		}
+		treq.Body = append(treq.Body, b...)
+	}
+	return treq
+}
+
+func TestTapVBucketList(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		testBucket.CreateVBucket(vbid)
+		testBucket.SetVBState(vbid, VBActive)
+	}
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	sendReq, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		sendReq(&gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: vbid,
+			Key:     []byte("a"),
+			Body:    []byte("100"),
+		})
+	}
+
+	treq := testTapConnect(gomemcached.BACKFILL|gomemcached.LIST_VBUCKETS, 0, 1)
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	go doTap(rh.currentBucket, treq, ackBuf, chpkt, cherr)
+
+	m := mustTransmit("backfill", gomemcached.TAP_MUTATION)
+	if m.VBucket != 1 {
+		t.Errorf("expected only vbucket 1 to be backfilled, got: %#v", m)
+	}
+	mustBeTapAck(mustTransmit("ack wanted", gomemcached.TAP_OPAQUE))
+
+	time.Sleep(10 * time.Millisecond) // Let TAP get to forwarding.
+
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		sendReq(&gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: vbid,
+			Key:     []byte("b"),
+			Body:    []byte("200"),
+		})
+	}
+
+	m = mustTransmit("forward", gomemcached.TAP_MUTATION)
+	if m.VBucket != 1 || string(m.Key) != "b" {
+		t.Errorf("expected only vbucket 1 to be forwarded, got: %#v", m)
+	}
+	mustTapDone("filtered", t, chpkt)
+}
+
+func TestTapBackFillFromCas(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	_, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	var cas []uint64
+	for _, k := range []string{"1", "2", "3"} {
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   []byte(k),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+		cas = append(cas, res.Cas)
+	}
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	go doTap(rh.currentBucket, testTapConnect(gomemcached.BACKFILL, cas[0]),
+		ackBuf, chpkt, cherr)
+
+	for _, k := range []string{"2", "3"} {
+		m := mustTransmit("mutation "+k, gomemcached.TAP_MUTATION)
+		if string(m.Key) != k {
+			t.Errorf("expected key %v after cas %v, got: %#v", k, cas[0], m)
+		}
+	}
+	mustBeTapAck(mustTransmit("ack wanted", gomemcached.TAP_OPAQUE))
+	mustTapDone("backfill from cas", t, chpkt)
+}
+
+func TestTapTakeover(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	testBucket.CreateVBucket(1)
+	testBucket.SetVBState(1, VBReplica)
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	sendReq, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	res := doTap(rh.currentBucket,
+		testTapConnect(gomemcached.TAKEOVER_VBUCKETS|gomemcached.LIST_VBUCKETS, 0, 1),
+		nil, chpkt, cherr)
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected EINVAL for takeover of a replica, got: %v", res)
+	}
+
+	sendReq(&gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("a"),
+		Body:   []byte("100"),
+	})
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	treq := testTapConnect(gomemcached.BACKFILL|
+		gomemcached.LIST_VBUCKETS|gomemcached.TAKEOVER_VBUCKETS, 0, 0)
+	go doTap(rh.currentBucket, treq, ackBuf, chpkt, cherr)
+
+	mustTransmit("backfill", gomemcached.TAP_MUTATION)
+	mustBeTapAck(mustTransmit("ack wanted", gomemcached.TAP_OPAQUE))
+
+	m := mustTransmit("vbucket pending", gomemcached.TAP_VBUCKET_SET)
+	if VBState(binary.BigEndian.Uint32(m.Body)) != VBPending {
+		t.Errorf("expected pending vbucket set, got: %#v", m)
+	}
+	m = mustTransmit("vbucket active", gomemcached.TAP_VBUCKET_SET)
+	if VBState(binary.BigEndian.Uint32(m.Body)) != VBActive {
+		t.Errorf("expected active vbucket set, got: %#v", m)
+	}
+
+	select {
+	case m, ok := <-chpkt:
+		if ok {
+			t.Errorf("expected closed tap stream, got: %v", m)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("expected tap stream to be closed")
+	}
+
+	vb, _ := testBucket.GetVBucket(0)
+	if vb.GetVBState() != VBDead {
+		t.Errorf("expected taken over vbucket to be dead, got: %v",
+			vb.GetVBState())
+	}
+}
+
+func TestTapTakeoverMany(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	vbids := []uint16{0, 1, 2}
+	for _, vbid := range vbids {
+		testBucket.CreateVBucket(vbid)
+		testBucket.SetVBState(vbid, VBActive)
+	}
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	sendReq, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	for _, vbid := range vbids {
+		sendReq(&gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: vbid,
+			Key:     []byte("a"),
+			Body:    []byte("100"),
+		})
+	}
+
+	treq := testTapConnect(gomemcached.BACKFILL|
+		gomemcached.LIST_VBUCKETS|gomemcached.TAKEOVER_VBUCKETS, 0, vbids...)
+	go doTap(rh.currentBucket, treq, nil, chpkt, cherr)
+
+	for i := 0; i < len(vbids); i++ {
+		mustTransmit("backfill", gomemcached.TAP_MUTATION)
+	}
+	mustBeTapAck(mustTransmit("ack wanted", gomemcached.TAP_OPAQUE))
+
+	takenOver := map[uint16]bool{}
+	for i := 0; i < len(vbids); i++ {
+		m := mustTransmit("vbucket pending", gomemcached.TAP_VBUCKET_SET)
+		if VBState(binary.BigEndian.Uint32(m.Body)) != VBPending {
+			t.Errorf("expected pending vbucket set, got: %#v", m)
+		}
+		vbid := m.VBucket
+		m = mustTransmit("vbucket active", gomemcached.TAP_VBUCKET_SET)
+		if VBState(binary.BigEndian.Uint32(m.Body)) != VBActive ||
+			m.VBucket != vbid {
+			t.Errorf("expected active vbucket set of %v, got: %#v", vbid, m)
+		}
+		takenOver[vbid] = true
+	}
+	if len(takenOver) != len(vbids) {
+		t.Errorf("expected every vbucket to be taken over, got: %v", takenOver)
+	}
+
+	select {
+	case m, ok := <-chpkt:
+		if ok {
+			t.Errorf("expected closed tap stream, got: %v", m)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("expected tap stream to be closed")
+	}
+
+	for _, vbid := range vbids {
+		vb, _ := testBucket.GetVBucket(vbid)
+		if vb.GetVBState() != VBDead {
+			t.Errorf("expected taken over vbucket %v to be dead, got: %v",
+				vbid, vb.GetVBState())
+		}
+	}
+
+	// The bucket's observers aren't left stuck by the takeovers.
+	done := make(chan error, 1)
+	go func() { done <- testBucket.SetVBState(0, VBReplica) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected SetVBState to work, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected SetVBState after the takeovers to not block")
+	}
+}
+
+func TestTapAckFlowControl(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := reqHandler{currentBucket: testBucket}
+
+	origInterval, origWindow := tapAckInterval, tapAckWindow
+	tapAckInterval, tapAckWindow = 2, 1
+	defer func() {
+		tapAckInterval, tapAckWindow = origInterval, origWindow
+	}()
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	sendReq, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	for _, k := range []string{"1", "2", "3"} {
+		sendReq(&gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   []byte(k),
+		})
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ack := func(opaque uint32) {
+		res := &gomemcached.MCResponse{
+			Opcode: gomemcached.TAP_OPAQUE,
+			Opaque: opaque,
+		}
+		go pw.Write(res.Bytes())
+	}
+
+	go doTap(rh.currentBucket,
+		testTapConnect(gomemcached.DUMP|gomemcached.SUPPORT_ACK, 0),
+		pr, chpkt, cherr)
+
+	mustTransmit("mutation 1", gomemcached.TAP_MUTATION)
+	m := mustTransmit("mutation 2", gomemcached.TAP_MUTATION)
+	mustBeTapAck(m)
+	time.Sleep(50 * time.Millisecond)
+	mustTapDone("window full", t, chpkt)
+
+	ack(m.Opaque)
+	mustTransmit("mutation 3", gomemcached.TAP_MUTATION)
+	m = mustTransmit("ack wanted", gomemcached.TAP_OPAQUE)
+	mustBeTapAck(m)
+
+	ack(m.Opaque)
+	select {
+	case m, ok := <-chpkt:
+		if ok {
+			t.Errorf("expected closed tap stream, got: %v", m)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("expected dump to finish after the last ack")
+	}
+}
+
+func TestTapItemMetadata(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	_, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	exp := uint32(time.Now().Add(time.Hour).Unix())
+	set := func(key string, flag uint32) uint64 {
+		req := &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(key),
+			Extras: make([]byte, 8),
+			Body:   []byte("v"),
+		}
+		binary.BigEndian.PutUint32(req.Extras, flag)
+		binary.BigEndian.PutUint32(req.Extras[4:], exp)
+		res := rh.HandleMessage(ioutil.Discard, nil, req)
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+		return res.Cas
+	}
+	mustMatch := func(m *gomemcached.MCRequest, cas uint64, flag uint32) {
+		if m.Cas != cas || len(m.Extras) != 16 || m.Extras[4] != TAP_TTL ||
+			binary.BigEndian.Uint32(m.Extras[8:]) != flag ||
+			binary.BigEndian.Uint32(m.Extras[12:]) != exp {
+			t.Errorf("expected cas %v, flag %v, exp %v, got: %#v",
+				cas, flag, exp, m)
+		}
+	}
+
+	cas := set("a", 7)
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	go doTap(rh.currentBucket, testTapConnect(gomemcached.BACKFILL, 0),
+		ackBuf, chpkt, cherr)
+
+	mustMatch(mustTransmit("backfill", gomemcached.TAP_MUTATION), cas, 7)
+	mustBeTapAck(mustTransmit("ack wanted", gomemcached.TAP_OPAQUE))
+
+	time.Sleep(10 * time.Millisecond) // Let TAP get to forwarding.
+
+	cas = set("b", 8)
+	mustMatch(mustTransmit("forward", gomemcached.TAP_MUTATION), cas, 8)
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("b"),
+	})
+	m := mustTransmit("delete", gomemcached.TAP_DELETE)
+	if m.Cas != res.Cas || len(m.Extras) != 8 || m.Extras[4] != TAP_TTL {
+		t.Errorf("expected delete with cas %v, got: %#v", res.Cas, m)
+	}
+}
+
 func TestSizeOfMutation(t *testing.T) {
 	t.Logf("sizeof various structs and types, in bytes...")
 	t.Logf("  Sizeof(mutation{}): %v", unsafe.Sizeof(mutation{}))
@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+var tlsCert = flag.String("tls-cert", "",
+	"TLS certificate file")
+var tlsKey = flag.String("tls-key", "",
+	"TLS private key file")
+var tlsClientCA = flag.String("tls-client-ca", "",
+	"CA file for verifying TLS client certificates, whose common names are bucket names")
+var tlsStrict = flag.Bool("tls-strict", false,
+	"Reject HTTP basic auth over non-TLS listeners")
+
+// Nil unless a TLS certificate and key were supplied.
+var tlsConfig *tls.Config
+
+func initTLS() error {
+	tlsConfig = nil
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsClientCA != "" {
+			return fmt.Errorf("tls-client-ca was supplied, but missing tls-cert/tls-key")
+		}
+		return nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return fmt.Errorf("tls-cert and tls-key must be supplied together")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(*tlsClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in tls-client-ca: %v", *tlsClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	tlsConfig = config
+	return nil
+}
+
+// Returns the common name of a verified client certificate, or "".
+func tlsClientName(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 ||
+		len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return cs.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Completes the TLS handshake and, given a verified client
+// certificate, switches the connection to the user or bucket it
+// names.
+func (rh *reqHandler) authTLS(tc *tls.Conn) error {
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	cs := tc.ConnectionState()
+	name := tlsClientName(&cs)
+	if name == "" {
+		return nil
+	}
+	if u := users.Get(name); u != nil {
+		rh.loginUser(u)
+		return nil
+	}
+	b := rh.buckets.Get(name)
+	if b == nil {
+		return fmt.Errorf("no bucket for TLS client certificate: %v", name)
+	}
+	rh.currentBucket = b
+	rh.currentBucketName = name
+	return nil
+}
+
+func StartTLSServer(addr string, maxConns int, buckets *Buckets,
+	defaultBucketName string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return nil, fmt.Errorf("TLS listener needs tls-cert and tls-key")
+	}
+	ls, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName)
+	return ls, nil
+}
+
+// Serves HTTP on a plaintext address, a TLS address, or both, until
+// either fails.  An empty address is not listened on.
+func serveHTTP(addr, addrTLS string, h http.Handler) error {
+	errs := make(chan error, 2)
+	if addr != "" {
+		go func() { errs <- http.ListenAndServe(addr, h) }()
+	}
+	if addrTLS != "" {
+		if tlsConfig == nil {
+			return fmt.Errorf("TLS listener needs tls-cert and tls-key")
+		}
+		ls, err := tls.Listen("tcp", addrTLS, tlsConfig)
+		if err != nil {
+			return err
+		}
+		go func() { errs <- (&http.Server{Handler: h}).Serve(ls) }()
+	}
+	return <-errs
+}
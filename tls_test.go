@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Makes a certificate with the given common name, signed by the
+// parent, or self-signed if the parent is nil.
+func testMakeCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected GenerateKey to work, got: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("expected CreateCertificate to work, got: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func testWriteCert(t *testing.T, dir string, name string, c tls.Certificate) {
+	err := ioutil.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}),
+		0600)
+	if err != nil {
+		t.Fatalf("expected WriteFile to work, got: %v", err)
+	}
+	der, _ := x509.MarshalECPrivateKey(c.PrivateKey.(*ecdsa.PrivateKey))
+	err = ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		0600)
+	if err != nil {
+		t.Fatalf("expected WriteFile to work, got: %v", err)
+	}
+}
+
+func TestInitTLS(t *testing.T) {
+	origCert, origKey, origCA := *tlsCert, *tlsKey, *tlsClientCA
+	defer func() {
+		*tlsCert, *tlsKey, *tlsClientCA = origCert, origKey, origCA
+		tlsConfig = nil
+	}()
+
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	ca := testMakeCert(t, "ca", nil)
+	testWriteCert(t, d, "ca", ca)
+	testWriteCert(t, d, "server", testMakeCert(t, "server", &ca))
+
+	tests := []struct {
+		cert, key, ca string
+		ok, config    bool
+	}{
+		{"", "", "", true, false},
+		{"", "", "ca.pem", false, false},
+		{"server.pem", "", "", false, false},
+		{"", "server-key.pem", "", false, false},
+		{"server.pem", "not-a-file.pem", "", false, false},
+		{"server.pem", "server-key.pem", "", true, true},
+		{"server.pem", "server-key.pem", "not-a-file.pem", false, false},
+		{"server.pem", "server-key.pem", "server-key.pem", false, false},
+		{"server.pem", "server-key.pem", "ca.pem", true, true},
+	}
+	path := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return filepath.Join(d, s)
+	}
+	for i, test := range tests {
+		*tlsCert, *tlsKey, *tlsClientCA =
+			path(test.cert), path(test.key), path(test.ca)
+		err := initTLS()
+		if (err == nil) != test.ok {
+			t.Errorf("test %v, expected ok %v, got err: %v", i, test.ok, err)
+		}
+		if (tlsConfig != nil) != test.config {
+			t.Errorf("test %v, expected config %v, got: %v",
+				i, test.config, tlsConfig)
+		}
+	}
+	if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("expected client certs to be verified, got: %v",
+			tlsConfig.ClientAuth)
+	}
+}
+
+func TestTLSClientCertBucket(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, err := NewBuckets(testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("Error with NewBuckets: %v", err)
+	}
+	defer b.CloseAll()
+	b.New(DEFAULT_BUCKET_NAME, b.settings)
+	b.New("foo", b.settings)
+
+	ca := testMakeCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testMakeCert(t, "server", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+
+	tests := []struct {
+		certs      []tls.Certificate
+		bucketName string
+		ok         bool
+	}{
+		{nil, DEFAULT_BUCKET_NAME, true},
+		{[]tls.Certificate{testMakeCert(t, "foo", &ca)}, "foo", true},
+		{[]tls.Certificate{testMakeCert(t, "bar", &ca)}, "", false},
+		{[]tls.Certificate{testMakeCert(t, "foo", nil)}, "", false},
+	}
+	for i, test := range tests {
+		cs, ss := net.Pipe()
+		c := tls.Client(cs, &tls.Config{
+			Certificates: test.certs,
+			RootCAs:      pool,
+			ServerName:   "127.0.0.1",
+		})
+		go c.Handshake()
+
+		rh := &reqHandler{
+			buckets:           b,
+			currentBucket:     b.Get(DEFAULT_BUCKET_NAME),
+			currentBucketName: DEFAULT_BUCKET_NAME,
+		}
+		err := rh.authTLS(tls.Server(ss, config))
+		if (err == nil) != test.ok {
+			t.Errorf("test %v, expected ok %v, got err: %v", i, test.ok, err)
+		}
+		if test.ok && rh.currentBucketName != test.bucketName {
+			t.Errorf("test %v, expected bucket %v, got: %v",
+				i, test.bucketName, rh.currentBucketName)
+		}
+		cs.Close()
+		ss.Close()
+	}
+}
+
+func TestStartTLSServerNoConfig(t *testing.T) {
+	l, err := StartTLSServer("127.0.0.1:0", 100, nil, "", nil)
+	if err == nil {
+		l.Close()
+		t.Errorf("expected StartTLSServer without a config to fail")
+	}
+}
+
+func TestAuthFilterTLSStrict(t *testing.T) {
+	defer func(orig bool) { *tlsStrict = orig }(*tlsStrict)
+
+	tests := []struct {
+		strict, tls, auth bool
+		code              int
+	}{
+		{false, false, true, 200},
+		{true, false, false, 200},
+		{true, false, true, 403},
+		{true, true, true, 200},
+	}
+	for i, test := range tests {
+		*tlsStrict = test.strict
+		req, _ := http.NewRequest("GET", "/", nil)
+		if test.auth {
+			req.SetBasicAuth(*adminUser, *adminPass)
+		}
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		authenticationFilter{http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {})}.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("test %v, expected %v, got: %v", i, test.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// restore loads a cbgb backup, either a directory or a tar archive
+// from POST /_api/buckets/{bucket}/backup, into a bucket of a cbgb
+// data directory.  It works on the store files directly, so cbgb must
+// not be running; use the /restore REST endpoint instead to restore
+// into a live server.
+package main
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/steveyen/gkvlite"
+)
+
+var data = flag.String("data", "./tmp", "Data directory of the stopped cbgb")
+var bucketName = flag.String("bucket", "default", "Bucket to restore into")
+var from = flag.String("from", "", "Backup directory or tar archive")
+var mode = flag.String("mode", "overwrite",
+	"Conflict mode: overwrite, skip-existing or newer-cas")
+var numPartitions = flag.Int("num-partitions", 0,
+	"Partitions of a newly created bucket (0 means the backup's)")
+var verbose = flag.Bool("v", false, "log each restored vbucket")
+
+// These mirror cbgb's on-disk layout.
+const (
+	collSuffixKeys    = ".k"
+	collSuffixChanges = ".s"
+	collSuffixTombs   = ".t"
+	collVBMeta        = "vbm"
+	storeSuffix       = "store"
+	vbidDDoc          = uint16(0xffff)
+	vbidLocal         = uint16(0xfffe)
+	itemHdrLen        = 4 + 4 + 8 + 2 + 4
+	itemRevSeqLen     = 8
+	itemRevCasLen     = 8
+	deletionFlag      = 0xffffffff
+	flushEvery        = 10000
+)
+
+type vbMeta struct {
+	LastCas uint64 `json:"lastCas"`
+	MetaCas uint64 `json:"metaCas"`
+	State   string `json:"state"`
+	Id      uint16 `json:"id"`
+}
+
+type item struct {
+	key       []byte
+	exp, flag uint32
+	cas       uint64
+	data      []byte
+	revSeq    uint64 // Persisted after the data when beyond 1.
+	revCas    uint64 // Persisted after the revSeq when not the cas.
+}
+
+func (i *item) getRevCas() uint64 {
+	if i.revCas == 0 {
+		return i.cas
+	}
+	return i.revCas
+}
+
+func (i *item) hasRevCas() bool {
+	return i.revCas != 0 && i.revCas != i.cas
+}
+
+func (i *item) revTrailerLen() int {
+	if i.hasRevCas() {
+		return itemRevSeqLen + itemRevCasLen
+	}
+	if i.revSeq > 1 {
+		return itemRevSeqLen
+	}
+	return 0
+}
+
+func (i *item) isDeletion() bool {
+	return i.exp&0x80000000 != 0 && i.flag == deletionFlag && len(i.data) == 0
+}
+
+func (i *item) toValueBytes() []byte {
+	rv := make([]byte, itemHdrLen+len(i.key)+len(i.data)+i.revTrailerLen())
+	binary.BigEndian.PutUint32(rv[0:], i.exp)
+	binary.BigEndian.PutUint32(rv[4:], i.flag)
+	binary.BigEndian.PutUint64(rv[8:], i.cas)
+	binary.BigEndian.PutUint16(rv[16:], uint16(len(i.key)))
+	binary.BigEndian.PutUint32(rv[18:], uint32(len(i.data)))
+	copy(rv[itemHdrLen:], i.key)
+	copy(rv[itemHdrLen+len(i.key):], i.data)
+	trailer := rv[itemHdrLen+len(i.key)+len(i.data):]
+	if i.revTrailerLen() > 0 {
+		binary.BigEndian.PutUint64(trailer, i.revSeq)
+	}
+	if i.hasRevCas() {
+		binary.BigEndian.PutUint64(trailer[itemRevSeqLen:], i.revCas)
+	}
+	return rv
+}
+
+func itemFromValueBytes(b []byte) (*item, error) {
+	if len(b) < itemHdrLen {
+		return nil, fmt.Errorf("item too short: %v", len(b))
+	}
+	i := &item{
+		exp:  binary.BigEndian.Uint32(b[0:]),
+		flag: binary.BigEndian.Uint32(b[4:]),
+		cas:  binary.BigEndian.Uint64(b[8:]),
+	}
+	keylen := int(binary.BigEndian.Uint16(b[16:]))
+	datalen := int(binary.BigEndian.Uint32(b[18:]))
+	if len(b) < itemHdrLen+keylen+datalen {
+		return nil, fmt.Errorf("item too short: %v, wanted: %v",
+			len(b), itemHdrLen+keylen+datalen)
+	}
+	i.key = append([]byte(nil), b[itemHdrLen:itemHdrLen+keylen]...)
+	i.data = append([]byte(nil), b[itemHdrLen+keylen:itemHdrLen+keylen+datalen]...)
+	trailer := b[itemHdrLen+keylen+datalen:]
+	if len(trailer) >= itemRevSeqLen {
+		i.revSeq = binary.BigEndian.Uint64(trailer)
+	}
+	if len(trailer) >= itemRevSeqLen+itemRevCasLen {
+		i.revCas = binary.BigEndian.Uint64(trailer[itemRevSeqLen:])
+	}
+	return i, nil
+}
+
+func casBytes(cas uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, cas)
+	return b
+}
+
+func vbucketIdForKey(key []byte, numVBuckets int) uint16 {
+	return uint16((crc32.ChecksumIEEE(key) >> uint32(16)) & uint32(numVBuckets-1))
+}
+
+// Like cbgb's BucketPath, as in "$DATA/00/df/default-bucket".
+func bucketPath(name string) string {
+	c := uint16(crc32.ChecksumIEEE([]byte(name)))
+	return filepath.Join(*data, fmt.Sprintf("%02x", c>>8),
+		fmt.Sprintf("%02x", c&0xff), name+"-bucket")
+}
+
+// Returns the highest versioned "0-VER.store" file in dir.
+func latestStoreFile(dir string) (string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	latestVer, latestName := 0, "0-0."+storeSuffix
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if !strings.HasPrefix(name, "0-") ||
+			!strings.HasSuffix(name, "."+storeSuffix) {
+			continue
+		}
+		ver, err := strconv.Atoi(name[2 : len(name)-len(storeSuffix)-1])
+		if err == nil && ver > latestVer {
+			latestVer, latestName = ver, name
+		}
+	}
+	return filepath.Join(dir, latestName), nil
+}
+
+func maybefatal(msg string, err error) {
+	if err != nil {
+		log.Fatalf("FATAL: %v: %v", msg, err)
+	}
+}
+
+func loadSettings(dir string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "settings.json"))
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]interface{}{}
+	return settings, json.Unmarshal(b, &settings)
+}
+
+func settingsPartitions(settings map[string]interface{}) int {
+	n, _ := settings["numPartitions"].(float64)
+	return int(n)
+}
+
+func untar(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(hdr.Name)
+		if name != hdr.Name || name == "." || name == ".." {
+			return fmt.Errorf("unexpected file in backup archive: %v", hdr.Name)
+		}
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type restorer struct {
+	dst     *gkvlite.Store
+	metas   map[uint16]*vbMeta
+	remap   bool
+	dstN    int
+	now     uint32
+	pending int
+
+	items, skipped, expired int
+}
+
+func (r *restorer) meta(vbid uint16, state string) *vbMeta {
+	m := r.metas[vbid]
+	if m == nil {
+		if r.remap {
+			state = "active"
+		}
+		m = &vbMeta{Id: vbid, State: state}
+		r.metas[vbid] = m
+	}
+	return m
+}
+
+func (r *restorer) restoreVBucket(src *gkvlite.Store, srcMeta *vbMeta) error {
+	changes := src.GetCollection(fmt.Sprintf("%v%s", srcMeta.Id, collSuffixChanges))
+	if changes == nil || srcMeta.Id == vbidLocal ||
+		(srcMeta.Id != vbidDDoc && srcMeta.State == "dead") {
+		return nil
+	}
+	if *verbose {
+		log.Printf("restoring vbucket: %v", srcMeta.Id)
+	}
+	var errVisit error
+	err := changes.VisitItemsAscend(nil, true, func(cItem *gkvlite.Item) bool {
+		var i *item
+		if i, errVisit = itemFromValueBytes(cItem.Val); errVisit != nil {
+			return false
+		}
+		if len(i.key) <= 0 || i.isDeletion() {
+			return true
+		}
+		if i.exp != 0 && i.exp <= r.now {
+			r.expired++
+			return true
+		}
+		vbid := srcMeta.Id
+		if r.remap && vbid != vbidDDoc {
+			vbid = vbucketIdForKey(i.key, r.dstN)
+		}
+		errVisit = r.restoreItem(r.meta(vbid, srcMeta.State), i)
+		return errVisit == nil
+	})
+	if err != nil {
+		return err
+	}
+	return errVisit
+}
+
+func (r *restorer) restoreItem(m *vbMeta, i *item) error {
+	keys := r.dst.GetCollection(fmt.Sprintf("%v%s", m.Id, collSuffixKeys))
+	if keys == nil {
+		keys = r.dst.SetCollection(fmt.Sprintf("%v%s", m.Id, collSuffixKeys), nil)
+	}
+	changes := r.dst.GetCollection(fmt.Sprintf("%v%s", m.Id, collSuffixChanges))
+	if changes == nil {
+		changes = r.dst.SetCollection(fmt.Sprintf("%v%s", m.Id, collSuffixChanges), nil)
+	}
+	oldCasBytes, err := keys.Get(i.key)
+	if err != nil {
+		return err
+	}
+	if oldCasBytes != nil {
+		oldRevCas := binary.BigEndian.Uint64(oldCasBytes)
+		oldVal, err := changes.Get(oldCasBytes)
+		if err != nil {
+			return err
+		}
+		if oldVal != nil {
+			old, err := itemFromValueBytes(oldVal)
+			if err != nil {
+				return err
+			}
+			oldRevCas = old.getRevCas()
+		}
+		if *mode == "skip-existing" || m.Id == vbidDDoc && *mode != "overwrite" ||
+			*mode == "newer-cas" && oldRevCas >= i.getRevCas() {
+			r.skipped++
+			return nil
+		}
+		if _, err = changes.Delete(oldCasBytes); err != nil {
+			return err
+		}
+	} else if tombs := r.dst.GetCollection(
+		fmt.Sprintf("%v%s", m.Id, collSuffixTombs)); tombs != nil {
+		// The key's no longer deleted.
+		if _, err = tombs.Delete(i.key); err != nil {
+			return err
+		}
+	}
+	// The changes are ordered by cas, so an item keeps its cas only
+	// if it's beyond all the vbucket's changes, but it always keeps
+	// its rev.
+	if i.revCas == 0 {
+		i.revCas = i.cas
+	}
+	if i.cas <= m.LastCas {
+		i.cas = m.LastCas + 1
+	}
+	m.LastCas = i.cas
+	if err = changes.Set(casBytes(i.cas), i.toValueBytes()); err != nil {
+		return err
+	}
+	if err = keys.Set(i.key, casBytes(i.cas)); err != nil {
+		return err
+	}
+	r.items++
+	r.pending++
+	if r.pending >= flushEvery {
+		r.pending = 0
+		return r.flush()
+	}
+	return nil
+}
+
+func (r *restorer) flush() error {
+	vbm := r.dst.GetCollection(collVBMeta)
+	if vbm == nil {
+		vbm = r.dst.SetCollection(collVBMeta, nil)
+	}
+	for vbid, m := range r.metas {
+		j, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err = vbm.Set([]byte(strconv.Itoa(int(vbid))), j); err != nil {
+			return err
+		}
+	}
+	return r.dst.Flush()
+}
+
+func main() {
+	flag.Parse()
+
+	if *from == "" {
+		log.Fatalf("FATAL: missing -from backup directory or archive")
+	}
+	if *mode != "overwrite" && *mode != "skip-existing" && *mode != "newer-cas" {
+		log.Fatalf("FATAL: unknown -mode: %v", *mode)
+	}
+
+	srcDir := *from
+	fi, err := os.Stat(srcDir)
+	maybefatal("reading backup", err)
+	if !fi.IsDir() {
+		srcDir, err = ioutil.TempDir("", "cbgb-restore")
+		maybefatal("creating temp dir", err)
+		defer os.RemoveAll(srcDir)
+		maybefatal("extracting backup archive", untar(*from, srcDir))
+	}
+	srcSettings, err := loadSettings(srcDir)
+	maybefatal("reading backup settings", err)
+
+	bdir := bucketPath(*bucketName)
+	dstSettings, err := loadSettings(bdir)
+	if os.IsNotExist(err) {
+		dstSettings = srcSettings
+		if *numPartitions > 0 {
+			dstSettings["numPartitions"] = *numPartitions
+		}
+		dstSettings["uuid"] = fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+		var j []byte
+		j, err = json.Marshal(dstSettings)
+		maybefatal("encoding bucket settings", err)
+		maybefatal("creating bucket dir", os.MkdirAll(bdir, 0777))
+		err = ioutil.WriteFile(filepath.Join(bdir, "settings.json"), j, 0666)
+		maybefatal("writing bucket settings", err)
+		log.Printf("created bucket: %v, dir: %v", *bucketName, bdir)
+		dstSettings, err = loadSettings(bdir)
+	}
+	maybefatal("reading bucket settings", err)
+
+	srcPath, err := latestStoreFile(srcDir)
+	maybefatal("finding backup store", err)
+	srcFile, err := os.Open(srcPath)
+	maybefatal("opening backup store", err)
+	defer srcFile.Close()
+	src, err := gkvlite.NewStore(srcFile)
+	maybefatal("reading backup store", err)
+
+	dstPath, err := latestStoreFile(bdir)
+	maybefatal("finding bucket store", err)
+	dstFile, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE, 0666)
+	maybefatal("opening bucket store", err)
+	defer dstFile.Close()
+	dst, err := gkvlite.NewStore(dstFile)
+	maybefatal("reading bucket store", err)
+
+	r := &restorer{
+		dst:   dst,
+		metas: map[uint16]*vbMeta{},
+		dstN:  settingsPartitions(dstSettings),
+		remap: settingsPartitions(srcSettings) != settingsPartitions(dstSettings),
+		now:   uint32(time.Now().Unix()),
+	}
+	srcMetas := []*vbMeta{}
+	if vbm := dst.GetCollection(collVBMeta); vbm != nil {
+		err = vbm.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+			m := &vbMeta{}
+			if json.Unmarshal(i.Val, m) == nil {
+				r.metas[m.Id] = m
+			}
+			return true
+		})
+		maybefatal("reading bucket vbuckets", err)
+	}
+	for _, m := range r.metas {
+		// Like cbgb's vbucket load, the changes may be beyond the
+		// last saved LastCas.
+		changes := dst.GetCollection(fmt.Sprintf("%v%s", m.Id, collSuffixChanges))
+		if changes == nil {
+			continue
+		}
+		last, err := changes.MaxItem(false)
+		maybefatal("reading bucket changes", err)
+		if last != nil && binary.BigEndian.Uint64(last.Key) > m.LastCas {
+			m.LastCas = binary.BigEndian.Uint64(last.Key)
+		}
+	}
+	vbm := src.GetCollection(collVBMeta)
+	if vbm == nil {
+		log.Fatalf("FATAL: backup store is missing vbuckets: %v", srcPath)
+	}
+	err = vbm.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+		m := &vbMeta{}
+		maybefatal("reading backup vbucket", json.Unmarshal(i.Val, m))
+		srcMetas = append(srcMetas, m)
+		return true
+	})
+	maybefatal("reading backup vbuckets", err)
+	if r.remap {
+		for vbid := 0; vbid < r.dstN; vbid++ {
+			r.meta(uint16(vbid), "active")
+		}
+	}
+	for _, m := range srcMetas {
+		maybefatal(fmt.Sprintf("restoring vbucket %v", m.Id),
+			r.restoreVBucket(src, m))
+	}
+	maybefatal("flushing bucket store", r.flush())
+
+	log.Printf("restored %v items into bucket: %v, mode: %v,"+
+		" skipped: %v, expired: %v",
+		r.items, *bucketName, *mode, r.skipped, r.expired)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/server"
+)
+
+// UPR (Unified Protocol for Replication) streams a vbucket's changes
+// collection by sequence number.  Our sequence numbers are CAS
+// values, which already order each vbucket's changes, so a consumer
+// can resume a stream exactly from the last sequence number it saw.
+
+const UPR_OPEN_PRODUCER = uint32(0x01)
+
+// UPR_SNAPSHOT_MARKER flags.
+const UPR_SNAPSHOT_MEMORY = uint32(0x01)
+
+// UPR_STREAM_END flags.
+const (
+	UPR_STREAM_END_OK            = uint32(0x00)
+	UPR_STREAM_END_STATE_CHANGED = uint32(0x02)
+)
+
+const UPR_MAX_SEQNO = uint64(0xffffffffffffffff)
+
+// We don't track vbucket failover histories, so every vbucket has
+// the same, single entry failover log of (uuid 0, seqno 0).
+const uprVBucketUUID = uint64(0)
+
+type uprStream struct {
+	vb      *VBucket
+	opaque  uint32
+	endSeq  uint64
+	sentSeq uint64 // Highest seqno sent, or skipped due to de-duplication.
+	snapEnd uint64 // End seqno of the current snapshot.
+}
+
+// The per-connection state of a UPR producer.
+type uprConn struct {
+	b     Bucket
+	name  string
+	chpkt chan<- transmissible
+
+	streams    map[uint16]*uprStream
+	mch        chan interface{}
+	bufferSize int // Zero means no flow control.
+	unacked    int // Bytes sent but not yet acknowledged by BUFFER_ACK.
+}
+
+func doUpr(b Bucket, req *gomemcached.MCRequest, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
+	if len(req.Extras) != 8 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for upr open: %v",
+				len(req.Extras))),
+		}
+	}
+	if binary.BigEndian.Uint32(req.Extras[4:])&UPR_OPEN_PRODUCER == 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("only upr producer connections are supported"),
+		}
+	}
+
+	defer close(chpkt)
+	chpkt <- &gomemcached.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque}
+
+	c := &uprConn{
+		b:       b,
+		name:    string(req.Key),
+		chpkt:   chpkt,
+		streams: map[uint16]*uprStream{},
+		mch:     make(chan interface{}, 100),
+	}
+
+	donech := make(chan bool)
+	defer close(donech)
+
+	reqch := make(chan *gomemcached.MCRequest)
+	readerr := make(chan error, 1)
+	if r != nil {
+		go readUprRequests(r, reqch, readerr, donech)
+	}
+
+	pending := newPendingVBuckets()
+	go pending.absorb(c.mch, donech)
+
+	bch := make(chan interface{})
+	b.Subscribe(bch)
+	defer unsubscribeDraining(b, bch, donech)
+
+	defer func() {
+		for _, s := range c.streams {
+			s.vb.observer.Unregister(c.mch)
+		}
+	}()
+
+	for {
+		select {
+		case req := <-reqch:
+			if res := c.handle(req, pending); res != nil {
+				res.Opcode = req.Opcode
+				res.Opaque = req.Opaque
+				chpkt <- res
+			}
+		case ci := <-bch:
+			if _, ok := ci.(bucketFlush); ok {
+				// UPR has no flush message, so consumers need to
+				// reopen their streams.
+				for _, s := range c.streams {
+					c.endStream(s, UPR_STREAM_END_STATE_CHANGED)
+				}
+				continue
+			}
+			ch := ci.(vbucketChange)
+			s := c.streams[ch.vbid]
+			if s != nil && (ch.newState != VBActive || ch.getVBucket() != s.vb) {
+				c.endStream(s, UPR_STREAM_END_STATE_CHANGED)
+			}
+		case <-pending.ch:
+		case <-readerr:
+			return &gomemcached.MCResponse{Fatal: true}
+		case <-cherr:
+			return &gomemcached.MCResponse{Fatal: true}
+		}
+
+		if c.bufferFull() {
+			continue
+		}
+		for vbid := range pending.take() {
+			s := c.streams[vbid]
+			if s == nil {
+				continue
+			}
+			complete, err := c.sendChanges(s)
+			if err != nil {
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+			if !complete {
+				pending.add(vbid)
+			}
+		}
+	}
+}
+
+func readUprRequests(r io.Reader, reqch chan<- *gomemcached.MCRequest,
+	readerr chan<- error, donech <-chan bool) {
+	for {
+		req, err := memcached.ReadPacket(r)
+		if err != nil {
+			readerr <- err
+			return
+		}
+		select {
+		case reqch <- &req:
+		case <-donech:
+			return
+		}
+	}
+}
+
+// Handles a request from the consumer, returning the response to
+// send, if any.
+func (c *uprConn) handle(req *gomemcached.MCRequest,
+	pending *pendingVBuckets) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case UPR_STREAM_REQ:
+		return c.streamRequest(req, pending)
+	case UPR_CLOSE_STREAM:
+		s := c.streams[req.VBucket]
+		if s == nil {
+			return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		}
+		c.removeStream(s)
+		return &gomemcached.MCResponse{}
+	case UPR_GET_FAILOVER_LOG:
+		vb, _ := c.b.GetVBucket(req.VBucket)
+		if vb == nil {
+			return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+		}
+		return &gomemcached.MCResponse{Body: uprFailoverLog()}
+	case UPR_BUFFER_ACK:
+		if len(req.Extras) == 4 {
+			c.unacked -= int(binary.BigEndian.Uint32(req.Extras))
+			if c.unacked < 0 {
+				c.unacked = 0
+			}
+			for vbid := range c.streams {
+				pending.add(vbid)
+			}
+		}
+		return nil // BUFFER_ACK has no response.
+	case UPR_CONTROL:
+		if string(req.Key) != "connection_buffer_size" {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("unknown upr control: %s", req.Key)),
+			}
+		}
+		n, err := strconv.Atoi(string(req.Body))
+		if err != nil || n < 0 {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("bad connection_buffer_size: %s", req.Body)),
+			}
+		}
+		c.bufferSize = n
+		return &gomemcached.MCResponse{}
+	case UPR_NOOP, gomemcached.NOOP:
+		return &gomemcached.MCResponse{}
+	}
+	return &gomemcached.MCResponse{
+		Status: gomemcached.UNKNOWN_COMMAND,
+		Body:   []byte(fmt.Sprintf("Unknown upr command %v", req.Opcode)),
+	}
+}
+
+// The UPR_STREAM_REQ extras are the flags (4 bytes), reserved (4),
+// start seqno (8), end seqno (8), vbucket uuid (8), snapshot start
+// seqno (8) and snapshot end seqno (8).
+func (c *uprConn) streamRequest(req *gomemcached.MCRequest,
+	pending *pendingVBuckets) *gomemcached.MCResponse {
+	if len(req.Extras) != 48 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for upr stream req: %v",
+				len(req.Extras))),
+		}
+	}
+	startSeq := binary.BigEndian.Uint64(req.Extras[8:])
+	endSeq := binary.BigEndian.Uint64(req.Extras[16:])
+	if startSeq > endSeq {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("start seqno %v is after end seqno %v",
+				startSeq, endSeq)),
+		}
+	}
+
+	vb, _ := c.b.GetVBucket(req.VBucket)
+	if vb == nil || vb.GetVBState() != VBActive {
+		return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+	}
+	if c.streams[req.VBucket] != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte(fmt.Sprintf("stream exists for vbucket %v", req.VBucket)),
+		}
+	}
+
+	// A consumer that's ahead of us (e.g., we lost changes that it
+	// saw) must roll back to our latest seqno.
+	if lastSeq := vb.ps.getLastCas(); startSeq > lastSeq {
+		res := &gomemcached.MCResponse{
+			Status: ROLLBACK,
+			Body:   make([]byte, 8),
+		}
+		binary.BigEndian.PutUint64(res.Body, lastSeq)
+		return res
+	}
+
+	s := &uprStream{
+		vb:      vb,
+		opaque:  req.Opaque,
+		endSeq:  endSeq,
+		sentSeq: startSeq,
+		snapEnd: startSeq,
+	}
+	c.streams[req.VBucket] = s
+	vb.observer.Register(c.mch)
+	pending.add(req.VBucket)
+
+	return &gomemcached.MCResponse{Body: uprFailoverLog()}
+}
+
+func uprFailoverLog() []byte {
+	rv := make([]byte, 16)
+	binary.BigEndian.PutUint64(rv, uprVBucketUUID)
+	return rv
+}
+
+func (c *uprConn) bufferFull() bool {
+	return c.bufferSize > 0 && c.unacked >= c.bufferSize
+}
+
+func (c *uprConn) transmit(pkt *gomemcached.MCRequest) {
+	c.unacked += gomemcached.HDR_LEN + len(pkt.Extras) + len(pkt.Key) + len(pkt.Body)
+	c.chpkt <- pkt
+}
+
+func (c *uprConn) removeStream(s *uprStream) {
+	s.vb.observer.Unregister(c.mch)
+	delete(c.streams, s.vb.vbid)
+}
+
+func (c *uprConn) endStream(s *uprStream, flags uint32) {
+	c.removeStream(s)
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_END,
+		VBucket: s.vb.vbid,
+		Opaque:  s.opaque,
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(pkt.Extras, flags)
+	c.transmit(pkt)
+}
+
+// Sends a stream's changes, one snapshot at a time, until the stream
+// catches up with the vbucket, reaches its end seqno, or the buffer
+// fills, in which case it returns false.
+func (c *uprConn) sendChanges(s *uprStream) (complete bool, err error) {
+	for {
+		if s.sentSeq >= s.endSeq {
+			c.endStream(s, UPR_STREAM_END_OK)
+			return true, nil
+		}
+		if s.sentSeq >= s.snapEnd {
+			lastSeq := s.vb.ps.getLastCas()
+			if lastSeq > s.endSeq {
+				lastSeq = s.endSeq
+			}
+			if lastSeq <= s.sentSeq {
+				return true, nil
+			}
+			if c.bufferFull() {
+				return false, nil
+			}
+			c.sendSnapshotMarker(s, s.sentSeq+1, lastSeq)
+			s.snapEnd = lastSeq
+		}
+
+		full := false
+		err = s.vb.ps.visitChanges(casBytes(s.sentSeq+1), true,
+			func(i *item) bool {
+				if i.cas <= s.sentSeq {
+					return true
+				}
+				if i.cas > s.snapEnd {
+					return false
+				}
+				if len(i.key) > 0 {
+					if c.bufferFull() {
+						full = true
+						return false
+					}
+					c.transmit(uprChange(s, i))
+				}
+				s.sentSeq = i.cas
+				return true
+			})
+		if err != nil {
+			return false, err
+		}
+		if full {
+			return false, nil
+		}
+		// Any remaining changes in the snapshot were de-duplicated.
+		s.sentSeq = s.snapEnd
+	}
+}
+
+// The UPR_SNAPSHOT_MARKER extras are the start seqno (8 bytes), end
+// seqno (8) and flags (4).
+func (c *uprConn) sendSnapshotMarker(s *uprStream, startSeq, endSeq uint64) {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_SNAPSHOT_MARKER,
+		VBucket: s.vb.vbid,
+		Opaque:  s.opaque,
+		Extras:  make([]byte, 20),
+	}
+	binary.BigEndian.PutUint64(pkt.Extras, startSeq)
+	binary.BigEndian.PutUint64(pkt.Extras[8:], endSeq)
+	binary.BigEndian.PutUint32(pkt.Extras[16:], UPR_SNAPSHOT_MEMORY)
+	c.transmit(pkt)
+}
+
+// The UPR_MUTATION extras are the by seqno (8 bytes), rev seqno (8),
+// flags (4), expiration (4), lock time (4), metadata length (2) and
+// nru (1).  The UPR_DELETION and UPR_EXPIRATION extras are the by
+// seqno (8), rev seqno (8) and metadata length (2).
+func uprChange(s *uprStream, i *item) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_MUTATION,
+		VBucket: s.vb.vbid,
+		Opaque:  s.opaque,
+		Key:     i.key,
+		Cas:     i.cas,
+	}
+	if i.isDeletion() {
+		pkt.Opcode = UPR_DELETION
+		if i.isExpiration() {
+			pkt.Opcode = UPR_EXPIRATION
+		}
+		pkt.Extras = make([]byte, 18)
+	} else {
+		pkt.Extras = make([]byte, 31)
+		binary.BigEndian.PutUint32(pkt.Extras[16:], i.flag)
+		binary.BigEndian.PutUint32(pkt.Extras[20:], i.exp)
+		pkt.Body = i.data
+	}
+	binary.BigEndian.PutUint64(pkt.Extras, i.cas)
+	binary.BigEndian.PutUint64(pkt.Extras[8:], i.getRevSeq())
+	return pkt
+}
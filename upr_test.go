@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testUprStreamReq(vbid uint16, opaque uint32,
+	startSeq, endSeq uint64) *gomemcached.MCRequest {
+	req := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_REQ,
+		VBucket: vbid,
+		Opaque:  opaque,
+		Extras:  make([]byte, 48),
+	}
+	binary.BigEndian.PutUint64(req.Extras[8:], startSeq)
+	binary.BigEndian.PutUint64(req.Extras[16:], endSeq)
+	return req
+}
+
+func testUprSetup(t *testing.T) (*reqHandler, *io.PipeWriter,
+	chan transmissible, func()) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := &reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	pr, pw := io.Pipe()
+
+	open := &gomemcached.MCRequest{
+		Opcode: UPR_OPEN,
+		Key:    []byte("test-upr"),
+		Extras: make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(open.Extras[4:], UPR_OPEN_PRODUCER)
+	go doUpr(testBucket, open, pr, chpkt, cherr)
+
+	return rh, pw, chpkt, func() {
+		pw.Close()
+		testBucket.Close()
+		os.RemoveAll(testBucketDir)
+	}
+}
+
+func testUprNext(t *testing.T, chpkt chan transmissible,
+	m string) transmissible {
+	select {
+	case pkt := <-chpkt:
+		return pkt
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("No upr message received at %v.", m)
+	}
+	return nil
+}
+
+func testUprMustResponse(t *testing.T, chpkt chan transmissible, m string,
+	status gomemcached.Status) *gomemcached.MCResponse {
+	res, ok := testUprNext(t, chpkt, m).(*gomemcached.MCResponse)
+	if !ok || res.Status != status {
+		t.Fatalf("At %v, expected response with status %v, got: %#v",
+			m, status, res)
+	}
+	return res
+}
+
+func testUprMustRequest(t *testing.T, chpkt chan transmissible, m string,
+	op gomemcached.CommandCode) *gomemcached.MCRequest {
+	req, ok := testUprNext(t, chpkt, m).(*gomemcached.MCRequest)
+	if !ok || req.Opcode != op {
+		t.Fatalf("At %v, expected request %v, got: %#v", m, op, req)
+	}
+	return req
+}
+
+func TestUprOpenInvalid(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+
+	res := doUpr(testBucket, &gomemcached.MCRequest{Opcode: UPR_OPEN},
+		nil, nil, nil)
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected EINVAL for missing extras, got: %v", res)
+	}
+	res = doUpr(testBucket, &gomemcached.MCRequest{
+		Opcode: UPR_OPEN,
+		Extras: make([]byte, 8),
+	}, nil, nil, nil)
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected EINVAL for a consumer open, got: %v", res)
+	}
+}
+
+func TestUprStream(t *testing.T) {
+	rh, pw, chpkt, done := testUprSetup(t)
+	defer done()
+
+	testUprMustResponse(t, chpkt, "open", gomemcached.SUCCESS)
+
+	sets := []uint64{}
+	for _, k := range []string{"a", "b"} {
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   []byte(k),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+		sets = append(sets, res.Cas)
+	}
+
+	testUprStreamReq(0, 1234, 0, UPR_MAX_SEQNO).Transmit(pw)
+	res := testUprMustResponse(t, chpkt, "stream req", gomemcached.SUCCESS)
+	if res.Opaque != 1234 || len(res.Body) != 16 {
+		t.Errorf("expected failover log response, got: %#v", res)
+	}
+
+	m := testUprMustRequest(t, chpkt, "snapshot", UPR_SNAPSHOT_MARKER)
+	if binary.BigEndian.Uint64(m.Extras) != 1 ||
+		binary.BigEndian.Uint64(m.Extras[8:]) != sets[1] {
+		t.Errorf("expected snapshot up to %v, got: %#v", sets[1], m)
+	}
+	for i, k := range []string{"a", "b"} {
+		m = testUprMustRequest(t, chpkt, "mutation "+k, UPR_MUTATION)
+		if string(m.Key) != k || m.Opaque != 1234 ||
+			binary.BigEndian.Uint64(m.Extras) != sets[i] ||
+			binary.BigEndian.Uint64(m.Extras[8:]) != 1 {
+			t.Errorf("expected mutation of %v at seqno %v, got: %#v",
+				k, sets[i], m)
+		}
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+	})
+	testUprMustRequest(t, chpkt, "delete snapshot", UPR_SNAPSHOT_MARKER)
+	m = testUprMustRequest(t, chpkt, "deletion", UPR_DELETION)
+	if string(m.Key) != "a" || binary.BigEndian.Uint64(m.Extras) != res.Cas ||
+		binary.BigEndian.Uint64(m.Extras[8:]) != 2 {
+		t.Errorf("expected deletion of rev 2 at seqno %v, got: %#v", res.Cas, m)
+	}
+
+	testUprStreamReq(0, 1, 0, UPR_MAX_SEQNO).Transmit(pw)
+	testUprMustResponse(t, chpkt, "dupe stream", gomemcached.KEY_EEXISTS)
+
+	(&gomemcached.MCRequest{Opcode: UPR_CLOSE_STREAM}).Transmit(pw)
+	testUprMustResponse(t, chpkt, "close stream", gomemcached.SUCCESS)
+
+	rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("c"),
+		Body:   []byte("c"),
+	})
+	select {
+	case pkt := <-chpkt:
+		t.Errorf("expected no messages after close stream, got: %#v", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUprStreamResume(t *testing.T) {
+	rh, pw, chpkt, done := testUprSetup(t)
+	defer done()
+
+	testUprMustResponse(t, chpkt, "open", gomemcached.SUCCESS)
+
+	sets := []uint64{}
+	for _, k := range []string{"a", "b", "c"} {
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   []byte(k),
+		})
+		sets = append(sets, res.Cas)
+	}
+
+	testUprStreamReq(0, 1, sets[2]+100, UPR_MAX_SEQNO).Transmit(pw)
+	rb := testUprMustResponse(t, chpkt, "rollback", ROLLBACK)
+	if binary.BigEndian.Uint64(rb.Body) != sets[2] {
+		t.Errorf("expected rollback to %v, got: %#v", sets[2], rb)
+	}
+
+	testUprStreamReq(0, 2, sets[0], sets[1]).Transmit(pw)
+	testUprMustResponse(t, chpkt, "stream req", gomemcached.SUCCESS)
+	testUprMustRequest(t, chpkt, "snapshot", UPR_SNAPSHOT_MARKER)
+	m := testUprMustRequest(t, chpkt, "mutation", UPR_MUTATION)
+	if string(m.Key) != "b" {
+		t.Errorf("expected resumed stream to start at b, got: %#v", m)
+	}
+	m = testUprMustRequest(t, chpkt, "stream end", UPR_STREAM_END)
+	if binary.BigEndian.Uint32(m.Extras) != UPR_STREAM_END_OK {
+		t.Errorf("expected ok stream end, got: %#v", m)
+	}
+}
+
+func TestUprStreamExpiration(t *testing.T) {
+	rh, pw, chpkt, done := testUprSetup(t)
+	defer done()
+
+	testUprMustResponse(t, chpkt, "open", gomemcached.SUCCESS)
+
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("a"),
+		Extras: make([]byte, 8),
+		Body:   []byte("a"),
+	}
+	binary.BigEndian.PutUint32(req.Extras[4:], 100)
+	res := rh.HandleMessage(ioutil.Discard, nil, req)
+
+	testUprStreamReq(0, 1, res.Cas, UPR_MAX_SEQNO).Transmit(pw)
+	testUprMustResponse(t, chpkt, "stream req", gomemcached.SUCCESS)
+
+	vb, _ := rh.currentBucket.GetVBucket(0)
+	if err := vb.expire([]byte("a"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("expected expire to work, got: %v", err)
+	}
+	testUprMustRequest(t, chpkt, "snapshot", UPR_SNAPSHOT_MARKER)
+	testUprMustRequest(t, chpkt, "expiration", UPR_EXPIRATION)
+
+	rh.currentBucket.SetVBState(0, VBReplica)
+	m := testUprMustRequest(t, chpkt, "stream end", UPR_STREAM_END)
+	if binary.BigEndian.Uint32(m.Extras) != UPR_STREAM_END_STATE_CHANGED {
+		t.Errorf("expected state changed stream end, got: %#v", m)
+	}
+}
+
+func TestUprBufferAck(t *testing.T) {
+	rh, pw, chpkt, done := testUprSetup(t)
+	defer done()
+
+	testUprMustResponse(t, chpkt, "open", gomemcached.SUCCESS)
+
+	for _, k := range []string{"a", "b"} {
+		rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   []byte(k),
+		})
+	}
+
+	(&gomemcached.MCRequest{
+		Opcode: UPR_CONTROL,
+		Key:    []byte("connection_buffer_size"),
+		Body:   []byte("1"),
+	}).Transmit(pw)
+	testUprMustResponse(t, chpkt, "control", gomemcached.SUCCESS)
+
+	testUprStreamReq(0, 1, 0, UPR_MAX_SEQNO).Transmit(pw)
+	testUprMustResponse(t, chpkt, "stream req", gomemcached.SUCCESS)
+	testUprMustRequest(t, chpkt, "snapshot", UPR_SNAPSHOT_MARKER)
+	select {
+	case pkt := <-chpkt:
+		t.Fatalf("expected full buffer to pause the stream, got: %#v", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ack := &gomemcached.MCRequest{
+		Opcode: UPR_BUFFER_ACK,
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(ack.Extras, 1000)
+	ack.Transmit(pw)
+	testUprMustRequest(t, chpkt, "mutation a", UPR_MUTATION)
+
+	ack.Transmit(pw)
+	m := testUprMustRequest(t, chpkt, "mutation b", UPR_MUTATION)
+	if string(m.Key) != "b" {
+		t.Errorf("expected mutation b, got: %#v", m)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dustin/gomemcached"
+)
+
+type userPerm uint8
+
+const (
+	PERM_READ userPerm = 1 << iota
+	PERM_WRITE
+	PERM_VIEWS
+	PERM_BUCKET_ADMIN
+
+	PERM_ALL = PERM_READ | PERM_WRITE | PERM_VIEWS | PERM_BUCKET_ADMIN
+)
+
+const (
+	ROLE_ADMIN        = "admin" // Cluster admin, for all buckets.
+	ROLE_BUCKET_ADMIN = "bucket_admin"
+	ROLE_READ_ONLY    = "read_only"
+	ROLE_DATA_WRITER  = "data_writer"
+	ROLE_VIEWS_READER = "views_reader"
+)
+
+var rolePerms = map[string]userPerm{
+	ROLE_ADMIN:        PERM_ALL,
+	ROLE_BUCKET_ADMIN: PERM_ALL,
+	ROLE_READ_ONLY:    PERM_READ | PERM_VIEWS,
+	ROLE_DATA_WRITER:  PERM_READ | PERM_WRITE,
+	ROLE_VIEWS_READER: PERM_VIEWS,
+}
+
+// The permission a named user needs for a data protocol command.
+// Unlisted commands need PERM_BUCKET_ADMIN.
+var opcodePerms = [256]userPerm{
+	gomemcached.GET:   PERM_READ,
+	gomemcached.GETK:  PERM_READ,
+	gomemcached.GETQ:  PERM_READ,
+	gomemcached.GETKQ: PERM_READ,
+	gomemcached.RGET:  PERM_READ,
+	gomemcached.STAT:  PERM_READ,
+
+	gomemcached.OBSERVE:     PERM_READ,
+	gomemcached.TAP_CONNECT: PERM_READ,
+
+	GET_META:   PERM_READ,
+	GETQ_META:  PERM_READ,
+	GET_VBMETA: PERM_READ,
+	UPR_OPEN:   PERM_READ,
+
+	gomemcached.SET:        PERM_WRITE,
+	gomemcached.SETQ:       PERM_WRITE,
+	gomemcached.DELETE:     PERM_WRITE,
+	gomemcached.DELETEQ:    PERM_WRITE,
+	gomemcached.ADD:        PERM_WRITE,
+	gomemcached.ADDQ:       PERM_WRITE,
+	gomemcached.REPLACE:    PERM_WRITE,
+	gomemcached.REPLACEQ:   PERM_WRITE,
+	gomemcached.APPEND:     PERM_WRITE,
+	gomemcached.APPENDQ:    PERM_WRITE,
+	gomemcached.PREPEND:    PERM_WRITE,
+	gomemcached.PREPENDQ:   PERM_WRITE,
+	gomemcached.INCREMENT:  PERM_WRITE,
+	gomemcached.INCREMENTQ: PERM_WRITE,
+	gomemcached.DECREMENT:  PERM_WRITE,
+	gomemcached.DECREMENTQ: PERM_WRITE,
+
+	SET_WITH_META:     PERM_WRITE,
+	SETQ_WITH_META:    PERM_WRITE,
+	DELETE_WITH_META:  PERM_WRITE,
+	DELETEQ_WITH_META: PERM_WRITE,
+	ADD_WITH_META:     PERM_WRITE,
+	ADDQ_WITH_META:    PERM_WRITE,
+
+	TOUCH:      PERM_WRITE,
+	GAT:        PERM_WRITE,
+	GATQ:       PERM_WRITE,
+	GETL:       PERM_WRITE,
+	UNLOCK_KEY: PERM_WRITE,
+}
+
+func opcodePerm(cmd gomemcached.CommandCode) userPerm {
+	if p := opcodePerms[uint8(cmd)]; p != 0 {
+		return p
+	}
+	return PERM_BUCKET_ADMIN
+}
+
+// TAP_CONNECT flags that change the server's state, by handing
+// vbuckets over to the consumer, or that register or pace a stream
+// like a replica would, which need PERM_BUCKET_ADMIN.
+var tapAdminFlags = []gomemcached.TapConnectFlag{
+	gomemcached.TAKEOVER_VBUCKETS,
+	gomemcached.REGISTERED_CLIENT,
+	gomemcached.SUPPORT_ACK,
+}
+
+// The permission a named user needs for a request, which for a
+// TAP_CONNECT also depends on its flags.
+func requestPerm(req *gomemcached.MCRequest) userPerm {
+	if req.Opcode == gomemcached.TAP_CONNECT {
+		tc, err := req.ParseTapCommands()
+		if err != nil {
+			return PERM_BUCKET_ADMIN
+		}
+		for _, flag := range tapAdminFlags {
+			if tapFlagExists(&tc, flag) {
+				return PERM_BUCKET_ADMIN
+			}
+		}
+	}
+	return opcodePerm(req.Opcode)
+}
+
+type UserRole struct {
+	Role string `json:"role"`
+
+	// A path.Match pattern of bucket names, where "" means all
+	// buckets.  Ignored by ROLE_ADMIN.
+	Buckets string `json:"buckets,omitempty"`
+}
+
+// Parses roles like "bucket_admin:foo*,read_only".
+func parseUserRoles(s string) ([]UserRole, error) {
+	rv := []UserRole{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		parts := strings.SplitN(r, ":", 2)
+		role := UserRole{Role: parts[0]}
+		if len(parts) > 1 {
+			role.Buckets = parts[1]
+		}
+		if _, ok := rolePerms[role.Role]; !ok {
+			return nil, fmt.Errorf("unknown role: %v", role.Role)
+		}
+		if _, err := path.Match(role.Buckets, ""); err != nil {
+			return nil, fmt.Errorf("bad buckets pattern: %v, err: %v",
+				role.Buckets, err)
+		}
+		rv = append(rv, role)
+	}
+	return rv, nil
+}
+
+func (r UserRole) matches(bucketName string) bool {
+	if r.Role == ROLE_ADMIN || r.Buckets == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Buckets, bucketName)
+	return ok
+}
+
+type User struct {
+	Name  string     `json:"name"`
+	Roles []UserRole `json:"roles"`
+
+	PasswordHashFunc string            `json:"passwordHashFunc"`
+	PasswordHash     string            `json:"passwordHash"`
+	PasswordSalt     string            `json:"passwordSalt"`
+	SaslSecrets      map[string]string `json:"saslSecrets,omitempty"`
+}
+
+// Users share the password handling of BucketSettings.
+func (u *User) credentials() *BucketSettings {
+	return &BucketSettings{
+		PasswordHashFunc: u.PasswordHashFunc,
+		PasswordHash:     u.PasswordHash,
+		PasswordSalt:     u.PasswordSalt,
+		SaslSecrets:      u.SaslSecrets,
+	}
+}
+
+func (u *User) Auth(password []byte) bool {
+	return u.credentials().Auth(password)
+}
+
+func (u *User) SaslSecret(mech string) (string, error) {
+	return u.credentials().SaslSecret(mech)
+}
+
+func (u *User) SetPassword(hashFunc string, password []byte) error {
+	if len(password) == 0 {
+		return fmt.Errorf("users need a password")
+	}
+	bs := &BucketSettings{}
+	if err := bs.SetPassword(hashFunc, password); err != nil {
+		return err
+	}
+	u.PasswordHashFunc = bs.PasswordHashFunc
+	u.PasswordHash = bs.PasswordHash
+	u.PasswordSalt = bs.PasswordSalt
+	u.SaslSecrets = bs.SaslSecrets
+	return nil
+}
+
+func (u *User) isAdmin() bool {
+	for _, r := range u.Roles {
+		if r.Role == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a role grants all of perm on the bucket.  A zero
+// perm asks whether any role applies to the bucket.
+func (u *User) can(bucketName string, perm userPerm) bool {
+	for _, r := range u.Roles {
+		if rolePerms[r.Role]&perm == perm && r.matches(bucketName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) Copy() *User {
+	rv := *u
+	rv.Roles = append([]UserRole(nil), u.Roles...)
+	return &rv
+}
+
+// Returns a safe subset (no passwords) useful for JSON-ification.
+func (u *User) SafeView() map[string]interface{} {
+	return map[string]interface{}{
+		"name":  u.Name,
+		"roles": u.Roles,
+	}
+}
+
+// Named users, persisted as users.json in the data directory.  A
+// named user takes precedence over a bucket of the same name when
+// authenticating.
+type Users struct {
+	lock  sync.Mutex
+	dir   string
+	users map[string]*User
+}
+
+var users *Users
+
+func NewUsers(dir string) (*Users, error) {
+	us := &Users{dir: dir, users: map[string]*User{}}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "users.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return us, nil
+		}
+		return nil, err
+	}
+	list := []*User{}
+	if err = jsonUnmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		us.users[u.Name] = u
+	}
+	return us, nil
+}
+
+// Returns a copy of the named user, or nil.
+func (us *Users) Get(name string) *User {
+	if us == nil {
+		return nil
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	u := us.users[name]
+	if u == nil {
+		return nil
+	}
+	return u.Copy()
+}
+
+func (us *Users) GetNames() []string {
+	if us == nil {
+		return nil
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	rv := make([]string, 0, len(us.users))
+	for name := range us.users {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Adds or replaces a user, and saves all users.
+func (us *Users) Set(u *User) error {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	prev := us.users[u.Name]
+	us.users[u.Name] = u.Copy()
+	err := us.save_unlocked()
+	if err != nil {
+		if prev != nil {
+			us.users[u.Name] = prev
+		} else {
+			delete(us.users, u.Name)
+		}
+	}
+	return err
+}
+
+// Removes a user, returning false if there was no such user.
+func (us *Users) Delete(name string) (bool, error) {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	prev := us.users[name]
+	if prev == nil {
+		return false, nil
+	}
+	delete(us.users, name)
+	err := us.save_unlocked()
+	if err != nil {
+		us.users[name] = prev
+	}
+	return true, err
+}
+
+func (us *Users) save_unlocked() error {
+	list := make([]*User, 0, len(us.users))
+	for _, u := range us.users {
+		list = append(list, u)
+	}
+	j, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	fname := filepath.Join(us.dir, "users.json")
+	fnameNew := filepath.Join(us.dir, "users.json.new")
+	fnameOld := filepath.Join(us.dir, "users.json.old")
+	if err = ioutil.WriteFile(fnameNew, j, 0600); err != nil {
+		return err
+	}
+	os.Rename(fname, fnameOld)
+	return os.Rename(fnameNew, fname)
+}
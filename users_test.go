@@ -0,0 +1,278 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestParseUserRoles(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp []UserRole
+		ok  bool
+	}{
+		{"", []UserRole{}, true},
+		{"admin", []UserRole{{ROLE_ADMIN, ""}}, true},
+		{"bucket_admin:app-*, read_only", []UserRole{
+			{ROLE_BUCKET_ADMIN, "app-*"}, {ROLE_READ_ONLY, ""}}, true},
+		{"not_a_role", nil, false},
+		{"read_only:[", nil, false},
+	}
+	for _, test := range tests {
+		got, err := parseUserRoles(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("expected ok %v for %q, got err: %v", test.ok, test.in, err)
+			continue
+		}
+		if len(got) != len(test.exp) {
+			t.Errorf("expected %v for %q, got: %v", test.exp, test.in, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.exp[i] {
+				t.Errorf("expected %v for %q, got: %v", test.exp, test.in, got)
+			}
+		}
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	u := &User{Roles: []UserRole{
+		{ROLE_DATA_WRITER, "app-*"},
+		{ROLE_VIEWS_READER, "reports"},
+	}}
+	tests := []struct {
+		bucket string
+		perm   userPerm
+		exp    bool
+	}{
+		{"app-1", PERM_READ, true},
+		{"app-1", PERM_WRITE, true},
+		{"app-1", PERM_VIEWS, false},
+		{"app-1", PERM_BUCKET_ADMIN, false},
+		{"app-1", 0, true},
+		{"reports", PERM_VIEWS, true},
+		{"reports", PERM_READ, false},
+		{"other", 0, false},
+	}
+	for _, test := range tests {
+		if u.can(test.bucket, test.perm) != test.exp {
+			t.Errorf("expected can(%v, %v) to be %v",
+				test.bucket, test.perm, test.exp)
+		}
+	}
+	if u.isAdmin() {
+		t.Errorf("expected non-admin")
+	}
+	a := &User{Roles: []UserRole{{ROLE_ADMIN, "ignored"}}}
+	if !a.isAdmin() || !a.can("anything", PERM_ALL) {
+		t.Errorf("expected admin to be able to do anything")
+	}
+}
+
+func TestUsersPersist(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+
+	us, err := NewUsers(d)
+	if err != nil {
+		t.Fatalf("expected NewUsers to work, got: %v", err)
+	}
+	u := &User{Name: "alice", Roles: []UserRole{{ROLE_READ_ONLY, "foo"}}}
+	if err = u.SetPassword(PASSWORD_HASH_PBKDF2_SHA256, nil); err == nil {
+		t.Errorf("expected an empty user password to fail")
+	}
+	if err = u.SetPassword(PASSWORD_HASH_PBKDF2_SHA256,
+		[]byte("secret")); err != nil {
+		t.Fatalf("expected SetPassword to work, got: %v", err)
+	}
+	if err = us.Set(u); err != nil {
+		t.Fatalf("expected Set to work, got: %v", err)
+	}
+
+	us, err = NewUsers(d)
+	if err != nil {
+		t.Fatalf("expected NewUsers reload to work, got: %v", err)
+	}
+	got := us.Get("alice")
+	if got == nil || !got.Auth([]byte("secret")) || got.Auth([]byte("wrong")) {
+		t.Fatalf("expected reloaded user to auth, got: %#v", got)
+	}
+	if !got.can("foo", PERM_READ) || got.can("foo", PERM_WRITE) {
+		t.Errorf("expected reloaded roles, got: %v", got.Roles)
+	}
+	if _, err = got.SaslSecret(SASL_SCRAM_SHA256); err != nil {
+		t.Errorf("expected a SCRAM secret, got: %v", err)
+	}
+	if names := us.GetNames(); len(names) != 1 || names[0] != "alice" {
+		t.Errorf("expected [alice], got: %v", names)
+	}
+
+	if ok, err := us.Delete("alice"); !ok || err != nil {
+		t.Errorf("expected Delete to work, got: %v, %v", ok, err)
+	}
+	if ok, _ := us.Delete("alice"); ok {
+		t.Errorf("expected second Delete to find no user")
+	}
+	us, _ = NewUsers(d)
+	if us.Get("alice") != nil {
+		t.Errorf("expected deleted user to stay deleted")
+	}
+}
+
+func TestUserSaslRoles(t *testing.T) {
+	rh, done := testSaslSetup(t)
+	defer done()
+
+	defer func(orig *Users) { users = orig }(users)
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	users, _ = NewUsers(d)
+	u := &User{Name: "reader", Roles: []UserRole{{ROLE_READ_ONLY, "haspwd"}}}
+	u.SetPassword(PASSWORD_HASH_PBKDF2_SHA256, []byte("pw"))
+	users.Set(u)
+
+	b := rh.buckets.Get("haspwd")
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(SASL_PLAIN),
+		Body:   []byte("\x00reader\x00pw"),
+	})
+	if res.Status != gomemcached.SUCCESS || rh.user != "reader" {
+		t.Fatalf("expected user SASL PLAIN to work, got: %v", res)
+	}
+	if rh.currentBucket != nil {
+		t.Errorf("expected no bucket before SELECT_BUCKET")
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SELECT_BUCKET,
+		Key:    []byte("plainpwd"),
+	})
+	if res.Status != EACCESS {
+		t.Errorf("expected SELECT_BUCKET without a role to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: SELECT_BUCKET,
+		Key:    []byte("haspwd"),
+	})
+	if res.Status != gomemcached.SUCCESS || rh.currentBucketName != "haspwd" {
+		t.Fatalf("expected SELECT_BUCKET to work, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("k"),
+		Body:   []byte("v"),
+	})
+	if res.Status != EACCESS {
+		t.Errorf("expected SET by a read_only user to fail, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("k"),
+	})
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected GET by a read_only user to work, got: %v", res)
+	}
+	for _, flags := range []gomemcached.TapConnectFlag{
+		gomemcached.TAKEOVER_VBUCKETS,
+		gomemcached.REGISTERED_CLIENT,
+		gomemcached.SUPPORT_ACK | gomemcached.BACKFILL,
+	} {
+		res = rh.HandleMessage(ioutil.Discard, nil, testTapConnect(flags, 0))
+		if res.Status != EACCESS {
+			t.Errorf("expected TAP_CONNECT with flags %x by a read_only user"+
+				" to fail, got: %v", flags, res)
+		}
+	}
+	if p := requestPerm(testTapConnect(gomemcached.BACKFILL, 0)); p != PERM_READ {
+		t.Errorf("expected a plain TAP_CONNECT to need PERM_READ, got: %v", p)
+	}
+
+	// Bucket auth drops the user's roles.
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(SASL_PLAIN),
+		Body:   []byte("\x00haspwd\x00a nice password"),
+	})
+	if res.Status != gomemcached.SUCCESS || rh.user != "" {
+		t.Errorf("expected bucket SASL PLAIN to work, got: %v", res)
+	}
+}
+
+func TestRestUsers(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	defer func(orig *Users) { users = orig }(users)
+	users, _ = NewUsers(d)
+	buckets.New("foo", &BucketSettings{NumPartitions: 1})
+	mr := authenticationFilter{testSetupMux(d)}
+
+	do := func(method, path, user string, form url.Values) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "http://127.0.0.1"+path,
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			r.SetBasicAuth(user, "pw")
+		}
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := do("PUT", "/_api/users/alice", "", url.Values{"roles": {"nope"}})
+	if rr.Code != 400 {
+		t.Errorf("expected unknown role to fail, got: %v", rr.Code)
+	}
+	rr = do("PUT", "/_api/users/alice", "", url.Values{"roles": {"read_only"}})
+	if rr.Code != 400 {
+		t.Errorf("expected new user without a password to fail, got: %v", rr.Code)
+	}
+	rr = do("PUT", "/_api/users/alice", "", url.Values{
+		"password": {"pw"}, "roles": {"read_only:foo"}})
+	if rr.Code != 204 {
+		t.Fatalf("expected PUT user to work, got: %v, %v", rr.Code, rr.Body)
+	}
+	rr = do("GET", "/_api/users/alice", "", nil)
+	if rr.Code != 200 || strings.Contains(rr.Body.String(), "password") {
+		t.Errorf("expected GET user without password, got: %v, %v",
+			rr.Code, rr.Body)
+	}
+
+	rr = do("GET", "/_api/buckets/foo", "alice", nil)
+	if rr.Code != 200 {
+		t.Errorf("expected read_only user to GET bucket, got: %v", rr.Code)
+	}
+	rr = do("GET", "/_api/buckets/default", "alice", nil)
+	if rr.Code != 403 {
+		t.Errorf("expected user without a role to be denied, got: %v", rr.Code)
+	}
+	rr = do("POST", "/_api/buckets/foo/compact", "alice", nil)
+	if rr.Code != 403 {
+		t.Errorf("expected read_only user to not compact, got: %v", rr.Code)
+	}
+	rr = do("GET", "/_api/users", "alice", nil)
+	if rr.Code != 401 && rr.Code != 403 {
+		t.Errorf("expected non-admin to not list users, got: %v", rr.Code)
+	}
+
+	rr = do("DELETE", "/_api/users/alice", "", nil)
+	if rr.Code != 204 {
+		t.Errorf("expected DELETE user to work, got: %v", rr.Code)
+	}
+	rr = do("DELETE", "/_api/users/alice", "", nil)
+	if rr.Code != 404 {
+		t.Errorf("expected second DELETE user to 404, got: %v", rr.Code)
+	}
+}
@@ -22,6 +22,7 @@ const (
 	SET_VBMETA           = gomemcached.CommandCode(0x62)
 	COLL_SUFFIX_KEYS     = ".k" // This suffix sorts before CHANGES suffix.
 	COLL_SUFFIX_CHANGES  = ".s" // The changes is like a "sequence" stream.
+	COLL_SUFFIX_TOMBS    = ".t" // The last deletion of each deleted key.
 	COLL_VBMETA          = "vbm"
 	MAX_VBID             = 0x0000ffff // Due to uint16.
 	MAX_ITEM_KEY_LENGTH  = 250
@@ -31,6 +32,12 @@ const (
 
 const (
 	// TODO: Graduate these to gomemcached/couchbase one day.
+	TOUCH             = gomemcached.CommandCode(0x1c)
+	GAT               = gomemcached.CommandCode(0x1d)
+	GATQ              = gomemcached.CommandCode(0x1e)
+	GETL              = gomemcached.CommandCode(0x94)
+	UNLOCK_KEY        = gomemcached.CommandCode(0x95)
+	SELECT_BUCKET     = gomemcached.CommandCode(0x89)
 	GET_META          = gomemcached.CommandCode(0xa0)
 	GETQ_META         = gomemcached.CommandCode(0xa1)
 	SET_WITH_META     = gomemcached.CommandCode(0xa2)
@@ -39,6 +46,25 @@ const (
 	ADDQ_WITH_META    = gomemcached.CommandCode(0xa5)
 	DELETE_WITH_META  = gomemcached.CommandCode(0xa8)
 	DELETEQ_WITH_META = gomemcached.CommandCode(0xa9)
+
+	UPR_OPEN             = gomemcached.CommandCode(0x50)
+	UPR_CLOSE_STREAM     = gomemcached.CommandCode(0x52)
+	UPR_STREAM_REQ       = gomemcached.CommandCode(0x53)
+	UPR_GET_FAILOVER_LOG = gomemcached.CommandCode(0x54)
+	UPR_STREAM_END       = gomemcached.CommandCode(0x55)
+	UPR_SNAPSHOT_MARKER  = gomemcached.CommandCode(0x56)
+	UPR_MUTATION         = gomemcached.CommandCode(0x57)
+	UPR_DELETION         = gomemcached.CommandCode(0x58)
+	UPR_EXPIRATION       = gomemcached.CommandCode(0x59)
+	UPR_NOOP             = gomemcached.CommandCode(0x5c)
+	UPR_BUFFER_ACK       = gomemcached.CommandCode(0x5d)
+	UPR_CONTROL          = gomemcached.CommandCode(0x5e)
+
+	LOCKED        = gomemcached.Status(0x09)
+	AUTH_CONTINUE = gomemcached.Status(0x21)
+	ROLLBACK      = gomemcached.Status(0x23)
+	EACCESS       = gomemcached.Status(0x24)
+	NOT_SUPPORTED = gomemcached.Status(0x83)
 )
 
 var ignore = errors.New("not-an-error/sentinel")
@@ -53,6 +79,7 @@ type VBucket struct {
 	bs       *bucketstore
 	ps       *partitionstore
 	lock     sync.Mutex
+	locks    map[string]*keyLock // Protected by lock.
 	observer broadcast.Broadcaster
 
 	bucketItemBytes *int64
@@ -100,14 +127,21 @@ var dispatchTable = [256]dispatchFun{
 	gomemcached.DECREMENT:  vbMutate,
 	gomemcached.DECREMENTQ: vbMutate,
 
-	GET_META:          vbGet,
-	GETQ_META:         vbGet,
-	SET_WITH_META:     vbMutate,
-	SETQ_WITH_META:    vbMutate,
-	DELETE_WITH_META:  vbDelete,
-	DELETEQ_WITH_META: vbDelete,
-	ADD_WITH_META:     vbMutate,
-	ADDQ_WITH_META:    vbMutate,
+	GET_META:          vbGetMeta,
+	GETQ_META:         vbGetMeta,
+	SET_WITH_META:     vbMutateWithMeta,
+	SETQ_WITH_META:    vbMutateWithMeta,
+	DELETE_WITH_META:  vbDeleteWithMeta,
+	DELETEQ_WITH_META: vbDeleteWithMeta,
+	ADD_WITH_META:     vbMutateWithMeta,
+	ADDQ_WITH_META:    vbMutateWithMeta,
+
+	TOUCH: vbTouch,
+	GAT:   vbTouch,
+	GATQ:  vbTouch,
+
+	GETL:       vbGetLocked,
+	UNLOCK_KEY: vbUnlockKey,
 
 	gomemcached.RGET: vbRGet,
 
@@ -155,6 +189,7 @@ func (v *VBucket) Dispatch(w io.Writer,
 			Body:   []byte(fmt.Sprintf("Unknown command %v", req.Opcode)),
 		}
 	}
+	defer v.parent.GetTimings().Op(req.Opcode).Since(time.Now())
 	return f(v, w, req)
 }
 
@@ -235,6 +270,45 @@ func (v *VBucket) setVBMeta(newMeta *VBMeta) (err error) {
 	return nil
 }
 
+// Drops all of the vbucket's items, along with their changes, key
+// locks and view indexes.  The vbucket's LastCas is kept, so CAS
+// values and change sequences don't restart.
+func (v *VBucket) flushItems() (err error) {
+	v.viewsLock.Lock()
+	defer v.viewsLock.Unlock()
+
+	v.bs.apply(func() {
+		v.Apply(func() {
+			v.ps.clear_unlocked()
+			v.locks = nil
+
+			prevMeta := v.Meta()
+			newMeta := prevMeta.Copy()
+			newMeta.MetaCas = atomic.AddUint64(&prevMeta.LastCas, 1)
+			// The VBMeta change is now the only change, which keeps
+			// the LastCas across a restart.
+			if err = v.setVBMeta(newMeta); err != nil {
+				return
+			}
+
+			var numItems, numItemBytes uint64
+			numItems, numItemBytes, err = v.ps.getTotals()
+			if err != nil {
+				return
+			}
+			atomic.StoreInt64(&v.stats.Items, int64(numItems))
+			atomic.StoreInt64(&v.stats.Expirable, 0)
+			prevItemBytes := atomic.SwapInt64(&v.stats.ItemBytes, int64(numItemBytes))
+			atomic.AddInt64(v.bucketItemBytes, int64(numItemBytes)-prevItemBytes)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&v.staleness, 0)
+	return v.clearViewsStore()
+}
+
 func (v *VBucket) load() (err error) {
 	v.Apply(func() {
 		meta := v.Meta().Copy()
@@ -266,6 +340,7 @@ func (v *VBucket) load() (err error) {
 			if meta.LastCas < lastCas {
 				meta.LastCas = lastCas
 			}
+			v.ps.loadedCas(lastCas)
 		}
 
 		atomic.StorePointer(&v.meta, unsafe.Pointer(meta))
@@ -289,8 +364,14 @@ func (v *VBucket) AddStatsTo(dest *BucketStats, key string) {
 	}
 }
 
-func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
-	res *gomemcached.MCResponse) {
+func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	res, _ := vbGetItem(v, w, req)
+	return res
+}
+
+// Like vbGet, but also returns the item on success.
+func vbGetItem(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse, i *item) {
 	atomic.AddInt64(&v.stats.Gets, 1)
 
 	i, err := v.getUnexpired(req.Key, time.Now())
@@ -298,14 +379,14 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 		return &gomemcached.MCResponse{
 			Status: gomemcached.TMPFAIL,
 			Body:   []byte(fmt.Sprintf("Store get error %v", err)),
-		}
+		}, nil
 	}
 	if i == nil {
 		atomic.AddInt64(&v.stats.GetMisses, 1)
 		if IsQuietEx(req.Opcode) {
-			return nil
+			return nil, nil
 		}
-		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}, nil
 	}
 
 	res = &gomemcached.MCResponse{
@@ -321,7 +402,7 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 
 	atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(i.data)))
 
-	return res
+	return res, i
 }
 
 func vbGetVBMeta(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
@@ -379,7 +460,7 @@ func vbSetVBMeta(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 			// to client; which might not be what some management
 			// use cases want (ability to switch vbstate even if
 			// dirty queues are huge).
-			if _, err := v.bs.flush_unlocked(); err != nil {
+			if _, err := v.bs.flush_unlocked(PERSIST_REASON_VBMETA); err != nil {
 				res = &gomemcached.MCResponse{
 					Status: gomemcached.TMPFAIL,
 					Body:   []byte(fmt.Sprintf("setVBMeta flush error %v", err)),
@@ -454,6 +535,6 @@ func (v *VBucket) Visit(start []byte,
 }
 
 func IsQuietEx(c gomemcached.CommandCode) bool {
-	return c.IsQuiet() ||
+	return c.IsQuiet() || c == GATQ ||
 		c == GETQ_META || c == SETQ_WITH_META || c == ADDQ_WITH_META || c == DELETEQ_WITH_META
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+var lockExpirePeriodic *periodically
+
+const (
+	DEFAULT_LOCK_TIMEOUT = 15 // In seconds.
+	MAX_LOCK_TIMEOUT     = 30
+)
+
+// A lock taken on an item by GETL.  Until the lock is released or
+// times out, only requests that supply the lock's cas may mutate the
+// item.
+type keyLock struct {
+	cas uint64
+	exp time.Time
+}
+
+// Returns the unexpired lock on a key, or nil.  Must be invoked while
+// holding the vbucket lock (via Apply).
+func (v *VBucket) getLock(key []byte, now time.Time) *keyLock {
+	l := v.locks[string(key)]
+	if l == nil {
+		return nil
+	}
+	if !now.Before(l.exp) {
+		delete(v.locks, string(key))
+		atomic.AddInt64(&v.stats.LockExpires, 1)
+		return nil
+	}
+	return l
+}
+
+// Must be invoked while holding the vbucket lock (via Apply).
+func (v *VBucket) unlock(key []byte) {
+	delete(v.locks, string(key))
+}
+
+// Checks whether a request may modify a possibly locked item.  When
+// the request holds the lock, the returned cas is that of the locked
+// item, so normal CAS validation succeeds; otherwise it's the
+// request's own cas.  Must be invoked while holding the vbucket lock
+// (via Apply).
+func (v *VBucket) checkLock(req *gomemcached.MCRequest, itemOld *item,
+	now time.Time) (*gomemcached.MCResponse, uint64, error) {
+	l := v.getLock(req.Key, now)
+	if l == nil {
+		return nil, req.Cas, nil
+	}
+	if itemOld == nil {
+		// The locked item went away (e.g., expired).
+		v.unlock(req.Key)
+		return nil, req.Cas, nil
+	}
+	if req.Cas != l.cas {
+		atomic.AddInt64(&v.stats.LockedErrs, 1)
+		return &gomemcached.MCResponse{
+			Status: LOCKED,
+			Body:   []byte(fmt.Sprintf("key is locked: %v", req.Key)),
+		}, 0, ignore
+	}
+	return nil, itemOld.cas, nil
+}
+
+func vbGetLocked(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.GetLocks, 1)
+
+	timeout := uint32(DEFAULT_LOCK_TIMEOUT)
+	switch len(req.Extras) {
+	case 0:
+	case 4:
+		timeout = binary.BigEndian.Uint32(req.Extras)
+		if timeout == 0 || timeout > MAX_LOCK_TIMEOUT {
+			timeout = DEFAULT_LOCK_TIMEOUT
+		}
+	default:
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for getl: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+
+	var i *item
+	var err error
+	var firstLock bool
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err = v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		if v.getLock(req.Key, now) != nil {
+			atomic.AddInt64(&v.stats.LockedErrs, 1)
+			res = &gomemcached.MCResponse{
+				Status: LOCKED,
+				Body:   []byte(fmt.Sprintf("key is locked: %v", req.Key)),
+			}
+			return
+		}
+
+		l := &keyLock{
+			cas: atomic.AddUint64(&v.Meta().LastCas, 1),
+			exp: now.Add(time.Duration(timeout) * time.Second),
+		}
+		if v.locks == nil {
+			v.locks = map[string]*keyLock{}
+		}
+		v.locks[string(req.Key)] = l
+		firstLock = len(v.locks) == 1
+
+		res = &gomemcached.MCResponse{
+			Cas:    l.cas,
+			Extras: make([]byte, 4),
+			Body:   i.data,
+		}
+		binary.BigEndian.PutUint32(res.Extras, i.flag)
+	})
+
+	if err != nil {
+		atomic.AddInt64(&v.stats.StoreErrors, 1)
+	} else if i == nil {
+		atomic.AddInt64(&v.stats.GetMisses, 1)
+	} else if res.Status == gomemcached.SUCCESS {
+		atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(i.data)))
+	}
+	if firstLock {
+		lockExpirePeriodic.Register(v.available, v.mkLockSweeper())
+	}
+
+	return res
+}
+
+func vbUnlockKey(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.Unlocks, 1)
+
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err := v.getUnexpired(req.Key, now)
+		if err != nil {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		l := v.getLock(req.Key, now)
+		if l == nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("key is not locked: %v", req.Key)),
+			}
+			return
+		}
+		if l.cas != req.Cas {
+			atomic.AddInt64(&v.stats.LockedErrs, 1)
+			res = &gomemcached.MCResponse{
+				Status: LOCKED,
+				Body:   []byte(fmt.Sprintf("key is locked: %v", req.Key)),
+			}
+			return
+		}
+		v.unlock(req.Key)
+		res = &gomemcached.MCResponse{}
+	})
+
+	return res
+}
+
+func (v *VBucket) mkLockSweeper() func(time.Time) bool {
+	return func(t time.Time) bool {
+		return v.lockExpirationScan(t)
+	}
+}
+
+// Releases timed out locks, returning true while any locks remain.
+func (v *VBucket) lockExpirationScan(now time.Time) bool {
+	remaining := 0
+	v.Apply(func() {
+		for k, l := range v.locks {
+			if !now.Before(l.exp) {
+				delete(v.locks, k)
+				atomic.AddInt64(&v.stats.LockExpires, 1)
+			}
+		}
+		remaining = len(v.locks)
+	})
+	return remaining > 0
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// The extras of SET_WITH_META, ADD_WITH_META and DELETE_WITH_META
+// requests: flags, exp, revSeq and cas.
+const withMetaExtrasLen = 4 + 4 + 8 + 8
+
+// The extras of GET_META responses: deleted, flags, exp and revSeq.
+const getMetaExtrasLen = 4 + 4 + 4 + 8
+
+func parseWithMetaExtras(req *gomemcached.MCRequest) (*item, error) {
+	if len(req.Extras) < withMetaExtrasLen {
+		return nil, fmt.Errorf("wrong extras size for with_meta: %v on key %v",
+			len(req.Extras), req.Key)
+	}
+	return &item{
+		key:    req.Key,
+		flag:   binary.BigEndian.Uint32(req.Extras),
+		exp:    binary.BigEndian.Uint32(req.Extras[4:]),
+		revSeq: binary.BigEndian.Uint64(req.Extras[8:]),
+		cas:    binary.BigEndian.Uint64(req.Extras[16:]),
+		revCas: binary.BigEndian.Uint64(req.Extras[16:]),
+	}, nil
+}
+
+// Handles GET_META, which for a deleted key returns the meta of its
+// tombstone, flagged as deleted, for conflict resolution elsewhere.
+func vbGetMeta(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	atomic.AddInt64(&v.stats.Gets, 1)
+
+	deleted := false
+	i, err := v.getUnexpired(req.Key, time.Now())
+	if err == nil && i == nil {
+		atomic.AddInt64(&v.stats.GetMisses, 1)
+		i, err = v.ps.getTombstone(req.Key)
+		deleted = true
+	}
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+		}
+	}
+	if i == nil {
+		if IsQuietEx(req.Opcode) {
+			return nil
+		}
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	}
+
+	res := &gomemcached.MCResponse{
+		Cas:    i.getRevCas(),
+		Extras: make([]byte, getMetaExtrasLen),
+	}
+	if deleted {
+		binary.BigEndian.PutUint32(res.Extras[0:], 1)
+	}
+	binary.BigEndian.PutUint32(res.Extras[4:], i.flag)
+	binary.BigEndian.PutUint32(res.Extras[8:], i.exp)
+	binary.BigEndian.PutUint64(res.Extras[12:], i.getRevSeq())
+	return res
+}
+
+// Handles SET_WITH_META and ADD_WITH_META, which store an item that
+// was changed elsewhere (e.g., by XDCR) along with its flags, exp and
+// revSeq.  An existing item, or the tombstone of a deleted item, is
+// only replaced if the incoming item wins the conflict resolution, so
+// a stale change can't resurrect a deleted item.  The incoming cas is always kept as
+// the cas of the item's revision, so revs match on both sides; it's
+// also the item's cas if it's beyond the vbucket's LastCas, but
+// otherwise, so that the changes stream stays ordered, a new local
+// cas is assigned.
+func vbMutateWithMeta(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	atomic.AddInt64(&v.stats.Mutations, 1)
+
+	cmd := updateMutationStats(req.Opcode, &v.stats)
+
+	itemNew, err := parseWithMetaExtras(req)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(err.Error()),
+		}
+	}
+	if len(req.Body) > MAX_ITEM_DATA_LENGTH {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.E2BIG,
+			Body: []byte(fmt.Sprintf("data too big: %v, key: %v",
+				len(req.Body), req.Key)),
+		}
+	}
+	itemNew.data = req.Body
+
+	var res *gomemcached.MCResponse
+	applied, err := v.applyItemIf(itemNew, func(itemOld *item) bool {
+		if itemOld != nil &&
+			(cmd == gomemcached.ADD || !itemNew.winsOver(itemOld)) {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.KEY_EEXISTS,
+				Body:   []byte("conflict with an existing item"),
+			}
+			return false
+		}
+		if itemOld == nil {
+			tomb, err := v.ps.getTombstone(itemNew.key)
+			if err != nil {
+				res = &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("Store get tombstone error %v", err)),
+				}
+				return false
+			}
+			if tomb != nil && !itemNew.winsOver(tomb) {
+				res = &gomemcached.MCResponse{
+					Status: gomemcached.KEY_EEXISTS,
+					Body:   []byte("conflict with a deleted item"),
+				}
+				return false
+			}
+		}
+		if req.Cas != 0 && (itemOld == nil || itemOld.cas != req.Cas) {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.KEY_EEXISTS,
+				Body:   []byte("CAS mismatch"),
+			}
+			return false
+		}
+		if itemNew.cas <= atomic.LoadUint64(&v.Meta().LastCas) {
+			itemNew.cas = 0
+		}
+		return true
+	})
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store set error %v", err)),
+		}
+	}
+	if !applied {
+		return res
+	}
+	if IsQuietEx(req.Opcode) {
+		return nil
+	}
+	return &gomemcached.MCResponse{Cas: itemNew.cas}
+}
+
+// Handles DELETE_WITH_META, which deletes an item that was deleted
+// elsewhere, keeping the deletion's revSeq and rev cas.  Like
+// vbMutateWithMeta, the deletion must win the conflict resolution
+// against the existing item.  The deletion of a missing item is
+// still recorded as the item's tombstone, if it wins over the
+// current tombstone, and responds with KEY_ENOENT.
+func vbDeleteWithMeta(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	atomic.AddInt64(&v.stats.Deletes, 1)
+
+	dItem, err := parseWithMetaExtras(req)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(err.Error()),
+		}
+	}
+	// The conflict resolution uses the deletion's meta, but what's
+	// stored is a regular deletion.
+	meta := dItem.clone()
+	dItem.markAsDeletion()
+
+	res := &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	applied, err := v.applyDeletionIf(dItem, func(prevItem *item) bool {
+		if !meta.winsOver(prevItem) {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.KEY_EEXISTS,
+				Body:   []byte("conflict with an existing item"),
+			}
+			return false
+		}
+		if req.Cas != 0 && prevItem.cas != req.Cas {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.KEY_EEXISTS,
+				Body:   []byte("CAS mismatch"),
+			}
+			return false
+		}
+		if dItem.cas <= atomic.LoadUint64(&v.Meta().LastCas) {
+			dItem.cas = 0
+		}
+		return true
+	})
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store del error %v", err)),
+		}
+	}
+	if !applied {
+		if res.Status == gomemcached.KEY_ENOENT {
+			if err = v.setTombstoneIfMissing(dItem); err != nil {
+				return &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("Store tombstone error %v", err)),
+				}
+			}
+			if IsQuietEx(req.Opcode) {
+				return nil
+			}
+		}
+		return res
+	}
+	if IsQuietEx(req.Opcode) {
+		return nil
+	}
+	return &gomemcached.MCResponse{Cas: dItem.cas}
+}
@@ -15,7 +15,14 @@ import (
 var expirePeriodic *periodically
 
 func vbMutate(v *VBucket, w io.Writer,
-	req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	res, _ := vbMutateItem(v, w, req)
+	return res
+}
+
+// Like vbMutate, but also returns the new item on success.
+func vbMutateItem(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) (res *gomemcached.MCResponse, itemNew *item) {
 	atomic.AddInt64(&v.stats.Mutations, 1)
 
 	cmd := updateMutationStats(req.Opcode, &v.stats)
@@ -25,18 +32,18 @@ func vbMutate(v *VBucket, w io.Writer,
 			Status: gomemcached.E2BIG,
 			Body: []byte(fmt.Sprintf("data too big: %v, key: %v",
 				len(req.Body), req.Key)),
-		}
+		}, nil
 	}
 
 	if cmd == gomemcached.ADD && req.Cas != 0 {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.EINVAL,
 			Body:   []byte("CAS should be 0 for ADD request"),
-		}
+		}, nil
 	}
 
 	var deltaItemBytes int64
-	var itemOld, itemNew *item
+	var itemOld *item
 	var itemCas uint64
 	var aval uint64
 	var err error
@@ -52,7 +59,13 @@ func vbMutate(v *VBucket, w io.Writer,
 			return
 		}
 
-		res, err = vbMutateValidate(v, w, req, cmd, itemOld)
+		var reqCas uint64
+		res, reqCas, err = v.checkLock(req, itemOld, now)
+		if err != nil {
+			return
+		}
+
+		res, err = vbMutateValidate(v, w, req, cmd, reqCas, itemOld)
 		if err != nil {
 			return
 		}
@@ -64,16 +77,24 @@ func vbMutate(v *VBucket, w io.Writer,
 			return
 		}
 
-		quotaBytes := v.parent.GetBucketSettings().QuotaBytes
+		settings := v.parent.GetBucketSettings()
+		quotaBytes := settings.QuotaBytes
 		if quotaBytes > 0 {
 			nb := atomic.LoadInt64(v.bucketItemBytes)
+			status := gomemcached.E2BIG
+			if settings.EvictionPolicy != EVICTION_NONE {
+				// Evictable buckets are limited only by what's
+				// resident, which eviction will soon free up.
+				nb = v.parent.GetResidentItemBytes()
+				status = gomemcached.TMPFAIL
+			}
 			nb = nb + itemNew.NumBytes()
 			if itemOld != nil {
 				nb = nb - itemOld.NumBytes()
 			}
 			if nb >= quotaBytes {
 				res = &gomemcached.MCResponse{
-					Status: gomemcached.E2BIG,
+					Status: status,
 					Body: []byte(fmt.Sprintf("quota reached: %v, key: %v",
 						quotaBytes, req.Key)),
 				}
@@ -88,6 +109,7 @@ func vbMutate(v *VBucket, w io.Writer,
 				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
 			}
 		} else {
+			v.unlock(req.Key)
 			if !IsQuietEx(req.Opcode) {
 				res = &gomemcached.MCResponse{Cas: itemCas}
 				if cmd == gomemcached.INCREMENT || cmd == gomemcached.DECREMENT {
@@ -102,6 +124,7 @@ func vbMutate(v *VBucket, w io.Writer,
 		if err != nil && err != ignore {
 			atomic.AddInt64(&v.stats.StoreErrors, 1)
 		}
+		itemNew = nil
 	} else {
 		if itemOld != nil {
 			atomic.AddInt64(&v.stats.Updates, 1)
@@ -117,11 +140,12 @@ func vbMutate(v *VBucket, w io.Writer,
 		v.observer.Submit(mutation{v.vbid, req.Key, itemCas, false})
 	}
 
-	return res
+	return res, itemNew
 }
 
 func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
-	cmd gomemcached.CommandCode, itemOld *item) (*gomemcached.MCResponse, error) {
+	cmd gomemcached.CommandCode, reqCas uint64,
+	itemOld *item) (*gomemcached.MCResponse, error) {
 	if cmd == gomemcached.ADD && itemOld != nil {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.KEY_EEXISTS,
@@ -134,7 +158,7 @@ func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 			Body:   []byte("REPLACE error because item does not exist"),
 		}, ignore
 	}
-	if req.Cas != 0 && (itemOld == nil || itemOld.cas != req.Cas) {
+	if reqCas != 0 && (itemOld == nil || itemOld.cas != reqCas) {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.KEY_EEXISTS,
 			Body:   []byte("CAS mismatch"),
@@ -167,11 +191,20 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 		}
 	}
 
+	revSeq, err := v.ps.nextRevSeq(req.Key, itemOld)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store get tombstone error %v", err)),
+		}, nil, 0, err
+	}
+
 	itemNew := &item{
-		key:  req.Key,
-		flag: flag,
-		exp:  computeExp(exp, time.Now),
-		cas:  itemCas,
+		key:    req.Key,
+		flag:   flag,
+		exp:    computeExp(exp, time.Now),
+		cas:    itemCas,
+		revSeq: revSeq,
 	}
 
 	if cmd == gomemcached.INCREMENT || cmd == gomemcached.DECREMENT {
@@ -220,20 +253,128 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 	}
 
 	if itemNew.exp != 0 {
-		expirable := atomic.AddInt64(&v.stats.Expirable, 1)
-		if expirable == 1 {
-			expirePeriodic.Register(v.available, v.mkVBucketSweeper())
-		}
+		v.addExpirable()
 	}
 
 	return nil, itemNew, aval, nil
 }
 
-func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+func (v *VBucket) addExpirable() {
+	expirable := atomic.AddInt64(&v.stats.Expirable, 1)
+	if expirable == 1 {
+		expirePeriodic.Register(v.available, v.mkVBucketSweeper())
+	}
+}
+
+// Uncounts an item that's no longer expirable.  The count never goes
+// below zero, as items loaded from storage aren't counted.
+func (v *VBucket) subExpirable() {
+	for {
+		expirable := atomic.LoadInt64(&v.stats.Expirable)
+		if expirable <= 0 || atomic.CompareAndSwapInt64(&v.stats.Expirable,
+			expirable, expirable-1) {
+			return
+		}
+	}
+}
+
+// Handles TOUCH, GAT and GATQ, which update an item's expiration
+// without changing its value.
+func vbTouch(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.Touches, 1)
+
+	if len(req.Extras) != 4 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for touch: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+	exp := binary.BigEndian.Uint32(req.Extras)
+
+	var deltaItemBytes int64
+	var itemOld, itemNew *item
+	var err error
+	now := time.Now()
+
+	v.Apply(func() {
+		itemOld, err = v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get itemOld error %v", err)),
+			}
+			return
+		}
+		if itemOld == nil {
+			if req.Opcode != GATQ {
+				res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			}
+			return
+		}
+		if res, _, err = v.checkLock(req, itemOld, now); err != nil {
+			return
+		}
+
+		itemNew = itemOld.clone()
+		itemNew.exp = computeExp(exp, time.Now)
+		itemNew.cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		itemNew.revSeq = itemOld.nextRevSeq()
+		itemNew.revCas = 0
+
+		deltaItemBytes, err = v.ps.set(itemNew, itemOld)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
+			}
+			return
+		}
+		v.unlock(req.Key)
+
+		res = &gomemcached.MCResponse{Cas: itemNew.cas}
+		if req.Opcode == GAT || req.Opcode == GATQ {
+			res.Extras = make([]byte, 4)
+			binary.BigEndian.PutUint32(res.Extras, itemNew.flag)
+			res.Body = itemNew.data
+		}
+	})
+
+	if err != nil {
+		if err != ignore {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
+	} else if itemNew != nil {
+		if itemNew.exp != 0 && itemOld.exp == 0 {
+			v.addExpirable()
+		} else if itemNew.exp == 0 && itemOld.exp != 0 {
+			v.subExpirable()
+		}
+		if req.Opcode == GAT || req.Opcode == GATQ {
+			atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(itemNew.data)))
+		}
+		atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+		atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+		v.markStale()
+		v.observer.Submit(mutation{v.vbid, req.Key, itemNew.cas, false})
+	}
+
+	return res
+}
+
+func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	res, _ := vbDeleteItem(v, w, req)
+	return res
+}
+
+// Like vbDelete, but also returns the deleted item on success.
+func vbDeleteItem(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) (res *gomemcached.MCResponse, prevItem *item) {
 	atomic.AddInt64(&v.stats.Deletes, 1)
 
 	var deltaItemBytes int64
-	var prevItem *item
 	var cas uint64
 	var err error
 	now := time.Now()
@@ -247,7 +388,12 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 			}
 			return
 		}
-		if req.Cas != 0 && (prevItem == nil || prevItem.cas != req.Cas) {
+		var reqCas uint64
+		res, reqCas, err = v.checkLock(req, prevItem, now)
+		if err != nil {
+			return
+		}
+		if reqCas != 0 && (prevItem == nil || prevItem.cas != reqCas) {
 			status := gomemcached.KEY_EEXISTS
 			if prevItem == nil {
 				status = gomemcached.KEY_ENOENT
@@ -256,6 +402,7 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 				Status: status,
 				Body:   []byte("CAS mismatch"),
 			}
+			err = ignore
 			return
 		}
 		if prevItem == nil {
@@ -275,6 +422,7 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 				Body:   []byte(fmt.Sprintf("Store del error %v", err)),
 			}
 		} else {
+			v.unlock(req.Key)
 			if !IsQuietEx(req.Opcode) {
 				res = &gomemcached.MCResponse{Cas: cas}
 			}
@@ -282,7 +430,9 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 	})
 
 	if err != nil {
-		atomic.AddInt64(&v.stats.StoreErrors, 1)
+		if err != ignore {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
 	} else if prevItem != nil {
 		atomic.AddInt64(&v.stats.Items, -1)
 		atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
@@ -294,7 +444,10 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 		v.observer.Submit(mutation{v.vbid, req.Key, cas, true})
 	}
 
-	return res
+	if err != nil || cas == 0 {
+		return res, nil
+	}
+	return res, prevItem
 }
 
 func (v *VBucket) mkVBucketSweeper() func(time.Time) bool {
@@ -306,7 +459,8 @@ func (v *VBucket) mkVBucketSweeper() func(time.Time) bool {
 func (v *VBucket) expirationScan() bool {
 	now := time.Now()
 	var cleaned int64
-	err := v.ps.visitItems(nil, false, func(i *item) bool {
+	// The scan needs each item's exp, which is stored with its value.
+	err := v.ps.visitItems(nil, true, func(i *item) bool {
 		if i.isExpired(now) {
 			err := v.expire(i.key, now)
 			if err != nil {
@@ -363,7 +517,10 @@ func (v *VBucket) expire(key []byte, now time.Time) (err error) {
 		}
 		if i.isExpired(now) {
 			expireCas = atomic.AddUint64(&v.Meta().LastCas, 1)
-			deltaItemBytes, err = v.ps.del(key, expireCas, i)
+			deltaItemBytes, err = v.ps.expire(key, expireCas, i)
+			if err == nil {
+				v.unlock(key)
+			}
 		}
 	})
 
@@ -377,3 +534,174 @@ func (v *VBucket) expire(key []byte, now time.Time) (err error) {
 
 	return err
 }
+
+// Raises the vbucket's LastCas to at least the given cas, so that
+// locally generated cas values continue to increase after applying
+// changes from elsewhere.  Must be invoked while holding the vbucket
+// lock (via Apply).
+func (v *VBucket) raiseLastCas(cas uint64) {
+	m := v.Meta()
+	for {
+		lastCas := atomic.LoadUint64(&m.LastCas)
+		if cas <= lastCas || atomic.CompareAndSwapUint64(&m.LastCas, lastCas, cas) {
+			return
+		}
+	}
+}
+
+// Applies an item that was changed elsewhere (e.g., received from a
+// replication stream), keeping the item's flags and expiration.  An
+// item whose rev cas matches the current item's rev cas is treated
+// as already applied.  Like vbMutateWithMeta, the item's cas is kept
+// as its rev cas, but it's the item's cas only if it's beyond the
+// vbucket's LastCas, as the cas is the key of the item's change and
+// the changes stream must stay ordered.
+func (v *VBucket) applyItem(itemNew *item) (applied bool, err error) {
+	if itemNew.revCas == 0 {
+		itemNew.revCas = itemNew.cas
+	}
+	return v.applyItemIf(itemNew, func(itemOld *item) bool {
+		if itemNew.revCas != 0 && itemOld != nil &&
+			itemOld.getRevCas() == itemNew.revCas {
+			return false
+		}
+		if itemNew.cas <= atomic.LoadUint64(&v.Meta().LastCas) {
+			itemNew.cas = 0
+		}
+		return true
+	})
+}
+
+// Like applyItem, but the item is only applied if ok, which is
+// invoked while holding the vbucket lock, returns true when given
+// the current item (or nil).  The ok func may also zero the item's
+// cas so that a new cas is assigned.  An item without a revSeq
+// continues the revisions of the item it replaces, or of the key's
+// tombstone.
+func (v *VBucket) applyItemIf(itemNew *item,
+	ok func(itemOld *item) bool) (applied bool, err error) {
+	var deltaItemBytes int64
+	var itemOld *item
+
+	v.Apply(func() {
+		itemOld, err = v.ps.get(itemNew.key)
+		if err != nil || !ok(itemOld) {
+			return
+		}
+		if itemNew.cas == 0 {
+			itemNew.cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		}
+		if itemNew.revSeq == 0 {
+			itemNew.revSeq, err = v.ps.nextRevSeq(itemNew.key, itemOld)
+			if err != nil {
+				return
+			}
+		}
+		v.raiseLastCas(itemNew.cas)
+		deltaItemBytes, err = v.ps.set(itemNew, itemOld)
+		if err == nil {
+			v.unlock(itemNew.key)
+			applied = true
+		}
+	})
+
+	if err != nil {
+		atomic.AddInt64(&v.stats.StoreErrors, 1)
+		return false, err
+	}
+	if !applied {
+		return false, nil
+	}
+	if itemOld != nil {
+		atomic.AddInt64(&v.stats.Updates, 1)
+	} else {
+		atomic.AddInt64(&v.stats.Creates, 1)
+		atomic.AddInt64(&v.stats.Items, 1)
+	}
+	if itemNew.exp != 0 {
+		v.addExpirable()
+	}
+	atomic.AddInt64(&v.stats.IncomingValueBytes, int64(len(itemNew.data)))
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+	v.markStale()
+	v.observer.Submit(mutation{v.vbid, itemNew.key, itemNew.cas, false})
+
+	return true, nil
+}
+
+// Applies a deletion that happened elsewhere, keeping its cas as its
+// rev cas, but as its cas only if it's beyond the vbucket's LastCas,
+// like applyItem.  Deleting a missing item is a no-op.
+func (v *VBucket) applyDeletion(key []byte, cas uint64) (applied bool, err error) {
+	dItem := (&item{key: key, cas: cas, revCas: cas}).markAsDeletion()
+	return v.applyDeletionIf(dItem, func(prevItem *item) bool {
+		if cas != 0 && prevItem.getRevCas() == cas {
+			return false
+		}
+		if dItem.cas <= atomic.LoadUint64(&v.Meta().LastCas) {
+			dItem.cas = 0
+		}
+		return true
+	})
+}
+
+// Records a deletion from elsewhere of an item that's missing here as
+// the item's tombstone, unless the item's current tombstone wins.
+func (v *VBucket) setTombstoneIfMissing(dItem *item) (err error) {
+	v.Apply(func() {
+		var cur *item
+		if cur, err = v.ps.get(dItem.key); err != nil || cur != nil {
+			return
+		}
+		err = v.ps.setTombstone(dItem)
+	})
+	return err
+}
+
+// Like applyDeletion, but the deletion, given as a deletion item, is
+// only applied if ok, which is invoked while holding the vbucket
+// lock, returns true when given the current item.  The ok func may
+// also zero the deletion's cas so that a new cas is assigned.
+func (v *VBucket) applyDeletionIf(dItem *item,
+	ok func(prevItem *item) bool) (applied bool, err error) {
+	var deltaItemBytes int64
+	key := dItem.key
+
+	v.Apply(func() {
+		var prevItem *item
+		prevItem, err = v.ps.get(key)
+		if err != nil || prevItem == nil || !ok(prevItem) {
+			return
+		}
+		if dItem.cas == 0 {
+			dItem.cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		}
+		if dItem.revSeq == 0 {
+			dItem.revSeq = prevItem.nextRevSeq()
+		}
+		v.raiseLastCas(dItem.cas)
+		deltaItemBytes, err = v.ps.delItem(dItem, prevItem)
+		if err == nil {
+			v.unlock(key)
+			applied = true
+		}
+	})
+
+	if err != nil {
+		atomic.AddInt64(&v.stats.StoreErrors, 1)
+		return false, err
+	}
+	if !applied {
+		return false, nil
+	}
+	atomic.AddInt64(&v.stats.Items, -1)
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+	v.markStale()
+	v.observer.Submit(mutation{v.vbid, key, dItem.cas, true})
+
+	return true, nil
+}
@@ -57,6 +57,7 @@ type ViewRow struct {
 	Key   interface{}   `json:"key,omitempty"`
 	Value interface{}   `json:"value,omitempty"`
 	Doc   *ViewDocValue `json:"doc,omitempty"`
+	Error string        `json:"error,omitempty"`
 }
 
 func (rows ViewRows) Len() int {
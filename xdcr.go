@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds on the delay before an XDCR replication retries after an
+// error.
+var xdcrRetryMin = time.Second
+var xdcrRetryMax = time.Second * 30
+
+// How long a caught-up XDCR replication waits before looking for
+// more changes.
+var xdcrPollInterval = time.Second
+
+// The max # of changes in each _revs_diff and _bulk_docs request.
+var xdcrBatchSize = 500
+
+// XDCR requests time out, so that a hung target gets retried, and
+// they're canceled when their replication stops.
+var xdcrTransport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+var xdcrHTTPClient = &http.Client{
+	Transport: xdcrTransport,
+	Timeout:   time.Minute,
+}
+
+var xdcrStopped = errors.New("XDCR replication stopped")
+
+var xdcrNameRegexp = regexp.MustCompile("^[A-Za-z0-9\\-_]+$")
+
+// All the XDCR replications, keyed by source bucket name and then
+// replication name.
+var xdcrReplications = &XDCRReplications{
+	m: map[string]map[string]*XDCRReplication{},
+}
+
+type XDCRStats struct {
+	Rounds      int64 `json:"rounds"`      // Passes over all the vbuckets.
+	Batches     int64 `json:"batches"`     // Batches sent to _revs_diff.
+	DocsChecked int64 `json:"docsChecked"` // Changes sent to _revs_diff.
+	DocsSkipped int64 `json:"docsSkipped"` // Changes the target already had.
+	DocsWritten int64 `json:"docsWritten"` // Changes applied by _bulk_docs.
+	Deletes     int64 `json:"deletes"`     // Deletions among DocsWritten.
+	Conflicts   int64 `json:"conflicts"`   // Changes where the target won.
+	Checkpoints int64 `json:"checkpoints"`
+	Errors      int64 `json:"errors"`
+}
+
+// An XDCR replication pushes the changes of a bucket's active
+// vbuckets to a bucket of another cbgb or Couchbase cluster, using
+// the target's couch API like Couchbase's XDCR: a _revs_diff of each
+// batch of changes, then a _bulk_docs of the changes the target is
+// missing.  Its progress in each vbucket, which is the cas of the
+// last change sent, is checkpointed in a _local doc on the target.
+// The source and target buckets should have the same number of
+// vbuckets, and the target's first node receives all the changes.
+type XDCRReplication struct {
+	Name         string    `json:"name"`
+	Bucket       string    `json:"bucket"`
+	Target       string    `json:"target"` // Like http://host:8091.
+	TargetBucket string    `json:"targetBucket"`
+	Started      time.Time `json:"started"`
+	Stats        XDCRStats `json:"stats"`
+
+	targetURL *url.URL // Unlike Target, may have a user and password.
+	buckets   *Buckets // Optional, used to reacquire a quiesced bucket.
+	stopch    chan bool
+	donech    chan bool
+	wakech    chan bool // Signaled on Resume().
+
+	// The cas of each vbucket's last checkpoint, only used by the
+	// run() goroutine.
+	seqs map[uint16]uint64
+
+	lock    sync.Mutex // Protects the fields below.
+	b       Bucket
+	paused  bool
+	lastErr error
+}
+
+// The target bucket's uuid and couch API, as found at the start of
+// each runOnce().
+type xdcrTarget struct {
+	uuid     string
+	couchURL *url.URL
+}
+
+type xdcrCheckpoint struct {
+	Seq          uint64 `json:"seq"`
+	SourceBucket string `json:"sourceBucket"`
+	SourceUUID   string `json:"sourceUUID"`
+}
+
+func NewXDCRReplication(name string, buckets *Buckets, bucketName string,
+	b Bucket, target, targetBucket string) (*XDCRReplication, error) {
+	if !xdcrNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("bad xdcr replication name: %v", name)
+	}
+	if targetBucket == "" {
+		return nil, fmt.Errorf("xdcr targetBucket is missing")
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (targetURL.Scheme != "http" && targetURL.Scheme != "https") ||
+		targetURL.Host == "" {
+		return nil, fmt.Errorf("xdcr target must be an http URL: %v", target)
+	}
+	safeURL := *targetURL
+	safeURL.User = nil
+	return &XDCRReplication{
+		Name:         name,
+		Bucket:       bucketName,
+		Target:       safeURL.String(),
+		TargetBucket: targetBucket,
+		targetURL:    targetURL,
+		buckets:      buckets,
+		b:            b,
+		stopch:       make(chan bool),
+		donech:       make(chan bool),
+		wakech:       make(chan bool, 1),
+	}, nil
+}
+
+func (r *XDCRReplication) Start() {
+	r.Started = time.Now()
+	go r.run()
+}
+
+// Stops the replication, canceling its current request, and waits
+// for it to finish.
+func (r *XDCRReplication) Stop() {
+	r.lock.Lock()
+	select {
+	case <-r.stopch:
+	default:
+		close(r.stopch)
+	}
+	r.lock.Unlock()
+	<-r.donech
+}
+
+// Pauses the replication after its current batch.
+func (r *XDCRReplication) Pause() {
+	r.lock.Lock()
+	r.paused = true
+	r.lock.Unlock()
+}
+
+func (r *XDCRReplication) Resume() {
+	r.lock.Lock()
+	r.paused = false
+	r.lock.Unlock()
+	select {
+	case r.wakech <- true:
+	default:
+	}
+}
+
+func (r *XDCRReplication) isPaused() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.paused
+}
+
+// A JSON-friendly snapshot of the replication.
+func (r *XDCRReplication) View() map[string]interface{} {
+	r.lock.Lock()
+	paused := r.paused
+	lastErr := ""
+	if r.lastErr != nil {
+		lastErr = r.lastErr.Error()
+	}
+	r.lock.Unlock()
+
+	stopped := false
+	select {
+	case <-r.donech:
+		stopped = true
+	default:
+	}
+
+	s := &r.Stats
+	return map[string]interface{}{
+		"name":         r.Name,
+		"bucket":       r.Bucket,
+		"target":       r.Target,
+		"targetBucket": r.TargetBucket,
+		"started":      r.Started,
+		"paused":       paused,
+		"stopped":      stopped,
+		"lastErr":      lastErr,
+		"stats": XDCRStats{
+			Rounds:      atomic.LoadInt64(&s.Rounds),
+			Batches:     atomic.LoadInt64(&s.Batches),
+			DocsChecked: atomic.LoadInt64(&s.DocsChecked),
+			DocsSkipped: atomic.LoadInt64(&s.DocsSkipped),
+			DocsWritten: atomic.LoadInt64(&s.DocsWritten),
+			Deletes:     atomic.LoadInt64(&s.Deletes),
+			Conflicts:   atomic.LoadInt64(&s.Conflicts),
+			Checkpoints: atomic.LoadInt64(&s.Checkpoints),
+			Errors:      atomic.LoadInt64(&s.Errors),
+		},
+	}
+}
+
+func (r *XDCRReplication) run() {
+	defer close(r.donech)
+
+	delay := xdcrRetryMin
+	for {
+		sent, err := r.runOnce()
+		if err == xdcrStopped {
+			return
+		}
+		select {
+		case <-r.stopch:
+			return
+		default:
+		}
+
+		atomic.AddInt64(&r.Stats.Errors, 1)
+		r.lock.Lock()
+		r.lastErr = err
+		r.lock.Unlock()
+		log.Printf("xdcr: %v, bucket: %v, target: %v/%v, err: %v",
+			r.Name, r.Bucket, r.Target, r.TargetBucket, err)
+
+		if sent {
+			delay = xdcrRetryMin
+		}
+		select {
+		case <-r.stopch:
+			return
+		case <-time.After(delay):
+		}
+		delay = delay * 2
+		if delay > xdcrRetryMax {
+			delay = xdcrRetryMax
+		}
+	}
+}
+
+// Replicates round after round until an error, returning whether any
+// changes were sent.  The target and its checkpoints are looked up
+// afresh on each call, in case the target bucket was recreated.
+func (r *XDCRReplication) runOnce() (sent bool, err error) {
+	r.seqs = map[uint16]uint64{}
+
+	t, err := r.lookupTarget()
+	if err != nil {
+		return false, err
+	}
+	for {
+		if err = r.waitWhilePaused(); err != nil {
+			return sent, err
+		}
+		b := r.bucket()
+		if b == nil {
+			return sent, xdcrStopped
+		}
+		var n int
+		n, err = r.replicateBucket(b, t)
+		if n > 0 {
+			sent = true
+		}
+		if err != nil {
+			return sent, err
+		}
+		atomic.AddInt64(&r.Stats.Rounds, 1)
+		if n <= 0 {
+			select {
+			case <-r.stopch:
+				return sent, xdcrStopped
+			case <-time.After(xdcrPollInterval):
+			}
+		}
+	}
+}
+
+func (r *XDCRReplication) waitWhilePaused() error {
+	for r.isPaused() {
+		select {
+		case <-r.stopch:
+			return xdcrStopped
+		case <-r.wakech:
+		}
+	}
+	select {
+	case <-r.stopch:
+		return xdcrStopped
+	default:
+	}
+	return nil
+}
+
+// Returns the source bucket, reacquiring it if it was quiesced, or
+// nil if it's gone.
+func (r *XDCRReplication) bucket() Bucket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.b != nil && !r.b.Available() {
+		r.b = nil
+		if r.buckets != nil {
+			r.b = r.buckets.Get(r.Bucket)
+		}
+	}
+	return r.b
+}
+
+func (r *XDCRReplication) lookupTarget() (*xdcrTarget, error) {
+	var nsBucket struct {
+		UUID  string `json:"uuid"`
+		Nodes []struct {
+			CouchAPIBase string `json:"couchApiBase"`
+		} `json:"nodes"`
+	}
+	_, err := r.doJSON("GET", r.targetURL,
+		"/pools/default/buckets/"+r.TargetBucket, nil, &nsBucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(nsBucket.Nodes) <= 0 || nsBucket.Nodes[0].CouchAPIBase == "" {
+		return nil, fmt.Errorf("xdcr target bucket has no couchApiBase: %v",
+			r.TargetBucket)
+	}
+	couchURL, err := url.Parse(nsBucket.Nodes[0].CouchAPIBase)
+	if err != nil {
+		return nil, err
+	}
+	couchURL.User = r.targetURL.User
+	return &xdcrTarget{uuid: nsBucket.UUID, couchURL: couchURL}, nil
+}
+
+// Returns the escaped path of a target vbucket's couch API resource,
+// like /db%2f12%3buuid/_revs_diff.
+func (t *xdcrTarget) vbucketPath(vbid uint16, resource string) string {
+	return fmt.Sprintf("%s%%2f%d%%3b%s/%s",
+		strings.TrimSuffix(t.couchURL.Path, "/"), vbid, t.uuid, resource)
+}
+
+func (r *XDCRReplication) replicateBucket(b Bucket, t *xdcrTarget) (
+	sent int, err error) {
+	settings := b.GetBucketSettings()
+	for vbid := 0; vbid < settings.NumPartitions; vbid++ {
+		if r.isPaused() {
+			break
+		}
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb == nil || vb.GetVBState() != VBActive {
+			continue
+		}
+		n, err := r.replicateVBucket(t, settings.UUID, vb)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Sends a vbucket's changes since its checkpoint, in batches,
+// checkpointing after each batch.
+func (r *XDCRReplication) replicateVBucket(t *xdcrTarget, srcUUID string,
+	vb *VBucket) (sent int, err error) {
+	seq, err := r.checkpoint(t, srcUUID, vb.vbid)
+	if err != nil {
+		return 0, err
+	}
+	if seq > atomic.LoadUint64(&vb.Meta().LastCas) {
+		seq = 0 // The checkpoint is from before a restore, so start over.
+	}
+	for {
+		select {
+		case <-r.stopch:
+			return sent, xdcrStopped
+		default:
+		}
+		batch := make([]*item, 0, xdcrBatchSize)
+		last := seq
+		err = vb.ps.visitChanges(casBytes(seq+1), true, func(i *item) bool {
+			last = i.cas
+			if len(i.key) > 0 { // Skip metadata changes.
+				batch = append(batch, i)
+			}
+			return len(batch) < xdcrBatchSize
+		})
+		if err != nil {
+			return sent, err
+		}
+		if last == seq || r.isPaused() {
+			return sent, nil
+		}
+		if len(batch) > 0 {
+			if err = r.sendBatch(t, vb.vbid, batch); err != nil {
+				return sent, err
+			}
+			sent += len(batch)
+		}
+		if err = r.setCheckpoint(t, srcUUID, vb.vbid, last); err != nil {
+			return sent, err
+		}
+		seq = last
+	}
+}
+
+// The checkpoints of different source buckets and replications stay
+// apart, even when they share a target.
+func (r *XDCRReplication) checkpointId(srcUUID string) string {
+	return "_local/cbgb-xdcr-" + srcUUID + "-" + r.Name
+}
+
+func (r *XDCRReplication) checkpoint(t *xdcrTarget, srcUUID string,
+	vbid uint16) (uint64, error) {
+	if seq, ok := r.seqs[vbid]; ok {
+		return seq, nil
+	}
+	cp := &xdcrCheckpoint{}
+	status, err := r.doJSON("GET", t.couchURL,
+		t.vbucketPath(vbid, r.checkpointId(srcUUID)), nil, cp)
+	if status == 404 {
+		cp.Seq = 0
+	} else if err != nil {
+		return 0, err
+	}
+	r.seqs[vbid] = cp.Seq
+	return cp.Seq, nil
+}
+
+func (r *XDCRReplication) setCheckpoint(t *xdcrTarget, srcUUID string,
+	vbid uint16, seq uint64) error {
+	_, err := r.doJSON("PUT", t.couchURL,
+		t.vbucketPath(vbid, r.checkpointId(srcUUID)), &xdcrCheckpoint{
+			Seq:          seq,
+			SourceBucket: r.Bucket,
+			SourceUUID:   srcUUID,
+		}, nil)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&r.Stats.Checkpoints, 1)
+	r.seqs[vbid] = seq
+	return nil
+}
+
+func (r *XDCRReplication) sendBatch(t *xdcrTarget, vbid uint16,
+	batch []*item) error {
+	// A key changed during the changes visit may be in the batch
+	// twice, where its latest change wins.
+	latest := map[string]*item{}
+	revs := map[string]string{}
+	for _, i := range batch {
+		latest[string(i.key)] = i
+		revs[string(i.key)] = couchDbItemRev(i)
+	}
+	atomic.AddInt64(&r.Stats.Batches, 1)
+	atomic.AddInt64(&r.Stats.DocsChecked, int64(len(revs)))
+
+	missing := map[string]interface{}{}
+	_, err := r.doJSON("POST", t.couchURL, t.vbucketPath(vbid, "_revs_diff"),
+		revs, &missing)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&r.Stats.DocsSkipped, int64(len(revs)-len(missing)))
+	if len(missing) <= 0 {
+		return nil
+	}
+
+	docs := make([]BulkDocsItem, 0, len(missing))
+	for key := range missing {
+		i := latest[key]
+		if i == nil {
+			continue
+		}
+		doc := BulkDocsItem{Meta: BulkDocsItemMeta{Id: key, Rev: revs[key]}}
+		if i.isDeletion() {
+			doc.Meta.Deleted = true
+		} else {
+			doc.Meta.Expiration = float64(i.exp)
+			doc.Meta.Flags = float64(i.flag)
+			doc.Base64 = base64.StdEncoding.EncodeToString(i.data)
+		}
+		docs = append(docs, doc)
+	}
+	results := []map[string]interface{}{}
+	_, err = r.doJSON("POST", t.couchURL, t.vbucketPath(vbid, "_bulk_docs"),
+		map[string]interface{}{"docs": docs, "new_edits": false}, &results)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		switch result["error"] {
+		case nil:
+			atomic.AddInt64(&r.Stats.DocsWritten, 1)
+			id, _ := result["id"].(string)
+			if i := latest[id]; i != nil && i.isDeletion() {
+				atomic.AddInt64(&r.Stats.Deletes, 1)
+			}
+		case "conflict":
+			// The target changed the doc since the _revs_diff.
+			atomic.AddInt64(&r.Stats.Conflicts, 1)
+		default:
+			return fmt.Errorf("xdcr _bulk_docs id: %v, error: %v, reason: %v",
+				result["id"], result["error"], result["reason"])
+		}
+	}
+	return nil
+}
+
+// Sends a JSON request to the target, returning the response's
+// status code.  The path must already be escaped.
+func (r *XDCRReplication) doJSON(method string, base *url.URL, path string,
+	in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		j, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(j)
+	}
+	req, err := http.NewRequest(method, base.Scheme+"://"+base.Host+"/", body)
+	if err != nil {
+		return 0, err
+	}
+	// An opaque path is sent as is, keeping the couch API's %2f and
+	// %3b escaped.
+	req.URL.Opaque = path
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if base.User != nil {
+		password, _ := base.User.Password()
+		req.SetBasicAuth(base.User.Username(), password)
+	}
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-r.stopch:
+			xdcrTransport.CancelRequest(req)
+		case <-finished:
+		}
+	}()
+	res, err := xdcrHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return res.StatusCode, fmt.Errorf("xdcr %v %v: %v, %s",
+			method, path, res.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	return res.StatusCode, nil
+}
+
+type XDCRReplications struct {
+	lock sync.Mutex
+	m    map[string]map[string]*XDCRReplication
+}
+
+func (x *XDCRReplications) Add(r *XDCRReplication) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	rs := x.m[r.Bucket]
+	if rs == nil {
+		rs = map[string]*XDCRReplication{}
+		x.m[r.Bucket] = rs
+	}
+	if rs[r.Name] != nil {
+		return fmt.Errorf("xdcr replication already exists: %v", r.Name)
+	}
+	rs[r.Name] = r
+	r.Start()
+	return nil
+}
+
+func (x *XDCRReplications) Get(bucketName, name string) *XDCRReplication {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.m[bucketName][name]
+}
+
+func (x *XDCRReplications) List(bucketName string) []*XDCRReplication {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	rv := make([]*XDCRReplication, 0, len(x.m[bucketName]))
+	for _, r := range x.m[bucketName] {
+		rv = append(rv, r)
+	}
+	return rv
+}
+
+// Stops and forgets a replication, returning false if it didn't
+// exist.  Its checkpoints stay on the target.
+func (x *XDCRReplications) Stop(bucketName, name string) bool {
+	x.lock.Lock()
+	r := x.m[bucketName][name]
+	if r != nil {
+		delete(x.m[bucketName], name)
+	}
+	x.lock.Unlock()
+	if r == nil {
+		return false
+	}
+	r.Stop()
+	return true
+}
+
+func (x *XDCRReplications) StopAll(bucketName string) {
+	x.lock.Lock()
+	rs := x.m[bucketName]
+	delete(x.m, bucketName)
+	x.lock.Unlock()
+	for _, r := range rs {
+		r.Stop()
+	}
+}
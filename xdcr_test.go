@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Starts a target server, with a "dst" bucket, for XDCR.
+func testXDCRTarget(t *testing.T, d string) (*httptest.Server, Bucket, func()) {
+	dst, err := buckets.New("dst", &BucketSettings{NumPartitions: 1})
+	if err != nil {
+		t.Fatalf("expected dst bucket, err: %v", err)
+	}
+	dst.CreateVBucket(0)
+	dst.SetVBState(0, VBActive)
+
+	ts := httptest.NewServer(testSetupMux(d))
+	// The target's couchApiBase has the couch API's port.
+	prevRestCouch, prevPoll := *restCouch, xdcrPollInterval
+	*restCouch = ts.Listener.Addr().String()
+	xdcrPollInterval = 10 * time.Millisecond
+	return ts, dst, func() {
+		ts.Close()
+		*restCouch, xdcrPollInterval = prevRestCouch, prevPoll
+	}
+}
+
+func testWaitForString(t *testing.T, b Bucket, key, val string,
+	r *XDCRReplication) {
+	for j := 0; j < 200; j++ {
+		if testGetString(t, b, 0, key) == val {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected %v to be replicated as %q, got: %q, view: %v",
+		key, val, testGetString(t, b, 0, key), r.View())
+}
+
+func TestXDCRReplication(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	ts, dst, done := testXDCRTarget(t, d)
+	defer done()
+
+	srcDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(srcDir)
+	src, _ := NewBucket("src", srcDir,
+		&BucketSettings{NumPartitions: 1, UUID: "srcuuid"})
+	defer src.Close()
+	src.CreateVBucket(0)
+	src.SetVBState(0, VBActive)
+	rh := &reqHandler{currentBucket: src}
+	testLoadInts(t, rh, 0, 5)
+	rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("4"),
+	})
+	// The target's "3" has more revisions, so it wins.
+	testSetString(t, dst, 0, "3", "3")
+	testSetString(t, dst, 0, "3", "target's")
+
+	xrs := &XDCRReplications{m: map[string]map[string]*XDCRReplication{}}
+	r, err := NewXDCRReplication("r", nil, "src", src, ts.URL, "dst")
+	if err != nil {
+		t.Fatalf("expected NewXDCRReplication to work, err: %v", err)
+	}
+	if err = xrs.Add(r); err != nil {
+		t.Fatalf("expected Add to work, err: %v", err)
+	}
+	defer xrs.StopAll("src")
+
+	testWaitForString(t, dst, "2", "2", r)
+	testWaitForString(t, dst, "0", "0", r)
+	if v := testGetString(t, dst, 0, "3"); v != "target's" {
+		t.Errorf("expected the target's 3 to win, got: %v", v)
+	}
+	if v := testGetString(t, dst, 0, "4"); v != "" {
+		t.Errorf("expected deleted 4 to stay missing, got: %v", v)
+	}
+	cp, err := dst.GetLocalDoc("0", "cbgb-xdcr-srcuuid-r")
+	if err != nil || !strings.Contains(string(cp), `"seq"`) {
+		t.Errorf("expected a checkpoint, got: %s, err: %v", cp, err)
+	}
+
+	testSetString(t, src, 0, "0", "changed")
+	testWaitForString(t, dst, "0", "changed", r)
+
+	r.Pause()
+	testSetString(t, src, 0, "1", "while paused")
+	time.Sleep(100 * time.Millisecond)
+	if v := testGetString(t, dst, 0, "1"); v != "1" {
+		t.Errorf("expected a paused replication to not send, got: %v", v)
+	}
+	r.Resume()
+	testWaitForString(t, dst, "1", "while paused", r)
+
+	v := r.View()
+	stats := v["stats"].(XDCRStats)
+	if stats.DocsWritten < 5 || stats.Deletes != 1 || stats.Checkpoints < 3 ||
+		stats.DocsSkipped != 1 || v["paused"] != false {
+		t.Errorf("unexpected replication view: %v", v)
+	}
+
+	// A restarted replication resumes from its checkpoint.
+	if !xrs.Stop("src", "r") {
+		t.Errorf("expected Stop to work")
+	}
+	if v := r.View(); v["stopped"] != true {
+		t.Errorf("expected stopped replication, got: %v", v)
+	}
+	r, _ = NewXDCRReplication("r", nil, "src", src, ts.URL, "dst")
+	xrs.Add(r)
+	for j := 0; j < 100 && r.View()["stats"].(XDCRStats).Rounds < 2; j++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := r.View()["stats"].(XDCRStats); stats.Rounds < 2 ||
+		stats.DocsChecked != 0 {
+		t.Errorf("expected restart from checkpoint, got: %#v", stats)
+	}
+}
+
+func TestXDCRStopHungTarget(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(srcDir)
+	src, _ := NewBucket("src", srcDir, &BucketSettings{NumPartitions: 1})
+	defer src.Close()
+
+	requested := make(chan bool, 1)
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case requested <- true:
+			default:
+			}
+			<-release
+		}))
+	defer ts.Close()
+	defer close(release)
+
+	r, err := NewXDCRReplication("r", nil, "src", src, ts.URL, "dst")
+	if err != nil {
+		t.Fatalf("expected NewXDCRReplication to work, err: %v", err)
+	}
+	r.Start()
+	select {
+	case <-requested:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a request to the target")
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected Stop to cancel the hung request")
+	}
+}